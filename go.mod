@@ -2,4 +2,10 @@ module ftgo
 
 go 1.26
 
-require golang.org/x/sys v0.31.0
+require (
+	golang.org/x/net v0.37.0
+	golang.org/x/sys v0.31.0
+	lukechampine.com/blake3 v1.4.1
+)
+
+require github.com/klauspost/cpuid/v2 v2.0.9 // indirect
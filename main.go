@@ -1,21 +1,52 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"math/bits"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"golang.org/x/net/proxy"
 	"golang.org/x/sys/unix" // Use unix package instead of syscall (preferred for Linux)
+	"lukechampine.com/blake3"
 )
 
 func formatWithCommas(n int64) string {
@@ -37,24 +68,383 @@ func formatWithCommas(n int64) string {
 	return result.String()
 }
 
+// formatBytes 按 -units 格式化字节数: raw 为逗号分组的字节数 (如 "1,610,612,736 bytes"),
+// iec 为 1024 进制 (如 "1.50 GiB"), si 为 1000 进制 (如 "1.61 GB")
+func formatBytes(n int64) string {
+	var base float64
+	var units []string
+	switch *unitsMode {
+	case "iec":
+		base, units = 1024, []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB"}
+	case "si":
+		base, units = 1000, []string{"B", "kB", "MB", "GB", "TB", "PB", "EB"}
+	default:
+		return formatWithCommas(n) + " bytes"
+	}
+	v := float64(n)
+	if math.Abs(v) < base {
+		return fmt.Sprintf("%d B", n)
+	}
+	i := 0
+	for math.Abs(v) >= base && i < len(units)-1 {
+		v /= base
+		i++
+	}
+	return fmt.Sprintf("%.2f %s", v, units[i])
+}
+
+// formatBytesPair 格式化进度中的 "已传输/总大小": raw 时保持 "1,024/2,048 bytes" 的格式
+func formatBytesPair(cur, total int64) string {
+	if *unitsMode != "iec" && *unitsMode != "si" {
+		return formatWithCommas(cur) + "/" + formatWithCommas(total) + " bytes"
+	}
+	return formatBytes(cur) + "/" + formatBytes(total)
+}
+
+const (
+	copyBufferSize = 65536            // 用于 io.CopyBuffer 和 splice 的缓冲区大小
+	copyRangeChunk = 16 << 20         // copy 模式下每次 copy_file_range/sendfile 的最大字节数
+	maxRetryDelay  = 30 * time.Second // 连接重试退避的上限
+	// unknownSize 表示数据长度未知 (如从 stdin 读取), 在线上编码为全 1 的 8 字节大小字段,
+	// 接收端持续读取直到连接关闭
+	unknownSize int64 = -1
+
+	// 每条连接建立后, 发送端先发送 4 字节魔数和 1 字节协议版本, 接收端校验通过后才解析文件头
+	protocolMagic   = "FTGO"
+	protocolVersion = 3
+
+	// 握手之后双方交换 4 字节能力位掩码, 只使用双方都支持的功能
+	capRange        = 1 << 0  // 分段传输 (extFlagRange)
+	capSparse       = 1 << 1  // 稀疏文件 (extFlagSparse)
+	capChecksum     = 1 << 2  // 校验尾部 (extFlagChecksum)
+	capMultiFile    = 1 << 3  // 单连接多文件: 依次发送多个文件头 + 数据, 以文件名长度为 0 的结束标记收尾
+	capDryRun       = 1 << 4  // 只发送文件头用于校验 (extFlagDryRun)
+	capEncrypt      = 1 << 5  // 预共享密钥 AES-256-GCM 加密 (extFlagEncrypt)
+	capBench        = 1 << 6  // 往返吞吐量测试 (extFlagBench)
+	capChecksumOnly = 1 << 7  // 只校验接收端已有的文件 (extFlagChecksumOnly)
+	capManifest     = 1 << 8  // 批量传输开始前发送文件数和总字节数 (extFlagManifest)
+	capResume       = 1 << 9  // 断点续传: 接收端保留 .part 并回复续传位置 (ext2Resume)
+	capAck          = 1 << 10 // 每个文件接收完成并同步到磁盘后, 接收端回复 1 字节确认 (ackOK/ackFail)
+	capDelta        = 1 << 11 // 增量传输: 接收端回复已有文件的块签名, 发送端只发送变化的数据 (ext2Delta)
+	capDedupe       = 1 << 12 // 发送数据前先比对校验值, 接收端已有相同文件时跳过传输 (ext2Dedupe)
+	capCompress     = 1 << 13 // 按文件压缩数据 (ext2Compress)
+	capHeaderTLV    = 1 << 14 // 文件头使用带长度前缀的 TLV 块 (headerBlockMarker), 未协商时使用旧格式
+	capFramed       = 1 << 15 // 数据分帧并逐帧附带序号和 CRC32C (ext2Framed)
+	capBatchRoot    = 1 << 16 // 单连接多文件结束前发送整批的根校验值 (batchRootMarker)
+
+	localCapabilities = capRange | capSparse | capChecksum | capMultiFile | capDryRun | capEncrypt | capBench | capChecksumOnly | capManifest | capResume | capAck | capDelta | capDedupe | capCompress | capHeaderTLV | capFramed | capBatchRoot
+
+	// extHeaderMarker 出现在文件名长度字段时表示扩展头:
+	// [0xFFFF][flags u8][nameLen u16][name][size u64] + 各标志位附带的字段
+	extHeaderMarker = 0xFFFF
+	// ext2HeaderMarker 出现在文件名长度字段时表示带第二标志字节的扩展头:
+	// [0xFFFC][flags u8][flags2 u8][nameLen u16][name][size u64] + 各标志位附带的字段, flags2 为 ext2* 标志位且不为 0
+	ext2HeaderMarker = 0xFFFC
+	// extFlagRange 分段传输: 后跟 offset(8) + length(8), 本连接只携带文件的这一段
+	extFlagRange = 1 << 0
+	// extFlagSparse 稀疏文件: 后跟区段数 count(4) + count 个 (offset(8), length(8)),
+	// 数据部分为各数据区段内容的顺序拼接, 区段之间是空洞
+	extFlagSparse = 1 << 1
+	// extFlagChecksum 校验: 后跟 1 字节算法编号 (见 checksumAlgos), 数据之后附带该算法的摘要作为尾部,
+	// 尾部长度由算法决定, 由接收端重新计算并比对
+	extFlagChecksum = 1 << 2
+	// extFlagDryRun 演练: 文件头之后没有数据和校验尾部, 接收端只校验文件头和可用空间, 不创建任何文件
+	extFlagDryRun = 1 << 3
+	// extFlagEncrypt 加密: 后跟 16 字节随机盐, 两端用 HKDF-SHA256(psk, salt) 派生本文件的 AES-256-GCM 密钥,
+	// 数据部分为一系列帧 [密文长度 u32][nonce 12][密文], 最后一帧标记为结束帧 (见 sealWriter)
+	extFlagEncrypt = 1 << 4
+	// extFlagBench 往返吞吐量测试 (-mode bench): 后跟 size 字节的零数据, 接收端读取并丢弃后
+	// 立即回传 size 字节的零数据, 不创建任何文件. 不能与其他标志位同时使用
+	extFlagBench = 1 << 5
+	// extFlagChecksumOnly 只校验 (-checksum-only): 与 extFlagChecksum 同时出现, 文件头之后没有数据, 直接是校验值尾部.
+	// 接收端重新计算同名已有文件的校验值并比对, 回复 1 字节结果 (checksumOnlyMatch 等)
+	extFlagChecksumOnly = 1 << 6
+	// extFlagManifest 批量清单 (-filelist): 文件名长度为 0, 后跟总字节数 size(8) + 文件数 count(4), 没有数据.
+	// 只作为连接上的第一个文件头出现, 接收端据此显示整批的进度并预先检查总的可用空间. 不能与其他标志位同时使用
+	extFlagManifest = 1 << 7
+	// ext2Compress 压缩: 其余字段之后 (加密盐之后) 跟 1 字节压缩算法编号 (compressDeflate), 数据部分为一系列帧
+	// [长度 u32][数据], 每帧是原始数据中最多 compressChunk 字节的一块独立压缩的结果; 长度最高位为 1 时表示该块
+	// 压缩后没有变小, 以原样存储. 接收端收齐文件大小的原始数据后结束. 不能与分段、稀疏和加密同时使用
+	ext2Compress = 1 << 0
+	// ext2Framed 分帧校验 (-framed): 没有附带字段, 数据部分为一系列帧 [序号 u32][长度 u32][CRC32C u32][数据],
+	// 序号从 0 开始, 每帧最多 copyBufferSize 字节, 接收端收齐文件大小的数据后结束. 不能与分段、稀疏、加密和压缩同时使用
+	ext2Framed = 1 << 1
+	// ext2Resume 断点续传 (-resume): 不能与其他标志位同时使用. 文件大小之后为 restart(1), 非 0 时接收端丢弃已有的 .part;
+	// 接收端回复续传位置 offset(8) (拒绝时为 resumeRefused), 之后发送端发送 [offset, size) 的数据.
+	ext2Resume = 1 << 2
+	// resumeRefused 是接收端拒绝续传请求时回复的续传位置
+	resumeRefused = ^uint64(0)
+	// ext2Delta 增量传输 (-delta): 不能与其他标志位同时使用, 其余部分与普通文件头相同.
+	// 接收端回复块签名头 blockSize(4) + count(4) + basisSize(8) (拒绝时 blockSize 为 deltaRefused),
+	// 后跟已有同名文件每一块的签名: 滚动弱校验(4) + MD5(16). 之后发送端发送一系列指令 [op(1)][a(4)][b(4)]
+	// (见 deltaOpLiteral 等), 以 deltaOpEnd 和整个新文件的 MD5 结尾, 接收端据此在 .part 中重建并校验文件.
+	ext2Delta = 1 << 3
+	// ext2Dedupe 去重 (-dedupe): 必须与 extFlagChecksum 同时出现, 可以与稀疏、加密标志位和 ext2Compress 组合.
+	// 文件头 (包括各标志位的字段) 之后发送端先发送整个文件的校验值, 接收端回复 1 字节 (dedupeSend 等),
+	// 只有 dedupeSend 时才接着发送数据和校验尾部.
+	ext2Dedupe = 1 << 4
+	// framedHeaderSize 是 ext2Framed 每帧的帧头长度
+	framedHeaderSize = 12
+	// compressDeflate 是 DEFLATE (compress/flate) 的算法编号
+	compressDeflate = 1
+	// compressChunk 是每帧压缩的原始数据大小, compressStored 是帧长度中表示原样存储的位
+	compressChunk  = 256 << 10
+	compressStored = 1 << 31
+	// -compress auto 时采样文件开头 compressSample 字节试压缩, 压缩后不超过原大小的 compressAutoRatio 才启用压缩
+	compressSample    = 64 << 10
+	compressAutoRatio = 0.9
+	// headerBlockMarker 出现在文件名长度字段时表示 TLV 文件头 (协商了 capHeaderTLV 时使用, 见 encodeHeader):
+	// [0xFFFE][块长度 u32][版本 u8] + 一系列字段 [类型 u8][长度 u32][值]. 字段的含义与旧格式相同,
+	// 接收端跳过不认识的字段类型, 新增字段不需要改变协议版本. 结束标记仍为文件名长度 0
+	headerBlockMarker = 0xFFFE
+	headerVersion     = 1
+	// maxHeaderBlock 是接收端接受的最大 TLV 文件头, 足以容纳 maxSparseExtents 个区段
+	maxHeaderBlock = 4<<20 + maxSparseExtents*16
+	// batchRootMarker 出现在文件名长度字段时表示整批的根校验值 (协商了 capBatchRoot 且指定了 -verify 时,
+	// 在结束标记之前发送, 见 batchRoot): [0xFFFD][算法编号 u8][根校验值], 接收端比对后回复 1 字节 (batchRootMatch 等)
+	batchRootMarker = 0xFFFD
+	// deltaRefused 是接收端拒绝增量传输时回复的块大小
+	deltaRefused = ^uint32(0)
+	// 增量传输的指令
+	deltaOpEnd     = 0 // 结束, 后跟整个新文件的 MD5
+	deltaOpLiteral = 1 // 后跟 a 字节的字面数据
+	deltaOpCopy    = 2 // 复制已有文件从第 a 块开始的连续 b 块
+	// deltaMaxLiteral 是一条字面数据指令携带的最大字节数
+	deltaMaxLiteral = 1 << 20
+
+	// ackOK / ackFail 是协商了 capAck 时接收端在每个文件 (包括校验尾部) 之后回复的确认字节
+	ackOK   = 0
+	ackFail = 1
+
+	// pullOK / pullNotFound 是 serve 模式的服务端对 get 请求的回复: 之后服务端转为发送端发送该文件
+	pullOK       = 0
+	pullNotFound = 1
+
+	// -checksum-only 时接收端回复的结果
+	checksumOnlyMatch    = 0 // 校验值一致
+	checksumOnlyMismatch = 1 // 大小或校验值不一致
+	checksumOnlyMissing  = 2 // 文件不存在或无法读取
+
+	// -dedupe 时接收端回复的结果
+	dedupeSend   = 0 // 需要传输
+	dedupeSame   = 1 // 已有内容相同的文件, 跳过
+	dedupeExists = 2 // 已有内容不同的文件, 但接收端按 -if 不替换, 跳过
+
+	// 整批根校验值的比对结果
+	batchRootMatch    = 0
+	batchRootMismatch = 1
+
+	maxSparseExtents = 1 << 20 // 接收端接受的最大区段数, 防止恶意头部导致大量内存分配
+	// maxFileNameLen 是文件名的最大字节数: 多数文件系统的单个路径分量上限 NAME_MAX 为 255,
+	// 接收端先写入 "<文件名>.part" 临时文件, 因此还要留出后缀的长度
+	maxFileNameLen = 255 - len(".part")
+	// writerMaxFile 是 -writers 时交给后台写入的最大文件: 更大的文件仍在接收线程中直接写入磁盘,
+	// 每个连接最多有 2N+1 个这样的文件缓冲在内存中 (N 个正在写入, N 个排队, 1 个正在接收)
+	writerMaxFile = 8 << 20
+
+	encryptChunk  = copyBufferSize // 加密时每帧的明文字节数
+	saltSize      = 16             // extFlagEncrypt 附带的随机盐长度
+	benchFileName = "bench.dat"    // bench 文件头中的虚拟文件名
+	probeFileName = "probe.dat"    // probe 模式 bench 文件头中的虚拟文件名, 接收端不为它输出常规日志
+	probeRounds   = 10             // probe 模式测量 RTT 的往返次数
+	probeSample   = 16 << 20       // probe 模式未指定 -size 时测量带宽上传的数据量
+)
+
+var (
+	mode          = flag.String("mode", "send", "运行模式: send (连接并发送), receive (监听并接收), copy (本机复制), relay (接收并转发到下一跳), serve (监听并按请求发送 -dir 中的文件), get (从 serve 端拉取 -file 指定的文件), bench (与接收端测试双向吞吐量), probe (测量到接收端的 RTT、MTU 并建议缓冲区大小) 或 retry (重新发送 -failed 日志中记录的失败文件)") // 恢复模式说明
+	file          = flag.String("file", "", "要发送的文件路径 (send 模式, '-' 表示从 stdin 读取, 包含 * ? [ 时按通配符展开并通过一条连接发送所有匹配的文件; copy 模式为源文件; get 模式为要拉取的文件名)")                                                                                                                         // 发送端仍需指定文件
+	dst           = flag.String("dst", "", "目标文件路径 (copy 模式, 为已存在的目录时复制到该目录下的同名文件)")
+	dir           = flag.String("dir", ".", "保存文件的目录路径 (receive 模式, '-' 表示写到 stdout)") // 接收端指定目录
+	dirTemplate   = flag.String("dir-template", "", "接收端把文件保存到 -dir 下按模板展开的子目录, 支持 {date} (YYYY-MM-DD), {remote} (对端 IP) 和 {name} (文件名), e.g., {date}/{remote}")
+	addr          = flag.String("addr", "localhost:8080", "网络地址 (连接地址 for send, 监听地址 for receive)")
+	listenOn      = flag.String("listen", "", "relay 模式的监听地址 (e.g., :8080)")
+	forward       = flag.String("forward", "", "relay 模式转发到的下一跳地址 (接收端或另一个 relay, e.g., next:8080)")
+	badFile       = "failed_files.log" // 记录传输失败的文件
+	retryLog      = flag.String("failed", "failed_files.log", "retry 模式读取的失败日志 (文本或 JSON 格式), 重试后只保留再次失败的文件")
+	noSplice      = flag.Bool("no-splice", false, "接收端不使用 splice 系统调用 (使用标准 Go io.Copy)")
+	sndBuf        = flag.Int("sndbuf", 0, "设置 TCP 发送缓冲区大小 (4194304字节, 0=系统默认)")
+	rcvBuf        = flag.Int("rcvbuf", 0, "设置 TCP 接收缓冲区大小 (4194304字节, 0=系统默认)")
+	nagle         = flag.Bool("nagle", false, "启用 Nagle 算法 (默认两端都设置 TCP_NODELAY, 减少多个小文件时文件头的发送延迟)")
+	keepAlive     = flag.Duration("keepalive", 15*time.Second, "TCP keepalive 探测间隔, 两端在连接空闲时发送探测以及时发现已断开的对端 (0=关闭 keepalive)")
+	userTimeout   = flag.Duration("user-timeout", 0, "设置 TCP_USER_TIMEOUT: 已发送的数据超过该时间仍未被确认时内核中止连接, 传输中对端静默消失时比 keepalive 更快失败 (e.g., 30s, 0=系统默认)")
+	sendSplice    = flag.Bool("send-splice", false, "发送端使用 splice (文件→管道→socket) 代替 sendfile 发送普通文件 (用于性能对比)")
+	mmapSend      = flag.Bool("mmap", false, "发送端 mmap 源文件后按块写入连接 (madvise MADV_SEQUENTIAL, 用于性能对比; /dev/zero 和 stdin 回退到标准写入)")
+	zeroCopy      = flag.Bool("zerocopy", false, "实验性: 发送端在无法使用 sendfile 的标准写入路径 (如 /dev/zero, stdin, -verify, -mmap, 一对多发送) 上设置 SO_ZEROCOPY 并以 MSG_ZEROCOPY 发送, 内核不支持时静默回退")
+	vmspliceSend  = flag.Bool("vmsplice", false, "实验性: 发送 /dev/zero 时以 vmsplice 把零页放入管道再 splice 到 socket, 发送来自管道的 stdin 时直接 splice 到 socket, 代替标准写入; 不可用时回退")
+	congestion    = flag.String("cc", "", "TCP 拥塞控制算法, 如 bbr, cubic, reno (两端均可设置, 内核不支持时使用系统默认算法; 空=系统默认)")
+	oDirect       = flag.Bool("odirect", false, "接收端打开目标文件时使用 O_DIRECT (Linux only, 绕过页缓存, 谨慎使用!)") // 添加缺失的 O_DIRECT 标志定义
+	seqHint       = flag.Bool("seq-hint", false, "接收端对目标文件调用 POSIX_FADV_SEQUENTIAL, 提示内核按顺序写入优化回写 (O_DIRECT 时忽略)")
+	prealloc      = flag.String("prealloc", "full", "接收端预分配目标文件空间的方式: full (fallocate 并设置文件大小), keepsize (FALLOC_FL_KEEP_SIZE, 只分配磁盘块不改变文件大小) 或 off (不预分配)")
+	noFallocate   = flag.Bool("no-fallocate", false, "接收端完全不调用 fallocate, 等同于 -prealloc off (用于不支持 fallocate 的网络文件系统等)")
+	sizeStr       = flag.String("size", "", "要传输的数据大小 (用于 -file /dev/zero 时指定大小, 单位 K/M/G/T 不区分大小写, e.g., 1T, 1G, 500MB, 1024K, 1048576)") // 更新 size 说明
+	prewarm       = flag.Bool("prewarm", false, "发送端在程序启动时预热文件到页缓存 (仅 send 模式)")
+	dropCache     = flag.Bool("drop-cache", false, "发送端在发送成功后释放源文件的页缓存 (POSIX_FADV_DONTNEED)")
+	sparse        = flag.Bool("sparse", false, "发送端检测稀疏文件, 只传输数据区段, 接收端保留空洞 (SEEK_DATA/SEEK_HOLE)")
+	fileList      = flag.String("filelist", "", "发送端从文件中读取待发送的文件路径列表 (每行一个, 忽略空行和 # 注释), 通过一条连接依次发送")
+	since         = flag.String("since", "", "批量发送 (-filelist 或通配符 -file) 时跳过修改时间早于该时间的文件: 时长表示距现在多久 (e.g., 24h), 或时间戳 (e.g., 2024-01-02, 2024-01-02T15:04:05Z)")
+	verify        = flag.String("verify", "", "发送端附带校验值供接收端验证: md5, sha256, crc32c 或 blake3 (需经过用户态计算, 会禁用 sendfile/splice 零拷贝)")
+	dryRun        = flag.Bool("dry-run", false, "发送端只连接、握手并发送文件头, 不传输数据, 输出将要发送的内容; 接收端只校验文件头和可用空间, 不创建文件")
+	checksumOnly  = flag.Bool("checksum-only", false, "发送端不传输数据, 只发送文件头和整个文件的校验值, 由接收端校验同名的已有文件并回复结果 (算法由 -verify 指定, 默认 sha256)")
+	pskSpec       = flag.String("psk", "", "预共享密钥 (密钥文件路径或十六进制字符串, 至少 16 字节), 两端指定相同的密钥后以 AES-256-GCM 加密传输数据 (会禁用 sendfile/splice 零拷贝)")
+	ioTimeout     = flag.Duration("io-timeout", 0, "网络 I/O 无进展超时时间, 超时后断开连接 (e.g., 30s, 0=不超时)")
+	deadline      = flag.Duration("deadline", 0, "整个传输的时间上限: 发送端从启动算起, 接收端对每个连接从开始处理算起, 超时后中止传输并以退出码 7 退出, 接收端删除未完成的临时文件 (e.g., 5m, 0=不限制)")
+	connTimeout   = flag.Duration("connect-timeout", 10*time.Second, "发送端每次建立连接的超时时间, 配合 -retry 时每次尝试单独计时 (0=不超时, 由系统决定)")
+	retryCount    = flag.Int("retry", 0, "发送端连接失败时的重试次数 (指数退避, 只重试连接建立; -ack 时单个文件被接收端否认后也会重新发送)")
+	ackMode       = flag.Bool("ack", false, "发送端在每个文件发送完成后等待接收端确认: 接收端收齐数据、校验通过并 fsync 到磁盘后才回复, 否认时记录到 failed_files.log")
+	retryDelay    = flag.Duration("retry-delay", time.Second, "发送端首次重试前的等待时间, 之后每次翻倍 (上限 30s)")
+	resume        = flag.Bool("resume", false, "发送端把单个文件的发送进度定期保存到 <文件>.ftgo-resume, 中断后以 -resume 重新运行时与接收端协商续传位置, 从断点继续发送 (接收端保留 .part 临时文件), 成功后删除该文件")
+	delta         = flag.Bool("delta", false, "发送端以增量方式发送常规文件: 接收端回复其同名已有文件的块签名 (滚动校验 + MD5), 发送端只发送变化的数据, 接收端重建后以 MD5 校验整个文件 (更新已有文件需要接收端 -force)")
+	dedupe        = flag.Bool("dedupe", false, "发送端在发送每个文件的数据之前先发送其校验值 (算法由 -verify 指定, 默认 sha256), 接收端已有内容相同的同名文件时回复跳过, 不再传输数据")
+	compressMode  = flag.String("compress", "off", "发送端压缩数据 (DEFLATE): off (不压缩), on (总是压缩) 或 auto (按文件采样开头 64KB 试压缩, 压缩率足够时才启用, 跳过已压缩的媒体等文件); 不压缩分段、稀疏、加密和大小未知的传输")
+	framed        = flag.Bool("framed", false, "发送端把数据按 64KB 分帧, 每帧附带序号和 CRC32C, 接收端逐帧检查并立即报告损坏数据的偏移量 (用于诊断不可靠的链路); 不使用 sendfile/splice")
+	keepXattrs    = flag.Bool("xattrs", false, "发送端在文件头中附带文件的扩展属性 (包括 SELinux 标签和 POSIX ACL), 接收端写入完成后恢复; 需要两端都支持 TLV 文件头")
+	cpuAffinity   = flag.String("cpu-affinity", "", "接收端标准 IO 复制时把读取网络和写入磁盘的 goroutine 绑定到指定的 CPU, 格式为 网络CPU列表:磁盘CPU列表 (e.g., 0-3:4-7, 或 0,2 表示两者相同); 绑定失败时只输出警告")
+	connections   = flag.Int("connections", 1, "发送端将单个文件切分为 N 段, 通过 N 条 TCP 连接并行发送 (适用于高延迟长肥管道)")
+	fanoutBufStr  = flag.String("fanout-buffer", "64M", "一对多发送 (-addr 为逗号分隔的多个地址) 时每个接收端的发送队列大小, 慢的接收端落后超过该值后才会拖慢其他接收端 (单位同 -size)")
+	limitStr      = flag.String("limit", "", "限制本进程所有连接合计的传输速度, 单位为每秒字节数 (单位同 -size, e.g., 100M 即 100 MB/s; 默认不限制)")
+	limitRxStr    = flag.String("limit-rx", "", "单独限制接收方向 (从连接读取) 的速度, 单位同 -limit; 与发送方向分别计算, 指定后接收方向不再受 -limit 和 -schedule 限制")
+	limitTxStr    = flag.String("limit-tx", "", "单独限制发送方向 (向连接写入) 的速度, 单位同 -limit; 与接收方向分别计算, 指定后发送方向不再受 -limit 和 -schedule 限制")
+	ramp          = flag.Duration("ramp", 0, "配合 -limit: 在该时间内把允许的速度从上限的 5% 线性提高到上限, 避免一开始就以全速冲击链路 (e.g., 30s)")
+	throttleLoad  = flag.Float64("throttle-on-load", 0, "配合 -limit: 系统 1 分钟平均负载超过该值时按比例降低速度上限, 负载回落后恢复 (e.g., 8, 0=不根据负载调整)")
+	scheduleStr   = flag.String("schedule", "", "按时段 (本地时间) 设置速度上限, 逗号分隔的 HH:MM-HH:MM=速度, 速度为 unlimited 时不限速, e.g., 09:00-17:00=10M,17:00-09:00=unlimited; 不在任何时段内时使用 -limit (未指定时不限速)")
+	netType       = flag.String("net", "tcp", "网络类型: tcp, sctp (一对一风格的 SCTP 关联, 本机内核不支持时回退到 tcp) 或 unix (unix 时 -addr 为 socket 文件路径, 包含 '/' 或以 '@' 开头 (抽象命名空间) 的 -addr 自动视为 unix)")
+	ipv4Only      = flag.Bool("ipv4only", false, "只使用 IPv4 (tcp4) 连接/监听")
+	ipv6Only      = flag.Bool("ipv6only", false, "只使用 IPv6 (tcp6) 连接/监听")
+	mptcp         = flag.Bool("mptcp", false, "发送端连接和接收端 (以及 relay/serve) 监听时启用 Multipath TCP, 聚合多条网络路径的带宽; 内核或对端不支持时自动使用普通 TCP")
+	reusePort     = flag.Bool("reuseport", false, "接收端监听时设置 SO_REUSEPORT, 允许多个接收端进程监听同一端口, 由内核分配连接")
+	proxyStr      = flag.String("proxy", "", "发送端经 SOCKS5 代理连接接收端, 格式为 socks5://[用户名:密码@]主机:端口 (e.g., 跳板机上的 ssh -D); 接收端地址由代理解析, 数据使用标准写入而不是 sendfile")
+	bindDevice    = flag.String("bind-device", "", "通过 SO_BINDTODEVICE 把发送端的连接 (以及接收端的监听 socket) 绑定到指定网络接口, e.g., eth1 (需要 CAP_NET_RAW)")
+	portRange     = flag.String("port-range", "", "接收端依次尝试该范围内的端口直到监听成功 (e.g., 9000-9100, 使用 -addr 的 host 部分), 并将实际监听地址输出到 stdout")
+	noSpaceChk    = flag.Bool("no-space-check", false, "接收端不在接收前检查目标文件系统的可用空间")
+	waitSpace     = flag.Duration("wait-space", 0, "接收端写入遇到空间不足 (ENOSPC/EDQUOT) 时暂停等待可用空间的最长时间, 期间按退避间隔重新检查, 有空间后从中断处继续 (e.g., 10m, 0=立即失败)")
+	zeroVerify    = flag.Bool("zero-verify", false, "接收端检查收到的每个字节都是 0, 遇到非零字节时报告其偏移量并判定接收失败 (配合发送端 -file /dev/zero 测试整条传输链路的正确性)")
+	teeTarget     = flag.String("tee", "", "接收端把收到的数据同时写入该目标: 文件路径 (所有文件的数据依次追加), '-' 表示 stdout, 以 '|' 开头时作为 shell 命令运行并写入其 stdin (e.g., '|sha256sum'); 需要经过用户态, 不使用 splice")
+	cpuProfile    = flag.String("cpuprofile", "", "将 CPU profile 写入该文件 (runtime/pprof, 用 go tool pprof 分析), 退出时输出 sendfile/splice 的系统调用次数")
+	memProfile    = flag.String("memprofile", "", "退出时将堆内存 profile 写入该文件 (runtime/pprof)")
+	traceFile     = flag.String("trace", "", "将执行跟踪写入该文件 (runtime/trace, 用 go tool trace 分析)")
+	force         = flag.Bool("force", false, "接收端覆盖已存在的同名文件 (默认跳过已存在的文件)")
+	ifPolicy      = flag.String("if", "", "接收端何时替换已存在的同名文件: never (跳过, 默认), always (同 -force), newer (发送端文件的修改时间晚于已有文件时替换, 同 cp -u), size-differs (大小不同时替换)")
+	appendMode    = flag.Bool("append", false, "接收端把数据追加到已存在的同名文件末尾而不是截断 (不使用临时文件和预分配, 接收失败时截断回原大小)")
+	writers       = flag.Int("writers", 0, "接收端用 N 个后台线程写入单连接多文件中的小文件 (不超过 8MB): 数据完整接收并校验后交给写入线程创建、写入、fsync 和改名, 接收线程随即接收下一个文件 (0=在接收线程中依次写入)")
+	tmpFile       = flag.Bool("tmpfile", false, "接收端用 O_TMPFILE 在目标目录中创建匿名文件写入, 传输和校验全部成功后才 linkat 为正式文件名, 不会留下 .part 文件; 文件系统不支持时回退为 .part + 改名")
+	maxSizeStr    = flag.String("max-file-size", "", "接收端拒绝文件头声明的大小超过该值的文件 (单位同 -size, e.g., 100G; 空=不限制)")
+	minFreeStr    = flag.String("min-free", "", "接收端在 -dir 所在文件系统可用空间低于该值时暂停接受新连接, 空间恢复后继续 (单位同 -size, e.g., 10G; 空=不检查)")
+	maxFiles      = flag.Int("max-files", 0, "接收端完整接收 N 个文件后停止接受新文件并退出 (0=不限制)")
+	acceptCount   = flag.Int("accept-count", 0, "接收端处理完 N 个连接后退出 (0=不限制, 一直等待新连接)")
+	acceptTimeout = flag.Duration("accept-timeout", 0, "接收端等待新连接的超时时间, 超时无连接时输出汇总并退出 (e.g., 5m, 0=不超时)")
+	manifestPath  = flag.String("manifest", "", "接收端将每个完整接收的文件追加记录到该清单文件 (JSON Lines: 文件名, 字节数, 耗时, 速度, 校验值)")
+	metricsAddr   = flag.String("metrics-addr", "", "接收端在该地址启动 HTTP 服务, 以 Prometheus 文本格式在 /metrics 提供接收统计 (e.g., :9100; 空=不启动)")
+	jsonSummary   = flag.Bool("json-summary", false, "运行结束时在 stdout 输出一行 JSON 汇总 (模式, 文件数, 总字节数, 耗时, 平均速度, 每个文件的结果), 便于脚本/CI 解析 (send, receive 和 copy 模式)")
+	bwLogPath     = flag.String("bwlog", "", "把每次进度刷新 (见 -progress-interval) 的吞吐量采样追加到该 CSV 文件: elapsed_seconds,transferred_bytes,instantaneous_mbps (发送端和接收端)")
+	logLevelStr   = flag.String("log-level", "normal", "日志级别: quiet (只输出错误和最终汇总, 不显示进度), normal 或 debug (额外输出每个协议步骤)")
+	progressMode  = flag.String("progress", "auto", "进度显示方式: auto (输出到终端时原地刷新, 否则每次更新输出一行), tty (总是原地刷新) 或 plain (每次更新输出一行, 不含控制字符)")
+	unitsMode     = flag.String("units", "raw", "进度和汇总中字节数的显示单位: raw (逗号分组的字节数), iec (1024 进制, 如 1.50 GiB) 或 si (1000 进制, 如 1.61 GB)")
+	progressEvery = flag.Duration("progress-interval", 0, "进度刷新间隔 (默认: 原地刷新时 500ms, 每次输出一行时 5s)")
+	configPath    = flag.String("config", "", "从该文件读取参数的默认值 (TOML 或 .json, 键为参数名, e.g., addr = \"host:8080\"), 命令行上显式指定的参数优先")
+	logFormat     = flag.String("log-format", "text", "日志格式: text (带颜色的文本) 或 json (每行一个 JSON 对象, 包含 time, level, msg, remote 以及与文件相关的消息附带的 file 和 bytes 字段, 便于日志系统采集)")
+	failLogFormat = flag.String("failed-log-format", "text", "failed_files.log 的格式: text (时间 - 角色 - 路径 - 原因) 或 json (每行一个 JSON 对象, 包含 time, role, path, reason, bytes_sent 和 remote 字段, bytes_sent 为失败时已传输到的文件偏移量, 便于重试脚本从该位置续传)")
+
+	// progressOut 是进度显示的输出目标; 接收到 stdout 时改为 stderr, 避免与数据混在一起
+	progressOut io.Writer = os.Stdout
+	// resultOut 是发送端/复制结束时结果提示的输出目标 (stdout), 与进度行协调时经由 progressTerminal
+	resultOut io.Writer = os.Stdout
+	// progressTick 是进度刷新间隔, 由 -progress 和 -progress-interval 决定
+	progressTick = 500 * time.Millisecond
+	// logLevel 由 -log-level 解析得到, 控制 logInfo/logDebug 是否输出
+	logLevel = levelNormal
+	// jsonLog 在 -log-format json 时非 nil, 所有日志经由它输出为 JSON
+	jsonLog *jsonLogger
+	// maxFileSize 由 -max-file-size 解析得到, 0 表示不限制
+	maxFileSize int64
+	// minFreeSpace 由 -min-free 解析得到, 0 表示不检查
+	minFreeSpace int64
+	// fanoutBuffer 由 -fanout-buffer 解析得到
+	fanoutBuffer int64
+	// portLow/portHigh 由 -port-range 解析得到, portHigh 为 0 表示未指定
+	portLow, portHigh int
+	// pskKey 由 -psk 加载得到, 非 nil 时发送端加密数据, 接收端只接受加密传输
+	pskKey []byte
+	// sinceTime 由 -since 解析得到, 零值表示不过滤
+	sinceTime time.Time
+	// netCPUs/diskCPUs 由 -cpu-affinity 解析得到, nil 表示不绑定
+	netCPUs, diskCPUs *unix.CPUSet
+)
+
+// 日志级别: 错误 (logError) 和最终汇总 (logFields.print) 在任何级别下都输出
+const (
+	levelQuiet  = iota // 只输出错误和最终汇总
+	levelNormal        // 额外输出连接、警告等常规信息
+	levelDebug         // 额外输出每个协议步骤 (如发送/接收的每个头部字段)
+)
+
+// 进程退出码, 供脚本区分失败类型 (见 README 的 "退出码" 一节)
 const (
-	copyBufferSize = 65536 // 用于 io.CopyBuffer 和 splice 的缓冲区大小
+	exitOK      = 0
+	exitFailure = 1 // 其他错误
+	exitUsage   = 2 // 参数错误 (flag 包解析失败时同样以 2 退出)
+	exitNetwork = 3 // 网络错误: 连接/监听失败, 连接断开, I/O 超时
+	exitIO      = 4 // 文件/IO 错误: 源文件无法读取, 目标文件无法写入, sendfile 失败
+	exitVerify  = 5 // -verify 校验值不匹配, 或 -checksum-only 时接收端的文件不一致/不存在
+	exitNoSpace = 6 // 目标文件系统空间不足
+	exitTimeout = 7 // 传输未能在 -deadline 时间内完成
 )
 
 var (
-	mode     = flag.String("mode", "send", "运行模式: send (连接并发送) 或 receive (监听并接收)") // 恢复模式说明
-	file     = flag.String("file", "", "要发送的文件路径 (send 模式)")                       // 发送端仍需指定文件
-	dir      = flag.String("dir", ".", "保存文件的目录路径 (receive 模式)")                   // 接收端指定目录
-	addr     = flag.String("addr", "localhost:8080", "网络地址 (连接地址 for send, 监听地址 for receive)")
-	badFile  = "failed_files.log" // 记录传输失败的文件
-	noSplice = flag.Bool("no-splice", false, "接收端不使用 splice 系统调用 (使用标准 Go io.Copy)")
-	sndBuf   = flag.Int("sndbuf", 0, "设置 TCP 发送缓冲区大小 (4194304字节, 0=系统默认)")
-	rcvBuf   = flag.Int("rcvbuf", 0, "设置 TCP 接收缓冲区大小 (4194304字节, 0=系统默认)")
-	oDirect  = flag.Bool("odirect", false, "接收端打开目标文件时使用 O_DIRECT (Linux only, 绕过页缓存, 谨慎使用!)")            // 添加缺失的 O_DIRECT 标志定义
-	sizeStr  = flag.String("size", "", "要传输的数据大小 (用于 send -file /dev/zero 时指定大小, e.g., 1G, 500M, 1024K)") // 更新 size 说明
-	prewarm  = flag.Bool("prewarm", false, "发送端在程序启动时预热文件到页缓存 (仅 send 模式)")
+	// errIOTimeout 表示连接在 -io-timeout 时间内没有任何数据进展
+	errIOTimeout = errors.New("I/O 超时")
+	// errDeadline 表示整个传输 (发送端) 或连接 (接收端) 没有在 -deadline 时间内完成而被中止
+	errDeadline = errors.New("超过 -deadline 时间限制")
+	// errNoSpace 表示目标文件系统的可用空间不足以容纳待接收的文件
+	errNoSpace = errors.New("磁盘空间不足")
+	// errChecksumMismatch 表示接收端计算的校验值与发送端附带的不一致
+	errChecksumMismatch = errors.New("校验值不匹配")
+	// errRemoteMissing 表示 -checksum-only 时接收端没有对应的文件或无法读取
+	errRemoteMissing = errors.New("不存在或无法读取")
+	// errRemoteNack 表示 -ack 时接收端回复了否认: 数据没有完整、正确地落盘
+	errRemoteNack = errors.New("未被接收端确认 (接收端写入、校验或同步到磁盘失败, 详见接收端日志)")
+	// errPullRefused 表示 get 请求的文件在服务端不存在或不是常规文件
+	errPullRefused = errors.New("服务端没有该文件 (不存在或不是常规文件)")
+	// errBindDevice 表示 -bind-device 指定的接口无法绑定 (权限不足或接口不存在), 重试连接没有意义
+	errBindDevice = errors.New("绑定网络接口失败")
+
+	crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// checksumAlgos 是 -verify 支持的校验算法, code 为扩展头中的 1 字节算法编号, 一经发布不能修改
+	checksumAlgos = []checksumAlgo{
+		{code: 1, name: "crc32c", newHash: func() hash.Hash { return crc32.New(crc32cTable) }},
+		{code: 2, name: "md5", newHash: md5.New},
+		{code: 3, name: "sha256", newHash: sha256.New},
+		{code: 4, name: "blake3", newHash: func() hash.Hash { return blake3.New(32, nil) }},
+	}
 )
 
+// checksumAlgo 描述一种校验算法, 尾部长度为 newHash().Size() 字节
+type checksumAlgo struct {
+	code    byte
+	name    string
+	newHash func() hash.Hash
+}
+
+// checksumAlgoByName 按 -verify 参数查找校验算法
+func checksumAlgoByName(name string) (checksumAlgo, bool) {
+	for _, algo := range checksumAlgos {
+		if algo.name == name {
+			return algo, true
+		}
+	}
+	return checksumAlgo{}, false
+}
+
+// checksumAlgoByCode 按扩展头中的算法编号查找校验算法
+func checksumAlgoByCode(code byte) (checksumAlgo, bool) {
+	for _, algo := range checksumAlgos {
+		if algo.code == code {
+			return algo, true
+		}
+	}
+	return checksumAlgo{}, false
+}
+
 type FileInfoError struct {
 	FilePath string
 	Err      error
@@ -97,124 +487,1120 @@ func main() {
 		fmt.Fprintln(os.Stderr, "  - 此程序仅在 Linux 系统上可用，因为它使用了 splice、sendfile 和 fallocate 等系统调用。")
 		fmt.Fprintln(os.Stderr, "  - 谨慎使用 -odirect 标志，因为它会绕过页缓存，可能影响性能，并且有严格的对齐要求。")
 		fmt.Fprintln(os.Stderr, "  - 发送 /dev/zero 时必须指定 -size 参数。")
+		fmt.Fprintln(os.Stderr, "  - 退出码: 0 成功, 1 其他错误, 2 参数错误, 3 网络错误, 4 文件/IO 错误, 5 校验不匹配, 6 磁盘空间不足, 7 超过 -deadline。")
 	}
 	flag.Parse()
+	// 优先级: 命令行参数 > FTGO_* 环境变量 > -config 文件 > 内置默认值
+	if err := applyEnvDefaults(); err != nil {
+		usageFatalf("错误: %v", err)
+	}
+	if *configPath != "" {
+		if err := applyConfigFile(*configPath); err != nil {
+			usageFatalf("错误: 无效的 -config 参数: %v", err)
+		}
+	}
 
 	if runtime.GOOS != "linux" {
 		log.Fatal("错误: 此程序只能在Linux系统上运行")
 	}
 
-	if len(os.Args) == 1 {
+	if len(os.Args) == 1 && flag.NFlag() == 0 { // 参数可能全部来自环境变量
 		flag.Usage()
 		os.Exit(0)
 	}
 
+	switch *logLevelStr {
+	case "quiet":
+		logLevel = levelQuiet
+		progressOut = io.Discard
+	case "normal":
+		logLevel = levelNormal
+	case "debug":
+		logLevel = levelDebug
+		sendfileStats = &sendfileCounters{}
+	default:
+		usageFatalf("错误: 无效的 -log-level 参数 %q. 请使用 'quiet', 'normal' 或 'debug'", *logLevelStr)
+	}
+	switch *logFormat {
+	case "text":
+	case "json":
+		// 所有日志都经由 jsonLogger 输出, 时间戳由其自行添加
+		jsonLog = &jsonLogger{out: os.Stderr}
+		log.SetFlags(0)
+		log.SetOutput(jsonLog)
+	default:
+		usageFatalf("错误: 无效的 -log-format 参数 %q. 请使用 'text' 或 'json'", *logFormat)
+	}
+
+	if *prealloc != "full" && *prealloc != "keepsize" && *prealloc != "off" {
+		usageFatalf("错误: 无效的 -prealloc 参数 %q. 请使用 'full', 'keepsize' 或 'off'", *prealloc)
+	}
+	if *noFallocate {
+		*prealloc = "off"
+	}
+	if _, ok := checksumAlgoByName(*verify); *verify != "" && !ok {
+		usageFatalf("错误: 无效的 -verify 参数 %q. 请使用 'md5', 'sha256', 'crc32c' 或 'blake3'", *verify)
+	}
+
+	// -file 包含通配符时展开为多个文件, 像 -filelist 一样通过一条连接依次发送
+	globFile := *mode == "send" && *fileList == "" && isGlobPattern(*file)
+	if globFile {
+		if _, err := filepath.Match(*file, ""); err != nil {
+			usageFatalf("错误: 无效的 -file 通配符模式 %q: %v", *file, err)
+		}
+	}
 	if *mode == "send" {
-		if *file == "" {
-			log.Fatal("错误: send 模式下必须指定 -file 参数")
+		if *file == "" && *fileList == "" {
+			usageFatalf("错误: send 模式下必须指定 -file 或 -filelist 参数")
+		}
+		if *file != "" && *fileList != "" {
+			usageFatalf("错误: -file 和 -filelist 不能同时使用")
 		}
 		if *file == "/dev/zero" && *sizeStr == "" {
-			log.Fatal("错误: 使用 -file /dev/zero 时必须指定 -size 参数")
+			usageFatalf("错误: 使用 -file /dev/zero 时必须指定 -size 参数")
 		}
 		if *file == "/dev/zero" {
 			if _, err := parseSize(*sizeStr); err != nil {
-				log.Fatalf("错误: 使用 -file /dev/zero 时 -size 参数无效: %v", err)
+				usageFatalf("错误: 使用 -file /dev/zero 时 -size 参数无效: %v", err)
 			}
 		}
 	}
+	if *checksumOnly {
+		if *mode != "send" || *file == "-" {
+			usageFatalf("错误: -checksum-only 只能用于 send 模式, 且不支持 stdin")
+		}
+		if *dryRun || *pskSpec != "" || strings.Contains(*addr, ",") {
+			usageFatalf("错误: -checksum-only 不能与 -dry-run, -psk 或一对多发送同时使用")
+		}
+		if *verify == "" {
+			*verify = "sha256"
+		}
+	}
+	if *mode == "bench" {
+		if size, err := parseSize(*sizeStr); err != nil || size <= 0 {
+			usageFatalf("错误: bench 模式下必须通过 -size 指定大于 0 的测试数据大小")
+		}
+		if *pskSpec != "" {
+			usageFatalf("错误: bench 模式不支持 -psk")
+		}
+	}
+	if *mode == "probe" {
+		if size, err := parseSize(*sizeStr); *sizeStr != "" && (err != nil || size <= 0) {
+			usageFatalf("错误: 无效的 -size 参数 %q", *sizeStr)
+		}
+		if *pskSpec != "" || *netType != "tcp" || strings.Contains(*addr, ",") {
+			usageFatalf("错误: probe 模式只支持单个 TCP 接收端, 不支持 -psk")
+		}
+	}
+	if *mode == "copy" {
+		if *file == "" || *dst == "" {
+			usageFatalf("错误: copy 模式下必须指定 -file 和 -dst 参数")
+		}
+		if *file == "/dev/zero" && *sizeStr == "" {
+			usageFatalf("错误: 使用 -file /dev/zero 时必须指定 -size 参数")
+		}
+	}
+	if *mode == "send" && *fileList == "" && !globFile && *file != "-" && *file != "/dev/zero" {
+		// 在连接接收端之前检查文件名, 文件头中的文件名是源文件路径的最后一个分量
+		if err := validateFileName(filepath.Base(*file)); err != nil {
+			usageFatalf("错误: 无法发送 '%s': %v", *file, err)
+		}
+	}
+	if *resume {
+		if *mode != "send" || *fileList != "" || globFile || *file == "-" || *file == "/dev/zero" {
+			usageFatalf("错误: -resume 只能用于 send 模式发送单个常规文件 (-file), 不支持 -filelist, 通配符, stdin 和 /dev/zero")
+		}
+		if *connections > 1 || *sparse || *verify != "" || *pskSpec != "" || *dryRun || *checksumOnly || *mmapSend || strings.Contains(*addr, ",") {
+			usageFatalf("错误: -resume 不能与 -connections, -sparse, -verify, -psk, -dry-run, -checksum-only, -mmap 或一对多发送同时使用")
+		}
+	}
+	if *since != "" {
+		if *mode != "send" || (*fileList == "" && !globFile) {
+			usageFatalf("错误: -since 只能用于批量发送 (-filelist 或包含通配符的 -file)")
+		}
+		t, err := parseSince(*since, time.Now())
+		if err != nil {
+			usageFatalf("错误: 无效的 -since 参数: %v", err)
+		}
+		sinceTime = t
+	}
+	if *delta {
+		if (*mode != "send" && *mode != "serve") || *file == "-" || *file == "/dev/zero" {
+			usageFatalf("错误: -delta 只能用于 send 或 serve 模式发送常规文件, 不支持 stdin 和 /dev/zero")
+		}
+		if *connections > 1 || *sparse || *verify != "" || *pskSpec != "" || *resume || *dryRun || *checksumOnly || strings.Contains(*addr, ",") {
+			usageFatalf("错误: -delta 不能与 -connections, -sparse, -verify (增量传输总是以 MD5 校验整个文件), -psk, -resume, -dry-run, -checksum-only 或一对多发送同时使用")
+		}
+	}
+	switch *compressMode {
+	case "off", "on", "auto":
+	default:
+		usageFatalf("错误: 无效的 -compress 参数 %q. 请使用 'off', 'on' 或 'auto'", *compressMode)
+	}
+	if *framed {
+		if *mode != "send" && *mode != "serve" && *mode != "retry" {
+			usageFatalf("错误: -framed 只能用于 send、serve 或 retry 模式")
+		}
+		if *compressMode != "off" || *pskSpec != "" || *connections > 1 || *sparse || *resume || *delta || *mmapSend {
+			usageFatalf("错误: -framed 不能与 -compress, -psk (加密帧已带认证), -connections, -sparse, -resume, -delta 或 -mmap 同时使用")
+		}
+	}
+	if *keepXattrs && *mode != "send" && *mode != "serve" && *mode != "retry" {
+		usageFatalf("错误: -xattrs 只能用于 send、serve 或 retry 模式 (接收端总是恢复文件头附带的扩展属性)")
+	}
+	if *compressMode != "off" && *pskSpec != "" {
+		usageFatalf("错误: -compress 不能与 -psk 同时使用 (加密后的数据无法压缩)")
+	}
+	if *dedupe {
+		if *mode != "send" && *mode != "serve" {
+			usageFatalf("错误: -dedupe 只能用于 send 或 serve 模式")
+		}
+		if *connections > 1 || *delta || *resume || *dryRun || *checksumOnly || strings.Contains(*addr, ",") {
+			usageFatalf("错误: -dedupe 不能与 -connections, -delta, -resume, -dry-run, -checksum-only 或一对多发送同时使用")
+		}
+		if *pskSpec != "" {
+			usageFatalf("错误: -dedupe 会以明文发送文件的校验值, 不能与 -psk 同时使用")
+		}
+		if *verify == "" {
+			*verify = "sha256"
+		}
+	}
+	if *cpuAffinity != "" {
+		n, d, err := parseCPUAffinity(*cpuAffinity)
+		if err != nil {
+			usageFatalf("错误: 无效的 -cpu-affinity 参数: %v", err)
+		}
+		netCPUs, diskCPUs = n, d
+	}
+	if *ackMode && strings.Contains(*addr, ",") {
+		usageFatalf("错误: -ack 不能与一对多发送同时使用")
+	}
 	if *mode == "receive" && *dir == "" {
-		log.Fatal("错误: receive 模式下必须指定 -dir 参数")
+		usageFatalf("错误: receive 模式下必须指定 -dir 参数")
+	}
+	if *mode == "serve" && *dir == "" {
+		usageFatalf("错误: serve 模式下必须通过 -dir 指定提供文件的目录")
+	}
+	if *mode == "get" {
+		if *file == "" {
+			usageFatalf("错误: get 模式下必须通过 -file 指定要拉取的文件名")
+		}
+		if err := validateFileName(*file); err != nil {
+			usageFatalf("错误: 无法拉取 '%s': %v", *file, err)
+		}
+		if *dir == "" {
+			*dir = "."
+		}
+		// 拉取的文件在唯一的一条连接上接收, 处理完该连接即退出
+		*acceptCount = 1
+	}
+	if *appendMode {
+		if *dir == "/dev/null" || *dir == "-" {
+			usageFatalf("错误: -append 不能与 -dir /dev/null 或 -dir - 同时使用")
+		}
+		if *oDirect {
+			usageFatalf("错误: -append 不能与 -odirect 同时使用")
+		}
+	}
+	if *dirTemplate != "" {
+		if *dir == "/dev/null" || *dir == "-" {
+			usageFatalf("错误: -dir-template 不能与 -dir /dev/null 或 -dir - 同时使用")
+		}
+		if _, err := expandDirTemplate(*dirTemplate, "127.0.0.1", "file"); err != nil {
+			usageFatalf("错误: 无效的 -dir-template 参数: %v", err)
+		}
+	}
+	if *mode == "relay" && (*listenOn == "" || *forward == "") {
+		usageFatalf("错误: relay 模式下必须指定 -listen 和 -forward 参数")
+	}
+	if *maxSizeStr != "" {
+		size, err := parseSize(*maxSizeStr)
+		if err != nil || size <= 0 {
+			usageFatalf("错误: 无效的 -max-file-size 参数 %q", *maxSizeStr)
+		}
+		maxFileSize = size
+	}
+	if *proxyStr != "" {
+		u, err := url.Parse(*proxyStr)
+		if err != nil || (u.Scheme != "socks5" && u.Scheme != "socks5h") || u.Host == "" || u.Port() == "" {
+			usageFatalf("错误: 无效的 -proxy 参数 %q (格式为 socks5://[用户名:密码@]主机:端口)", *proxyStr)
+		}
+		if *mode != "send" && *mode != "bench" && *mode != "get" {
+			usageFatalf("错误: -proxy 只能用于 send、bench 或 get 模式")
+		}
+		if *netType != "tcp" {
+			usageFatalf("错误: -proxy 只能用于 -net tcp")
+		}
+		// 分段传输和续传直接对 TCP socket 调用 sendfile, 经代理的连接不是 *net.TCPConn
+		if *connections > 1 || *resume {
+			usageFatalf("错误: -proxy 不能与 -connections 或 -resume 同时使用")
+		}
+		proxyURL = u
+	}
+	if *bindDevice != "" && *netType != "tcp" {
+		usageFatalf("错误: -bind-device 只能用于 -net tcp")
+	}
+	if *tmpFile && *mode != "receive" && *mode != "get" {
+		usageFatalf("错误: -tmpfile 只能用于 receive 或 get 模式")
+	}
+	if *writers < 0 {
+		usageFatalf("错误: -writers 不能为负数")
+	}
+	if *writers > 0 && *mode != "receive" {
+		usageFatalf("错误: -writers 只能用于 receive 模式")
+	}
+	if *ifPolicy != "" {
+		switch *ifPolicy {
+		case "never", "always", "newer", "size-differs":
+		default:
+			usageFatalf("错误: 无效的 -if 参数 %q (可选 never, always, newer, size-differs)", *ifPolicy)
+		}
+		if *mode != "receive" && *mode != "get" && *mode != "copy" {
+			usageFatalf("错误: -if 只能用于 receive、get 或 copy 模式")
+		}
+		if *force && *ifPolicy != "always" {
+			usageFatalf("错误: -force 等同于 -if always, 不能与 -if %s 同时使用", *ifPolicy)
+		}
+		if *appendMode {
+			usageFatalf("错误: -if 不能与 -append 同时使用 (-append 总是写入已存在的文件)")
+		}
+	} else if *force {
+		*ifPolicy = "always"
+	}
+	if *minFreeStr != "" {
+		if *mode != "receive" {
+			usageFatalf("错误: -min-free 只能用于 receive 模式")
+		}
+		size, err := parseSize(*minFreeStr)
+		if err != nil || size <= 0 {
+			usageFatalf("错误: 无效的 -min-free 参数 %q", *minFreeStr)
+		}
+		minFreeSpace = size
+	}
+	if *maxFiles < 0 {
+		usageFatalf("错误: -max-files 不能为负数")
+	}
+	if *connTimeout < 0 {
+		usageFatalf("错误: -connect-timeout 不能为负数")
+	}
+	if *userTimeout < 0 || userTimeout.Milliseconds() > math.MaxInt32 {
+		usageFatalf("错误: 无效的 -user-timeout 参数 %v", *userTimeout)
+	}
+	if *deadline < 0 {
+		usageFatalf("错误: -deadline 不能为负数")
+	}
+	if *acceptCount < 0 || *acceptTimeout < 0 {
+		usageFatalf("错误: -accept-count 和 -accept-timeout 不能为负数")
+	}
+	if *pskSpec != "" {
+		key, err := loadPSK(*pskSpec)
+		if err != nil {
+			usageFatalf("错误: 无效的 -psk 参数: %v", err)
+		}
+		pskKey = key
+	}
+	if *teeTarget != "" {
+		if *mode != "receive" {
+			usageFatalf("错误: -tee 只能用于 receive 模式")
+		}
+		if *teeTarget == "-" && *dir == "-" {
+			usageFatalf("错误: -tee - 不能与 -dir - 同时使用")
+		}
+	}
+	if (*mode == "receive" || *mode == "get") && (*dir == "-" || *teeTarget == "-") && logLevel != levelQuiet {
+		progressOut = os.Stderr
+	}
+	if *progressEvery < 0 {
+		usageFatalf("错误: -progress-interval 不能为负数")
+	}
+	switch *progressMode {
+	case "auto", "tty", "plain":
+	default:
+		usageFatalf("错误: 无效的 -progress 参数 %q. 请使用 'auto', 'tty' 或 'plain'", *progressMode)
+	}
+	switch *failLogFormat {
+	case "text", "json":
+	default:
+		usageFatalf("错误: 无效的 -failed-log-format 参数 %q. 请使用 'text' 或 'json'", *failLogFormat)
+	}
+	switch *unitsMode {
+	case "raw", "iec", "si":
+	default:
+		usageFatalf("错误: 无效的 -units 参数 %q. 请使用 'raw', 'iec' 或 'si'", *unitsMode)
+	}
+	if progressOut != io.Discard && (*progressMode == "plain" || (*progressMode == "auto" && !isTerminal(progressOut))) {
+		// 输出被重定向到文件或管道时, 回车和清行控制字符只会留下乱码
+		progressOut = &plainProgressWriter{w: progressOut}
+		progressTick = 5 * time.Second
+	} else if progressOut != io.Discard {
+		// 原地刷新的进度行和日志输出到同一终端, 经由 progressTerminal 协调, 日志输出时先清除进度行再重画
+		term := &progressTerminal{out: progressOut}
+		progressOut = term
+		if jsonLog != nil {
+			jsonLog.out = term.logWriter(jsonLog.out)
+		} else {
+			log.SetOutput(term.logWriter(os.Stderr))
+		}
+		resultOut = &progressLogWriter{t: term, w: os.Stdout, endLine: true}
+	}
+	if *progressEvery > 0 {
+		progressTick = *progressEvery
+	}
+	if *ipv4Only && *ipv6Only {
+		usageFatalf("错误: -ipv4only 和 -ipv6only 不能同时使用")
+	}
+	if *netType != "tcp" && *netType != "sctp" && *netType != "unix" {
+		usageFatalf("错误: 无效的 -net 参数 %q. 请使用 'tcp', 'sctp' 或 'unix'", *netType)
+	}
+	// 以 '@' 开头的地址是 Linux 抽象命名空间的 Unix socket (Go 将开头的 '@' 映射为 NUL 字节)
+	if strings.Contains(*addr, "/") || strings.HasPrefix(*addr, "@") {
+		*netType = "unix"
+	}
+	if *mptcp && *netType != "tcp" {
+		usageFatalf("错误: -mptcp 只能用于 TCP 连接 (-net tcp)")
+	}
+	if *netType == "sctp" {
+		if err := probeSCTP(); err != nil {
+			logWarn("\x1b[33m警告: 本机不支持 SCTP (%v, 可能需要加载 sctp 内核模块)，回退到 TCP\x1b[0m", err)
+			*netType = "tcp"
+		}
+	}
+	if *netType != "unix" {
+		var err error
+		// 发送端的 -addr 可以是逗号分隔的多个地址 (一对多发送)
+		if *mode == "send" || *mode == "retry" {
+			*addr, err = normalizeDialAddrs(*addr)
+		} else {
+			*addr, err = normalizeAddr(*addr)
+		}
+		if err != nil {
+			usageFatalf("错误: 无效的 -addr 参数: %v", err)
+		}
+		if *mode == "relay" {
+			if *listenOn, err = normalizeAddr(*listenOn); err != nil {
+				usageFatalf("错误: 无效的 -listen 参数: %v", err)
+			}
+			if *forward, err = normalizeDialAddrs(*forward); err != nil {
+				usageFatalf("错误: 无效的 -forward 参数: %v", err)
+			}
+		}
+	}
+	// -limit / -schedule 是两个方向合计的上限, 两个方向共用同一个限速器;
+	// -limit-rx / -limit-tx 为对应方向换成单独的限速器
+	if *limitStr != "" || *scheduleStr != "" {
+		var rate int64 // 0 表示不限速 (只指定了 -schedule)
+		if *limitStr != "" {
+			var err error
+			rate, err = parseSize(*limitStr)
+			if err != nil || rate <= 0 {
+				usageFatalf("错误: 无效的 -limit 参数 %q", *limitStr)
+			}
+		}
+		shared := newRateLimiter(rate, *ramp)
+		if *scheduleStr != "" {
+			entries, err := parseSchedule(*scheduleStr)
+			if err != nil {
+				usageFatalf("错误: 无效的 -schedule 参数: %v", err)
+			}
+			shared.slots = entries
+		}
+		rxLimiter, txLimiter = shared, shared
+	}
+	for _, dir := range []struct {
+		name    string
+		value   string
+		limiter **rateLimiter
+	}{{"-limit-rx", *limitRxStr, &rxLimiter}, {"-limit-tx", *limitTxStr, &txLimiter}} {
+		if dir.value == "" {
+			continue
+		}
+		rate, err := parseSize(dir.value)
+		if err != nil || rate <= 0 {
+			usageFatalf("错误: 无效的 %s 参数 %q", dir.name, dir.value)
+		}
+		*dir.limiter = newRateLimiter(rate, *ramp)
+	}
+	if *ramp < 0 || (*ramp > 0 && rxLimiter == nil && txLimiter == nil) {
+		usageFatalf("错误: -ramp 必须为正数, 且需要与 -limit、-limit-rx、-limit-tx 或 -schedule 同时使用")
+	}
+	if *throttleLoad < 0 || (*throttleLoad > 0 && rxLimiter == nil && txLimiter == nil) {
+		usageFatalf("错误: -throttle-on-load 必须为正数, 且需要与 -limit、-limit-rx、-limit-tx 或 -schedule 同时使用")
+	}
+	if *throttleLoad > 0 {
+		if rxLimiter != nil {
+			go rxLimiter.followLoad(*throttleLoad)
+		}
+		if txLimiter != nil && txLimiter != rxLimiter {
+			go txLimiter.followLoad(*throttleLoad)
+		}
+	}
+	if size, err := parseSize(*fanoutBufStr); err != nil || size <= 0 {
+		usageFatalf("错误: 无效的 -fanout-buffer 参数 %q", *fanoutBufStr)
+	} else {
+		fanoutBuffer = size
+	}
+	if *portRange != "" {
+		if *mode != "receive" || *netType != "tcp" {
+			usageFatalf("错误: -port-range 只能用于 TCP 接收端")
+		}
+		lo, hi, err := parsePortRange(*portRange)
+		if err != nil {
+			usageFatalf("错误: 无效的 -port-range 参数: %v", err)
+		}
+		portLow, portHigh = lo, hi
 	}
 
 	if runtime.GOOS != "linux" {
-		log.Printf("\x1b[33m警告: 当前系统 %s 非 Linux，程序功能可能受限\x1b[0m", runtime.GOOS)
+		logWarn("\x1b[33m警告: 当前系统 %s 非 Linux，程序功能可能受限\x1b[0m", runtime.GOOS)
 	}
 
-	if *mode == "send" && *prewarm && *file != "/dev/zero" {
+	if (*mode == "send" || *mode == "copy") && *prewarm && !*dryRun && !globFile && *file != "/dev/zero" && *file != "-" {
 		if err := doPrewarm(*file); err != nil {
 			// Prewarming failure is logged as a warning but doesn't stop the process
-			log.Printf("\x1b[33m警告: 文件预热失败: %v\x1b[0m", err)
+			logWarn("\x1b[33m警告: 文件预热失败: %v\x1b[0m", err)
+		}
+	}
+
+	if *bwLogPath != "" {
+		var err error
+		if bwLog, err = openBWLog(*bwLogPath); err != nil {
+			logError("\x1b[31m创建 -bwlog 文件失败: %v\x1b[0m", err)
+			os.Exit(exitIO)
+		}
+	}
+	if *cpuProfile != "" || *memProfile != "" || *traceFile != "" {
+		stop, err := startProfiling()
+		if err != nil {
+			logError("\x1b[31m启动性能分析失败: %v\x1b[0m", err)
+			os.Exit(exitIO)
+		}
+		stopProfiling = stop
+		if sendfileStats == nil {
+			sendfileStats = &sendfileCounters{}
+		}
+		if *mode == "receive" || *mode == "relay" || *mode == "serve" {
+			// 接收端、转发端和服务端通常以 Ctrl+C 结束, 退出前写出 profile
+			go func() {
+				sigCh := make(chan os.Signal, 1)
+				signal.Notify(sigCh, os.Interrupt, unix.SIGTERM)
+				sig := <-sigCh
+				stopProfiling()
+				signal.Reset(sig)
+				unix.Kill(os.Getpid(), sig.(unix.Signal))
+			}()
 		}
 	}
 
 	switch *mode {
 	case "send":
+		// Ctrl+C / SIGTERM 取消正在进行的连接重试或传输
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+		defer stop()
+		// -deadline 到期时同样取消: 各连接被 shutdown, 阻塞中的 sendfile/splice/写入随之返回错误
+		if *deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *deadline)
+			defer cancel()
+		}
 		var err error
-		if *file == "/dev/zero" {
-			log.Printf("检测到发送 /dev/zero，将使用 -size 指定的大小并采用标准网络写入")
-			err = sender(*file, *addr) // sender handles /dev/zero internally
+		var offset int64                     // 单个文件发送失败时已发送到的偏移量
+		batch := *fileList != "" || globFile // 批量发送时失败的文件已逐个记录
+		if *fileList != "" {
+			err = sendFileList(ctx, *fileList, *addr)
+		} else if globFile {
+			err = sendGlob(ctx, *file, *addr)
+		} else if *file == "/dev/zero" {
+			logDebug("检测到发送 /dev/zero，将使用 -size 指定的大小并采用标准网络写入")
+			err = sender(ctx, *file, *addr, sendOptions{resume: *resume, sent: &offset}) // sender handles /dev/zero internally
 		} else {
-			err = sender(*file, *addr)
+			err = sender(ctx, *file, *addr, sendOptions{resume: *resume, sent: &offset})
+		}
+		sendfileStats.report()
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("%w (%v): %w", errDeadline, *deadline, err)
 		}
 		if err != nil {
-			if _, ok := err.(*net.OpError); ok {
-				log.Fatalf("\x1b[31m发送端网络错误: %v\x1b[0m", err)
-			} else if _, ok := err.(*FileInfoError); ok {
-				log.Printf("\x1b[31m发送端文件错误: %v\x1b[0m", err)
-				os.Exit(1)
-			} else if e, ok := err.(*SendfileIOError); ok {
-				log.Printf("\x1b[31m发送端传输错误: %v\x1b[0m", e)
-				logFailedFile(*file, e.Error())
-				os.Exit(1)
-			} else {
-				log.Printf("\x1b[31m发送端未知错误: %v\x1b[0m", err)
-				os.Exit(1)
+			var sendfileErr *SendfileIOError
+			switch code := exitCode(err); {
+			case code == exitTimeout:
+				logError("\x1b[31m发送端超时: %v\x1b[0m", err)
+				if !batch {
+					logFailedFile(roleSender, *file, *addr, offset, err.Error())
+				}
+			case code == exitNetwork:
+				logError("\x1b[31m发送端网络错误: %v\x1b[0m", err)
+				// 传输中途断开 (而不是连接失败) 时记录已发送到的位置, 供 retry 续传
+				if !batch && offset > 0 {
+					logFailedFile(roleSender, *file, *addr, offset, err.Error())
+				}
+			case errors.As(err, &sendfileErr):
+				logError("\x1b[31m发送端传输错误: %v\x1b[0m", sendfileErr)
+				if !batch {
+					logFailedFile(roleSender, *file, *addr, sendfileErr.Offset, sendfileErr.Error())
+				}
+			case errors.Is(err, errRemoteNack):
+				logError("\x1b[31m发送端传输错误: %v\x1b[0m", err)
+				if !batch {
+					logFailedFile(roleSender, *file, *addr, offset, err.Error())
+				}
+			case code == exitIO:
+				logError("\x1b[31m发送端文件错误: %v\x1b[0m", err)
+			case code == exitVerify:
+				logError("\x1b[31m校验失败: %v\x1b[0m", err)
+			default:
+				logError("\x1b[31m发送端未知错误: %v\x1b[0m", err)
 			}
+			if !batch {
+				runStats.fail(*file, err)
+			}
+			runStats.emit(err)
+			exit(exitCode(err))
+		} else if *dryRun {
+			fmt.Fprintln(resultOut, "dry-run 完成, 未传输任何数据 (接收端的校验结果见接收端日志).")
+		} else if *checksumOnly {
+			fmt.Fprintln(resultOut, "校验完成, 接收端的文件与源文件一致.")
 		} else {
-			fmt.Println("文件发送成功完成.")
+			fmt.Fprintln(resultOut, "文件发送成功完成.")
 		}
+		runStats.emit(nil)
 	case "receive":
 		err := receiver(*dir, *addr, *noSplice) // receiver handles /dev/null internally
 		if err != nil {
-			log.Fatalf("\x1b[31m接收端错误: %v\x1b[0m", err)
+			logError("\x1b[31m接收端错误: %v\x1b[0m", err)
+			runStats.emit(err)
+			exit(exitCode(err))
+		}
+		runStats.emit(nil)
+	case "serve":
+		if err := serve(*addr, *dir); err != nil {
+			logError("\x1b[31m服务端错误: %v\x1b[0m", err)
+			exit(exitCode(err))
+		}
+	case "get":
+		if err := get(context.Background(), *file, *addr, *dir); err != nil {
+			logError("\x1b[31m拉取失败: %v\x1b[0m", err)
+			runStats.emit(err)
+			exit(exitCode(err))
+		}
+		runStats.emit(nil)
+	case "copy":
+		if err := copyLocal(*file, *dst); err != nil {
+			logError("\x1b[31m复制失败: %v\x1b[0m", err)
+			runStats.fail(*file, err)
+			runStats.emit(err)
+			exit(exitCode(err))
+		}
+		fmt.Fprintln(resultOut, "文件复制成功完成.")
+		runStats.emit(nil)
+	case "bench":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+		defer stop()
+		if err := bench(ctx, *addr); err != nil {
+			logError("\x1b[31mbench 失败: %v\x1b[0m", err)
+			exit(exitCode(err))
+		}
+	case "probe":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+		defer stop()
+		if err := probe(ctx, *addr); err != nil {
+			logError("\x1b[31mprobe 失败: %v\x1b[0m", err)
+			exit(exitCode(err))
+		}
+	case "relay":
+		if err := relay(*listenOn, *forward); err != nil {
+			logError("\x1b[31m转发端错误: %v\x1b[0m", err)
+			exit(exitCode(err))
+		}
+
+	case "retry":
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+		defer stop()
+		if *deadline > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, *deadline)
+			defer cancel()
+		}
+		// 未指定 -addr 时发送到每条记录中的目标地址
+		retryAddr := ""
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "addr" {
+				retryAddr = *addr
+			}
+		})
+		err := retryFailed(ctx, *retryLog, retryAddr)
+		sendfileStats.report()
+		if err != nil {
+			logError("\x1b[31m%v\x1b[0m", err)
+			runStats.emit(err)
+			exit(exitCode(err))
 		}
+		runStats.emit(nil)
 
 	default:
-		log.Fatalf("错误: 无效的模式 %q. 请使用 'send' 或 'receive'", *mode) // 恢复默认错误消息
+		usageFatalf("错误: 无效的模式 %q. 请使用 'send', 'receive', 'copy', 'relay', 'serve', 'get', 'bench', 'probe' 或 'retry'", *mode) // 恢复默认错误消息
 	}
+	stopProfiling()
 }
 
-// logFailedFile records details about failed transfers.
-func logFailedFile(filePath string, reason string) {
-	f, err := os.OpenFile(badFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		log.Printf("错误: 无法打开失败日志文件 %s: %v", badFile, err)
-		return
-	}
-	defer f.Close()
-	logLine := fmt.Sprintf("%s - %s - %s\n", time.Now().Format(time.RFC3339), filePath, reason)
-	if _, err := f.WriteString(logLine); err != nil {
-		log.Printf("错误: 写入失败日志文件 %s 失败: %v", badFile, err)
-	}
+// stopProfiling 停止 -cpuprofile / -trace 并写出 -memprofile, 未启用性能分析时为空操作
+var stopProfiling = func() {}
+
+// exit 写出性能分析结果后以 code 退出 (os.Exit 不会执行 defer)
+func exit(code int) {
+	stopProfiling()
+	os.Exit(code)
 }
 
-func displayProgress(totalSize int64, transferred *int64, startTime time.Time, done chan struct{}) {
-	ticker := time.NewTicker(500 * time.Millisecond)
-	defer ticker.Stop()
-	fmt.Printf("\r\033[K进度: 0.00%% (0/%d bytes), 速度: 0.00 MB/s", totalSize)
-	for {
-		select {
-		case <-ticker.C:
-			currentTransferred := atomic.LoadInt64(transferred)
-			elapsed := time.Since(startTime).Seconds()
-			if elapsed < 0.1 {
-				elapsed = 0.1
+// startProfiling 按 -cpuprofile / -trace 开始采样, 返回的函数输出系统调用统计、停止采样并写出 -memprofile (只执行一次)
+func startProfiling() (func(), error) {
+	var cpuFile, traceOut *os.File
+	if *cpuProfile != "" {
+		f, err := os.Create(*cpuProfile)
+		if err != nil {
+			return nil, &FileInfoError{FilePath: *cpuProfile, Err: err}
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("启动 CPU profile 失败: %w", err)
+		}
+		cpuFile = f
+	}
+	if *traceFile != "" {
+		f, err := os.Create(*traceFile)
+		if err == nil {
+			if err = trace.Start(f); err != nil {
+				f.Close()
 			}
-			speed := float64(currentTransferred) / elapsed / 1024 / 1024
-			var progress float64
-			if totalSize > 0 {
-				progress = float64(currentTransferred) * 100 / float64(totalSize)
-			} else if currentTransferred == 0 && totalSize == 0 {
-				progress = 100.0
-			} else {
-				progress = 0.0
+		}
+		if err != nil {
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
 			}
-			if progress > 100.0 {
-				progress = 100.0
+			return nil, &FileInfoError{FilePath: *traceFile, Err: err}
+		}
+		traceOut = f
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			sendfileStats.report()
+			if cpuFile != nil {
+				pprof.StopCPUProfile()
+				cpuFile.Close()
+				logInfo("CPU profile 已写入 %s", *cpuProfile)
+			}
+			if traceOut != nil {
+				trace.Stop()
+				traceOut.Close()
+				logInfo("执行跟踪已写入 %s", *traceFile)
+			}
+			if *memProfile != "" {
+				f, err := os.Create(*memProfile)
+				if err == nil {
+					runtime.GC() // 获取最新的堆统计
+					err = pprof.WriteHeapProfile(f)
+					f.Close()
+				}
+				if err != nil {
+					logError("\x1b[31m写入内存 profile '%s' 失败: %v\x1b[0m", *memProfile, err)
+				} else {
+					logInfo("内存 profile 已写入 %s", *memProfile)
+				}
+			}
+		})
+	}, nil
+}
+
+// usageFatalf 输出参数错误并以 exitUsage 退出
+func usageFatalf(format string, args ...any) {
+	logError(format, args...)
+	os.Exit(exitUsage)
+}
+
+// exitCode 将错误映射为进程退出码, 供脚本区分失败类型
+func exitCode(err error) int {
+	var fileErr *FileInfoError
+	var sendfileErr *SendfileIOError
+	var pathErr *os.PathError
+	var opErr *net.OpError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, errDeadline):
+		return exitTimeout
+	case errors.Is(err, errChecksumMismatch), errors.Is(err, errRemoteMissing):
+		return exitVerify
+	case errors.Is(err, errNoSpace), errors.Is(err, unix.ENOSPC), errors.Is(err, unix.EDQUOT):
+		return exitNoSpace
+	case errors.As(err, &fileErr), errors.As(err, &sendfileErr), errors.As(err, &pathErr), errors.Is(err, errRemoteNack), errors.Is(err, errPullRefused):
+		return exitIO
+	case errors.As(err, &opErr), errors.Is(err, errIOTimeout), errors.Is(err, unix.EPIPE), errors.Is(err, unix.ECONNRESET):
+		return exitNetwork
+	default:
+		return exitFailure
+	}
+}
+
+// logFields 是 -log-format json 时随消息输出的 file、bytes 和 remote 字段, 由调用方直接提供, 不从渲染后的消息中解析
+type logFields struct {
+	file   string
+	bytes  int64  // 负数表示没有 bytes 字段
+	remote string // 对端地址, 文本日志中显示为消息前的 "[地址] "
+}
+
+// noFields 不带 file 和 bytes 字段, 供 logInfo/logWarn/logDebug/logError 使用
+var noFields = logFields{bytes: -1}
+
+// fileLog 返回带 file 字段的 logFields, bytes 为负数时不输出 bytes 字段
+func fileLog(file string, bytes int64) logFields {
+	return logFields{file: file, bytes: bytes}
+}
+
+// peerLog 返回只带 remote 字段的 logFields, 用于与某个连接相关的消息
+func peerLog(remote string) logFields {
+	return noFields.peer(remote)
+}
+
+// peer 返回加上 remote 字段的 f
+func (f logFields) peer(remote string) logFields {
+	f.remote = remote
+	return f
+}
+
+// print 以 level (error, warn, info 或 debug) 输出一条日志, 不受 -log-level 限制; level 只用于 JSON 日志,
+// 文本日志的颜色仍由消息本身决定. 文本日志中 remote 显示在消息开头 (颜色代码之后)
+func (f logFields) print(level, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if jsonLog != nil {
+		jsonLog.event(level, f, msg)
+		return
+	}
+	if f.remote != "" {
+		color := ""
+		if loc := ansiColorRe.FindStringIndex(msg); loc != nil && loc[0] == 0 {
+			color = msg[:loc[1]]
+		}
+		msg = color + "[" + f.remote + "] " + msg[len(color):]
+	}
+	log.Print(msg)
+}
+
+// info 输出常规信息, -log-level quiet 时不输出
+func (f logFields) info(format string, args ...any) {
+	if logLevel >= levelNormal {
+		f.print("info", format, args...)
+	}
+}
+
+// warn 输出警告, -log-level quiet 时不输出
+func (f logFields) warn(format string, args ...any) {
+	if logLevel >= levelNormal {
+		f.print("warn", format, args...)
+	}
+}
+
+// debug 输出协议步骤等调试信息, 仅在 -log-level debug 时输出
+func (f logFields) debug(format string, args ...any) {
+	if logLevel >= levelDebug {
+		f.print("debug", format, args...)
+	}
+}
+
+// error 输出错误, 在任何级别下都输出
+func (f logFields) error(format string, args ...any) {
+	f.print("error", format, args...)
+}
+
+// logInfo 输出常规信息, -log-level quiet 时不输出
+func logInfo(format string, args ...any) { noFields.info(format, args...) }
+
+// logWarn 输出警告, -log-level quiet 时不输出
+func logWarn(format string, args ...any) { noFields.warn(format, args...) }
+
+// logDebug 输出协议步骤等调试信息, 仅在 -log-level debug 时输出
+func logDebug(format string, args ...any) { noFields.debug(format, args...) }
+
+// logError 输出错误, 在任何级别下都输出
+func logError(format string, args ...any) { noFields.error(format, args...) }
+
+var ansiColorRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+// jsonLogger 把日志转换为 JSON Lines (-log-format json). level、file、bytes 和 remote 由 logFields 的方法传入;
+// 其他直接写入 log 包的消息经由 Write 输出, level 为 info.
+type jsonLogger struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+type jsonLogRecord struct {
+	Time   string `json:"time"`
+	Level  string `json:"level"`
+	Msg    string `json:"msg"`
+	Remote string `json:"remote,omitempty"`
+	File   string `json:"file,omitempty"`
+	Bytes  *int64 `json:"bytes,omitempty"`
+}
+
+// Write 接收 log 包格式化好的一行日志
+func (l *jsonLogger) Write(p []byte) (int, error) {
+	l.event("info", noFields, string(p))
+	return len(p), nil
+}
+
+// event 输出一条日志
+func (l *jsonLogger) event(level string, f logFields, msg string) {
+	msg = ansiColorRe.ReplaceAllString(strings.TrimRight(msg, "\n"), "")
+	rec := jsonLogRecord{Time: time.Now().Format(time.RFC3339Nano), Level: level, File: f.file, Remote: f.remote, Msg: msg}
+	if f.bytes >= 0 {
+		rec.Bytes = &f.bytes
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// failed_files.log 中记录的写入方, retry 模式只重发发送端的记录
+const (
+	roleSender   = "sender"
+	roleReceiver = "receiver"
+)
+
+// failedRecord 是 -failed-log-format json 时 failed_files.log 中的一行
+type failedRecord struct {
+	Time      string `json:"time"`
+	Role      string `json:"role,omitempty"` // sender 或 receiver, 旧版本写入的记录为空
+	Path      string `json:"path"`
+	Reason    string `json:"reason"`
+	BytesSent int64  `json:"bytes_sent"`       // 失败时该文件已发送 (接收端为已接收) 的位置, 重试时可从这里续传
+	Remote    string `json:"remote,omitempty"` // 发送端为目标地址, 接收端为对端地址
+}
+
+// logFailedFile records details about failed transfers.
+// role 为 roleSender 或 roleReceiver, bytes 为失败时已传输到的文件偏移量, remote 为对端地址; 文本格式只记录时间、角色、路径和原因
+func logFailedFile(role, filePath, remote string, bytes int64, reason string) {
+	f, err := os.OpenFile(badFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logError("错误: 无法打开失败日志文件 %s: %v", badFile, err)
+		return
+	}
+	defer f.Close()
+	now := time.Now().Format(time.RFC3339)
+	logLine := fmt.Sprintf("%s - %s - %s - %s\n", now, role, filePath, reason)
+	if *failLogFormat == "json" {
+		line, _ := json.Marshal(failedRecord{Time: now, Role: role, Path: filePath, Reason: reason, BytesSent: bytes, Remote: remote})
+		logLine = string(line) + "\n"
+	}
+	if _, err := f.WriteString(logLine); err != nil {
+		logError("错误: 写入失败日志文件 %s 失败: %v", badFile, err)
+	}
+}
+
+// fallocateUnsupported 在 fallocate 第一次返回不支持 (EOPNOTSUPP/ENOSYS) 后置位, 本次运行之后的文件不再尝试预分配
+var fallocateUnsupported atomic.Bool
+
+// preallocate 按 -prealloc 为目标文件预分配 size 字节:
+// full 预分配并立即把文件大小设为 size, keepsize 只分配磁盘块而不改变文件大小 (FALLOC_FL_KEEP_SIZE), off 不预分配.
+// 文件系统不支持 fallocate (EOPNOTSUPP/ENOSYS, 如部分 tmpfs/网络文件系统) 时跳过, 并在本次运行中不再尝试.
+func preallocate(fd int, size int64) error {
+	var mode uint32
+	switch *prealloc {
+	case "off":
+		return nil
+	case "keepsize":
+		mode = unix.FALLOC_FL_KEEP_SIZE
+	}
+	if fallocateUnsupported.Load() {
+		return nil
+	}
+	err := unix.Fallocate(fd, mode, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		if !fallocateUnsupported.Swap(true) {
+			logInfo("目标文件系统不支持 fallocate (%v)，本次运行不再预分配文件空间", err)
+		}
+		return nil
+	}
+	return err
+}
+
+// isNoSpace 判断写入错误是否为空间不足 (磁盘已满或超出配额)
+func isNoSpace(err error) bool {
+	return errors.Is(err, unix.ENOSPC) || errors.Is(err, unix.EDQUOT)
+}
+
+// waitForSpace 在写入 fd 遇到空间不足时 (-wait-space) 按指数退避等待, 直到所在文件系统至少有 need 字节可用.
+// 在 -wait-space 时间内等到空间时返回 true, 调用方从中断处重试写入; 超时返回 false, 调用方按原错误失败
+func waitForSpace(fd int, targetPath string, need int64) bool {
+	logWarn("\x1b[33m警告: 写入 '%s' 时空间不足, 等待可用空间 (最长 %v)...\x1b[0m", targetPath, *waitSpace)
+	deadline := time.Now().Add(*waitSpace)
+	delay := time.Second
+	for {
+		wait := min(delay, time.Until(deadline))
+		if wait <= 0 {
+			logError("\x1b[31m等待可用空间超时 (%v)\x1b[0m", *waitSpace)
+			return false
+		}
+		time.Sleep(wait)
+		var st unix.Statfs_t
+		if err := unix.Fstatfs(fd, &st); err == nil && int64(st.Bavail)*int64(st.Bsize) >= need {
+			logInfo("'%s' 所在文件系统已有 %s bytes 可用, 继续写入", targetPath, formatWithCommas(int64(st.Bavail)*int64(st.Bsize)))
+			return true
+		}
+		delay = min(delay*2, maxRetryDelay)
+	}
+}
+
+// spaceWaitWriter 写入文件时遇到空间不足则等待可用空间 (-wait-space) 后从中断处继续写入剩余的数据,
+// 只有成功写完或等待超时才返回, 因此可以放在 io.MultiWriter 中与校验计算一起使用
+type spaceWaitWriter struct {
+	f    *os.File
+	path string
+}
+
+func (w *spaceWaitWriter) Write(p []byte) (int, error) {
+	var written int
+	for {
+		n, err := w.f.Write(p[written:])
+		written += n
+		if err == nil || !isNoSpace(err) || !waitForSpace(int(w.f.Fd()), w.path, int64(len(p)-written)) {
+			return written, err
+		}
+	}
+}
+
+// directIOBlockSize 返回 O_DIRECT 写入需要对齐的块大小: 目标为块设备时使用其逻辑块大小 (BLKSSZGET),
+// 否则使用所在文件系统的块大小, 都无法获取时假定为 4096
+func directIOBlockSize(fd int) int {
+	if size, err := unix.IoctlGetInt(fd, unix.BLKSSZGET); err == nil && size > 0 {
+		return size
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(fd, &st); err == nil && st.Bsize > 0 {
+		return int(st.Bsize)
+	}
+	return 4096
+}
+
+// linkTmpFile 把 O_TMPFILE 创建的匿名文件 f 链接为 path. 通过 /proc/self/fd 链接不需要 AT_EMPTY_PATH
+// 所需的 CAP_DAC_READ_SEARCH; linkat 不能替换已存在的文件 (-force), 此时先链接到同目录下的临时名称再原子改名
+func linkTmpFile(f *os.File, path string) error {
+	procPath := fmt.Sprintf("/proc/self/fd/%d", f.Fd())
+	err := unix.Linkat(unix.AT_FDCWD, procPath, unix.AT_FDCWD, path, unix.AT_SYMLINK_FOLLOW)
+	if !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	tmp := fmt.Sprintf("%s.%d.link", path, time.Now().UnixNano())
+	if err := unix.Linkat(unix.AT_FDCWD, procPath, unix.AT_FDCWD, tmp, unix.AT_SYMLINK_FOLLOW); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// syncDir 对目录执行 fsync, 使其中新建或改名的文件项持久化
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// clearODirect 清除 fd 上的 O_DIRECT 标志, 之后的写入经过页缓存, 不再有对齐要求
+func clearODirect(fd int) error {
+	flags, err := unix.FcntlInt(uintptr(fd), unix.F_GETFL, 0)
+	if err != nil {
+		return err
+	}
+	_, err = unix.FcntlInt(uintptr(fd), unix.F_SETFL, flags&^unix.O_DIRECT)
+	return err
+}
+
+// checkFreeSpace 检查 dirPath 所在文件系统的可用空间是否足以容纳 need 字节.
+// 无法获取文件系统信息时只记录警告, 不阻止传输.
+func checkFreeSpace(dirPath string, need int64) error {
+	avail, err := freeSpace(dirPath)
+	if err != nil {
+		logWarn("\x1b[33m警告: 获取 '%s' 的文件系统信息失败, 跳过空间检查: %v\x1b[0m", dirPath, err)
+		return nil
+	}
+	if need > avail {
+		return fmt.Errorf("%w: 需要 %s bytes, '%s' 仅剩 %s bytes 可用", errNoSpace, formatWithCommas(need), dirPath, formatWithCommas(avail))
+	}
+	return nil
+}
+
+// freeSpace 返回 path 所在文件系统对非特权用户可用的字节数
+func freeSpace(path string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// nearestExisting 返回 path 自身或其最近的已存在上级目录, 用于目标目录尚未创建时检查其所在的文件系统
+func nearestExisting(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
+
+func displayProgress(totalSize int64, transferred *int64, startTime time.Time, done chan struct{}) {
+	ticker := time.NewTicker(progressTick)
+	defer ticker.Stop()
+	if totalSize == unknownSize {
+		displayStreamProgress(transferred, startTime, done, ticker)
+		return
+	}
+	fmt.Fprintf(progressOut, "\r\033[K进度: 0.00%% (%s), 速度: 0.00 MB/s", formatBytesPair(0, totalSize))
+	window := newSpeedWindow(startTime)
+	for {
+		select {
+		case <-ticker.C:
+			currentTransferred := atomic.LoadInt64(transferred)
+			elapsed := time.Since(startTime).Seconds()
+			if elapsed < 0.1 {
+				elapsed = 0.1
+			}
+			speed := float64(currentTransferred) / elapsed / 1024 / 1024
+			curSpeed := window.add(time.Now(), currentTransferred) / 1024 / 1024
+			bwLog.sample(time.Since(startTime), currentTransferred, curSpeed)
+			var progress float64
+			if totalSize > 0 {
+				progress = float64(currentTransferred) * 100 / float64(totalSize)
+			} else if currentTransferred == 0 && totalSize == 0 {
+				progress = 100.0
+			} else {
+				progress = 0.0
+			}
+			if progress > 100.0 {
+				progress = 100.0
+			}
+			eta := ""
+			if totalSize > 0 && curSpeed > 0 && currentTransferred < totalSize {
+				remaining := float64(totalSize-currentTransferred) / (curSpeed * 1024 * 1024)
+				eta = " ETA " + formatETA(time.Duration(remaining*float64(time.Second)))
 			}
-			fmt.Printf("\r\033[K进度: %.2f%% (%s/%s bytes), 速度: %.2f MB/s", progress, formatWithCommas(currentTransferred), formatWithCommas(totalSize), speed)
+			fmt.Fprintf(progressOut, "\r\033[K进度: %.2f%% (%s), 速度: 当前 %.2f MB/s, 平均 %.2f MB/s%s", progress, formatBytesPair(currentTransferred, totalSize), curSpeed, speed, eta)
 		case <-done:
 			currentTransferred := atomic.LoadInt64(transferred)
+			bwLog.sample(time.Since(startTime), currentTransferred, window.add(time.Now(), currentTransferred)/1024/1024)
 			elapsed := time.Since(startTime).Seconds()
 			if elapsed < 0.1 {
 				elapsed = 0.1
@@ -229,649 +1615,8211 @@ func displayProgress(totalSize int64, transferred *int64, startTime time.Time, d
 			if progress > 100.0 {
 				progress = 100.0
 			}
-			fmt.Printf("\r\033[K进度: %.2f%% (%s/%s bytes), 速度: %.2f MB/s\n", progress, formatWithCommas(currentTransferred), formatWithCommas(totalSize), speed)
+			fmt.Fprintf(progressOut, "\r\033[K进度: %.2f%% (%s), 速度: %.2f MB/s\n", progress, formatBytesPair(currentTransferred, totalSize), speed)
 			return
 		}
 	}
 }
 
-func sender(filePath string, connectAddr string) error {
-	isDevZero := (filePath == "/dev/zero")
-	conn, err := net.DialTimeout("tcp", connectAddr, 10*time.Second)
-	if err != nil {
-		return fmt.Errorf("连接失败 %s: %w", connectAddr, err)
+// batchManifest 是接收端从批量清单 (extFlagManifest) 得知的整批信息, 只在处理该连接的 goroutine 中使用
+type batchManifest struct {
+	files int   // 文件总数
+	bytes int64 // 所有文件的总字节数
+	index int   // 当前是第几个文件 (从 1 开始)
+	done  int64 // 已处理完的文件的字节数
+}
+
+// rangeFile 是接收端本次运行中正在分段接收 (-connections) 的文件. 各分段连接分别打开目标文件、定位到
+// 自己的偏移量后并发写入; 除 transferred 外只在持有接收端的 recvMu 时访问.
+type rangeFile struct {
+	received    int64         // 已完整接收的分段的字节数之和, 达到文件大小后该文件接收完成
+	active      int           // 正在传输数据的分段数
+	transferred int64         // 正在传输的分段已接收的字节数 (原子操作), 各分段合并显示一个进度
+	done        chan struct{} // 最后一个正在传输的分段结束时关闭, 停止进度显示
+}
+
+// receiveRange 接收分段连接上的一段数据, 由 receive 写入目标文件中本段的区间并检查结果; receive 的参数是该文件
+// 所有分段共享的进度计数. 调用方不持有 mu: 只在更新 files 中 path 对应的 rangeFile 时持有 mu, 数据传输期间
+// 同一文件的其他分段可以并发写入. 返回本段接收的字节数, 以及接收成功后该文件的所有分段是否已经收齐
+func receiveRange(mu *sync.Mutex, files map[string]*rangeFile, path string, totalSize int64, receive func(shared *int64) (int64, error)) (n int64, complete bool, err error) {
+	mu.Lock()
+	rf := files[path]
+	if rf == nil {
+		// 其他分段已把该文件收齐 (发送端重复发送了分段), 重新登记
+		rf = &rangeFile{}
+		files[path] = rf
 	}
-	defer conn.Close()
-	log.Printf("\x1b[32m已连接到接收端 %s\x1b[0m", connectAddr)
+	if rf.active == 0 {
+		rf.done = make(chan struct{})
+		go displayProgress(totalSize-rf.received, &rf.transferred, time.Now(), rf.done)
+	}
+	rf.active++
+	mu.Unlock()
 
-	// 尝试设置 TCP 发送缓冲区
-	if tcpConn, ok := conn.(*net.TCPConn); ok && *sndBuf > 0 {
-		if err := tcpConn.SetWriteBuffer(*sndBuf); err != nil {
-			log.Printf("\x1b[33m警告: 设置 TCP 发送缓冲区为 %d 失败: %v\x1b[0m", *sndBuf, err)
-		} else {
-			// 无法直接通过 Go API 获取实际大小，需要 OS 工具检查
-			log.Printf("已尝试设置 TCP 发送缓冲区为 %d (实际大小需通过 OS 工具检查)", *sndBuf)
+	n, err = receive(&rf.transferred)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if rf.active--; rf.active == 0 {
+		close(rf.done)
+		atomic.StoreInt64(&rf.transferred, 0)
+	}
+	// 所有分段都收齐后, 该文件不再视为本次运行正在写入的文件
+	if err == nil {
+		rf.received += n
+		if rf.received >= totalSize {
+			delete(files, path)
+			complete = true
 		}
 	}
+	return n, complete, err
+}
 
-	var fileSize int64
-	var fileName string
-
-	if isDevZero {
-		fileSize, err = parseSize(*sizeStr) // 从 -size 获取大小
-		if err != nil {
-			// 理论上 main 函数已检查，但再次检查更安全
-			return fmt.Errorf("无法解析 -size 参数 '%s' 用于 /dev/zero: %w", *sizeStr, err)
+// displayProgress 与 displayProgress 函数相同, 但同时显示当前文件序号和整批的进度.
+// index 和 base (之前的文件已处理的字节数) 由调用方传入, 避免与更新它们的接收 goroutine 并发访问
+func (b *batchManifest) displayProgress(index int, base, fileSize int64, transferred *int64, startTime time.Time, done chan struct{}) {
+	ticker := time.NewTicker(progressTick)
+	defer ticker.Stop()
+	window := newSpeedWindow(startTime)
+	render := func(end string) {
+		cur := atomic.LoadInt64(transferred)
+		bwLog.sample(time.Since(startTime), cur, window.add(time.Now(), cur)/1024/1024)
+		speed := float64(cur) / max(time.Since(startTime).Seconds(), 0.1) / 1024 / 1024
+		filePct, batchPct := 100.0, 100.0
+		if fileSize > 0 {
+			filePct = min(float64(cur)*100/float64(fileSize), 100)
 		}
-		fileName = "zero.dat" // 给 /dev/zero 一个虚拟文件名
-		log.Printf("发送 /dev/zero，虚拟文件名: %s, 大小: %d bytes", fileName, fileSize)
-	} else {
-		fileInfo, err := os.Stat(filePath)
-		if err != nil {
-			return &FileInfoError{FilePath: filePath, Err: err}
+		if b.bytes > 0 {
+			batchPct = min(float64(base+cur)*100/float64(b.bytes), 100)
 		}
-		fileSize = fileInfo.Size()
-		fileName = fileInfo.Name() // 获取真实文件名
+		fmt.Fprintf(progressOut, "\r\033[K文件 %d/%d: %.2f%%, 总进度: %.2f%% (%s), 速度: %.2f MB/s%s",
+			index, b.files, filePct, batchPct, formatBytesPair(base+cur, b.bytes), speed, end)
 	}
-	fileNameBytes := []byte(fileName)
-	fileNameLen := uint16(len(fileNameBytes))
-
-	// 1. 发送文件名长度 (2 bytes)
-	lenBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(lenBytes, fileNameLen)
-	if _, err := conn.Write(lenBytes); err != nil {
-		return fmt.Errorf("发送文件名长度失败: %w", err)
+	render("")
+	for {
+		select {
+		case <-ticker.C:
+			render("")
+		case <-done:
+			render("\n")
+			return
+		}
 	}
-	log.Printf("\x1b[32m已发送文件名长度: %d\x1b[0m", fileNameLen)
+}
+
+// bwLogger 把进度刷新时的吞吐量采样写入 CSV 文件 (-bwlog). 每个采样直接写入文件 (不在用户态缓冲),
+// 进程崩溃时已采集的数据仍然保留. 多个传输同时进行时 (多连接接收, -connections) 它们的采样交错写入同一文件
+type bwLogger struct {
+	mu     sync.Mutex
+	f      *os.File
+	failed bool
+}
+
+// bwLog 在指定了 -bwlog 时非 nil
+var bwLog *bwLogger
 
-	// 2. 发送文件名
-	if _, err := conn.Write(fileNameBytes); err != nil {
-		return fmt.Errorf("发送文件名失败: %w", err)
+func openBWLog(path string) (*bwLogger, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteString("elapsed_seconds,transferred_bytes,instantaneous_mbps\n"); err != nil {
+		f.Close()
+		return nil, err
 	}
-	log.Printf("\x1b[32m已发送文件名: %s\x1b[0m", fileName)
+	return &bwLogger{f: f}, nil
+}
 
-	// 3. 发送文件大小 (8 bytes)
-	sizeBytes := make([]byte, 8)
-	binary.BigEndian.PutUint64(sizeBytes, uint64(fileSize))
-	if _, err := conn.Write(sizeBytes); err != nil {
-		return fmt.Errorf("发送文件大小失败: %w", err)
+// sample 记录一个采样: 本次传输开始后的时间, 已传输字节数和瞬时速度 (MB/s, 与进度显示的 "当前" 速度相同)
+func (b *bwLogger) sample(elapsed time.Duration, transferred int64, mbps float64) {
+	if b == nil {
+		return
 	}
-	log.Printf("\x1b[32m已发送文件大小: %s\x1b[0m", formatWithCommas(fileSize))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := fmt.Fprintf(b.f, "%.3f,%d,%.2f\n", elapsed.Seconds(), transferred, mbps); err != nil && !b.failed {
+		b.failed = true
+		logWarn("\x1b[33m警告: 写入 -bwlog 文件失败: %v\x1b[0m", err)
+	}
+}
 
-	// 对于 /dev/zero，我们不需要打开它然后用 sendfile，直接写网络
-	// 对于常规文件，才需要打开并获取 fd
-	// --- 准备传输 ---
-	var srcFile *os.File // 用于标准写入或获取 fd
-	var srcFd int = -1   // 用于 sendfile
-	if !isDevZero {
-		srcFile, err = os.Open(filePath)
-		if err != nil {
-			return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("打开源文件失败: %w", err)}
+// formatETA 将剩余时间格式化为 HH:MM:SS (超过 99 小时时小时数照常增长)
+func formatETA(d time.Duration) string {
+	secs := int64(d.Round(time.Second) / time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", secs/3600, secs%3600/60, secs%60)
+}
+
+// displayStreamProgress 用于总大小未知的流式传输, 只显示已传输字节数和速度
+func displayStreamProgress(transferred *int64, startTime time.Time, done chan struct{}, ticker *time.Ticker) {
+	window := newSpeedWindow(startTime)
+	line := func() string {
+		currentTransferred := atomic.LoadInt64(transferred)
+		elapsed := time.Since(startTime).Seconds()
+		if elapsed < 0.1 {
+			elapsed = 0.1
 		}
-		defer srcFile.Close()
-		srcFd = int(srcFile.Fd())
+		speed := float64(currentTransferred) / elapsed / 1024 / 1024
+		curSpeed := window.add(time.Now(), currentTransferred) / 1024 / 1024
+		bwLog.sample(time.Since(startTime), currentTransferred, curSpeed)
+		return fmt.Sprintf("\r\033[K进度: %s (总大小未知), 速度: 当前 %.2f MB/s, 平均 %.2f MB/s", formatBytes(currentTransferred), curSpeed, speed)
 	}
-
-	// 获取网络连接的 fd (sendfile 需要) 或直接使用 conn (标准写入需要)
-	var dstFd int = -1
-	if !isDevZero {
-		tcpConn, ok := conn.(*net.TCPConn)
-		if !ok {
-			log.Printf("\x1b[33m警告: 连接不是 TCP 连接，无法使用 sendfile，将回退到标准写入\x1b[0m")
-		} else {
-			dstFile, err := tcpConn.File()
-			if err != nil {
-				log.Printf("\x1b[33m警告: 获取连接文件描述符失败 (%v)，无法使用 sendfile，将回退到标准写入\x1b[0m", err)
-			} else {
-				defer dstFile.Close()
-				dstFd = int(dstFile.Fd())
-			}
+	for {
+		select {
+		case <-ticker.C:
+			fmt.Fprint(progressOut, line())
+		case <-done:
+			fmt.Fprintln(progressOut, line())
+			return
 		}
 	}
+}
 
-	var transferred int64
-	startTime := time.Now()
-	done := make(chan struct{})
-	go displayProgress(fileSize, &transferred, startTime, done)
-	defer close(done)
+// isTerminal 报告 w 是否为终端
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
 
-	totalSent := int64(0)
+// progressTerminal 协调原地刷新的进度行 (以 "\r\033[K" 开头, 不换行) 和日志输出: 两者通过同一把锁写出,
+// 输出日志之前先清除当前的进度行, 日志写完后再把进度行重画在其下方, 避免两者在终端上互相覆盖
+type progressTerminal struct {
+	mu   sync.Mutex
+	out  io.Writer
+	line []byte // 当前显示中的未结束进度行, nil 表示没有
+}
 
-	if fileSize == 0 {
-		atomic.StoreInt64(&transferred, 0)
-		time.Sleep(100 * time.Millisecond)
-		return nil
+func (t *progressTerminal) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if bytes.HasSuffix(b, []byte("\n")) {
+		t.line = nil
+	} else {
+		t.line = append(t.line[:0], b...)
 	}
+	return t.out.Write(b)
+}
 
-	// 根据情况选择传输方式
-	if !isDevZero && srcFd != -1 && dstFd != -1 { // No need to check runtime.GOOS
-		// 使用 sendfile (Linux 上的常规文件)
-		log.Printf("使用 sendfile 传输文件 %s", filePath)
-		var offset int64 = 0 // sendfile 需要 offset，在此声明
-		for totalSent < fileSize {
-			remaining := fileSize - totalSent
-			count := int64(copyBufferSize)
-			if remaining < count {
-				count = remaining
-			}
-			currentOffset := offset
-			n, err := unix.Sendfile(dstFd, srcFd, &offset, int(count))
-			if err != nil {
-				if errno, ok := err.(unix.Errno); ok && errno == unix.EIO {
-					return &SendfileIOError{FilePath: filePath, Offset: currentOffset, Err: err}
-				}
-				if errno, ok := err.(unix.Errno); ok && (errno == unix.EPIPE || errno == unix.ECONNRESET) {
-					log.Printf("发送端检测到连接断开 (sendfile): %v", err)
-					return fmt.Errorf("连接已断开: %w", err)
-				}
-				return fmt.Errorf("sendfile 在偏移量 %d 失败: %w", currentOffset, err)
+// logWriter 返回写入 w 的日志输出, 每次写入前后清除和重画进度行
+func (t *progressTerminal) logWriter(w io.Writer) io.Writer {
+	return &progressLogWriter{t: t, w: w}
+}
+
+// progressLogWriter 是 progressTerminal 协调的日志输出. endLine 为 true 时 (结束时的结果提示) 不清除进度行,
+// 而是换行保留最后一次进度, 之后也不再重画
+type progressLogWriter struct {
+	t       *progressTerminal
+	w       io.Writer
+	endLine bool
+}
+
+func (l *progressLogWriter) Write(b []byte) (int, error) {
+	l.t.mu.Lock()
+	defer l.t.mu.Unlock()
+	if l.t.line != nil {
+		if l.endLine {
+			io.WriteString(l.t.out, "\n")
+			l.t.line = nil
+		} else {
+			io.WriteString(l.t.out, "\r\033[K")
+		}
+	}
+	n, err := l.w.Write(b)
+	if l.t.line != nil {
+		l.t.out.Write(l.t.line)
+	}
+	return n, err
+}
+
+// plainProgressWriter 把原地刷新的进度显示转换为逐行输出 (-progress plain): 去掉回车和清行控制字符,
+// 每次更新以换行结尾
+type plainProgressWriter struct {
+	w io.Writer
+}
+
+func (p *plainProgressWriter) Write(b []byte) (int, error) {
+	s := strings.ReplaceAll(string(b), "\r\033[K", "")
+	if s == "" {
+		return len(b), nil
+	}
+	if !strings.HasSuffix(s, "\n") {
+		s += "\n"
+	}
+	if _, err := io.WriteString(p.w, s); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+const (
+	speedWindowSpan    = 2 * time.Second // 瞬时速度的统计窗口
+	speedWindowSamples = 8               // 环形缓冲区容量, 需大于窗口内的采样次数 (默认每 500ms 一次, 采样更密时只统计最近的几次)
+)
+
+type speedSample struct {
+	at          time.Time
+	transferred int64
+}
+
+// speedWindow 保存最近若干次进度采样的环形缓冲区, 用于计算最近 speedWindowSpan 内的瞬时速度
+type speedWindow struct {
+	samples [speedWindowSamples]speedSample
+	next    int
+	count   int
+}
+
+func newSpeedWindow(startTime time.Time) *speedWindow {
+	w := &speedWindow{}
+	w.add(startTime, 0)
+	return w
+}
+
+// add 记录一次采样, 返回从窗口内最早的采样到现在的速度 (bytes/s)
+func (w *speedWindow) add(now time.Time, transferred int64) float64 {
+	w.samples[w.next] = speedSample{at: now, transferred: transferred}
+	w.next = (w.next + 1) % speedWindowSamples
+	if w.count < speedWindowSamples {
+		w.count++
+	}
+	// 从最旧的采样开始找第一个仍在窗口内的; 都不在窗口内时使用上一次采样
+	var oldest speedSample
+	for i := 0; i < w.count; i++ {
+		oldest = w.samples[(w.next-w.count+i+speedWindowSamples)%speedWindowSamples]
+		if now.Sub(oldest.at) <= speedWindowSpan || i >= w.count-2 {
+			break
+		}
+	}
+	elapsed := now.Sub(oldest.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(transferred-oldest.transferred) / elapsed
+}
+
+// sendOptions 是 sender 发送单个文件的选项, 由调用方显式传入
+type sendOptions struct {
+	resume     bool   // 以断点续传请求发送 (-resume, 或 retry 模式中记录了偏移量的文件)
+	lastOffset int64  // retry 模式: failed_files.log 记录的上次发送到的偏移量, 没有匹配的断点文件时据此请求接收端续传
+	sent       *int64 // 非 nil 时在返回前写入已发送到的文件偏移量, 发送失败时记录到 failed_files.log
+}
+
+func sender(ctx context.Context, filePath string, connectAddr string, opts sendOptions) error {
+	isDevZero := (filePath == "/dev/zero")
+	isStdin := (filePath == "-")
+	if *connections > 1 && !isDevZero && !isStdin {
+		if *checksumOnly {
+			logDebug("-checksum-only 不传输数据, 忽略 -connections")
+		} else if *sparse || *verify != "" || pskKey != nil {
+			logWarn("\x1b[33m警告: -sparse, -verify 和 -psk 不支持 -connections 并行发送，将使用单连接\x1b[0m")
+		} else if *dryRun {
+			logInfo("dry-run: 实际传输时将通过 %d 条连接并行发送, 本次只通过单连接发送文件头", *connections)
+		} else if strings.Contains(connectAddr, ",") {
+			logWarn("\x1b[33m警告: 一对多发送不支持 -connections 并行发送，将对每个接收端使用单连接\x1b[0m")
+		} else if *netType == "unix" {
+			logWarn("\x1b[33m警告: Unix socket 不支持 -connections 并行发送，将使用单连接\x1b[0m")
+		} else if *netType == "sctp" {
+			logWarn("\x1b[33m警告: SCTP 连接不支持 -connections 并行发送 (分段发送依赖 sendfile)，将使用单连接\x1b[0m")
+		} else {
+			return sendParallel(ctx, filePath, connectAddr, *connections)
+		}
+	}
+	// -ack 时接收端否认的文件重新建立连接再发送一次, 最多重试 -retry 次 (stdin 无法重新读取)
+	for attempt := 1; ; attempt++ {
+		err := sendSingle(ctx, filePath, connectAddr, opts)
+		if !errors.Is(err, errRemoteNack) || isStdin || attempt > *retryCount || ctx.Err() != nil {
+			return err
+		}
+		logWarn("\x1b[33m警告: %v，重新发送 (第 %d/%d 次重试)\x1b[0m", err, attempt, *retryCount)
+	}
+}
+
+// sendSingle 建立一条连接发送单个文件 (或 /dev/zero, stdin)
+func sendSingle(ctx context.Context, filePath string, connectAddr string, opts sendOptions) error {
+	isStdin := (filePath == "-")
+	conn, features, closeConn, err := connectAndNegotiate(ctx, connectAddr)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	var sendErr error
+	if opts.resume {
+		sendErr = sendResumable(conn, features, filePath, connectAddr, opts.lastOffset, opts.sent)
+	} else {
+		sendErr = sendFile(conn, features, filePath, opts.sent)
+	}
+	// -checksum-only 校验不一致时数据流仍然对齐, 照常发送结束标记后再报告结果
+	if sendErr != nil && !(*checksumOnly && (errors.Is(sendErr, errChecksumMismatch) || errors.Is(sendErr, errRemoteMissing))) {
+		return sendErr
+	}
+	// 流式传输以连接关闭作为数据结尾, 不能再发送结束标记
+	if features.MultiFile && !isStdin {
+		if err := writeBatchEnd(conn); err != nil {
+			return err
+		}
+	}
+	if err := finishSend(conn); err != nil {
+		return err
+	}
+	return sendErr
+}
+
+// sendFileList 读取 listPath 中的文件路径 (每行一个, 忽略空行和 # 开头的注释), 通过一条连接依次发送.
+// 不存在或无法读取的文件记录到 failed_files.log 并跳过, 不中断整批传输.
+func sendFileList(ctx context.Context, listPath string, connectAddr string) error {
+	paths, err := readFileList(listPath)
+	if err != nil {
+		return &FileInfoError{FilePath: listPath, Err: err}
+	}
+	if len(paths) == 0 {
+		return &FileInfoError{FilePath: listPath, Err: fmt.Errorf("文件列表为空")}
+	}
+	logInfo("从 %s 读取到 %d 个待发送文件", listPath, len(paths))
+	return sendPaths(ctx, paths, connectAddr)
+}
+
+// readFailedLog 读取 failed_files.log 中的记录, 同时支持文本格式 (时间 - 角色 - 路径 - 原因) 和 JSON 格式.
+// 同一角色的同一路径出现多次时只保留最后一条 (其中的偏移量最新), 顺序按路径第一次出现的位置
+func readFailedLog(logPath string) ([]failedRecord, error) {
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取失败日志失败: %w", err)
+	}
+	var records []failedRecord
+	index := make(map[string]int)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var rec failedRecord
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &rec); err != nil {
+				logWarn("\x1b[33m警告: %s 第 %d 行不是有效的 JSON 记录, 已忽略: %v\x1b[0m", logPath, i+1, err)
+				continue
+			}
+		} else {
+			// 时间中不含 " - ", 路径中含有 " - " 时文本格式无法区分, 请使用 -failed-log-format json.
+			// 旧版本写入的行没有角色字段 (时间 - 路径 - 原因)
+			parts := strings.SplitN(line, " - ", 4)
+			switch {
+			case len(parts) == 4 && (parts[1] == roleSender || parts[1] == roleReceiver):
+				rec = failedRecord{Time: parts[0], Role: parts[1], Path: parts[2], Reason: parts[3]}
+			case len(parts) >= 3:
+				rec = failedRecord{Time: parts[0], Path: parts[1], Reason: strings.Join(parts[2:], " - ")}
+			default:
+				logWarn("\x1b[33m警告: 无法解析 %s 第 %d 行, 已忽略\x1b[0m", logPath, i+1)
+				continue
+			}
+		}
+		if rec.Path == "" {
+			continue
+		}
+		// 发送端和接收端可能共用同一个日志文件, 同一路径按角色分别去重
+		key := rec.Role + "\x00" + rec.Path
+		if j, ok := index[key]; ok {
+			records[j] = rec
+			continue
+		}
+		index[key] = len(records)
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// retryFailed 重新发送 logPath 中记录的每个失败文件 (-mode retry). 原日志先改名为 <logPath>.old,
+// 再次失败的文件重新记录到 logPath, 全部处理完后删除 .old. connectAddr 为空时使用记录中的目标地址.
+// 记录了偏移量的文件使用 -resume 的续传请求发送, 实际的续传位置由接收端保留的 .part 决定.
+// 接收端写入的记录 (路径为接收端的文件) 不重发, 原样保留在 logPath 中; 没有角色的旧记录按发送端处理
+func retryFailed(ctx context.Context, logPath, connectAddr string) error {
+	all, err := readFailedLog(logPath)
+	if err != nil {
+		return &FileInfoError{FilePath: logPath, Err: err}
+	}
+	var records, skipped []failedRecord
+	for _, rec := range all {
+		if rec.Role == roleReceiver {
+			skipped = append(skipped, rec)
+			continue
+		}
+		records = append(records, rec)
+	}
+	if len(skipped) > 0 {
+		names := make([]string, len(skipped))
+		for i, rec := range skipped {
+			names[i] = rec.Path
+		}
+		logWarn("\x1b[33m警告: 跳过 %d 条接收端写入的记录 (retry 只重发发送端失败的文件): %s\x1b[0m", len(skipped), strings.Join(names, ", "))
+	}
+	if len(records) == 0 {
+		noFields.print("info", "%s 中没有需要重试的文件", logPath)
+		return nil
+	}
+	oldPath := logPath + ".old"
+	if err := os.Rename(logPath, oldPath); err != nil {
+		return &FileInfoError{FilePath: logPath, Err: err}
+	}
+	badFile = logPath
+	for _, rec := range skipped {
+		logFailedFile(rec.Role, rec.Path, rec.Remote, rec.BytesSent, rec.Reason)
+	}
+	logInfo("从 %s 读取到 %d 个失败的文件，开始重试", logPath, len(records))
+
+	// -resume 与这些选项互斥 (见参数检查), 此时记录的偏移量只能忽略, 从头发送
+	canResume := *connections <= 1 && !*sparse && *verify == "" && pskKey == nil && !*mmapSend && !*delta && !*dedupe && *netType != "sctp"
+	var retried int
+	var lastErr error
+	for i, rec := range records {
+		target := connectAddr
+		if target == "" {
+			target = rec.Remote
+		}
+		if target == "" {
+			target = *addr
+		}
+		logInfo("重试第 %d/%d 个文件: %s -> %s", i+1, len(records), rec.Path, target)
+		var err error
+		var offset int64
+		if rec.Path == "-" || rec.Path == "/dev/zero" {
+			err = fmt.Errorf("从 stdin 或 /dev/zero 发送的数据无法重试")
+		} else if err = checkSendable(rec.Path); err == nil {
+			opts := sendOptions{resume: rec.BytesSent > 0 && canResume, sent: &offset}
+			if opts.resume {
+				opts.lastOffset = rec.BytesSent
 			}
-			if n == 0 {
-				if totalSent < fileSize {
-					return fmt.Errorf("sendfile 返回 0 但文件未传输完成 (已发送 %d / %d)", totalSent, fileSize)
+			err = sender(ctx, rec.Path, target, opts)
+		}
+		if err != nil {
+			fileLog(rec.Path, -1).error("\x1b[31m重试 '%s' 失败: %v\x1b[0m", rec.Path, err)
+			logFailedFile(roleSender, rec.Path, target, max(offset, rec.BytesSent), err.Error())
+			runStats.fail(rec.Path, err)
+			lastErr = err
+			if ctx.Err() != nil {
+				// 被中断时剩余的文件原样保留在日志中
+				for _, rest := range records[i+1:] {
+					logFailedFile(roleSender, rest.Path, rest.Remote, rest.BytesSent, rest.Reason)
 				}
-				break // 正常完成
+				break
+			}
+			continue
+		}
+		retried++
+	}
+	if err := os.Remove(oldPath); err != nil {
+		logWarn("\x1b[33m警告: 删除 '%s' 失败: %v\x1b[0m", oldPath, err)
+	}
+	if lastErr != nil {
+		return fmt.Errorf("重试完成: 成功 %d 个, %d 个文件仍未成功 (已记录到 %s): %w", retried, len(records)-retried, logPath, lastErr)
+	}
+	noFields.print("info", "重试完成: %d 个文件全部发送成功", retried)
+	return nil
+}
+
+// sendGlob 发送通配符模式 pattern 匹配的所有文件 (目录除外), 按文件名顺序通过一条连接依次发送
+func sendGlob(ctx context.Context, pattern string, connectAddr string) error {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return &FileInfoError{FilePath: pattern, Err: err}
+	}
+	var paths []string
+	for _, m := range matches {
+		if info, err := os.Stat(m); err == nil && info.IsDir() {
+			continue
+		}
+		paths = append(paths, m)
+	}
+	if len(paths) == 0 {
+		return &FileInfoError{FilePath: pattern, Err: fmt.Errorf("没有匹配的文件")}
+	}
+	logInfo("%s 匹配到 %d 个待发送文件", pattern, len(paths))
+	return sendPaths(ctx, paths, connectAddr)
+}
+
+// isGlobPattern 判断 -file 是否为通配符模式: 包含 * ? [ 之一, 且不是一个已存在的路径 (文件名本身含这些字符时按原样发送)
+func isGlobPattern(path string) bool {
+	if !strings.ContainsAny(path, "*?[") {
+		return false
+	}
+	_, err := os.Lstat(path)
+	return err != nil
+}
+
+// sendPaths 通过一条连接依次发送 paths 中的文件.
+// 不存在或无法读取的文件记录到 failed_files.log 并跳过, 不中断整批传输.
+func sendPaths(ctx context.Context, paths []string, connectAddr string) error {
+	var unchanged int // 修改时间早于 -since 的文件数
+	if !sinceTime.IsZero() {
+		paths, unchanged = filterSince(paths, sinceTime)
+		logInfo("-since %s: %d 个文件在此之后修改过，跳过 %d 个未修改的文件", sinceTime.Format(time.RFC3339), len(paths), unchanged)
+		if len(paths) == 0 {
+			noFields.print("info", "批量发送完成: 没有需要发送的文件，跳过 %d 个未修改的文件", unchanged)
+			return nil
+		}
+	}
+
+	conn, features, closeConn, err := connectAndNegotiate(ctx, connectAddr)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+	if !features.MultiFile {
+		return fmt.Errorf("接收端不支持单连接多文件传输，无法批量发送多个文件")
+	}
+	if features.Manifest && !*dryRun && !*checksumOnly {
+		if err := writeBatchManifest(conn, features, paths); err != nil {
+			return err
+		}
+	}
+
+	if *verify != "" && features.Checksum && !*dryRun && !*checksumOnly {
+		if features.BatchRoot {
+			sentDigests = &batchRoot{}
+			defer func() { sentDigests = nil }()
+		} else {
+			logDebug("接收端不支持整批根校验值 (版本过旧)，只逐个文件校验")
+		}
+	}
+
+	var sent int
+	var skipped []string
+	var unverified []string // -checksum-only 时接收端的文件不一致或不存在
+	dedupedBefore := dedupeSkipped.Load()
+	for i, path := range paths {
+		if err := checkSendable(path); err != nil {
+			fileLog(path, -1).warn("\x1b[33m警告: 跳过文件 '%s': %v\x1b[0m", path, err)
+			logFailedFile(roleSender, path, connectAddr, 0, err.Error())
+			runStats.record(path, 0, err)
+			skipped = append(skipped, path)
+			continue
+		}
+		logInfo("发送第 %d/%d 个文件: %s", i+1, len(paths), path)
+		var offset int64
+		if err := sendFile(conn, features, path, &offset); err != nil {
+			if *checksumOnly && (errors.Is(err, errChecksumMismatch) || errors.Is(err, errRemoteMissing)) {
+				// 校验结果由接收端回复, 数据流仍然对齐, 继续校验后续文件
+				logError("\x1b[31m%v\x1b[0m", err)
+				logFailedFile(roleSender, path, connectAddr, 0, err.Error())
+				runStats.record(path, 0, err)
+				unverified = append(unverified, path)
+				continue
 			}
-			sentBytes := int64(n)
-			atomic.AddInt64(&transferred, sentBytes)
-			totalSent += sentBytes
+			// 文件头已发出, 数据流无法再与接收端对齐, 只能中止整批传输
+			logFailedFile(roleSender, path, connectAddr, offset, err.Error())
+			runStats.fail(path, err)
+			return fmt.Errorf("发送文件 '%s' 失败，批量传输中止 (已成功发送 %d 个): %w", path, sent, err)
+		}
+		sent++
+	}
+	var rootErr error // 整批根校验值不一致: 数据流仍然对齐, 照常结束批量传输后再报告
+	if sentDigests != nil {
+		if rootErr = sendBatchRoot(conn, sentDigests); rootErr != nil && !errors.Is(rootErr, errChecksumMismatch) {
+			return rootErr
+		}
+	}
+	if err := writeBatchEnd(conn); err != nil {
+		return err
+	}
+	if err := finishSend(conn); err != nil {
+		return err
+	}
+
+	if *dryRun {
+		noFields.print("info", "dry-run 完成: 校验 %d 个文件头，跳过 %d 个", sent, len(skipped))
+	} else if *checksumOnly {
+		level := "info"
+		if len(unverified) > 0 {
+			level = "error"
+		}
+		noFields.print(level, "批量校验完成: 一致 %d 个文件，不一致或不存在 %d 个，跳过 %d 个", sent, len(unverified), len(skipped))
+		if len(unverified) > 0 {
+			return fmt.Errorf("%d 个文件%w (详见 %s): %s", len(unverified), errChecksumMismatch, badFile, strings.Join(unverified, ", "))
 		}
-		log.Printf("\x1b[32mSendfile 完成，总共发送 %d bytes\x1b[0m", totalSent)
 	} else {
-		// 使用标准网络写入 (发送 /dev/zero 或 非 Linux 或 获取 fd 失败)
-		if isDevZero {
-			log.Printf("使用标准网络写入传输 /dev/zero 数据")
+		noFields.print("info", "批量发送完成: 成功 %d 个文件，跳过 %d 个", sent, len(skipped))
+	}
+	if deduped := dedupeSkipped.Load() - dedupedBefore; deduped > 0 {
+		noFields.print("info", "其中 %d 个文件接收端已有 (-dedupe)，未传输数据，实际传输 %d 个", deduped, int64(sent)-deduped)
+	}
+	if unchanged > 0 {
+		noFields.print("info", "另有 %d 个文件自 %s 以来未修改，未发送", unchanged, sinceTime.Format(time.RFC3339))
+	}
+	if rootErr != nil {
+		return rootErr
+	}
+	if len(skipped) > 0 {
+		return fmt.Errorf("%d 个文件无法读取已跳过 (详见 %s): %s", len(skipped), badFile, strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// writeBatchManifest 在批量传输开始前发送批量清单 (extFlagManifest): 可以发送的文件数和它们的总字节数.
+// 无法读取的文件稍后会被跳过, 因此不计入清单
+func writeBatchManifest(conn net.Conn, features Features, paths []string) error {
+	var count uint32
+	var total int64
+	for _, path := range paths {
+		if checkSendable(path) != nil {
+			continue
+		}
+		if path == "/dev/zero" {
+			size, _ := parseSize(*sizeStr)
+			total += size
+		} else if info, err := os.Stat(path); err == nil {
+			total += info.Size()
 		} else {
-			log.Printf("使用标准网络写入传输文件 %s (sendfile 不可用)", filePath) // 移除 "非 Linux"
+			continue
 		}
-		buffer := make([]byte, copyBufferSize)
-		var reader io.Reader
-		if isDevZero {
-			reader = &zeroReader{size: fileSize} // 使用自定义的 reader 模拟
+		count++
+	}
+	setIODeadline(conn)
+	if _, err := conn.Write(encodeFileHeader(features, fileHeader{flags: extFlagManifest, size: total, files: count})); err != nil {
+		return fmt.Errorf("发送批量清单失败: %w", wrapIOTimeout(err))
+	}
+	logDebug("已发送批量清单: %d 个文件, 共 %s bytes", count, formatWithCommas(total))
+	return nil
+}
+
+// readFileList 读取文件列表, 返回去除首尾空白后的非空、非注释行
+func readFileList(listPath string) ([]string, error) {
+	data, err := os.ReadFile(listPath)
+	if err != nil {
+		return nil, fmt.Errorf("读取文件列表失败: %w", err)
+	}
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, nil
+}
+
+// expandDirTemplate 展开 -dir-template: {date} 为当天日期, {remote} 为对端 IP (Unix socket 为 "unix"), {name} 为文件名.
+// 替换值中的路径分隔符被替换为 '_', 展开结果必须是相对路径且不能通过 ".." 跳出 -dir
+func expandDirTemplate(tmpl, remote, name string) (string, error) {
+	r := strings.NewReplacer(
+		"{date}", time.Now().Format("2006-01-02"),
+		"{remote}", sanitizePathComponent(remote),
+		"{name}", sanitizePathComponent(name),
+	)
+	expanded := filepath.Clean(r.Replace(tmpl))
+	if !filepath.IsLocal(expanded) {
+		return "", fmt.Errorf("-dir-template 展开后的路径 '%s' 不在 -dir 之内", expanded)
+	}
+	return expanded, nil
+}
+
+// sanitizePathComponent 把 s 转换为可以安全用作单个路径分量的字符串
+func sanitizePathComponent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == '/' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" || s == "." || s == ".." {
+		return "_"
+	}
+	return s
+}
+
+// checkSendable 在发送文件头之前确认文件存在且可读, 以便跳过而不打乱连接上的数据流
+func checkSendable(path string) error {
+	if path == "-" {
+		return fmt.Errorf("文件列表中不支持 stdin ('-')")
+	}
+	if path == "/dev/zero" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("不是普通文件")
+	}
+	if err := validateFileName(info.Name()); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// validateFileName 检查文件头中的文件名: 不能为空 (长度 0 是批量传输的结束标记), 不能超过 maxFileNameLen,
+// 也不能包含路径分隔符或为 "." / "..", 接收端据此保证文件只写在目标目录之内
+func validateFileName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("文件名为空")
+	}
+	if name == "." || name == ".." || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("文件名 %q 无效: 只能是单个路径分量", name)
+	}
+	if len(name) > maxFileNameLen {
+		return fmt.Errorf("文件名过长 (%d 字节, 最多 %d 字节)", len(name), maxFileNameLen)
+	}
+	return nil
+}
+
+// connectAndNegotiate 连接接收端并完成协议握手和能力协商, 返回的 closeConn 负责关闭连接.
+// connectAddr 为逗号分隔的多个地址时连接所有接收端, 返回把数据复制给所有接收端的 fanoutConn.
+func connectAndNegotiate(ctx context.Context, connectAddr string) (net.Conn, Features, func(), error) {
+	if addrs := strings.Split(connectAddr, ","); len(addrs) > 1 {
+		return connectFanout(ctx, addrs)
+	}
+	conn, err := dialWithRetry(ctx, network(), connectAddr)
+	if err != nil {
+		return nil, Features{}, nil, fmt.Errorf("连接失败 %s: %w", connectAddr, err)
+	}
+	if proxyURL != nil {
+		peerLog(connectAddr).info("\x1b[32m已连接到接收端 (经 SOCKS5 代理 %s)\x1b[0m", proxyURL.Host)
+	} else {
+		peerLog(connectAddr).info("\x1b[32m已连接到接收端\x1b[0m")
+	}
+
+	stopAbort := abortOnCancel(ctx, conn)
+	closeConn := func() {
+		stopAbort()
+		conn.Close()
+	}
+
+	applySendBuffer(conn)
+	applyNoDelay(conn)
+	applyKeepAlive(conn)
+	applyUserTimeout(conn)
+	logMultipath(conn)
+	if err := writeHandshake(conn); err != nil {
+		closeConn()
+		return nil, Features{}, nil, err
+	}
+	features, err := negotiate(conn, senderCapabilities())
+	if err != nil {
+		closeConn()
+		return nil, Features{}, nil, err
+	}
+	if *sparse && !features.Sparse {
+		logWarn("\x1b[33m警告: 接收端不支持稀疏文件传输，将发送完整文件\x1b[0m")
+	}
+	if *verify != "" && !features.Checksum {
+		logWarn("\x1b[33m警告: 接收端不支持校验，将不进行校验\x1b[0m")
+	}
+	if pskKey != nil && !features.Encrypt {
+		closeConn()
+		return nil, Features{}, nil, fmt.Errorf("接收端不支持加密传输，拒绝以明文发送")
+	}
+	if pskKey != nil && *sparse {
+		logWarn("\x1b[33m警告: 加密传输不支持稀疏文件，将发送完整文件\x1b[0m")
+	}
+	if *checksumOnly && !(features.ChecksumOnly && features.Checksum) {
+		closeConn()
+		return nil, Features{}, nil, fmt.Errorf("接收端不支持 -checksum-only (版本过旧或经过 relay 转发)")
+	}
+	if *dryRun && !features.DryRun {
+		closeConn()
+		return nil, Features{}, nil, fmt.Errorf("接收端不支持 dry-run，无法在不传输数据的情况下校验")
+	}
+	if *ackMode && !features.Ack {
+		logWarn("\x1b[33m警告: 接收端不支持逐个文件确认 (版本过旧或经过 relay 转发)，-ack 不生效\x1b[0m")
+	}
+	if *delta && !features.Delta {
+		logWarn("\x1b[33m警告: 接收端不支持增量传输 (版本过旧或经过 relay 转发)，将发送完整文件\x1b[0m")
+	}
+	if *compressMode != "off" && !features.Compress {
+		logWarn("\x1b[33m警告: 接收端不支持压缩 (版本过旧)，将不压缩传输\x1b[0m")
+	}
+	if *dedupe && !(features.Dedupe && features.Checksum) {
+		logWarn("\x1b[33m警告: 接收端不支持去重 (版本过旧或经过 relay 转发)，将发送所有文件\x1b[0m")
+	}
+	return conn, features, closeConn, nil
+}
+
+// connectFanout 连接所有接收端, 任一接收端连接失败时整体失败. 协商结果为所有接收端都支持的功能.
+func connectFanout(ctx context.Context, addrs []string) (net.Conn, Features, func(), error) {
+	f := &fanoutConn{}
+	var agreed Features
+	queueLen := max(1, int(fanoutBuffer/copyBufferSize))
+	for i, a := range addrs {
+		conn, features, closeConn, err := connectAndNegotiate(ctx, a)
+		if err != nil {
+			for _, p := range f.peers {
+				p.closeConn()
+			}
+			return nil, Features{}, nil, err
+		}
+		if i == 0 {
+			f.Conn = conn
+			agreed = features
 		} else {
-			if srcFile == nil {
-				return fmt.Errorf("无法获取源文件句柄进行标准读取")
+			agreed = agreed.intersect(features)
+		}
+		agreed.BatchRoot = false // 只能读取第一个接收端的比对结果
+		f.peers = append(f.peers, &fanoutPeer{addr: a, conn: conn, zc: newZerocopyWriter(conn), closeConn: closeConn, queue: make(chan []byte, queueLen), done: make(chan struct{})})
+	}
+	for _, p := range f.peers {
+		go p.run()
+	}
+	logInfo("一对多发送: 已连接 %d 个接收端，每个接收端的发送队列 %s bytes", len(f.peers), formatWithCommas(fanoutBuffer))
+	return f, agreed, func() { f.Close() }, nil
+}
+
+// fanoutConn 把写入的数据复制给多个接收端 (-addr 为逗号分隔的多个地址). sendfile 只能写一个 fd,
+// 因此一对多发送总是从文件读取一次, 再由每个接收端独立的 goroutine 写出; 各接收端之间通过最多缓存
+// -fanout-buffer 字节的队列解耦, 慢的接收端只有在其队列写满后才会拖慢其他接收端.
+// 某个接收端失败后被丢弃, 其余接收端继续; 所有接收端都失败时 Write 返回错误.
+type fanoutConn struct {
+	net.Conn // 第一个接收端的连接, 提供 LocalAddr/RemoteAddr 等方法
+	peers    []*fanoutPeer
+	finished bool
+	result   error
+}
+
+// fanoutPeer 是一对多发送中的一个接收端
+type fanoutPeer struct {
+	addr      string
+	conn      net.Conn
+	zc        *zerocopyWriter // -zerocopy 时非 nil
+	closeConn func()
+	queue     chan []byte
+	done      chan struct{}
+	written   int64 // done 关闭后才能读取
+
+	mu  sync.Mutex
+	err error
+}
+
+// run 依次写出队列中的数据; 失败后继续取出队列中的数据并丢弃, 使 Write 不会因该接收端阻塞
+func (p *fanoutPeer) run() {
+	defer close(p.done)
+	for data := range p.queue {
+		if p.failure() != nil {
+			continue
+		}
+		setIODeadline(p.conn)
+		var n int
+		var err error
+		if p.zc != nil {
+			n, err = p.zc.Write(data)
+		} else {
+			n, err = p.conn.Write(data)
+		}
+		p.written += int64(n)
+		if err != nil {
+			p.mu.Lock()
+			p.err = wrapIOTimeout(err)
+			p.mu.Unlock()
+			logWarn("\x1b[33m警告: 接收端 %s 写入失败: %v，继续向其他接收端发送\x1b[0m", p.addr, err)
+		}
+	}
+}
+
+func (p *fanoutPeer) failure() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+func (f *fanoutConn) Write(b []byte) (int, error) {
+	data := bytes.Clone(b) // 调用方会复用缓冲区, 队列中需要保存副本
+	var lastErr error
+	for _, p := range f.peers {
+		if err := p.failure(); err != nil {
+			lastErr = err
+			continue
+		}
+		p.queue <- data
+	}
+	for _, p := range f.peers {
+		if p.failure() == nil {
+			return len(b), nil
+		}
+	}
+	return 0, fmt.Errorf("所有接收端均已失败: %w", lastErr)
+}
+
+// SetDeadline 由各接收端的写出 goroutine 在每次写入前自行设置
+func (f *fanoutConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// finish 等待所有接收端写完队列中的数据, 返回失败的接收端汇总; 重复调用返回相同的结果
+func (f *fanoutConn) finish() error {
+	if f.finished {
+		return f.result
+	}
+	f.finished = true
+	for _, p := range f.peers {
+		close(p.queue)
+	}
+	var failed []string
+	var firstErr error
+	for _, p := range f.peers {
+		<-p.done
+		if err := p.failure(); err != nil {
+			failed = append(failed, p.addr)
+			if firstErr == nil {
+				firstErr = err
 			}
-			if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
-				return fmt.Errorf("无法重置文件指针: %w", err)
+		} else {
+			logInfo("接收端 %s: 已发送 %s", p.addr, formatBytes(p.written))
+		}
+	}
+	if len(failed) > 0 {
+		f.result = fmt.Errorf("%d/%d 个接收端发送失败 (%s): %w", len(failed), len(f.peers), strings.Join(failed, ", "), firstErr)
+	}
+	return f.result
+}
+
+// Close 等待队列写完后关闭所有接收端的连接
+func (f *fanoutConn) Close() error {
+	err := f.finish()
+	for _, p := range f.peers {
+		p.closeConn()
+	}
+	return err
+}
+
+// finishSend 在发送端结束前等待一对多发送的所有接收端写完, 返回发送失败的接收端; 单个接收端时无操作
+func finishSend(conn net.Conn) error {
+	if f, ok := conn.(*fanoutConn); ok {
+		return f.finish()
+	}
+	return nil
+}
+
+// dedupeSkipped 是 -dedupe 时因接收端已有相同文件 (或不允许覆盖) 而没有传输数据的文件数
+var dedupeSkipped atomic.Int64
+
+// sendFile 在已完成握手的连接上发送单个文件: 文件头, 数据以及可选的校验尾部.
+// sent 非 nil 时在返回前写入已发送的数据字节数 (未压缩、未加密的原始数据), 发送失败时作为续传的偏移量记录
+func sendFile(conn net.Conn, features Features, filePath string, sent *int64) error {
+	isDevZero := (filePath == "/dev/zero")
+	isStdin := (filePath == "-")
+	if *delta && features.Delta && !isDevZero && !isStdin {
+		return sendDelta(conn, features, filePath)
+	}
+	var err error
+	var fileSize int64
+	var fileName string
+	var mtime int64      // 常规文件的修改时间, 供接收端的 -if newer 判断
+	var extents []extent // 非 nil 时以稀疏格式发送
+
+	if isDevZero {
+		fileSize, err = parseSize(*sizeStr) // 从 -size 获取大小
+		if err != nil {
+			// 理论上 main 函数已检查，但再次检查更安全
+			return fmt.Errorf("无法解析 -size 参数 '%s' 用于 /dev/zero: %w", *sizeStr, err)
+		}
+		fileName = "zero.dat" // 给 /dev/zero 一个虚拟文件名
+		fileLog(fileName, fileSize).info("发送 /dev/zero，虚拟文件名: %s, 大小: %d bytes", fileName, fileSize)
+	} else if isStdin {
+		fileSize = unknownSize // 长度未知, 发送到 EOF 为止
+		fileName = "stdin.dat"
+		logInfo("从 stdin 读取数据，虚拟文件名: %s, 大小未知 (读取到 EOF 为止)", fileName)
+	} else {
+		fileInfo, err := os.Stat(filePath)
+		if err != nil {
+			return &FileInfoError{FilePath: filePath, Err: err}
+		}
+		fileSize = fileInfo.Size()
+		fileName = fileInfo.Name() // 获取真实文件名
+		mtime = fileInfo.ModTime().UnixNano()
+		if err := validateFileName(fileName); err != nil {
+			return &FileInfoError{FilePath: filePath, Err: err}
+		}
+		if *dryRun {
+			// 正常传输时在发送文件头之后才打开源文件, dry-run 不会走到那一步, 这里提前确认可读
+			f, err := os.Open(filePath)
+			if err != nil {
+				return &FileInfoError{FilePath: filePath, Err: err}
+			}
+			f.Close()
+		}
+		if *sparse && features.Sparse && pskKey == nil && fileInfo.Mode().IsRegular() {
+			extents, err = sparseExtents(filePath, fileSize)
+			if err != nil {
+				return &FileInfoError{FilePath: filePath, Err: err}
+			}
+		}
+	}
+	if *checksumOnly {
+		return sendChecksumOnly(conn, features, filePath, fileName, fileSize, isDevZero)
+	}
+	// 稀疏模式下只发送数据区段, payloadSize 为实际发送的字节数
+	payloadSize := fileSize
+	if extents != nil {
+		payloadSize = 0
+		for _, ext := range extents {
+			payloadSize += ext.length
+		}
+		logInfo("稀疏文件: %d 个数据区段, 实际数据 %s / %s 字节", len(extents), formatWithCommas(payloadSize), formatWithCommas(fileSize))
+	}
+	// 校验值在数据之后发送, 流式传输没有明确的数据结尾, 无法附带
+	var hasher hash.Hash
+	algo, _ := checksumAlgoByName(*verify)
+	if *verify != "" && features.Checksum {
+		if isStdin {
+			logWarn("\x1b[33m警告: 从 stdin 流式发送时不支持 -verify，将不进行校验\x1b[0m")
+		} else {
+			hasher = algo.newHash()
+		}
+	}
+
+	// 稀疏文件或启用校验等时文件头带有扩展头标志位
+	var extFlags byte
+	if extents != nil {
+		extFlags |= extFlagSparse
+	}
+	if hasher != nil {
+		extFlags |= extFlagChecksum
+	}
+	if *dryRun {
+		extFlags |= extFlagDryRun
+	}
+	// -compress: 只压缩大小已知的完整文件; auto 时按文件采样决定
+	compress := *compressMode != "off" && features.Compress && fileSize != unknownSize && extents == nil && pskKey == nil && !*dryRun && !isStdin
+	if compress && *compressMode == "auto" {
+		ratio, err := sampleCompressRatio(filePath, isDevZero)
+		if err != nil {
+			return &FileInfoError{FilePath: filePath, Err: err}
+		}
+		compress = ratio <= compressAutoRatio
+		if compress {
+			fileLog(fileName, -1).info("'%s' 采样压缩率 %.0f%%，启用压缩", fileName, ratio*100)
+		} else {
+			fileLog(fileName, -1).debug("'%s' 采样压缩率 %.0f%%，不压缩", fileName, ratio*100)
+		}
+	}
+	// -dedupe: 先计算整个文件的校验值, 在数据之前发送给接收端比对
+	var dedupeDigest []byte
+	if *dedupe && features.Dedupe && hasher != nil && !isDevZero {
+		if dedupeDigest, err = fileDigest(filePath, algo); err != nil {
+			return err
+		}
+	}
+	// 每个文件使用新的随机盐派生密钥
+	var salt []byte
+	var aead cipher.AEAD
+	if pskKey != nil {
+		extFlags |= extFlagEncrypt
+		salt = make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return fmt.Errorf("生成随机盐失败: %w", err)
+		}
+		if aead, err = newPayloadAEAD(pskKey, salt); err != nil {
+			return err
+		}
+	}
+
+	// -framed: 只对大小已知的完整文件分帧
+	framedSend := *framed && fileSize != unknownSize && !*dryRun
+	if framedSend && !features.Framed {
+		fileLog(fileName, -1).warn("\x1b[33m警告: 接收端不支持 -framed (版本过旧)，'%s' 将不分帧发送\x1b[0m", fileName)
+		framedSend = false
+	}
+
+	// 1. 发送文件头: 文件名、大小和各标志位附带的字段 (稀疏区段表、校验算法、加密盐、压缩算法、去重校验值)
+	header := fileHeader{flags: extFlags, name: fileName, size: fileSize, extents: extents, algo: algo.code, salt: salt, digest: dedupeDigest, mtime: mtime}
+	if dedupeDigest != nil {
+		header.flags2 |= ext2Dedupe
+	}
+	if compress {
+		header.flags2 |= ext2Compress
+		header.compress = compressDeflate
+	}
+	if framedSend {
+		header.flags2 |= ext2Framed
+	}
+	if !isDevZero && !isStdin && !*dryRun {
+		header.xattrs = headerXattrs(features, filePath, true)
+	}
+	setIODeadline(conn)
+	if _, err := conn.Write(encodeFileHeader(features, header)); err != nil {
+		return fmt.Errorf("发送文件头失败: %w", wrapIOTimeout(err))
+	}
+	if fileSize == unknownSize {
+		logDebug("\x1b[32m已发送文件头: %s, 大小未知 (流式传输), 标志位: %#02x\x1b[0m", fileName, extFlags)
+	} else {
+		logDebug("\x1b[32m已发送文件头: %s, 大小 %s, 标志位: %#02x\x1b[0m", fileName, formatWithCommas(fileSize), extFlags)
+	}
+	if hasher != nil {
+		logDebug("\x1b[32m校验算法: %s\x1b[0m", algo.name)
+	}
+	if aead != nil {
+		logDebug("\x1b[32m加密盐: %x\x1b[0m", salt)
+	}
+
+	// 2. 去重: 接收端已有相同 (或不允许覆盖的) 文件时不再发送数据
+	if dedupeDigest != nil {
+		reply := make([]byte, 1)
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("读取去重结果失败: %w", wrapIOTimeout(err))
+		}
+		switch reply[0] {
+		case dedupeSend:
+		case dedupeSame:
+			dedupeSkipped.Add(1)
+			fileLog(fileName, 0).print("info", "接收端已有内容相同的 '%s' (%s 校验值: %x)，跳过传输", fileName, algo.name, dedupeDigest)
+			runStats.record(filePath, 0, nil)
+			return nil
+		case dedupeExists:
+			dedupeSkipped.Add(1)
+			fileLog(fileName, -1).warn("\x1b[33m警告: 接收端已有内容不同的 '%s' 且不替换 (-force / -if)，跳过传输\x1b[0m", fileName)
+			runStats.record(filePath, 0, nil)
+			return nil
+		default:
+			return fmt.Errorf("接收端回复了未知的去重结果: %d", reply[0])
+		}
+	}
+
+	if *dryRun {
+		fileLog(filePath, payloadSize).print("info", "[dry-run] 将发送 '%s' -> 文件名 %s, 大小 %s, 实际数据 %s bytes, 发送方式: %s, 校验: %s",
+			filePath, fileName, dryRunSize(fileSize), dryRunSize(payloadSize), sendMethod(isDevZero, isStdin, hasher != nil), dryRunChecksum(hasher != nil))
+		return nil
+	}
+
+	// 对于 /dev/zero，我们不需要打开它然后用 sendfile，直接写网络
+	// 对于常规文件，才需要打开并获取 fd
+	// --- 准备传输 ---
+	var srcFile *os.File // 用于标准写入或获取 fd
+	var srcFd int = -1   // 用于 sendfile
+	if isStdin {
+		srcFile = os.Stdin
+	} else if !isDevZero {
+		srcFile, err = os.Open(filePath)
+		if err != nil {
+			return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("打开源文件失败: %w", err)}
+		}
+		defer srcFile.Close()
+		srcFd = int(srcFile.Fd())
+	}
+
+	// -mmap: 映射源文件后直接从映射区写入连接; /dev/zero 和 stdin 无法按指定大小映射, 回退到标准写入
+	var mapped []byte
+	useMmap := *mmapSend && !isDevZero && !isStdin && aead == nil && !compress && !framedSend
+	if *mmapSend && !useMmap {
+		logWarn("\x1b[33m警告: -mmap 不支持 /dev/zero、stdin 和加密传输，将使用标准写入\x1b[0m")
+	}
+	if useMmap && fileSize > 0 {
+		mapped, err = unix.Mmap(srcFd, 0, int(fileSize), unix.PROT_READ, unix.MAP_SHARED)
+		if err != nil {
+			logWarn("\x1b[33m警告: mmap 源文件失败 (%v)，将回退到 sendfile/标准写入\x1b[0m", err)
+			useMmap = false
+		} else {
+			defer unix.Munmap(mapped)
+			if err := unix.Madvise(mapped, unix.MADV_SEQUENTIAL); err != nil {
+				logDebug("madvise(MADV_SEQUENTIAL) 失败: %v", err)
+			}
+		}
+	}
+
+	// 获取网络连接的 fd (sendfile 需要) 或直接使用 conn (标准写入需要)
+	var dstFd int = -1
+	if compress {
+		logDebug("压缩传输需要在用户态压缩数据，使用标准写入")
+	} else if framedSend {
+		logDebug("分帧传输需要在用户态计算每帧的 CRC32C，使用标准写入")
+	} else if useMmap {
+		// 映射区通过 conn.Write 发送, 不需要 socket fd
+	} else if aead != nil {
+		logDebug("加密传输需要在用户态加密数据，使用标准写入")
+	} else if hasher != nil && !isDevZero {
+		logWarn("\x1b[33m警告: -verify 需要在用户态计算校验值，与 sendfile 零拷贝互斥，将使用标准写入\x1b[0m")
+	} else if _, ok := conn.(*fanoutConn); ok {
+		logDebug("一对多发送需要把数据复制给多个连接，使用标准写入")
+	} else if _, ok := conn.(sctpConn); ok {
+		logDebug("SCTP 连接使用标准写入")
+	} else if _, ok := conn.(proxyConn); ok {
+		logDebug("经 SOCKS5 代理的连接使用标准写入")
+	} else if !isDevZero && !isStdin {
+		tcpConn, ok := conn.(*net.TCPConn)
+		if !ok {
+			logWarn("\x1b[33m警告: 连接不是 TCP 连接，无法使用 sendfile，将回退到标准写入\x1b[0m")
+		} else {
+			dstFile, err := tcpConn.File()
+			if err != nil {
+				logWarn("\x1b[33m警告: 获取连接文件描述符失败 (%v)，无法使用 sendfile，将回退到标准写入\x1b[0m", err)
+			} else {
+				defer dstFile.Close()
+				dstFd = int(dstFile.Fd())
+			}
+		}
+	}
+
+	var transferred int64
+	if sent != nil {
+		defer func() { *sent = atomic.LoadInt64(&transferred) }()
+	}
+	startTime := time.Now()
+	done := make(chan struct{})
+	go displayProgress(payloadSize, &transferred, startTime, done)
+	defer close(done)
+
+	totalSent := int64(0)
+
+	if payloadSize == 0 && hasher == nil && aead == nil {
+		atomic.StoreInt64(&transferred, 0)
+		time.Sleep(100 * time.Millisecond)
+		if features.Ack {
+			return waitAck(conn, fileName)
+		}
+		return nil
+	}
+
+	// 根据情况选择传输方式
+	if compress {
+		var reader io.Reader
+		if isDevZero {
+			reader = &zeroReader{size: fileSize, fill: true}
+		} else {
+			reader = srcFile
+		}
+		if hasher != nil {
+			reader = io.TeeReader(reader, hasher)
+		}
+		var wire int64
+		cw := newCompressWriter(&progressUpdater{conn: conn, transferred: &wire}, &transferred)
+		totalSent, err = io.CopyBuffer(cw, reader, make([]byte, compressChunk))
+		if err == nil {
+			err = cw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("压缩发送失败 (已发送 %d bytes): %w", totalSent, wrapIOTimeout(err))
+		}
+		fileLog(fileName, wire).info("压缩传输 '%s': 原始 %s, 实际发送 %s", fileName, formatBytes(totalSent), formatBytes(wire))
+	} else if framedSend {
+		var reader io.Reader
+		if isDevZero {
+			reader = &zeroReader{size: fileSize, fill: true}
+		} else {
+			reader = srcFile
+		}
+		if hasher != nil {
+			reader = io.TeeReader(reader, hasher)
+		}
+		var wire int64
+		fw := &framedWriter{w: &progressUpdater{conn: conn, transferred: &wire}, raw: &transferred}
+		totalSent, err = io.CopyBuffer(fw, reader, make([]byte, copyBufferSize))
+		if err == nil {
+			err = fw.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("分帧发送失败 (已发送 %d bytes): %w", totalSent, wrapIOTimeout(err))
+		}
+		logDebug("\x1b[32m分帧发送完成，共 %d 帧, %s bytes\x1b[0m", fw.seq, formatWithCommas(totalSent))
+	} else if useMmap {
+		logDebug("使用 mmap 传输文件 %s", filePath)
+		if extents == nil {
+			extents = []extent{{offset: 0, length: fileSize}}
+		}
+		progressWriter := &progressUpdater{conn: conn, transferred: &transferred, zc: newZerocopyWriter(conn)}
+		var prevEnd int64
+		for _, ext := range extents {
+			if hasher != nil {
+				hashZeros(hasher, ext.offset-prevEnd)
+				prevEnd = ext.offset + ext.length
+			}
+			n, err := writeMapped(progressWriter, mapped[ext.offset:ext.offset+ext.length], hasher)
+			totalSent += n
+			if err != nil {
+				return fmt.Errorf("mmap 写入失败 (已发送 %d bytes): %w", totalSent, wrapIOTimeout(err))
+			}
+		}
+		logDebug("\x1b[32mmmap 发送完成，总共发送 %d bytes\x1b[0m", totalSent)
+	} else if !isDevZero && srcFd != -1 && dstFd != -1 { // No need to check runtime.GOOS
+		// 使用 sendfile (Linux 上的常规文件)
+		if *sendSplice {
+			logDebug("使用 splice (文件→管道→socket) 传输文件 %s", filePath)
+		} else {
+			logDebug("使用 sendfile 传输文件 %s", filePath)
+		}
+		if extents != nil {
+			for _, ext := range extents {
+				n, err := sendFileData(dstFd, srcFd, filePath, ext.offset, ext.length, &transferred)
+				totalSent += n
+				if err != nil {
+					return err
+				}
+			}
+		} else {
+			totalSent, err = sendFileData(dstFd, srcFd, filePath, 0, fileSize, &transferred)
+			if err != nil {
+				return err
+			}
+		}
+		logDebug("\x1b[32mSendfile 完成，总共发送 %d bytes\x1b[0m", totalSent)
+	} else if sent, ok, err := spliceSource(conn, isDevZero && aead == nil, isStdin && hasher == nil && aead == nil, payloadSize, &transferred); ok {
+		totalSent = sent
+		if err != nil {
+			return err
+		}
+		if hasher != nil {
+			hashZeros(hasher, totalSent) // 只有 /dev/zero 会在启用校验时走到这里
+		}
+		logDebug("\x1b[32mvmsplice/splice 发送完成，总共发送 %d bytes\x1b[0m", totalSent)
+	} else {
+		// 使用标准网络写入 (发送 /dev/zero 或 非 Linux 或 获取 fd 失败)
+		if isDevZero {
+			logDebug("使用标准网络写入传输 /dev/zero 数据")
+		} else if isStdin {
+			logDebug("使用标准网络写入传输 stdin 数据")
+		} else {
+			logDebug("使用标准网络写入传输文件 %s (sendfile 不可用)", filePath) // 移除 "非 Linux"
+		}
+		buffer := make([]byte, copyBufferSize)
+		var reader io.Reader
+		if isDevZero {
+			// 发送端无法得知接收端是否写入 /dev/null, 因此总是填充零字节, 保证落盘数据正确
+			reader = &zeroReader{size: fileSize, fill: true}
+		} else if isStdin {
+			reader = os.Stdin
+		} else {
+			if srcFile == nil {
+				return fmt.Errorf("无法获取源文件句柄进行标准读取")
+			}
+			if extents != nil {
+				var readers []io.Reader
+				var prevEnd int64
+				for _, ext := range extents {
+					if hasher != nil {
+						readers = append(readers, &holeHasher{hasher: hasher, size: ext.offset - prevEnd})
+						prevEnd = ext.offset + ext.length
+					}
+					readers = append(readers, io.NewSectionReader(srcFile, ext.offset, ext.length))
+				}
+				reader = io.MultiReader(readers...)
+			} else {
+				if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+					return fmt.Errorf("无法重置文件指针: %w", err)
+				}
+				reader = srcFile
+			}
+		}
+
+		if hasher != nil {
+			reader = io.TeeReader(reader, hasher)
+		}
+
+		zc := newZerocopyWriter(conn)
+		var progressWriter io.Writer = &progressUpdater{conn: conn, transferred: &transferred, zc: zc}
+		var sealer *sealWriter
+		if aead != nil {
+			// 进度按明文字节数计算, 帧头和认证标签不计入
+			sealer = &sealWriter{w: &progressUpdater{conn: conn, transferred: new(int64), zc: zc}, aead: aead, plain: &transferred}
+			progressWriter = sealer
+		}
+		written, err := io.CopyBuffer(progressWriter, reader, buffer)
+		totalSent = written
+		if err == nil && sealer != nil {
+			err = sealer.Close()
+		}
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && (opErr.Err == unix.EPIPE || opErr.Err == unix.ECONNRESET) {
+				logInfo("发送端检测到连接断开 (标准写入): %v", err)
+				return fmt.Errorf("连接已断开: %w", err)
+			}
+			return fmt.Errorf("标准写入失败 (已发送 %d bytes): %w", totalSent, wrapIOTimeout(err))
+		}
+		logDebug("\x1b[32m标准网络写入完成，总共发送 %d bytes\x1b[0m", totalSent)
+	}
+
+	// 短暂休眠，允许进度显示的 goroutine 可能进行最后一次更新
+	time.Sleep(100 * time.Millisecond)
+
+	// 最终检查: 确保发送的总字节数与预期文件大小匹配 (流式传输无预期大小)
+	if payloadSize != unknownSize && totalSent != payloadSize {
+		return fmt.Errorf("最终发送字节数 (%d) 与预期文件大小 (%d) 不符", totalSent, payloadSize)
+	}
+
+	// 9. 发送校验值尾部
+	if hasher != nil {
+		if extents != nil {
+			hashZeros(hasher, fileSize-sparseEnd(extents))
+		}
+		digest := hasher.Sum(nil)
+		setIODeadline(conn)
+		if _, err := conn.Write(digest); err != nil {
+			return fmt.Errorf("发送校验值失败: %w", wrapIOTimeout(err))
+		}
+		sentDigests.add(fileName, digest)
+		// 与 md5sum/sha256sum/b3sum 的输出格式一致, 便于与外部工具对照
+		noFields.print("info", "%s 校验值: %x  %s", algo.name, digest, fileName)
+	}
+
+	// 10. 等待接收端确认数据已落盘 (流式传输以连接关闭为结尾, 无法确认)
+	if features.Ack && fileSize != unknownSize {
+		if err := waitAck(conn, fileName); err != nil {
+			return err
+		}
+	}
+
+	if *dropCache && !isDevZero && !isStdin {
+		dropPageCache(srcFile, fileSize)
+	}
+
+	noFields.print("info", "发送完成，总共发送 %s", formatBytes(totalSent)) // Generic completion message
+	runStats.record(filePath, totalSent, nil)
+	return nil
+}
+
+// dryRunSize 格式化 dry-run 输出中的大小, 未知大小显示为 "未知"
+func dryRunSize(size int64) string {
+	if size == unknownSize {
+		return "未知"
+	}
+	return formatWithCommas(size)
+}
+
+// dryRunChecksum 返回 dry-run 输出中的校验方式
+func dryRunChecksum(enabled bool) string {
+	if enabled {
+		return *verify
+	}
+	return "无"
+}
+
+// holeHasher 在 io.MultiReader 中代表稀疏文件的一个空洞: 被读取时把 size 个零字节计入 hasher, 本身不产生数据
+type holeHasher struct {
+	hasher hash.Hash
+	size   int64
+}
+
+func (h *holeHasher) Read(p []byte) (int, error) {
+	hashZeros(h.hasher, h.size)
+	h.size = 0
+	return 0, io.EOF
+}
+
+// sendMethod 返回 sendFile 对该文件将采用的数据发送方式, 用于 dry-run 输出
+func sendMethod(isDevZero, isStdin, checksum bool) string {
+	switch {
+	case pskKey != nil:
+		return "标准写入 (AES-256-GCM 加密)"
+	case isDevZero || isStdin:
+		return "标准写入"
+	case *mmapSend:
+		return "mmap"
+	case checksum:
+		return "标准写入 (校验)"
+	case *sendSplice:
+		return "splice"
+	default:
+		return "sendfile"
+	}
+}
+
+// writeMapped 将映射区按 copyBufferSize 分块写入 w, hasher 非 nil 时同时计算校验值
+func writeMapped(w io.Writer, data []byte, hasher hash.Hash) (int64, error) {
+	var total int64
+	for len(data) > 0 {
+		chunk := data[:min(len(data), copyBufferSize)]
+		n, err := w.Write(chunk)
+		if hasher != nil {
+			hasher.Write(chunk[:n])
+		}
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		data = data[n:]
+	}
+	return total, nil
+}
+
+// sendFileData 发送源文件 [offset, offset+length) 区间到 socket: 默认使用 sendfile, 指定 -send-splice 时使用 splice
+func sendFileData(dstFd, srcFd int, filePath string, offset, length int64, transferred *int64) (int64, error) {
+	if *sendSplice {
+		return spliceRange(dstFd, srcFd, filePath, offset, length, transferred)
+	}
+	return sendfileRange(dstFd, srcFd, filePath, offset, length, transferred)
+}
+
+// spliceRange 通过管道 splice 将源文件 [offset, offset+length) 区间发送到 socket (文件→管道→socket),
+// 与接收端的 splice 方式对称, 返回实际发送的字节数
+func spliceRange(dstFd, srcFd int, filePath string, offset, length int64, transferred *int64) (int64, error) {
+	pipeFds := make([]int, 2)
+	if err := unix.Pipe(pipeFds); err != nil {
+		return 0, fmt.Errorf("创建管道失败: %w", err)
+	}
+	defer unix.Close(pipeFds[0])
+	defer unix.Close(pipeFds[1])
+	unix.FcntlInt(uintptr(pipeFds[1]), unix.F_SETPIPE_SZ, copyBufferSize*4)
+
+	watchdog := startIOWatchdog(dstFd, transferred, *ioTimeout)
+	defer watchdog.Stop()
+	totalSent := int64(0)
+	for totalSent < length {
+		count := min(length-totalSent, copyBufferSize)
+		currentOffset := offset
+		// 从文件读取数据到管道
+		n, err := unix.Splice(srcFd, &offset, pipeFds[1], nil, int(count), unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
+		sendfileStats.splice(n)
+		txLimiter.wait(n)
+		if err != nil {
+			if errno, ok := err.(unix.Errno); ok && errno == unix.EIO {
+				return totalSent, &SendfileIOError{FilePath: filePath, Offset: currentOffset, Err: err}
+			}
+			return totalSent, fmt.Errorf("从文件到管道的 splice 在偏移量 %d 失败: %w", currentOffset, err)
+		}
+		if n == 0 {
+			return totalSent, fmt.Errorf("splice 读到文件末尾但文件未传输完成 (已发送 %d / %d)", totalSent, length)
+		}
+
+		// 从管道写入 socket, 循环直到管道排空
+		var written int64
+		for written < n {
+			w, err := unix.Splice(pipeFds[0], nil, dstFd, nil, int(n-written), unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
+			sendfileStats.splice(w)
+			if err != nil && watchdog.TimedOut() {
+				return totalSent, fmt.Errorf("splice 在偏移量 %d 处中断 (%w, %v 内无数据进展)", currentOffset, errIOTimeout, *ioTimeout)
+			}
+			if err != nil {
+				if errno, ok := err.(unix.Errno); ok && (errno == unix.EPIPE || errno == unix.ECONNRESET) {
+					logInfo("发送端检测到连接断开 (splice): %v", err)
+					return totalSent, fmt.Errorf("连接已断开: %w", err)
+				}
+				return totalSent, fmt.Errorf("从管道到 socket 的 splice 失败: %w", err)
+			}
+			if w == 0 {
+				return totalSent, fmt.Errorf("splice 写入 socket 返回 0 (已发送 %d / %d)", totalSent, length)
+			}
+			written += w
+			atomic.AddInt64(transferred, w)
+		}
+		totalSent += written
+	}
+	return totalSent, nil
+}
+
+// errVmspliceUnsupported 表示内核不支持 vmsplice, 此时还没有发送任何数据, 可以回退到标准写入
+var errVmspliceUnsupported = errors.New("vmsplice 不可用")
+
+// spliceSource 在指定了 -vmsplice 时以 vmsplice/splice 发送 /dev/zero 或来自管道的 stdin, 省去标准写入时
+// 用户态缓冲区到 socket 的复制 (需要在用户态处理数据时, 如加密, 调用方传入 false). 返回 ok=false 表示不适用 (不是 TCP 连接, stdin 不是管道,
+// 或内核不支持 vmsplice), 此时还没有发送任何数据, 由调用方回退到标准写入
+func spliceSource(conn net.Conn, isDevZero, isStdin bool, size int64, transferred *int64) (int64, bool, error) {
+	if !*vmspliceSend || !(isDevZero || isStdin) {
+		return 0, false, nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, false, nil
+	}
+	if isStdin {
+		var st unix.Stat_t
+		if err := unix.Fstat(int(os.Stdin.Fd()), &st); err != nil || st.Mode&unix.S_IFMT != unix.S_IFIFO {
+			logDebug("stdin 不是管道，-vmsplice 回退到标准写入")
+			return 0, false, nil
+		}
+	}
+	dstFile, err := tcpConn.File()
+	if err != nil {
+		logDebug("获取连接文件描述符失败 (%v)，-vmsplice 回退到标准写入", err)
+		return 0, false, nil
+	}
+	defer dstFile.Close()
+	dstFd := int(dstFile.Fd())
+
+	if isStdin {
+		logDebug("使用 splice (stdin 管道→socket) 传输 stdin 数据")
+		sent, err := spliceStdin(dstFd, size, transferred)
+		return sent, true, err
+	}
+	logDebug("使用 vmsplice (零页→管道→socket) 传输 /dev/zero 数据")
+	sent, err := vmspliceZeros(dstFd, size, transferred)
+	if errors.Is(err, errVmspliceUnsupported) {
+		logWarn("\x1b[33m警告: %v，回退到标准写入\x1b[0m", err)
+		return 0, false, nil
+	}
+	return sent, true, err
+}
+
+// vmspliceZeros 把只读的 zeroBlock 以 vmsplice 放入管道 (只引用页面, 不复制), 再 splice 到 socket.
+// zeroBlock 的内容永远不变, 因此无需等待内核释放这些页面就可以重复使用
+func vmspliceZeros(dstFd int, size int64, transferred *int64) (int64, error) {
+	pipeFds := make([]int, 2)
+	if err := unix.Pipe(pipeFds); err != nil {
+		return 0, fmt.Errorf("创建管道失败: %w", err)
+	}
+	defer unix.Close(pipeFds[0])
+	defer unix.Close(pipeFds[1])
+	unix.FcntlInt(uintptr(pipeFds[1]), unix.F_SETPIPE_SZ, copyBufferSize*4)
+
+	watchdog := startIOWatchdog(dstFd, transferred, *ioTimeout)
+	defer watchdog.Stop()
+	var total int64
+	for total < size {
+		var iov unix.Iovec
+		iov.Base = &zeroBlock[0]
+		iov.SetLen(int(min(size-total, int64(len(zeroBlock)))))
+		n, err := unix.Vmsplice(pipeFds[1], []unix.Iovec{iov}, 0)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			if total == 0 && (err == unix.ENOSYS || err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+				return 0, fmt.Errorf("%w: %v", errVmspliceUnsupported, err)
+			}
+			return total, fmt.Errorf("vmsplice 失败: %w", err)
+		}
+		// 从管道写入 socket, 循环直到管道排空
+		for written := 0; written < n; {
+			w, err := unix.Splice(pipeFds[0], nil, dstFd, nil, n-written, unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
+			sendfileStats.splice(w)
+			if err != nil && watchdog.TimedOut() {
+				return total, fmt.Errorf("splice 中断 (%w, %v 内无数据进展)", errIOTimeout, *ioTimeout)
+			}
+			if err != nil {
+				if err == unix.EPIPE || err == unix.ECONNRESET {
+					logInfo("发送端检测到连接断开 (splice): %v", err)
+					return total, fmt.Errorf("连接已断开: %w", err)
+				}
+				return total, fmt.Errorf("从管道到 socket 的 splice 失败: %w", err)
+			}
+			if w == 0 {
+				return total, fmt.Errorf("splice 写入 socket 返回 0 (已发送 %d / %d)", total, size)
+			}
+			written += int(w)
+			total += w
+			txLimiter.wait(w)
+			atomic.AddInt64(transferred, w)
+		}
+	}
+	return total, nil
+}
+
+// spliceStdin 把作为管道的 stdin 直接 splice 到 socket, 直到发送 size 字节 (大小未知时直到 EOF)
+func spliceStdin(dstFd int, size int64, transferred *int64) (int64, error) {
+	watchdog := startIOWatchdog(dstFd, transferred, *ioTimeout)
+	defer watchdog.Stop()
+	srcFd := int(os.Stdin.Fd())
+	var total int64
+	for size == unknownSize || total < size {
+		chunk := int64(copyBufferSize)
+		if size != unknownSize {
+			chunk = min(chunk, size-total)
+		}
+		n, err := unix.Splice(srcFd, nil, dstFd, nil, int(chunk), unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
+		sendfileStats.splice(n)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil && watchdog.TimedOut() {
+			return total, fmt.Errorf("splice 中断 (%w, %v 内无数据进展)", errIOTimeout, *ioTimeout)
+		}
+		if err != nil {
+			if err == unix.EPIPE || err == unix.ECONNRESET {
+				logInfo("发送端检测到连接断开 (splice): %v", err)
+				return total, fmt.Errorf("连接已断开: %w", err)
+			}
+			return total, fmt.Errorf("从 stdin 到 socket 的 splice 失败: %w", err)
+		}
+		if n == 0 {
+			break // stdin 已结束, 由调用方检查发送的字节数
+		}
+		total += n
+		txLimiter.wait(n)
+		atomic.AddInt64(transferred, n)
+	}
+	return total, nil
+}
+
+// sendfileCounters 统计 sendfile/splice 的系统调用次数和移动的字节数, 以及 sendfile 的返回值分布:
+// socket 发送缓冲区满时 sendfile 只发送一部分就返回, 短返回越多说明对端读取或链路越慢; 调用次数则用于把 profile
+// 与所选的传输方式对应起来. 只在 -log-level debug 或启用性能分析时创建, 否则 sendfileStats 为 nil,
+// 热路径上每次系统调用只多一次方法调用和指针比较
+type sendfileCounters struct {
+	calls       atomic.Int64
+	bytes       atomic.Int64
+	short       atomic.Int64     // 返回值小于请求字节数的次数
+	sizes       [64]atomic.Int64 // 按返回字节数分桶: sizes[i] 统计 [2^(i-1), 2^i) 字节的返回
+	spliceCalls atomic.Int64
+	spliceBytes atomic.Int64
+	reported    sync.Once
+}
+
+var sendfileStats *sendfileCounters
+
+// sendfile 记录一次请求 count 字节、返回 n 的 sendfile (出错时 n 为 -1, 只计调用次数)
+func (s *sendfileCounters) sendfile(n, count int) {
+	if s == nil {
+		return
+	}
+	s.calls.Add(1)
+	if n <= 0 {
+		return
+	}
+	s.bytes.Add(int64(n))
+	if n < count {
+		s.short.Add(1)
+	}
+	s.sizes[bits.Len(uint(n))].Add(1)
+}
+
+// splice 记录一次返回 n 的 splice (出错时 n 为 -1, 只计调用次数)
+func (s *sendfileCounters) splice(n int64) {
+	if s == nil {
+		return
+	}
+	s.spliceCalls.Add(1)
+	s.spliceBytes.Add(max(n, 0))
+}
+
+// report 输出 sendfile/splice 的调用次数和字节数, 以及 sendfile 返回值的分布 (-log-level debug);
+// 发送结束和停止性能分析时都会调用, 只输出一次
+func (s *sendfileCounters) report() {
+	if s == nil {
+		return
+	}
+	s.reported.Do(func() {
+		line := func(name string, calls, bytes int64) {
+			if calls > 0 {
+				logInfo("%s: %d 次系统调用, 共 %s bytes, 平均每次 %s bytes", name, calls, formatWithCommas(bytes), formatWithCommas(bytes/calls))
+			}
+		}
+		calls, short := s.calls.Load(), s.short.Load()
+		line("sendfile", calls, s.bytes.Load())
+		line("splice", s.spliceCalls.Load(), s.spliceBytes.Load())
+		if calls+s.spliceCalls.Load() == 0 {
+			logInfo("未调用 sendfile/splice (没有传输数据或使用了标准 IO 复制)")
+			return
+		}
+		if calls == 0 {
+			return
+		}
+		logDebug("sendfile 共调用 %d 次, 其中 %d 次 (%.1f%%) 返回的字节数少于请求 (socket 发送缓冲区已满, 对端或链路跟不上)",
+			calls, short, float64(short)*100/float64(calls))
+		for i := range s.sizes {
+			c := s.sizes[i].Load()
+			if c == 0 {
+				continue
+			}
+			lo, hi := int64(0), int64(1)
+			if i > 0 {
+				lo, hi = int64(1)<<(i-1), int64(1)<<i
+			}
+			logDebug("  sendfile 返回 [%s, %s) bytes: %d 次 (%.1f%%)", formatWithCommas(lo), formatWithCommas(hi), c, float64(c)*100/float64(calls))
+		}
+	})
+}
+
+// sendfileRange 使用 sendfile 将源文件 [offset, offset+length) 区间发送到 socket, 返回实际发送的字节数
+func sendfileRange(dstFd, srcFd int, filePath string, offset, length int64, transferred *int64) (int64, error) {
+	watchdog := startIOWatchdog(dstFd, transferred, *ioTimeout)
+	defer watchdog.Stop()
+	totalSent := int64(0)
+	for totalSent < length {
+		remaining := length - totalSent
+		count := int64(copyBufferSize)
+		if remaining < count {
+			count = remaining
+		}
+		currentOffset := offset
+		n, err := unix.Sendfile(dstFd, srcFd, &offset, int(count))
+		sendfileStats.sendfile(n, int(count))
+		if err != nil && watchdog.TimedOut() {
+			return totalSent, fmt.Errorf("sendfile 在偏移量 %d 处中断 (%w, %v 内无数据进展)", currentOffset, errIOTimeout, *ioTimeout)
+		}
+		if err != nil {
+			if errno, ok := err.(unix.Errno); ok && errno == unix.EIO {
+				return totalSent, &SendfileIOError{FilePath: filePath, Offset: currentOffset, Err: err}
+			}
+			if errno, ok := err.(unix.Errno); ok && (errno == unix.EPIPE || errno == unix.ECONNRESET) {
+				logInfo("发送端检测到连接断开 (sendfile): %v", err)
+				return totalSent, fmt.Errorf("连接已断开: %w", err)
+			}
+			return totalSent, fmt.Errorf("sendfile 在偏移量 %d 失败: %w", currentOffset, err)
+		}
+		if n == 0 {
+			return totalSent, fmt.Errorf("sendfile 返回 0 但文件未传输完成 (已发送 %d / %d)", totalSent, length)
+		}
+		sentBytes := int64(n)
+		txLimiter.wait(sentBytes)
+		atomic.AddInt64(transferred, sentBytes)
+		totalSent += sentBytes
+	}
+	return totalSent, nil
+}
+
+// sendChecksumOnly 只发送文件头和整个文件的校验值 (-checksum-only), 由接收端校验同名的已有文件并回复结果.
+// 校验值在发送文件头之前计算, 读取源文件失败时不会打乱连接上的数据流.
+func sendChecksumOnly(conn net.Conn, features Features, filePath, fileName string, fileSize int64, isDevZero bool) error {
+	algo, _ := checksumAlgoByName(*verify)
+	var digest []byte
+	if isDevZero {
+		h := algo.newHash()
+		hashZeros(h, fileSize)
+		digest = h.Sum(nil)
+	} else {
+		var err error
+		logInfo("计算 '%s' 的 %s 校验值...", filePath, algo.name)
+		if digest, err = fileDigest(filePath, algo); err != nil {
+			return err
+		}
+	}
+	noFields.print("info", "%s 校验值: %x  %s", algo.name, digest, fileName)
+
+	// 校验值不属于文件头, 紧跟在文件头之后作为尾部
+	header := encodeFileHeader(features, fileHeader{flags: extFlagChecksum | extFlagChecksumOnly, name: fileName, size: fileSize, algo: algo.code})
+	header = append(header, digest...)
+	setIODeadline(conn)
+	if _, err := conn.Write(header); err != nil {
+		return fmt.Errorf("发送文件头和校验值失败: %w", wrapIOTimeout(err))
+	}
+
+	reply := make([]byte, 1)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("读取接收端的校验结果失败: %w", wrapIOTimeout(err))
+	}
+	switch reply[0] {
+	case checksumOnlyMatch:
+		fileLog(fileName, -1).print("info", "\x1b[32m接收端的文件 '%s' 与源文件一致\x1b[0m", fileName)
+		runStats.record(filePath, 0, nil)
+		return nil
+	case checksumOnlyMismatch:
+		return fmt.Errorf("接收端的文件 '%s' 与源文件%w (详见接收端日志)", fileName, errChecksumMismatch)
+	default:
+		return fmt.Errorf("接收端的文件 '%s' %w", fileName, errRemoteMissing)
+	}
+}
+
+// sendParallel 将单个文件切分为 n 个连续区间, 通过 n 条 TCP 连接并行发送.
+// 每条连接发送带 extFlagRange 的扩展头, 接收端据此把数据写到文件的对应偏移处.
+func sendParallel(ctx context.Context, filePath string, connectAddr string, n int) error {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return &FileInfoError{FilePath: filePath, Err: err}
+	}
+	fileSize := fileInfo.Size()
+	fileName := fileInfo.Name()
+	if err := validateFileName(fileName); err != nil {
+		return &FileInfoError{FilePath: filePath, Err: err}
+	}
+	srcFile, err := os.Open(filePath)
+	if err != nil {
+		return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("打开源文件失败: %w", err)}
+	}
+	defer srcFile.Close()
+	srcFd := int(srcFile.Fd()) // sendfile 使用显式 offset, 多个 goroutine 共享同一 fd 是安全的
+
+	if int64(n) > fileSize {
+		n = int(max(fileSize, 1))
+	}
+	chunk := max((fileSize+int64(n)-1)/int64(n), 1)
+	n = int(max((fileSize+chunk-1)/chunk, 1)) // 向上取整后段数可能减少 (如 9 字节分 4 段), 避免出现空段
+	fileLog(filePath, fileSize).info("使用 %d 条连接并行发送文件 %s (%s bytes, 每段约 %s bytes)", n, filePath, formatWithCommas(fileSize), formatWithCommas(chunk))
+
+	var transferred int64
+	done := make(chan struct{})
+	go displayProgress(fileSize, &transferred, time.Now(), done)
+
+	errCh := make(chan error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		offset := int64(i) * chunk
+		length := min(chunk, fileSize-offset)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sendRange(ctx, connectAddr, srcFd, filePath, fileName, fileSize, fileInfo.ModTime().UnixNano(), offset, length, &transferred); err != nil {
+				errCh <- fmt.Errorf("分段 [%d, %d) 发送失败: %w", offset, offset+length, err)
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	close(errCh)
+	// 短暂休眠，允许进度显示的 goroutine 进行最后一次更新
+	time.Sleep(100 * time.Millisecond)
+
+	if err := <-errCh; err != nil {
+		return err
+	}
+	if *dropCache {
+		dropPageCache(srcFile, fileSize)
+	}
+	noFields.print("info", "发送完成，%d 条连接总共发送 %s", n, formatBytes(atomic.LoadInt64(&transferred)))
+	runStats.record(filePath, atomic.LoadInt64(&transferred), nil)
+	return nil
+}
+
+// sendRange 建立一条连接, 发送分段扩展头和文件的 [offset, offset+length) 区间
+func sendRange(ctx context.Context, connectAddr string, srcFd int, filePath, fileName string, fileSize, mtime, offset, length int64, transferred *int64) (err error) {
+	conn, err := dialWithRetry(ctx, tcpNetwork(), connectAddr)
+	if err != nil {
+		return fmt.Errorf("连接失败 %s: %w", connectAddr, err)
+	}
+	defer conn.Close()
+	stopAbort := abortOnCancel(ctx, conn)
+	defer stopAbort()
+	applySendBuffer(conn)
+	applyNoDelay(conn)
+	applyKeepAlive(conn)
+	applyUserTimeout(conn)
+	logMultipath(conn)
+	if err := writeHandshake(conn); err != nil {
+		return err
+	}
+	features, err := negotiate(conn, senderCapabilities())
+	if err != nil {
+		return err
+	}
+	if !features.Range {
+		return fmt.Errorf("接收端不支持分段传输，无法使用 -connections")
+	}
+	if features.MultiFile {
+		// 本连接只携带这一个分段, 数据之后即发送结束标记
+		defer func() {
+			if err == nil {
+				err = writeBatchEnd(conn)
+			}
+		}()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("连接不是 TCP 连接，无法使用 sendfile")
+	}
+	dstFile, err := tcpConn.File()
+	if err != nil {
+		return fmt.Errorf("获取连接文件描述符失败: %w", err)
+	}
+	defer dstFile.Close()
+
+	header := fileHeader{flags: extFlagRange, name: fileName, size: fileSize, offset: offset, length: length, xattrs: headerXattrs(features, filePath, offset == 0), mtime: mtime}
+	setIODeadline(conn)
+	if _, err := conn.Write(encodeFileHeader(features, header)); err != nil {
+		return fmt.Errorf("发送分段头失败: %w", wrapIOTimeout(err))
+	}
+
+	sent, err := sendFileData(int(dstFile.Fd()), srcFd, filePath, offset, length, transferred)
+	if err != nil {
+		return err
+	}
+	if features.Ack {
+		if err := waitAck(conn, fileName); err != nil {
+			return err
+		}
+	}
+	logDebug("\x1b[32m分段 [%d, %d) 发送完成，共 %s bytes\x1b[0m", offset, offset+length, formatWithCommas(sent))
+	return nil
+}
+
+// resumeSuffix 是 -resume 断点文件的后缀, 断点文件与源文件放在同一目录
+const resumeSuffix = ".ftgo-resume"
+
+// resumeSaveInterval 是发送过程中更新断点文件的间隔
+const resumeSaveInterval = time.Second
+
+// resumeState 是断点文件的内容. 已发送字节数只是参考, 实际续传位置以接收端 .part 文件的大小为准
+// (发送端被杀死时, 已写入 socket 的数据不一定都到达了接收端).
+type resumeState struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	BytesSent int64  `json:"bytes_sent"`
+	Addr      string `json:"addr"`
+}
+
+// loadResumeState 读取断点文件, 文件不存在时返回 nil
+func loadResumeState(statePath string) (*resumeState, error) {
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var st resumeState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("解析断点文件 '%s' 失败: %w", statePath, err)
+	}
+	return &st, nil
+}
+
+// save 先写临时文件再改名, 保证进程在任何时刻被杀死时断点文件都是完整的
+func (st *resumeState) save(statePath string) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	tmp := statePath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
+// sendResumable 以断点续传方式发送单个常规文件 (-resume): 发送续传请求, 由接收端根据已有的 .part
+// 回复续传位置, 再从该位置发送剩余数据. 发送过程中定期把进度写入断点文件, 成功后删除断点文件.
+// 没有与本次传输匹配的断点文件时要求接收端从头开始, 避免拼接上一次不相关传输留下的 .part;
+// 只有 retry 模式传入了 failed_files.log 记录的偏移量 lastOffset 时例外. sentOffset 非 nil 时在返回前写入已发送到的文件偏移量.
+func sendResumable(conn net.Conn, features Features, filePath, connectAddr string, lastOffset int64, sentOffset *int64) (err error) {
+	if !features.Resume {
+		return fmt.Errorf("接收端不支持断点续传，无法使用 -resume")
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return &FileInfoError{FilePath: filePath, Err: err}
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("-resume 只支持常规文件")}
+	}
+	fileSize := fileInfo.Size()
+	fileName := fileInfo.Name()
+	if err := validateFileName(fileName); err != nil {
+		return &FileInfoError{FilePath: filePath, Err: err}
+	}
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return &FileInfoError{FilePath: filePath, Err: err}
+	}
+	srcFile, err := os.Open(filePath)
+	if err != nil {
+		return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("打开源文件失败: %w", err)}
+	}
+	defer srcFile.Close()
+
+	statePath := filePath + resumeSuffix
+	saved, err := loadResumeState(statePath)
+	if err != nil {
+		logWarn("\x1b[33m警告: %v，将从头开始发送\x1b[0m", err)
+	}
+	restart := true
+	if saved != nil {
+		if saved.Path == absPath && saved.Size == fileSize && saved.Addr == connectAddr {
+			restart = false
+			logInfo("断点文件 '%s': 上次已发送 %s / %s bytes, 与接收端协商续传位置", statePath, formatWithCommas(saved.BytesSent), formatWithCommas(fileSize))
+		} else {
+			logWarn("\x1b[33m警告: 断点文件 '%s' 与本次传输不符 (文件、大小或接收端不同)，将从头开始发送\x1b[0m", statePath)
+		}
+	} else if lastOffset > 0 {
+		restart = false
+		fileLog(filePath, lastOffset).info("'%s' 上次失败时已发送 %s bytes，请求接收端续传", filePath, formatWithCommas(lastOffset))
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return fmt.Errorf("连接不是 TCP 连接，-resume 只支持 TCP")
+	}
+	dstFile, err := tcpConn.File()
+	if err != nil {
+		return fmt.Errorf("获取连接文件描述符失败: %w", err)
+	}
+	defer dstFile.Close()
+
+	header := fileHeader{flags2: ext2Resume, name: fileName, size: fileSize, restart: restart, xattrs: headerXattrs(features, filePath, true), mtime: fileInfo.ModTime().UnixNano()}
+	setIODeadline(conn)
+	if _, err := conn.Write(encodeFileHeader(features, header)); err != nil {
+		return fmt.Errorf("发送续传请求失败: %w", wrapIOTimeout(err))
+	}
+	reply := make([]byte, 8)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("读取续传位置失败: %w", wrapIOTimeout(err))
+	}
+	if binary.BigEndian.Uint64(reply) == resumeRefused {
+		return fmt.Errorf("接收端拒绝了 '%s' 的续传请求 (原因见接收端日志)", fileName)
+	}
+	offset := int64(binary.BigEndian.Uint64(reply))
+	if offset < 0 || offset > fileSize {
+		return fmt.Errorf("接收端回复的续传位置 %d 无效 (文件大小 %d)", offset, fileSize)
+	}
+	if offset > 0 {
+		fileLog(filePath, fileSize-offset).info("从偏移量 %s bytes 继续发送 '%s' (剩余 %s bytes)", formatWithCommas(offset), filePath, formatWithCommas(fileSize-offset))
+	}
+
+	state := &resumeState{Path: absPath, Size: fileSize, BytesSent: offset, Addr: connectAddr}
+	if err := state.save(statePath); err != nil {
+		return fmt.Errorf("写入断点文件 '%s' 失败: %w", statePath, err)
+	}
+	var transferred int64
+	done := make(chan struct{})
+	go displayProgress(fileSize-offset, &transferred, time.Now(), done)
+	stopSave := make(chan struct{})
+	saverDone := make(chan struct{})
+	go func() {
+		defer close(saverDone)
+		ticker := time.NewTicker(resumeSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopSave:
+				return
+			case <-ticker.C:
+				state.BytesSent = offset + atomic.LoadInt64(&transferred)
+				if err := state.save(statePath); err != nil {
+					logDebug("更新断点文件 '%s' 失败: %v", statePath, err)
+				}
+			}
+		}
+	}()
+	defer func() {
+		close(stopSave)
+		<-saverDone
+		close(done)
+		// 短暂休眠，允许进度显示的 goroutine 进行最后一次更新
+		time.Sleep(100 * time.Millisecond)
+		if sentOffset != nil {
+			*sentOffset = offset + atomic.LoadInt64(&transferred)
+		}
+		if err != nil {
+			state.BytesSent = offset + atomic.LoadInt64(&transferred)
+			if saveErr := state.save(statePath); saveErr != nil {
+				logWarn("\x1b[33m警告: 更新断点文件 '%s' 失败: %v\x1b[0m", statePath, saveErr)
+			} else {
+				logInfo("已将进度保存到断点文件 '%s'，可使用 -resume 重新运行以继续发送", statePath)
+			}
+		} else if rmErr := os.Remove(statePath); rmErr != nil {
+			logWarn("\x1b[33m警告: 删除断点文件 '%s' 失败: %v\x1b[0m", statePath, rmErr)
+		}
+	}()
+
+	sent, err := sendFileData(int(dstFile.Fd()), int(srcFile.Fd()), filePath, offset, fileSize-offset, &transferred)
+	if err != nil {
+		return err
+	}
+	if features.Ack {
+		if err := waitAck(conn, fileName); err != nil {
+			return err
+		}
+	}
+	if *dropCache {
+		dropPageCache(srcFile, fileSize)
+	}
+	noFields.print("info", "发送完成，本次发送 %s (续传位置 %s, 文件大小 %s)", formatBytes(sent), formatBytes(offset), formatBytes(fileSize))
+	runStats.record(filePath, sent, nil)
+	return nil
+}
+
+// deltaSignature 是增量传输时接收端已有文件的块签名
+type deltaSignature struct {
+	blockSize int
+	basisSize int64
+	weak      []uint32
+	strong    [][md5.Size]byte
+	index     map[uint32][]uint32 // 弱校验 -> 块编号
+}
+
+// lastLen 返回最后一块的长度 (可能不足 blockSize)
+func (s *deltaSignature) lastLen() int {
+	if len(s.weak) == 0 {
+		return 0
+	}
+	return s.blockLen(uint32(len(s.weak) - 1))
+}
+
+// blockLen 返回第 i 块的长度
+func (s *deltaSignature) blockLen(i uint32) int {
+	return int(min(int64(s.blockSize), s.basisSize-int64(i)*int64(s.blockSize)))
+}
+
+// find 在签名中查找与 data 相同的块: 先比较弱校验, 再比较 MD5. 有多个相同的块时优先返回 prefer,
+// 使连续的块可以合并为一条复制指令
+func (s *deltaSignature) find(weak uint32, data []byte, prefer uint32) (uint32, bool) {
+	candidates := s.index[weak]
+	if len(candidates) == 0 {
+		return 0, false
+	}
+	sum := md5.Sum(data)
+	found, ok := uint32(0), false
+	for _, i := range candidates {
+		if s.blockLen(i) != len(data) || s.strong[i] != sum {
+			continue
+		}
+		if i == prefer {
+			return i, true
+		}
+		if !ok {
+			found, ok = i, true
+		}
+	}
+	return found, ok
+}
+
+// deltaBlockSize 按已有文件的大小选择块大小: 约为大小的平方根 (2 的幂), 限制在 2K 到 128K 之间,
+// 块数和签名大小随文件大小缓慢增长
+func deltaBlockSize(basisSize int64) int {
+	bs := 2048
+	for bs < 128<<10 && int64(bs)*int64(bs) < basisSize {
+		bs *= 2
+	}
+	return bs
+}
+
+// rollingChecksum 计算 rsync 式的滚动弱校验 (类似 Adler-32): a 为字节之和, b 为加权和, 各取低 16 位
+func rollingChecksum(data []byte) (a, b uint32) {
+	n := uint32(len(data))
+	for i, c := range data {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a, b
+}
+
+// weakSum 把滚动校验的两部分组合为 4 字节弱校验
+func weakSum(a, b uint32) uint32 {
+	return a&0xffff | (b&0xffff)<<16
+}
+
+// writeDeltaSignature 计算并回复接收端已有文件 basis 的块签名; basis 为 nil (文件不存在) 时回复空签名,
+// 发送端将全部以字面数据发送
+func writeDeltaSignature(conn net.Conn, basis *os.File) (*deltaSignature, error) {
+	sig := &deltaSignature{}
+	if basis != nil {
+		fi, err := basis.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("读取已有文件信息失败: %w", err)
+		}
+		sig.basisSize = fi.Size()
+	}
+	sig.blockSize = deltaBlockSize(sig.basisSize)
+	count := (sig.basisSize + int64(sig.blockSize) - 1) / int64(sig.blockSize)
+	w := bufio.NewWriterSize(conn, copyBufferSize)
+	header := binary.BigEndian.AppendUint32(nil, uint32(sig.blockSize))
+	header = binary.BigEndian.AppendUint32(header, uint32(count))
+	header = binary.BigEndian.AppendUint64(header, uint64(sig.basisSize))
+	setIODeadline(conn)
+	w.Write(header)
+	buf := make([]byte, sig.blockSize)
+	entry := make([]byte, 4+md5.Size)
+	for i := int64(0); i < count; i++ {
+		n, err := io.ReadFull(basis, buf)
+		if err != nil && !(err == io.ErrUnexpectedEOF && i == count-1) {
+			return nil, fmt.Errorf("读取已有文件计算块签名失败: %w", err)
+		}
+		a, b := rollingChecksum(buf[:n])
+		sum := md5.Sum(buf[:n])
+		sig.weak = append(sig.weak, weakSum(a, b))
+		sig.strong = append(sig.strong, sum)
+		binary.BigEndian.PutUint32(entry, weakSum(a, b))
+		copy(entry[4:], sum[:])
+		setIODeadline(conn)
+		if _, err := w.Write(entry); err != nil {
+			return nil, fmt.Errorf("发送块签名失败: %w", wrapIOTimeout(err))
+		}
+	}
+	setIODeadline(conn)
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("发送块签名失败: %w", wrapIOTimeout(err))
+	}
+	return sig, nil
+}
+
+// readDeltaSignature 读取接收端回复的块签名
+func readDeltaSignature(conn net.Conn, fileName string) (*deltaSignature, error) {
+	header := make([]byte, 16)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("读取块签名失败: %w", wrapIOTimeout(err))
+	}
+	blockSize := binary.BigEndian.Uint32(header)
+	if blockSize == deltaRefused {
+		return nil, fmt.Errorf("接收端拒绝了 '%s' 的增量传输 (原因见接收端日志)", fileName)
+	}
+	count := binary.BigEndian.Uint32(header[4:])
+	basisSize := int64(binary.BigEndian.Uint64(header[8:]))
+	if blockSize == 0 || blockSize > 1<<24 || basisSize < 0 || (basisSize+int64(blockSize)-1)/int64(blockSize) != int64(count) {
+		return nil, fmt.Errorf("接收端回复的块签名无效: 块大小 %d, 块数 %d, 文件大小 %d", blockSize, count, basisSize)
+	}
+	sig := &deltaSignature{
+		blockSize: int(blockSize),
+		basisSize: basisSize,
+		weak:      make([]uint32, count),
+		strong:    make([][md5.Size]byte, count),
+		index:     make(map[uint32][]uint32, count),
+	}
+	r := bufio.NewReaderSize(conn, copyBufferSize) // 签名之后接收端不会再发送数据 (除 -ack 的确认), 预读是安全的
+	entry := make([]byte, 4+md5.Size)
+	for i := range sig.weak {
+		setIODeadline(conn)
+		if _, err := io.ReadFull(r, entry); err != nil {
+			return nil, fmt.Errorf("读取块签名失败: %w", wrapIOTimeout(err))
+		}
+		sig.weak[i] = binary.BigEndian.Uint32(entry)
+		copy(sig.strong[i][:], entry[4:])
+		sig.index[sig.weak[i]] = append(sig.index[sig.weak[i]], uint32(i))
+	}
+	return sig, nil
+}
+
+// deltaEncoder 把增量传输的指令写入连接, 连续的块引用合并为一条复制指令
+type deltaEncoder struct {
+	conn      net.Conn
+	w         *bufio.Writer
+	copyStart uint32 // 尚未发出的复制指令
+	copyCount uint32
+	literal   int64 // 已发送的字面数据字节数
+	reused    int64 // 引用已有文件的字节数
+}
+
+func (e *deltaEncoder) op(code byte, a, b uint32) error {
+	buf := []byte{code}
+	buf = binary.BigEndian.AppendUint32(buf, a)
+	buf = binary.BigEndian.AppendUint32(buf, b)
+	setIODeadline(e.conn)
+	if _, err := e.w.Write(buf); err != nil {
+		return fmt.Errorf("发送增量指令失败: %w", wrapIOTimeout(err))
+	}
+	return nil
+}
+
+func (e *deltaEncoder) flushCopy() error {
+	if e.copyCount == 0 {
+		return nil
+	}
+	err := e.op(deltaOpCopy, e.copyStart, e.copyCount)
+	e.copyCount = 0
+	return err
+}
+
+// copyBlock 引用已有文件的第 idx 块 (长度为 n)
+func (e *deltaEncoder) copyBlock(idx uint32, n int) error {
+	e.reused += int64(n)
+	if e.copyCount > 0 && e.copyStart+e.copyCount == idx {
+		e.copyCount++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyStart, e.copyCount = idx, 1
+	return nil
+}
+
+// literalData 发送字面数据, 超过 deltaMaxLiteral 时拆分为多条指令
+func (e *deltaEncoder) literalData(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	for len(p) > 0 {
+		n := min(len(p), deltaMaxLiteral)
+		if err := e.op(deltaOpLiteral, uint32(n), 0); err != nil {
+			return err
+		}
+		txLimiter.wait(int64(n))
+		setIODeadline(e.conn)
+		if _, err := e.w.Write(p[:n]); err != nil {
+			return fmt.Errorf("发送增量数据失败: %w", wrapIOTimeout(err))
+		}
+		e.literal += int64(n)
+		p = p[n:]
+	}
+	return nil
+}
+
+// deltaScan 顺序读取新文件, 用滚动弱校验逐字节查找与已有文件相同的块: 找到时发送块引用并跳过整块,
+// 找不到时窗口后移一个字节, 移出窗口的字节成为字面数据. transferred 累计已读取的新文件字节数.
+func deltaScan(src io.Reader, sig *deltaSignature, enc *deltaEncoder, h hash.Hash, transferred *int64) error {
+	bs := sig.blockSize
+	buf := make([]byte, 0, deltaMaxLiteral+4*bs)
+	litStart, pos := 0, 0 // buf[litStart:pos] 为尚未发送的字面数据, buf[pos:pos+bs] 为当前窗口
+	var a, b uint32
+	rolling := false // a, b 是否为当前窗口的滚动校验
+	eof := false
+	for {
+		if len(buf)-pos <= bs && !eof {
+			// 窗口之后的数据不足时读取更多数据, 先丢弃已发送的部分
+			if litStart > 0 {
+				n := copy(buf, buf[litStart:])
+				buf = buf[:n]
+				pos -= litStart
+				litStart = 0
+			}
+			n, err := src.Read(buf[len(buf):cap(buf)])
+			if n > 0 {
+				h.Write(buf[len(buf) : len(buf)+n])
+				buf = buf[:len(buf)+n]
+				atomic.AddInt64(transferred, int64(n))
+			}
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return fmt.Errorf("读取源文件失败: %w", err)
+			}
+			continue
+		}
+		avail := len(buf) - pos
+		if avail < bs {
+			// 文件末尾不足一块: 只可能与已有文件的最后一块 (长度相同时) 相同
+			if avail > 0 && avail == sig.lastLen() {
+				ta, tb := rollingChecksum(buf[pos:])
+				if idx, ok := sig.find(weakSum(ta, tb), buf[pos:], uint32(len(sig.weak)-1)); ok {
+					if err := enc.literalData(buf[litStart:pos]); err != nil {
+						return err
+					}
+					return enc.copyBlock(idx, avail)
+				}
+			}
+			return enc.literalData(buf[litStart:])
+		}
+		if !rolling {
+			a, b = rollingChecksum(buf[pos : pos+bs])
+			rolling = true
+		}
+		if idx, ok := sig.find(weakSum(a, b), buf[pos:pos+bs], enc.copyStart+enc.copyCount); ok {
+			if err := enc.literalData(buf[litStart:pos]); err != nil {
+				return err
+			}
+			if err := enc.copyBlock(idx, bs); err != nil {
+				return err
+			}
+			pos += bs
+			litStart = pos
+			rolling = false
+			continue
+		}
+		// 窗口后移一个字节
+		if avail > bs {
+			out, in := uint32(buf[pos]), uint32(buf[pos+bs])
+			a = a - out + in
+			b = b - uint32(bs)*out + a
+		} else {
+			rolling = false
+		}
+		pos++
+		if pos-litStart >= deltaMaxLiteral {
+			if err := enc.literalData(buf[litStart:pos]); err != nil {
+				return err
+			}
+			litStart = pos
+		}
+	}
+}
+
+// sendDelta 以增量方式发送常规文件 (-delta): 接收端回复其同名已有文件的块签名, 发送端在新文件中查找相同的块,
+// 只发送变化的字面数据和对已有块的引用, 最后附带整个新文件的 MD5 供接收端校验重建结果.
+func sendDelta(conn net.Conn, features Features, filePath string) error {
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return &FileInfoError{FilePath: filePath, Err: err}
+	}
+	if !fileInfo.Mode().IsRegular() {
+		return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("-delta 只支持常规文件")}
+	}
+	fileSize := fileInfo.Size()
+	fileName := fileInfo.Name()
+	if err := validateFileName(fileName); err != nil {
+		return &FileInfoError{FilePath: filePath, Err: err}
+	}
+	srcFile, err := os.Open(filePath)
+	if err != nil {
+		return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("打开源文件失败: %w", err)}
+	}
+	defer srcFile.Close()
+
+	header := fileHeader{flags2: ext2Delta, name: fileName, size: fileSize, xattrs: headerXattrs(features, filePath, true), mtime: fileInfo.ModTime().UnixNano()}
+	setIODeadline(conn)
+	if _, err := conn.Write(encodeFileHeader(features, header)); err != nil {
+		return fmt.Errorf("发送增量传输请求失败: %w", wrapIOTimeout(err))
+	}
+	sig, err := readDeltaSignature(conn, fileName)
+	if err != nil {
+		return err
+	}
+	logDebug("接收端已有文件 %s bytes, %d 块 (块大小 %d)", formatWithCommas(sig.basisSize), len(sig.weak), sig.blockSize)
+
+	var transferred int64
+	startTime := time.Now()
+	done := make(chan struct{})
+	go displayProgress(fileSize, &transferred, startTime, done)
+	enc := &deltaEncoder{conn: conn, w: bufio.NewWriterSize(conn, copyBufferSize)}
+	h := md5.New()
+	err = deltaScan(srcFile, sig, enc, h, &transferred)
+	if err == nil {
+		err = enc.flushCopy()
+	}
+	if err == nil {
+		err = enc.op(deltaOpEnd, 0, 0)
+	}
+	if err == nil {
+		setIODeadline(conn)
+		enc.w.Write(h.Sum(nil))
+		if err = enc.w.Flush(); err != nil {
+			err = fmt.Errorf("发送增量数据失败: %w", wrapIOTimeout(err))
+		}
+	}
+	close(done)
+	// 短暂休眠，允许进度显示的 goroutine 进行最后一次更新
+	time.Sleep(100 * time.Millisecond)
+	if err != nil {
+		return err
+	}
+	if read := atomic.LoadInt64(&transferred); read != fileSize {
+		return &FileInfoError{FilePath: filePath, Err: fmt.Errorf("发送过程中文件大小发生变化 (%d -> %d)", fileSize, read)}
+	}
+	if features.Ack {
+		if err := waitAck(conn, fileName); err != nil {
+			return err
+		}
+	}
+	if *dropCache {
+		dropPageCache(srcFile, fileSize)
+	}
+	fileLog(filePath, enc.literal).print("info", "增量发送完成，文件 %s: 复用接收端已有数据 %s，发送新数据 %s",
+		formatBytes(fileSize), formatBytes(enc.reused), formatBytes(enc.literal))
+	runStats.record(filePath, enc.literal, nil)
+	return nil
+}
+
+// applyDelta 读取发送端的增量指令, 用字面数据和已有文件 basis 中的块重建新文件并写入 dst,
+// 最后比对整个新文件的 MD5. 返回写入的字节数和其中引用已有文件的字节数.
+func applyDelta(conn net.Conn, dst io.Writer, basis *os.File, sig *deltaSignature, size int64, counter *int64, targetPath string) (int64, int64, error) {
+	h := md5.New()
+	out := io.MultiWriter(dst, h)
+	var written, reused int64
+	op := make([]byte, 9)
+	buf := make([]byte, copyBufferSize)
+	for {
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, op); err != nil {
+			return written, reused, fmt.Errorf("读取增量指令失败: %w", wrapIOTimeout(err))
+		}
+		a, b := binary.BigEndian.Uint32(op[1:5]), binary.BigEndian.Uint32(op[5:9])
+		switch op[0] {
+		case deltaOpLiteral:
+			if a == 0 || a > deltaMaxLiteral || written+int64(a) > size {
+				return written, reused, fmt.Errorf("无效的增量指令: 字面数据 %d 字节 (已写入 %d / %d)", a, written, size)
+			}
+			n, err := copyToFile(conn, out, int64(a), counter, targetPath)
+			written += n
+			if err != nil {
+				return written, reused, err
+			}
+		case deltaOpCopy:
+			start := int64(a) * int64(sig.blockSize)
+			if basis == nil || b == 0 || int64(a)+int64(b) > int64(len(sig.weak)) {
+				return written, reused, fmt.Errorf("无效的增量指令: 复制第 %d 块起的 %d 块 (已有文件共 %d 块)", a, b, len(sig.weak))
+			}
+			length := min(int64(b)*int64(sig.blockSize), sig.basisSize-start)
+			if written+length > size {
+				return written, reused, fmt.Errorf("无效的增量指令: 重建的数据超过文件大小 %d", size)
+			}
+			for off := start; off < start+length; {
+				n := int(min(int64(len(buf)), start+length-off))
+				if _, err := basis.ReadAt(buf[:n], off); err != nil {
+					return written, reused, fmt.Errorf("读取已有文件失败: %w", err)
+				}
+				if _, err := out.Write(buf[:n]); err != nil {
+					return written, reused, fmt.Errorf("写入文件 '%s' 失败: %w", targetPath, err)
+				}
+				off += int64(n)
+				atomic.AddInt64(counter, int64(n))
+			}
+			written += length
+			reused += length
+		case deltaOpEnd:
+			sum := make([]byte, md5.Size)
+			setIODeadline(conn)
+			if _, err := io.ReadFull(conn, sum); err != nil {
+				return written, reused, fmt.Errorf("读取增量传输的 MD5 失败: %w", wrapIOTimeout(err))
+			}
+			if written != size {
+				return written, reused, fmt.Errorf("重建的文件大小 (%d) 与预期大小 (%d) 不符", written, size)
+			}
+			if local := h.Sum(nil); !bytes.Equal(local, sum) {
+				return written, reused, fmt.Errorf("重建的文件%w (MD5 本端 %x, 发送端 %x)", errChecksumMismatch, local, sum)
+			}
+			return written, reused, nil
+		default:
+			return written, reused, fmt.Errorf("未知的增量指令: %d", op[0])
+		}
+	}
+}
+
+// senderCapabilities 返回发送端在能力协商中提供的能力: 只有指定了 -ack 才要求接收端逐个文件确认
+func senderCapabilities() uint32 {
+	if *ackMode {
+		return localCapabilities
+	}
+	return localCapabilities &^ capAck
+}
+
+// waitAck 等待接收端对刚发送完的文件的确认 (capAck), 接收端在数据落盘后才会回复
+func waitAck(conn net.Conn, fileName string) error {
+	buf := make([]byte, 1)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("等待接收端确认文件 '%s' 失败: %w", fileName, wrapIOTimeout(err))
+	}
+	if buf[0] != ackOK {
+		return fmt.Errorf("文件 '%s' %w", fileName, errRemoteNack)
+	}
+	fileLog(fileName, -1).debug("\x1b[32m接收端已确认文件 '%s'\x1b[0m", fileName)
+	return nil
+}
+
+// writeHandshake 发送魔数和协议版本
+func writeHandshake(conn net.Conn) error {
+	setIODeadline(conn)
+	if _, err := conn.Write(append([]byte(protocolMagic), protocolVersion)); err != nil {
+		return fmt.Errorf("发送协议握手失败: %w", wrapIOTimeout(err))
+	}
+	return nil
+}
+
+// readHandshake 读取并校验魔数和协议版本, 拒绝非 ftgo 连接和版本不一致的发送端
+func readHandshake(conn net.Conn) error {
+	buf := make([]byte, len(protocolMagic)+1)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("读取协议握手失败: %w", wrapIOTimeout(err))
+	}
+	if string(buf[:len(protocolMagic)]) != protocolMagic {
+		return fmt.Errorf("不是 ftgo 连接: 魔数为 %q (期望 %q)", buf[:len(protocolMagic)], protocolMagic)
+	}
+	if version := buf[len(protocolMagic)]; version != protocolVersion {
+		return fmt.Errorf("协议版本不兼容: 发送端版本 %d, 接收端版本 %d (请两端使用相同版本的 ftgo)", version, protocolVersion)
+	}
+	return nil
+}
+
+// Features 是握手时双方协商一致的功能集合
+type Features struct {
+	Range        bool // 分段传输 (-connections)
+	Sparse       bool // 稀疏文件 (-sparse)
+	Checksum     bool // 校验 (-verify)
+	MultiFile    bool // 单连接多文件 (-filelist)
+	DryRun       bool // 只发送文件头 (-dry-run)
+	Encrypt      bool // 预共享密钥加密 (-psk)
+	Bench        bool // 往返吞吐量测试 (-mode bench)
+	ChecksumOnly bool // 只校验已有文件 (-checksum-only)
+	Manifest     bool // 批量清单 (-filelist)
+	Resume       bool // 断点续传 (-resume)
+	Ack          bool // 逐个文件确认 (-ack)
+	Delta        bool // 增量传输 (-delta)
+	Dedupe       bool // 跳过接收端已有的相同文件 (-dedupe)
+	Compress     bool // 压缩 (-compress)
+	HeaderTLV    bool // TLV 文件头 (headerBlockMarker)
+	Framed       bool // 分帧校验 (-framed)
+	BatchRoot    bool // 整批根校验值 (-verify 时的单连接多文件)
+}
+
+// intersect 返回两组功能的交集, 用于一对多发送时只启用所有接收端都支持的功能
+func (f Features) intersect(g Features) Features {
+	return Features{
+		Range:        f.Range && g.Range,
+		Sparse:       f.Sparse && g.Sparse,
+		Checksum:     f.Checksum && g.Checksum,
+		MultiFile:    f.MultiFile && g.MultiFile,
+		DryRun:       f.DryRun && g.DryRun,
+		Encrypt:      f.Encrypt && g.Encrypt,
+		Bench:        f.Bench && g.Bench,
+		ChecksumOnly: f.ChecksumOnly && g.ChecksumOnly,
+		Manifest:     f.Manifest && g.Manifest,
+		Resume:       f.Resume && g.Resume,
+		Ack:          f.Ack && g.Ack,
+		Delta:        f.Delta && g.Delta,
+		Dedupe:       f.Dedupe && g.Dedupe,
+		Compress:     f.Compress && g.Compress,
+		HeaderTLV:    f.HeaderTLV && g.HeaderTLV,
+		Framed:       f.Framed && g.Framed,
+		BatchRoot:    f.BatchRoot && g.BatchRoot,
+	}
+}
+
+// caps 返回功能集合对应的能力位掩码
+func (f Features) caps() uint32 {
+	var caps uint32
+	if f.Range {
+		caps |= capRange
+	}
+	if f.Sparse {
+		caps |= capSparse
+	}
+	if f.Checksum {
+		caps |= capChecksum
+	}
+	if f.MultiFile {
+		caps |= capMultiFile
+	}
+	if f.DryRun {
+		caps |= capDryRun
+	}
+	if f.Encrypt {
+		caps |= capEncrypt
+	}
+	if f.Bench {
+		caps |= capBench
+	}
+	if f.ChecksumOnly {
+		caps |= capChecksumOnly
+	}
+	if f.Manifest {
+		caps |= capManifest
+	}
+	if f.Resume {
+		caps |= capResume
+	}
+	if f.Ack {
+		caps |= capAck
+	}
+	if f.Delta {
+		caps |= capDelta
+	}
+	if f.Dedupe {
+		caps |= capDedupe
+	}
+	if f.Compress {
+		caps |= capCompress
+	}
+	if f.HeaderTLV {
+		caps |= capHeaderTLV
+	}
+	if f.Framed {
+		caps |= capFramed
+	}
+	if f.BatchRoot {
+		caps |= capBatchRoot
+	}
+	return caps
+}
+
+// extFlags 返回协商后允许出现在扩展头中的标志位
+func (f Features) extFlags() byte {
+	var flags byte
+	if f.Range {
+		flags |= extFlagRange
+	}
+	if f.Sparse {
+		flags |= extFlagSparse
+	}
+	if f.Checksum {
+		flags |= extFlagChecksum
+	}
+	if f.DryRun {
+		flags |= extFlagDryRun
+	}
+	if f.Encrypt {
+		flags |= extFlagEncrypt
+	}
+	if f.Bench {
+		flags |= extFlagBench
+	}
+	if f.ChecksumOnly {
+		flags |= extFlagChecksumOnly
+	}
+	if f.Manifest {
+		flags |= extFlagManifest
+	}
+	return flags
+}
+
+// ext2Flags 返回协商后允许出现在第二标志字节中的标志位
+func (f Features) ext2Flags() byte {
+	var flags byte
+	if f.Compress {
+		flags |= ext2Compress
+	}
+	if f.Framed {
+		flags |= ext2Framed
+	}
+	if f.Resume {
+		flags |= ext2Resume
+	}
+	if f.Delta {
+		flags |= ext2Delta
+	}
+	if f.Dedupe {
+		flags |= ext2Dedupe
+	}
+	return flags
+}
+
+// negotiate 在握手之后与对端交换能力位掩码, 返回双方都支持的功能. local 通常为 localCapabilities,
+// relay 模式下为与下一跳协商的结果. 两端都是先写后读, 因此发送端和接收端可以使用同一个函数.
+func negotiate(conn net.Conn, local uint32) (Features, error) {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, local)
+	setIODeadline(conn)
+	if _, err := conn.Write(buf); err != nil {
+		return Features{}, fmt.Errorf("发送能力协商失败: %w", wrapIOTimeout(err))
+	}
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return Features{}, fmt.Errorf("读取能力协商失败: %w", wrapIOTimeout(err))
+	}
+	peer := binary.BigEndian.Uint32(buf)
+	agreed := peer & local
+	logDebug("能力协商: 本端 %#x, 对端 %#x, 协商结果 %#x", local, peer, agreed)
+	return Features{
+		Range:        agreed&capRange != 0,
+		Sparse:       agreed&capSparse != 0,
+		Checksum:     agreed&capChecksum != 0,
+		MultiFile:    agreed&capMultiFile != 0,
+		DryRun:       agreed&capDryRun != 0,
+		Encrypt:      agreed&capEncrypt != 0,
+		Bench:        agreed&capBench != 0,
+		ChecksumOnly: agreed&capChecksumOnly != 0,
+		Manifest:     agreed&capManifest != 0,
+		Resume:       agreed&capResume != 0,
+		Ack:          agreed&capAck != 0,
+		Delta:        agreed&capDelta != 0,
+		Dedupe:       agreed&capDedupe != 0,
+		Compress:     agreed&capCompress != 0,
+		HeaderTLV:    agreed&capHeaderTLV != 0,
+		Framed:       agreed&capFramed != 0,
+		BatchRoot:    agreed&capBatchRoot != 0,
+	}, nil
+}
+
+// writeBatchEnd 发送单连接多文件的结束标记 (文件名长度为 0), 告知接收端本连接不再有后续文件
+func writeBatchEnd(conn net.Conn) error {
+	setIODeadline(conn)
+	if _, err := conn.Write([]byte{0, 0}); err != nil {
+		return fmt.Errorf("发送结束标记失败: %w", wrapIOTimeout(err))
+	}
+	return nil
+}
+
+// TLV 文件头的字段类型, 值的格式与旧格式中对应的字段相同
+const (
+	hdrTagFlags    = 1  // extFlag* 标志位 (1)
+	hdrTagFlags2   = 2  // ext2* 标志位 (1): 压缩、分帧、续传、增量和去重各占一位
+	hdrTagName     = 3  // 文件名
+	hdrTagSize     = 4  // 文件大小 (8), 批量清单中为总字节数
+	hdrTagFiles    = 5  // 批量清单的文件数 (4)
+	hdrTagRestart  = 6  // 续传时是否丢弃已有的 .part (1)
+	hdrTagRange    = 7  // 分段 offset(8) + length(8)
+	hdrTagExtents  = 8  // 稀疏文件的区段表 (见 encodeExtents)
+	hdrTagChecksum = 9  // 校验算法编号 (1)
+	hdrTagSalt     = 10 // 加密盐
+	hdrTagCompress = 11 // 压缩算法编号 (1)
+	hdrTagDigest   = 12 // 去重时发送端附带的校验值
+	hdrTagXattrs   = 13 // 扩展属性 (见 encodeXattrs), 旧格式中没有对应字段
+	hdrTagMtime    = 14 // 发送端文件的修改时间 (8, Unix 纳秒), 旧格式中没有对应字段
+)
+
+// fileHeader 是一个文件头的全部字段, 可以编码为 TLV 格式 (encodeHeader) 或旧格式 (encodeLegacyHeader),
+// 接收端分别由 decodeHeader 和 readLegacyHeader 解析
+type fileHeader struct {
+	flags    byte // extFlag* 标志位
+	flags2   byte // ext2* 标志位, 非 0 时旧格式使用 ext2HeaderMarker
+	name     string
+	size     int64
+	files    uint32 // 批量清单的文件数
+	restart  bool
+	offset   int64 // 分段
+	length   int64
+	extents  []extent
+	algo     byte // 校验算法编号
+	salt     []byte
+	compress byte // 压缩算法编号
+	digest   []byte
+	xattrs   []xattr // 仅 TLV 格式
+	mtime    int64   // 修改时间 (Unix 纳秒), 0 表示未提供; 仅 TLV 格式
+}
+
+// encodeHeader 把文件头编码为 TLV 块: [headerBlockMarker][块长度 u32][版本 u8] + 字段,
+// 只写入该文件头实际带有的字段
+func encodeHeader(h fileHeader) []byte {
+	block := []byte{headerVersion}
+	put := func(tag byte, value []byte) {
+		block = append(block, tag)
+		block = binary.BigEndian.AppendUint32(block, uint32(len(value)))
+		block = append(block, value...)
+	}
+	if h.flags != 0 {
+		put(hdrTagFlags, []byte{h.flags})
+	}
+	if h.flags2 != 0 {
+		put(hdrTagFlags2, []byte{h.flags2})
+	}
+	put(hdrTagName, []byte(h.name))
+	put(hdrTagSize, binary.BigEndian.AppendUint64(nil, uint64(h.size)))
+	if h.flags == extFlagManifest {
+		put(hdrTagFiles, binary.BigEndian.AppendUint32(nil, h.files))
+	}
+	if h.flags2&ext2Resume != 0 {
+		restart := byte(0)
+		if h.restart {
+			restart = 1
+		}
+		put(hdrTagRestart, []byte{restart})
+	}
+	if h.flags&extFlagRange != 0 {
+		put(hdrTagRange, binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, uint64(h.offset)), uint64(h.length)))
+	}
+	if h.flags&extFlagSparse != 0 {
+		put(hdrTagExtents, encodeExtents(h.extents))
+	}
+	if h.flags&extFlagChecksum != 0 {
+		put(hdrTagChecksum, []byte{h.algo})
+	}
+	if h.flags&extFlagEncrypt != 0 {
+		put(hdrTagSalt, h.salt)
+	}
+	if h.flags2&ext2Compress != 0 {
+		put(hdrTagCompress, []byte{h.compress})
+	}
+	if h.flags2&ext2Dedupe != 0 {
+		put(hdrTagDigest, h.digest)
+	}
+	if len(h.xattrs) > 0 {
+		put(hdrTagXattrs, encodeXattrs(h.xattrs))
+	}
+	if h.mtime != 0 {
+		put(hdrTagMtime, binary.BigEndian.AppendUint64(nil, uint64(h.mtime)))
+	}
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 6+len(block)), headerBlockMarker)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(block)))
+	return append(buf, block...)
+}
+
+// decodeHeader 解析 TLV 块 (不含标记和块长度) 中的字段. 不认识的字段类型被跳过, 标志位要求的字段必须齐全;
+// 标志位的组合是否有效由接收端与旧格式的文件头 (readLegacyHeader) 一起检查
+func decodeHeader(block []byte) (fileHeader, error) {
+	var h fileHeader
+	if len(block) == 0 || block[0] != headerVersion {
+		return h, fmt.Errorf("不支持的文件头版本")
+	}
+	fixed := func(tag byte, value []byte, n int) error {
+		if len(value) != n {
+			return fmt.Errorf("文件头字段 %d 长度无效: %d (期望 %d)", tag, len(value), n)
+		}
+		return nil
+	}
+	var seen uint32
+	for rest := block[1:]; len(rest) > 0; {
+		if len(rest) < 5 {
+			return h, fmt.Errorf("文件头被截断")
+		}
+		tag, n := rest[0], binary.BigEndian.Uint32(rest[1:5])
+		if uint64(n) > uint64(len(rest)-5) {
+			return h, fmt.Errorf("文件头字段 %d 长度 %d 超出文件头", tag, n)
+		}
+		value := rest[5 : 5+n]
+		rest = rest[5+n:]
+		if tag < 32 {
+			seen |= 1 << tag
+		}
+		var err error
+		switch tag {
+		case hdrTagFlags:
+			if err = fixed(tag, value, 1); err == nil {
+				h.flags = value[0]
+			}
+		case hdrTagFlags2:
+			if err = fixed(tag, value, 1); err == nil {
+				h.flags2 = value[0]
+			}
+		case hdrTagName:
+			if len(value) > maxFileNameLen {
+				return h, fmt.Errorf("文件名过长 (%d 字节, 最多 %d 字节)", len(value), maxFileNameLen)
+			}
+			h.name = string(value)
+		case hdrTagSize:
+			if err = fixed(tag, value, 8); err == nil {
+				h.size = int64(binary.BigEndian.Uint64(value))
+			}
+		case hdrTagFiles:
+			if err = fixed(tag, value, 4); err == nil {
+				h.files = binary.BigEndian.Uint32(value)
+			}
+		case hdrTagRestart:
+			if err = fixed(tag, value, 1); err == nil {
+				h.restart = value[0] != 0
+			}
+		case hdrTagRange:
+			if err = fixed(tag, value, 16); err == nil {
+				h.offset = int64(binary.BigEndian.Uint64(value))
+				h.length = int64(binary.BigEndian.Uint64(value[8:]))
+			}
+		case hdrTagExtents:
+			if len(value) < 4 || uint64(len(value)-4) != uint64(binary.BigEndian.Uint32(value))*16 {
+				return h, fmt.Errorf("文件头中的稀疏区段表长度无效")
+			}
+			h.extents = make([]extent, 0, (len(value)-4)/16)
+			for table := value[4:]; len(table) > 0; table = table[16:] {
+				h.extents = append(h.extents, extent{offset: int64(binary.BigEndian.Uint64(table)), length: int64(binary.BigEndian.Uint64(table[8:]))})
+			}
+		case hdrTagChecksum:
+			if err = fixed(tag, value, 1); err == nil {
+				h.algo = value[0]
+			}
+		case hdrTagSalt:
+			if err = fixed(tag, value, saltSize); err == nil {
+				h.salt = value
+			}
+		case hdrTagCompress:
+			if err = fixed(tag, value, 1); err == nil {
+				h.compress = value[0]
+			}
+		case hdrTagDigest:
+			h.digest = value
+		case hdrTagXattrs:
+			h.xattrs, err = decodeXattrs(value)
+		case hdrTagMtime:
+			if err = fixed(tag, value, 8); err == nil {
+				h.mtime = int64(binary.BigEndian.Uint64(value))
+			}
+		default:
+			logDebug("跳过未知的文件头字段 %d (%d 字节)", tag, n)
+		}
+		if err != nil {
+			return h, err
+		}
+	}
+	need := uint32(1<<hdrTagName | 1<<hdrTagSize)
+	for _, req := range []struct {
+		present bool
+		tag     byte
+	}{
+		{h.flags == extFlagManifest, hdrTagFiles},
+		{h.flags2&ext2Resume != 0, hdrTagRestart},
+		{h.flags&extFlagRange != 0, hdrTagRange},
+		{h.flags&extFlagSparse != 0, hdrTagExtents},
+		{h.flags&extFlagChecksum != 0, hdrTagChecksum},
+		{h.flags&extFlagEncrypt != 0, hdrTagSalt},
+		{h.flags2&ext2Compress != 0, hdrTagCompress},
+		{h.flags2&ext2Dedupe != 0, hdrTagDigest},
+	} {
+		if req.present {
+			need |= 1 << req.tag
+		}
+	}
+	if missing := need &^ seen; missing != 0 {
+		return h, fmt.Errorf("文件头缺少字段 (%#x)", missing)
+	}
+	if h.name == "" && h.flags != extFlagManifest {
+		return h, fmt.Errorf("文件名为空")
+	}
+	// 旧格式中校验值的长度由算法决定, 不一致时会与之后的数据错位
+	if algo, ok := checksumAlgoByCode(h.algo); ok && h.digest != nil && len(h.digest) != algo.newHash().Size() {
+		return h, fmt.Errorf("校验值长度 %d 与 %s 不符", len(h.digest), algo.name)
+	}
+	return h, nil
+}
+
+// encodeLegacyHeader 按旧格式编码文件头: 没有标志位时为 [nameLen][name][size], 只有第一标志字节时为
+// [0xFFFF][flags][nameLen][name][size], 否则为 [0xFFFC][flags][flags2][nameLen][name][size]; 之后是各标志位附带的字段
+func encodeLegacyHeader(h fileHeader) []byte {
+	var buf []byte
+	switch {
+	case h.flags2 != 0:
+		buf = binary.BigEndian.AppendUint16(buf, ext2HeaderMarker)
+		buf = append(buf, h.flags, h.flags2)
+	case h.flags != 0:
+		buf = binary.BigEndian.AppendUint16(buf, extHeaderMarker)
+		buf = append(buf, h.flags)
+	}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(h.name)))
+	buf = append(buf, h.name...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(h.size))
+	if h.flags == extFlagManifest {
+		buf = binary.BigEndian.AppendUint32(buf, h.files)
+	}
+	if h.flags2&ext2Resume != 0 {
+		if h.restart {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+	if h.flags&extFlagRange != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(h.length))
+	}
+	if h.flags&extFlagSparse != 0 {
+		buf = append(buf, encodeExtents(h.extents)...)
+	}
+	if h.flags&extFlagChecksum != 0 {
+		buf = append(buf, h.algo)
+	}
+	if h.flags&extFlagEncrypt != 0 {
+		buf = append(buf, h.salt...)
+	}
+	if h.flags2&ext2Compress != 0 {
+		buf = append(buf, h.compress)
+	}
+	if h.flags2&ext2Dedupe != 0 {
+		buf = append(buf, h.digest...)
+	}
+	return buf
+}
+
+// encodeFileHeader 按协商结果编码文件头: 对端支持时使用 TLV 格式, 否则使用旧格式
+func encodeFileHeader(features Features, h fileHeader) []byte {
+	if features.HeaderTLV {
+		return encodeHeader(h)
+	}
+	return encodeLegacyHeader(h)
+}
+
+// readLegacyHeader 按旧格式读取文件名长度 (已由调用方读取为 nameLen) 之后的文件头, 是 encodeLegacyHeader 的逆过程,
+// 只用于没有协商 capHeaderTLV 的对端. 这里只检查读取所需的长度, 字段的有效性由接收端与 TLV 文件头一起检查
+func readLegacyHeader(conn net.Conn, nameLen uint16) (fileHeader, error) {
+	var h fileHeader
+	read := func(n int, what string) ([]byte, error) {
+		buf := make([]byte, n)
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return nil, fmt.Errorf("读取%s失败: %w", what, wrapIOTimeout(err))
+		}
+		return buf, nil
+	}
+	// 扩展头: 先读取标志位, 再读取真正的文件名长度
+	switch nameLen {
+	case extHeaderMarker:
+		ext, err := read(3, "扩展头")
+		if err != nil {
+			return h, err
+		}
+		h.flags = ext[0]
+		nameLen = binary.BigEndian.Uint16(ext[1:])
+	case ext2HeaderMarker:
+		ext, err := read(4, "扩展头")
+		if err != nil {
+			return h, err
+		}
+		h.flags, h.flags2 = ext[0], ext[1]
+		nameLen = binary.BigEndian.Uint16(ext[2:])
+		if h.flags2 == 0 {
+			return h, fmt.Errorf("扩展头无效: 第二标志字节为 0")
+		}
+	}
+	// 在读取文件名之前拒绝过长的长度, 避免按对端给出的长度分配内存
+	if int(nameLen) > maxFileNameLen {
+		return h, fmt.Errorf("拒绝文件头: 文件名过长 (%d 字节, 最多 %d 字节)", nameLen, maxFileNameLen)
+	}
+	name, err := read(int(nameLen), "文件名")
+	if err != nil {
+		return h, err
+	}
+	h.name = string(name)
+	size, err := read(8, "文件大小")
+	if err != nil {
+		return h, err
+	}
+	h.size = int64(binary.BigEndian.Uint64(size))
+	if h.flags == extFlagManifest {
+		files, err := read(4, "批量清单")
+		if err != nil {
+			return h, err
+		}
+		h.files = binary.BigEndian.Uint32(files)
+	}
+	if h.flags2&ext2Resume != 0 {
+		restart, err := read(1, "续传请求")
+		if err != nil {
+			return h, err
+		}
+		h.restart = restart[0] != 0
+	}
+	if h.flags&extFlagRange != 0 {
+		rng, err := read(16, "分段信息")
+		if err != nil {
+			return h, err
+		}
+		h.offset = int64(binary.BigEndian.Uint64(rng))
+		h.length = int64(binary.BigEndian.Uint64(rng[8:]))
+	}
+	if h.flags&extFlagSparse != 0 {
+		if h.extents, err = readExtents(conn); err != nil {
+			return h, err
+		}
+	}
+	if h.flags&extFlagChecksum != 0 {
+		code, err := read(1, "校验算法")
+		if err != nil {
+			return h, err
+		}
+		h.algo = code[0]
+	}
+	if h.flags&extFlagEncrypt != 0 {
+		if h.salt, err = read(saltSize, "加密盐"); err != nil {
+			return h, err
+		}
+	}
+	if h.flags2&ext2Compress != 0 {
+		code, err := read(1, "压缩算法")
+		if err != nil {
+			return h, err
+		}
+		h.compress = code[0]
+	}
+	// 校验值的长度由算法决定, 算法无效时无法继续读取
+	if h.flags2&ext2Dedupe != 0 {
+		algo, ok := checksumAlgoByCode(h.algo)
+		if !ok {
+			return h, fmt.Errorf("不支持的校验算法编号: %d", h.algo)
+		}
+		if h.digest, err = read(algo.newHash().Size(), "校验值"); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// readHeaderBlock 读取标记之后的 TLV 文件头并解析为 fileHeader
+func readHeaderBlock(conn net.Conn) (fileHeader, error) {
+	lenBytes := make([]byte, 4)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, lenBytes); err != nil {
+		return fileHeader{}, fmt.Errorf("读取文件头长度失败: %w", wrapIOTimeout(err))
+	}
+	n := binary.BigEndian.Uint32(lenBytes)
+	if n > maxHeaderBlock {
+		return fileHeader{}, fmt.Errorf("文件头过大: %d 字节 (最多 %d 字节)", n, maxHeaderBlock)
+	}
+	block := make([]byte, n)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, block); err != nil {
+		return fileHeader{}, fmt.Errorf("读取文件头失败: %w", wrapIOTimeout(err))
+	}
+	h, err := decodeHeader(block)
+	if err != nil {
+		return fileHeader{}, fmt.Errorf("文件头无效: %w", err)
+	}
+	return h, nil
+}
+
+// abortOnCancel 在 ctx 被取消时 shutdown 连接, 使阻塞中的 sendfile/写入尽快返回错误.
+// 返回的函数用于解除注册.
+func abortOnCancel(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.CloseRead()
+			tcpConn.CloseWrite()
+		} else {
+			conn.Close()
+		}
+	})
+}
+
+// applySendBuffer 按 -sndbuf 尝试设置 TCP 发送缓冲区
+func applySendBuffer(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && *sndBuf > 0 {
+		if err := tcpConn.SetWriteBuffer(*sndBuf); err != nil {
+			logWarn("\x1b[33m警告: 设置 TCP 发送缓冲区为 %d 失败: %v\x1b[0m", *sndBuf, err)
+		} else if actual, err := socketBufferSize(tcpConn, unix.SO_SNDBUF); err != nil {
+			logWarn("\x1b[33m警告: 读取 TCP 发送缓冲区实际大小失败: %v\x1b[0m", err)
+		} else {
+			logInfo("TCP 发送缓冲区: 请求 %d, 内核实际 %d%s", *sndBuf, actual, bufferClampNote(*sndBuf, actual, "net.core.wmem_max"))
+		}
+	}
+}
+
+// socketBufferSize 读取内核实际应用的 socket 缓冲区大小 (SO_SNDBUF/SO_RCVBUF)
+func socketBufferSize(tcpConn *net.TCPConn, opt int) (int, error) {
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		size, sockErr = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+	}); err != nil {
+		return 0, err
+	}
+	return size, sockErr
+}
+
+// bufferClampNote 内核会把请求的缓冲区大小翻倍 (预留簿记开销), 实际值小于请求值的两倍说明被 sysctl 上限截断
+func bufferClampNote(requested, actual int, sysctl string) string {
+	if actual < requested*2 {
+		return fmt.Sprintf(" (被 %s 限制, 可调大该内核参数)", sysctl)
+	}
+	return ""
+}
+
+// applyNoDelay 设置 TCP_NODELAY (关闭 Nagle 算法), 避免多个小文件的文件头被合并延迟发送;
+// 指定 -nagle 时重新启用 Nagle 算法
+func applyNoDelay(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.SetNoDelay(!*nagle); err != nil {
+			logWarn("\x1b[33m警告: 设置 TCP_NODELAY 失败: %v\x1b[0m", err)
+		}
+	}
+}
+
+// applyKeepAlive 按 -keepalive 设置 TCP keepalive. 单连接多文件时连接可能在两个文件之间长时间空闲,
+// keepalive 探测使静默断开的对端被及时发现, 而不是等到下一次写入才失败.
+func applyKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if *keepAlive <= 0 {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			logWarn("\x1b[33m警告: 关闭 TCP keepalive 失败: %v\x1b[0m", err)
+		}
+		return
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		logWarn("\x1b[33m警告: 启用 TCP keepalive 失败: %v\x1b[0m", err)
+		return
+	}
+	if err := tcpConn.SetKeepAlivePeriod(*keepAlive); err != nil {
+		logWarn("\x1b[33m警告: 设置 TCP keepalive 间隔为 %v 失败: %v\x1b[0m", *keepAlive, err)
+	}
+}
+
+// applyUserTimeout 按 -user-timeout 设置 TCP_USER_TIMEOUT. keepalive 只探测空闲连接,
+// 传输过程中对端静默消失时写入会因重传阻塞数分钟; 设置后内核在数据超过该时间未被确认时中止连接.
+func applyUserTimeout(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || *userTimeout <= 0 {
+		return
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		logWarn("\x1b[33m警告: 设置 TCP_USER_TIMEOUT 失败: %v\x1b[0m", err)
+		return
+	}
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(userTimeout.Milliseconds()))
+	}); err != nil {
+		sockErr = err
+	}
+	if sockErr != nil {
+		logWarn("\x1b[33m警告: 设置 TCP_USER_TIMEOUT 为 %v 失败: %v\x1b[0m", *userTimeout, sockErr)
+		return
+	}
+	logDebug("已设置 TCP_USER_TIMEOUT: %v", *userTimeout)
+}
+
+// logMultipath 在指定了 -mptcp 时输出连接实际是否使用了 MPTCP (内核未启用或对端不支持时回退为普通 TCP)
+func logMultipath(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !*mptcp || !ok {
+		return
+	}
+	used, err := tcpConn.MultipathTCP()
+	switch {
+	case err != nil:
+		logWarn("\x1b[33m警告: 查询 MPTCP 状态失败: %v\x1b[0m", err)
+	case used:
+		logInfo("连接 %s 使用 MPTCP", conn.RemoteAddr())
+	default:
+		logWarn("\x1b[33m警告: 连接 %s 未使用 MPTCP (内核未启用 net.mptcp.enabled 或对端不支持)，使用普通 TCP\x1b[0m", conn.RemoteAddr())
+	}
+}
+
+// normalizeAddr 校验并规范化 host:port 形式的地址.
+// IPv6 字面量必须使用方括号 (如 [::1]:8080), 空 host (如 :8080) 表示监听所有接口.
+func normalizeAddr(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if ip := net.ParseIP(strings.Trim(address, "[]")); ip != nil {
+			return "", fmt.Errorf("地址 '%s' 缺少端口或 IPv6 地址未加方括号 (请使用 [%s]:端口 的形式)", address, ip)
+		}
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return "", fmt.Errorf("地址 '%s' 无法解析: IPv6 地址需要用方括号括起来, 如 [::1]:8080", address)
+		}
+		return "", fmt.Errorf("地址 '%s' 无法解析: %w", address, err)
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", fmt.Errorf("地址 '%s' 的端口 '%s' 无效: %w", address, port, err)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeDialAddrs 规范化逗号分隔的连接地址列表, 连接地址必须指定端口
+func normalizeDialAddrs(list string) (string, error) {
+	addrs := strings.Split(list, ",")
+	for i, a := range addrs {
+		normalized, err := normalizeAddr(strings.TrimSpace(a))
+		if err != nil {
+			return "", err
+		}
+		// 端口为空或 0 只对监听地址有意义 (由内核分配空闲端口)
+		if _, port, _ := net.SplitHostPort(normalized); port == "" || port == "0" {
+			return "", fmt.Errorf("连接地址 '%s' 必须指定端口", a)
+		}
+		addrs[i] = normalized
+	}
+	return strings.Join(addrs, ","), nil
+}
+
+// network 返回当前 -net 对应的 net.Dial/net.Listen 网络类型
+func network() string {
+	if *netType == "unix" {
+		return "unix"
+	}
+	return tcpNetwork()
+}
+
+// newListenConfig 返回监听使用的 ListenConfig, 按 -mptcp 启用 Multipath TCP
+func newListenConfig() net.ListenConfig {
+	lc := net.ListenConfig{Control: listenControl}
+	lc.SetMultipathTCP(*mptcp)
+	return lc
+}
+
+// listenControl 在 bind 之前设置监听 socket 的选项 (仅 TCP):
+// SO_REUSEADDR 允许在旧连接处于 TIME_WAIT 时立即重新绑定同一端口, 便于接收端退出后马上重启;
+// SO_REUSEPORT (-reuseport) 允许多个 socket 同时绑定同一地址端口, 内核在它们之间分配新连接.
+func listenControl(network, address string, c syscall.RawConn) error {
+	if *netType != "tcp" {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); sockErr != nil {
+			sockErr = fmt.Errorf("设置 SO_REUSEADDR 失败: %w", sockErr)
+			return
+		}
+		if *reusePort {
+			if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); sockErr != nil {
+				sockErr = fmt.Errorf("设置 SO_REUSEPORT 失败: %w", sockErr)
+				return
+			}
+		}
+		// 接受的连接继承监听 socket 的拥塞控制算法
+		setCongestion(int(fd))
+		sockErr = bindToDevice(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// dialControl 在 connect 之前设置发送端 socket 的选项 (仅 TCP)
+func dialControl(network, address string, c syscall.RawConn) error {
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		setCongestion(int(fd))
+		sockErr = bindToDevice(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// bindToDevice 按 -bind-device 设置 SO_BINDTODEVICE, 使连接只经由该接口收发.
+// 权限不足和接口不存在时返回说明原因的 errBindDevice
+func bindToDevice(fd int) error {
+	if *bindDevice == "" {
+		return nil
+	}
+	err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, *bindDevice)
+	switch {
+	case err == nil:
+		logDebug("已绑定网络接口: %s", *bindDevice)
+		return nil
+	case errors.Is(err, unix.EPERM):
+		return fmt.Errorf("%w %s: 需要 CAP_NET_RAW 权限 (以 root 运行或执行 setcap cap_net_raw+ep ftgo): %w", errBindDevice, *bindDevice, err)
+	case errors.Is(err, unix.ENODEV):
+		return fmt.Errorf("%w %s: 接口不存在 (可用 ip link 查看): %w", errBindDevice, *bindDevice, err)
+	default:
+		return fmt.Errorf("%w %s: %w", errBindDevice, *bindDevice, err)
+	}
+}
+
+// setCongestion 按 -cc 设置 TCP 拥塞控制算法; 内核不支持 (如模块未加载) 时只记录警告, 继续使用系统默认算法
+func setCongestion(fd int) {
+	if *congestion == "" {
+		return
+	}
+	if err := unix.SetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION, *congestion); err != nil {
+		logWarn("\x1b[33m警告: 设置 TCP 拥塞控制算法为 %s 失败 (%v)，使用系统默认算法\x1b[0m", *congestion, err)
+		return
+	}
+	logDebug("已设置 TCP 拥塞控制算法: %s", *congestion)
+}
+
+// parseCPUAffinity 解析 -cpu-affinity: "网络CPU列表:磁盘CPU列表", 只有一个列表时两者相同.
+// CPU 列表为逗号分隔的编号或范围, 如 "0-3,8"
+func parseCPUAffinity(s string) (netSet, diskSet *unix.CPUSet, err error) {
+	netSpec, diskSpec, found := strings.Cut(s, ":")
+	if !found {
+		diskSpec = netSpec
+	}
+	if netSet, err = parseCPUList(netSpec); err != nil {
+		return nil, nil, err
+	}
+	if diskSet, err = parseCPUList(diskSpec); err != nil {
+		return nil, nil, err
+	}
+	return netSet, diskSet, nil
+}
+
+// parseCPUList 解析逗号分隔的 CPU 编号或范围 (如 "0-3,8") 为 CPUSet
+func parseCPUList(s string) (*unix.CPUSet, error) {
+	set := new(unix.CPUSet)
+	maxCPU := len(set) * 64
+	for _, part := range strings.Split(s, ",") {
+		loStr, hiStr, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		lo, err := strconv.Atoi(loStr)
+		if err != nil {
+			return nil, fmt.Errorf("无法解析 CPU 编号 %q", part)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(hiStr); err != nil {
+				return nil, fmt.Errorf("无法解析 CPU 范围 %q", part)
+			}
+		}
+		if lo < 0 || hi < lo || hi >= maxCPU {
+			return nil, fmt.Errorf("无效的 CPU 范围 %q (编号需在 0-%d 之间)", part, maxCPU-1)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			set.Set(cpu)
+		}
+	}
+	return set, nil
+}
+
+// parseSince 解析 -since: 时长表示 now 之前多久, 否则按 RFC 3339 或 "2006-01-02[ 15:04:05]" (本地时间) 解析为时间戳
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("时长不能为负数: %q", s)
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q 既不是时长 (如 24h) 也不是时间戳 (如 2024-01-02 或 2024-01-02T15:04:05Z)", s)
+}
+
+// filterSince 去掉 paths 中修改时间早于 cutoff 的文件, 返回保留的路径和去掉的个数.
+// 无法获取信息的文件保留, 之后按无法读取的文件跳过并记录
+func filterSince(paths []string, cutoff time.Time) ([]string, int) {
+	kept := paths[:0:0]
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.ModTime().Before(cutoff) {
+			continue
+		}
+		kept = append(kept, path)
+	}
+	return kept, len(paths) - len(kept)
+}
+
+// parsePortRange 解析 "起始-结束" 形式的端口范围
+func parsePortRange(s string) (int, int, error) {
+	loStr, hiStr, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("'%s' 不是 起始-结束 的形式", s)
+	}
+	lo, err := strconv.Atoi(strings.TrimSpace(loStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("起始端口 '%s' 无效", loStr)
+	}
+	hi, err := strconv.Atoi(strings.TrimSpace(hiStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("结束端口 '%s' 无效", hiStr)
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, fmt.Errorf("端口范围 %d-%d 无效 (需要 1 <= 起始 <= 结束 <= 65535)", lo, hi)
+	}
+	return lo, hi, nil
+}
+
+// listenPortRange 使用 listenAddr 的 host 部分依次尝试 [lo, hi] 内的端口, 返回第一个监听成功的 listener.
+// 端口被占用或无权限时尝试下一个, 其他错误 (如 host 无效) 直接返回.
+func listenPortRange(lc net.ListenConfig, listenAddr string, lo, hi int) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	for port := lo; port <= hi; port++ {
+		listener, err := lc.Listen(context.Background(), network(), net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+		if !errors.Is(err, unix.EADDRINUSE) && !errors.Is(err, unix.EACCES) {
+			return nil, err
+		}
+		logDebug("端口 %d 不可用: %v", port, err)
+	}
+	return nil, &net.OpError{Op: "listen", Net: network(), Err: fmt.Errorf("端口范围 %d-%d 内的端口均已被占用或无权限使用", lo, hi)}
+}
+
+// removeStaleSocket 删除上次运行遗留的 Unix socket 文件, 否则 net.Listen 会报 "address already in use".
+// 只删除 socket 类型的文件, 避免误删同名的普通文件.
+func removeStaleSocket(path string) {
+	if strings.HasPrefix(path, "@") {
+		return // 抽象命名空间的 socket 不对应文件, 随最后一个引用关闭自动释放
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			logWarn("\x1b[33m警告: 删除遗留的 socket 文件 '%s' 失败: %v\x1b[0m", path, err)
+		}
+	}
+}
+
+// tcpNetwork 根据 -ipv4only/-ipv6only 返回 net.Dial/net.Listen 使用的网络类型.
+// 默认的 "tcp" 在空 host 监听时为双栈 (同时接受 IPv4 和 IPv6 连接).
+func tcpNetwork() string {
+	switch {
+	case *ipv4Only:
+		return "tcp4"
+	case *ipv6Only:
+		return "tcp6"
+	default:
+		return "tcp"
+	}
+}
+
+// listenStream 按 -net 监听 address: sctp 时创建 SCTP 监听 socket, 否则使用 lc
+func listenStream(lc net.ListenConfig, address string) (net.Listener, error) {
+	if *netType == "sctp" {
+		return listenSCTP(address)
+	}
+	return lc.Listen(context.Background(), network(), address)
+}
+
+// sctpConn 是一对一风格 (SOCK_STREAM) 的 SCTP 连接. net.FileConn 会把这种 socket 当作 *net.TCPConn,
+// 这里只保留 net.Conn 的方法, 使 sendfile/splice、TCP_NODELAY、keepalive 和缓冲区设置等依赖 TCP 的路径
+// 识别为非 TCP 连接并回退到标准读写 (包括 io.Copy 不会经由 TCPConn.ReadFrom 使用 splice)
+type sctpConn struct {
+	net.Conn
+}
+
+// sctpListener 把接受的连接包装为 sctpConn
+type sctpListener struct {
+	net.Listener
+}
+
+func (l sctpListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return sctpConn{conn}, nil
+}
+
+// probeSCTP 检查本机内核是否支持 SCTP (未加载 sctp 模块或被禁用时 socket 返回 EPROTONOSUPPORT)
+func probeSCTP() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		return err
+	}
+	unix.Close(fd)
+	return nil
+}
+
+// sctpSockaddr 把 IP 和端口转换为 socket 地址, 返回地址族
+func sctpSockaddr(ip net.IP, port int) (unix.Sockaddr, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := &unix.SockaddrInet4{Port: port}
+		copy(sa.Addr[:], ip4)
+		return sa, unix.AF_INET
+	}
+	sa := &unix.SockaddrInet6{Port: port}
+	copy(sa.Addr[:], ip.To16())
+	return sa, unix.AF_INET6
+}
+
+// newSCTPSocket 创建非阻塞的 SCTP socket 并包装为 *os.File (非阻塞的 fd 会注册到 Go 的网络轮询器)
+func newSCTPSocket(family int) (*os.File, error) {
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	return os.NewFile(uintptr(fd), "sctp"), nil
+}
+
+// sctpControl 在 f 的 fd 上执行 fn (不能使用 f.Fd(), 它会把 fd 切换为阻塞模式)
+func sctpControl(f *os.File, fn func(fd int) error) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := rc.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+// resolveSCTP 解析 host:port, network 为 tcp/tcp4/tcp6 (对应 -ipv4only/-ipv6only). 空 host 返回 nil IP
+func resolveSCTP(ctx context.Context, network, address string) (net.IP, int, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, 0, fmt.Errorf("无效的端口 '%s'", portStr)
+	}
+	if host == "" {
+		return nil, port, nil
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, strings.Replace(network, "tcp", "ip", 1), host)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ips[0], port, nil
+}
+
+// dialSCTP 建立到 address 的 SCTP 连接, 遵守 -conn-timeout 和 ctx 的取消
+func dialSCTP(ctx context.Context, network, address string) (net.Conn, error) {
+	ip, port, err := resolveSCTP(ctx, network, address)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "sctp", Err: err}
+	}
+	if ip == nil {
+		ip = net.IPv4(127, 0, 0, 1)
+		if network == "tcp6" {
+			ip = net.IPv6loopback
+		}
+	}
+	sa, family := sctpSockaddr(ip, port)
+	f, err := newSCTPSocket(family)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "sctp", Err: err}
+	}
+	defer f.Close() // FileConn 复制了 fd
+	if *connTimeout > 0 {
+		f.SetWriteDeadline(time.Now().Add(*connTimeout))
+	}
+	stop := context.AfterFunc(ctx, func() { f.SetWriteDeadline(time.Now()) })
+	defer stop()
+
+	// 非阻塞 connect 返回 EINPROGRESS 后等待 socket 可写, 再由 SO_ERROR 取得连接结果
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var connectErr error
+	started := false
+	if err := rc.Write(func(fd uintptr) bool {
+		if !started {
+			started = true
+			connectErr = unix.Connect(int(fd), sa)
+			return connectErr != unix.EINPROGRESS
+		}
+		soErr, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			connectErr = err
+		} else if soErr != 0 {
+			connectErr = unix.Errno(soErr)
+		} else {
+			connectErr = nil
+		}
+		return true
+	}); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, &net.OpError{Op: "dial", Net: "sctp", Addr: &net.TCPAddr{IP: ip, Port: port}, Err: err}
+	}
+	if connectErr != nil {
+		return nil, &net.OpError{Op: "dial", Net: "sctp", Addr: &net.TCPAddr{IP: ip, Port: port}, Err: os.NewSyscallError("connect", connectErr)}
+	}
+	f.SetWriteDeadline(time.Time{})
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	return sctpConn{conn}, nil
+}
+
+// listenSCTP 在 address 上监听 SCTP 连接. 空 host 时绑定通配地址 (IPv6 双栈, -ipv4only 时为 IPv4),
+// 内核会把本机所有地址作为关联的多宿主地址通告给对端
+func listenSCTP(address string) (net.Listener, error) {
+	ip, port, err := resolveSCTP(context.Background(), tcpNetwork(), address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "sctp", Err: err}
+	}
+	if ip == nil {
+		ip = net.IPv6unspecified
+		if *ipv4Only {
+			ip = net.IPv4zero
+		}
+	}
+	sa, family := sctpSockaddr(ip, port)
+	f, err := newSCTPSocket(family)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "sctp", Err: err}
+	}
+	defer f.Close() // FileListener 复制了 fd
+	err = sctpControl(f, func(fd int) error {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			return os.NewSyscallError("setsockopt", err)
+		}
+		if family == unix.AF_INET6 && ip.IsUnspecified() {
+			v6Only := 0
+			if *ipv6Only {
+				v6Only = 1
+			}
+			unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6Only)
+		}
+		if err := unix.Bind(fd, sa); err != nil {
+			return os.NewSyscallError("bind", err)
+		}
+		return os.NewSyscallError("listen", unix.Listen(fd, unix.SOMAXCONN))
+	})
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "sctp", Addr: &net.TCPAddr{IP: ip, Port: port}, Err: err}
+	}
+	listener, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	return sctpListener{listener}, nil
+}
+
+// dialWithRetry 建立到接收端的连接, 失败时按 -retry/-retry-delay 指数退避重试.
+// 只重试连接建立阶段, 传输中途的失败不会在这里重试.
+func dialWithRetry(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: *connTimeout, Control: dialControl}
+	dialer.SetMultipathTCP(*mptcp)
+	delay := *retryDelay
+	for attempt := 1; ; attempt++ {
+		var conn net.Conn
+		var err error
+		if *netType == "sctp" {
+			conn, err = dialSCTP(ctx, network, address)
+		} else if proxyURL != nil {
+			conn, err = dialProxy(ctx, &dialer, network, address)
+		} else {
+			conn, err = dialer.DialContext(ctx, network, address)
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if attempt > *retryCount || ctx.Err() != nil || errors.Is(err, errBindDevice) {
+			return nil, err
+		}
+		logWarn("\x1b[33m警告: 连接 %s 失败 (%v)，%v 后进行第 %d/%d 次重试\x1b[0m", address, err, delay, attempt, *retryCount)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// proxyURL 是 -proxy 解析后的代理地址, 未指定时为 nil
+var proxyURL *url.URL
+
+// proxyConn 是经 -proxy 建立的连接. 代理完成 CONNECT 之后就是普通的 TCP 数据流, 但连接被 SOCKS5 客户端包装过,
+// sendfile/splice 和 TCP 选项都按非 TCP 连接处理, 回退到标准读写
+type proxyConn struct {
+	net.Conn
+}
+
+// dialProxy 经 SOCKS5 代理连接 address: 到代理的 TCP 连接使用 dialer (-conn-timeout、-bind-device 等同样生效),
+// address 原样交给代理, 主机名由代理解析. -conn-timeout 同时限制与代理的握手
+func dialProxy(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	d, err := proxy.FromURL(proxyURL, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("创建 SOCKS5 代理客户端失败: %w", err)
+	}
+	if *connTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *connTimeout)
+		defer cancel()
+	}
+	conn, err := d.(proxy.ContextDialer).DialContext(ctx, network, address)
+	if err != nil {
+		return nil, fmt.Errorf("经 SOCKS5 代理 %s 连接失败: %w", proxyURL.Host, err)
+	}
+	logDebug("已经 SOCKS5 代理 %s 连接到 %s", proxyURL.Host, address)
+	return proxyConn{conn}, nil
+}
+
+// --- 文件预热函数 (使用 Readahead 预热整个文件) ---
+func doPrewarm(filePath string) error {
+	logDebug("发起预读请求: 文件 %s (整个文件)...", filePath)
+	prewarmStartTime := time.Now()
+
+	// 获取文件信息以得到大小
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("预热时获取文件信息失败: %w", err)
+	}
+	fileSize := fileInfo.Size()
+	if fileSize == 0 {
+		logInfo("文件 %s 大小为 0，跳过预热。", filePath)
+		return nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("预热时打开文件失败: %w", err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	_, _, err = unix.Syscall(unix.SYS_READAHEAD, uintptr(fd), uintptr(0), uintptr(fileSize))
+
+	prewarmDuration := time.Since(prewarmStartTime)
+
+	// unix.Syscall 返回的 err 是 unix.Errno 类型
+	// 如果 err == 0, 表示成功
+	if err.(unix.Errno) != 0 { // Errno 应与 0 比较而非 nil
+		// Readahead 失败通常不是致命的，记录警告
+		logWarn("\x1b[33m警告: 发起 Readahead 请求失败: %v\x1b[0m", err)
+	} else {
+		logDebug("Readahead 请求已发起，耗时: %v (注意: 数据加载是异步的)", prewarmDuration)
+	}
+	// Readahead 失败不应阻止主流程
+	return nil
+}
+
+// dropPageCache 通知内核释放刚发送完的文件在页缓存中的数据, 避免大文件挤占其他有用的缓存.
+// 与 -prewarm 的 readahead 相对应, 失败只记录警告.
+func dropPageCache(f *os.File, size int64) {
+	if err := unix.Fadvise(int(f.Fd()), 0, size, unix.FADV_DONTNEED); err != nil {
+		logWarn("\x1b[33m警告: 释放文件 %s 的页缓存失败: %v\x1b[0m", f.Name(), err)
+		return
+	}
+	logInfo("已释放文件 %s 的页缓存 (POSIX_FADV_DONTNEED)", f.Name())
+}
+
+// copyLocal 在本机将 srcPath 复制到 dstPath, 不经过 socket.
+// 优先使用 copy_file_range 在内核中复制, 不支持时依次回退到 sendfile 和 io.CopyBuffer.
+func copyLocal(srcPath, dstPath string) error {
+	isDevZero := srcPath == "/dev/zero"
+	var size int64
+	var mtime time.Time // 源文件的修改时间, 供 -if newer 判断; /dev/zero 没有
+	var src *os.File
+	if isDevZero {
+		var err error
+		size, err = parseSize(*sizeStr)
+		if err != nil {
+			return fmt.Errorf("无法解析 -size 参数 '%s' 用于 /dev/zero: %w", *sizeStr, err)
+		}
+	} else {
+		fileInfo, err := os.Stat(srcPath)
+		if err != nil {
+			return &FileInfoError{FilePath: srcPath, Err: err}
+		}
+		if !fileInfo.Mode().IsRegular() {
+			return &FileInfoError{FilePath: srcPath, Err: fmt.Errorf("copy 模式只支持普通文件或 /dev/zero")}
+		}
+		size = fileInfo.Size()
+		mtime = fileInfo.ModTime()
+		src, err = os.Open(srcPath)
+		if err != nil {
+			return &FileInfoError{FilePath: srcPath, Err: fmt.Errorf("打开源文件失败: %w", err)}
+		}
+		defer src.Close()
+	}
+
+	// 目标为已存在的目录时使用源文件名
+	if st, err := os.Stat(dstPath); err == nil && st.IsDir() {
+		name := filepath.Base(srcPath)
+		if isDevZero {
+			name = "zero.dat"
+		}
+		dstPath = filepath.Join(dstPath, name)
+	}
+	isDevNull := dstPath == "/dev/null"
+	if info, err := os.Stat(dstPath); err == nil && !isDevNull {
+		if replace, reason := replaceExisting(info, size, mtime); !replace {
+			return fmt.Errorf("目标文件 '%s' 已存在 (%s)", dstPath, reason)
+		}
+	}
+	if !*noSpaceChk && !isDevNull {
+		if err := checkFreeSpace(filepath.Dir(dstPath), size); err != nil {
+			return err
+		}
+	}
+
+	dstFile, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("创建目标文件 '%s' 失败: %w", dstPath, err)
+	}
+	defer dstFile.Close()
+	dstFd := int(dstFile.Fd())
+	if size > 0 && !isDevNull {
+		if err := preallocate(dstFd, size); err != nil {
+			logWarn("\x1b[33m警告: 目标文件预分配空间失败 (%v)，继续复制\x1b[0m", err)
+		}
+	}
+	fileLog(srcPath, size).info("开始复制 '%s' -> '%s' (%s bytes)", srcPath, dstPath, formatWithCommas(size))
+
+	var transferred int64
+	startTime := time.Now()
+	done := make(chan struct{})
+	go displayProgress(size, &transferred, startTime, done)
+	defer close(done)
+
+	var copied int64
+	if !isDevZero {
+		copied, err = copyFileRange(src, dstFile, size, &transferred)
+		if err != nil {
+			return fmt.Errorf("复制 '%s' 失败 (已复制 %d 字节): %w", srcPath, copied, err)
+		}
+	}
+	// copy_file_range 与 sendfile 都不可用, 或源为 /dev/zero 时使用用户态复制
+	if copied < size {
+		// 写入真实文件时必须是真正的零字节; 写到 /dev/null 时无需填充
+		var reader io.Reader = &zeroReader{size: size, fill: !isDevNull}
+		if !isDevZero {
+			reader = io.NewSectionReader(src, copied, size-copied)
+			if _, err := dstFile.Seek(copied, io.SeekStart); err != nil {
+				return fmt.Errorf("定位目标文件失败: %w", err)
+			}
+		}
+		buffer := make([]byte, copyBufferSize)
+		for {
+			n, rerr := reader.Read(buffer)
+			if n > 0 {
+				if _, err := dstFile.Write(buffer[:n]); err != nil {
+					return fmt.Errorf("写入目标文件失败 (已复制 %d 字节): %w", copied, err)
+				}
+				copied += int64(n)
+				atomic.AddInt64(&transferred, int64(n))
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return fmt.Errorf("读取源数据失败 (已复制 %d 字节): %w", copied, rerr)
+			}
+		}
+	}
+	if copied != size {
+		return fmt.Errorf("复制的字节数 (%d) 与源文件大小 (%d) 不符", copied, size)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	elapsed := time.Since(startTime).Seconds()
+	noFields.print("info", "\x1b[32m复制完成，共 %s，速度: %.2f MB/s\x1b[0m", formatBytes(copied), float64(copied)/max(elapsed, 0.001)/1024/1024)
+	runStats.record(srcPath, copied, nil)
+	if *dropCache && !isDevZero {
+		dropPageCache(src, size)
+	}
+	return nil
+}
+
+// copyFileRange 使用 copy_file_range 在内核中复制两个普通文件, 不支持 (如跨文件系统的旧内核) 时回退到 sendfile.
+// 两者在开始前就不可用时返回 0, nil, 由调用方回退到用户态复制.
+func copyFileRange(src, dst *os.File, size int64, transferred *int64) (int64, error) {
+	srcFd, dstFd := int(src.Fd()), int(dst.Fd())
+	var copied int64
+	useSendfile := false
+	for copied < size {
+		chunk := int(min(size-copied, copyRangeChunk))
+		var n int
+		var err error
+		if useSendfile {
+			off := copied
+			n, err = unix.Sendfile(dstFd, srcFd, &off, chunk)
+		} else {
+			n, err = unix.CopyFileRange(srcFd, nil, dstFd, nil, chunk, 0)
+		}
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil && copied == 0 {
+			if !useSendfile && (err == unix.ENOSYS || err == unix.EXDEV || err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+				logInfo("copy_file_range 不可用 (%v)，回退到 sendfile", err)
+				useSendfile = true
+				continue
+			}
+			if useSendfile && (err == unix.ENOSYS || err == unix.EINVAL) {
+				logInfo("sendfile 不可用 (%v)，回退到标准 IO 复制", err)
+				return 0, nil
+			}
+		}
+		if err != nil {
+			return copied, err
+		}
+		if n == 0 {
+			return copied, fmt.Errorf("源文件在偏移量 %d 处提前结束 (预期 %d 字节)", copied, size)
+		}
+		copied += int64(n)
+		atomic.AddInt64(transferred, int64(n))
+	}
+	return copied, nil
+}
+
+func receiver(dirPath string, listenAddr string, useStandardCopy bool) error {
+	if err := probeWritable(dirPath); err != nil {
+		return err
+	}
+	if *metricsAddr != "" {
+		if err := startMetricsServer(*metricsAddr); err != nil {
+			return err
+		}
+	}
+
+	if *netType == "unix" {
+		removeStaleSocket(listenAddr)
+	}
+	lc := newListenConfig()
+	var listener net.Listener
+	var err error
+	if portHigh > 0 {
+		listener, err = listenPortRange(lc, listenAddr, portLow, portHigh)
+		if err != nil {
+			return fmt.Errorf("监听失败: %w", err)
+		}
+	} else {
+		listener, err = listenStream(lc, listenAddr)
+	}
+	if err != nil {
+		return fmt.Errorf("监听 %s 失败: %w", listenAddr, err) // 监听失败是致命错误
+	}
+	defer listener.Close()
+	// 端口由 -port-range 或内核选择时, 把实际地址单独输出一行, 供包装脚本传给发送端;
+	// 接收到 stdout 时 stdout 用于数据, 改为输出到 stderr
+	if host, port, err := net.SplitHostPort(listenAddr); err == nil && *netType != "unix" && (portHigh > 0 || port == "" || port == "0") {
+		_, actualPort, _ := net.SplitHostPort(listener.Addr().String())
+		listenAddr = net.JoinHostPort(host, actualPort)
+		out := os.Stdout
+		if dirPath == "-" || *teeTarget == "-" {
+			out = os.Stderr
+		}
+		fmt.Fprintln(out, listenAddr)
+	}
+	if *teeTarget != "" {
+		w, closeTee, err := openTee(*teeTarget)
+		if err != nil {
+			return err
+		}
+		teeOut = w
+		defer func() {
+			if err := closeTee(); err != nil {
+				logError("\x1b[31m错误: -tee 目标 '%s' 结束时出错: %v\x1b[0m", *teeTarget, err)
+			}
+		}()
+	}
+	logInfo("\x1b[32m服务器启动，正在监听 %s\x1b[0m", listenAddr)
+	return receiveConns(listener, dirPath, useStandardCopy)
+}
+
+// teeOut 是 -tee 的写入目标, 未指定时为 nil
+var teeOut io.Writer
+
+// openTee 打开 -tee 的目标: '-' 为 stdout, '|' 开头时通过 sh -c 运行命令并返回其 stdin, 否则以追加方式打开文件.
+// 返回的函数在接收端退出时关闭目标, 命令则等待其结束
+func openTee(target string) (io.Writer, func() error, error) {
+	if target == "-" {
+		return teeWriter{os.Stdout}, func() error { return nil }, nil
+	}
+	if command, ok := strings.CutPrefix(target, "|"); ok {
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, nil, fmt.Errorf("创建 -tee 命令的管道失败: %w", err)
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, nil, fmt.Errorf("启动 -tee 命令 '%s' 失败: %w", command, err)
+		}
+		return teeWriter{stdin}, func() error {
+			stdin.Close()
+			return cmd.Wait()
+		}, nil
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("打开 -tee 文件失败: %w", err)
+	}
+	return teeWriter{f}, f.Close, nil
+}
+
+// teeWriter 给写入 -tee 目标的错误加上说明, 使其与写入目标文件的错误区分开
+type teeWriter struct {
+	w io.Writer
+}
+
+func (t teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if err != nil {
+		err = fmt.Errorf("写入 -tee 目标失败: %w", err)
+	}
+	return n, err
+}
+
+// writeJob 是 -writers 时交给后台写入的一个文件: 数据已完整接收到内存并通过校验,
+// 剩下创建临时文件、写入、fsync、改名为正式文件和恢复扩展属性
+type writeJob struct {
+	remote    string
+	name      string
+	tmpPath   string
+	finalPath string
+	data      *bytes.Buffer
+	xattrs    []xattr
+	manifest  *manifestRecord // 写入成功后追加到 -manifest
+	bytes     int64           // 接收到的字节数, 写入成功后才计入接收结果
+	seconds   float64         // 接收用时, 用于速度和 -metrics
+	done      chan struct{}   // 写入结束 (无论成功与否) 时关闭
+	err       error
+}
+
+// write 把 job 的数据写入临时文件并 fsync 后原子改名为正式文件, 失败时删除临时文件
+func (j *writeJob) write() error {
+	f, err := os.OpenFile(j.tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return &FileInfoError{FilePath: j.tmpPath, Err: fmt.Errorf("创建临时文件失败: %w", err)}
+	}
+	var w io.Writer = f
+	if *waitSpace > 0 {
+		w = &spaceWaitWriter{f: f, path: j.tmpPath}
+	}
+	if _, err = w.Write(j.data.Bytes()); err != nil {
+		err = fmt.Errorf("写入失败: %w", err)
+	} else if err = f.Sync(); err != nil {
+		err = fmt.Errorf("同步到磁盘失败: %w", err)
+	}
+	if cerr := f.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("关闭失败: %w", cerr)
+	}
+	if err == nil {
+		if err = os.Rename(j.tmpPath, j.finalPath); err != nil {
+			err = fmt.Errorf("重命名临时文件 '%s' -> '%s' 失败: %w", j.tmpPath, j.finalPath, err)
+		}
+	}
+	if err != nil {
+		os.Remove(j.tmpPath)
+		return &FileInfoError{FilePath: j.finalPath, Err: err}
+	}
+	return nil
+}
+
+// writerPool 是一个连接上 -writers 的后台写入线程: 接收线程把收齐的小文件交给它后立即接收下一个文件,
+// 前面的文件在后台写入和 fsync. 各文件互不依赖, 写入顺序不限; 连接结束时由 wait 汇总结果.
+// 方法在 nil 接收者上什么都不做 (未指定 -writers)
+type writerPool struct {
+	jobs    chan *writeJob
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	pending map[string]*writeJob // 正在写入或排队的文件, 以正式路径为键
+	done    []*writeJob
+}
+
+func newWriterPool(n int) *writerPool {
+	if n <= 0 {
+		return nil
+	}
+	p := &writerPool{jobs: make(chan *writeJob, n), pending: make(map[string]*writeJob)}
+	for range n {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for j := range p.jobs {
+				if j.err = j.write(); j.err != nil {
+					fileLog(j.name, -1).peer(j.remote).error("\x1b[31m错误: 后台写入文件 '%s' 失败: %v\x1b[0m", j.name, j.err)
+				} else {
+					peerLog(j.remote).debug("后台写入完成: %s", j.finalPath)
+					fileLog(j.name, j.bytes).peer(j.remote).print("info", "\x1b[32m传输完成，文件 '%s' 接收了 %s，速度: %.2f MB/s\x1b[0m",
+						j.name, formatBytes(j.bytes), float64(j.bytes)/max(j.seconds, 0.001)/1024/1024)
+					if len(j.xattrs) > 0 {
+						restoreXattrs(j.remote, j.finalPath, j.xattrs)
+					}
+					if j.manifest != nil {
+						if err := appendManifest(*manifestPath, *j.manifest); err != nil {
+							peerLog(j.remote).warn("\x1b[33m警告: 写入清单文件 '%s' 失败: %v\x1b[0m", *manifestPath, err)
+						}
+					}
+				}
+				j.data = nil
+				p.mu.Lock()
+				delete(p.pending, j.finalPath)
+				p.done = append(p.done, j)
+				p.mu.Unlock()
+				close(j.done)
+			}
+		}()
+	}
+	return p
+}
+
+// submit 把 j 交给写入线程; 所有线程都在忙且队列已满时阻塞, 以此限制缓冲在内存中的文件数
+func (p *writerPool) submit(j *writeJob) {
+	j.done = make(chan struct{})
+	p.mu.Lock()
+	p.pending[j.finalPath] = j
+	p.mu.Unlock()
+	p.jobs <- j
+}
+
+// settle 等待同一路径上尚未写完的文件, 使后续对该路径的存在检查和写入看到它写完之后的状态
+func (p *writerPool) settle(path string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	j := p.pending[path]
+	p.mu.Unlock()
+	if j != nil {
+		<-j.done
+	}
+}
+
+// wait 等待所有写入线程结束, 返回交给它们的全部文件 (写入失败的 err 非 nil)
+func (p *writerPool) wait() []*writeJob {
+	if p == nil {
+		return nil
+	}
+	close(p.jobs)
+	p.wg.Wait()
+	return p.done
+}
+
+// receiveConns 从 listener 接受连接并接收文件, 直到达到 -max-files / -accept-count / -accept-timeout 限制或监听器关闭
+func receiveConns(listener net.Listener, dirPath string, useStandardCopy bool) error {
+	// 添加变量来跟踪所有文件的传输统计
+	var totalBytesReceived int64
+	var totalFilesReceived int
+	var startTime = time.Now()
+	var skippedFiles []string                    // 因目标已存在而跳过的文件
+	var dedupedFiles int                         // -dedupe 时因已有相同文件而跳过的文件数
+	var completedFiles int                       // 完整接收的文件数, 用于 -max-files
+	var acceptedConns int                        // 已处理的连接数, 用于 -accept-count
+	var failedFiles int                          // 接收失败的文件数
+	var lastFailure error                        // 最后一次接收失败的错误, 接收端退出时据此决定退出码
+	rangeReceived := make(map[string]*rangeFile) // 本次运行中正在分段接收的文件
+	// 每个连接在单独的 goroutine 中处理, 整个处理过程持有 recvMu, 因此普通连接仍然依次处理;
+	// 分段连接在传输数据期间释放 recvMu (见 receiveRange), 同一文件的各分段可以并发写入
+	var recvMu sync.Mutex
+	var active int        // 正在处理 (或等待 recvMu) 的连接数
+	var exiting bool      // 已达到 -max-files / -accept-count 限制, 停止接受新连接
+	var exitResult error  // 接收端自行退出时的结果
+	var wg sync.WaitGroup // 正在处理的连接, 退出前等待它们结束
+	var lowSpace bool     // -min-free: 可用空间不足, 新连接被拒绝
+	var noTmpFile bool    // -tmpfile: 已因不支持 O_TMPFILE 改用 .part (只警告一次)
+
+	// exitSummary 在 -accept-count / -accept-timeout 使接收端退出时输出最终汇总
+	exitSummary := func(reason string) {
+		level := "info"
+		if failedFiles > 0 {
+			level = "error"
+		}
+		noFields.print(level, "%s，接收端退出: 共处理 %d 个连接，完整接收 %d 个文件，总大小 %s，用时 %s",
+			reason, acceptedConns, completedFiles, formatBytes(totalBytesReceived), time.Since(startTime).Round(time.Second))
+	}
+	// exitErr 返回接收端自行退出时的结果: 有文件接收失败时以最后一次失败作为错误, 使退出码反映失败类型
+	exitErr := func() error {
+		if failedFiles > 0 {
+			return fmt.Errorf("%d 个文件接收失败，最后一个错误: %w", failedFiles, lastFailure)
+		}
+		return nil
+	}
+
+	for { // 无限循环，每个连接在单独的 goroutine 中处理
+		if *acceptTimeout > 0 {
+			if dl, ok := listener.(interface{ SetDeadline(time.Time) error }); ok {
+				dl.SetDeadline(time.Now().Add(*acceptTimeout))
+			}
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			recvMu.Lock()
+			stopped, result, idle := exiting, exitResult, active == 0
+			recvMu.Unlock()
+			if stopped {
+				wg.Wait()
+				return result
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if !idle {
+					continue // 还有连接 (如其他分段) 正在处理, 重新计时
+				}
+				recvMu.Lock()
+				defer recvMu.Unlock()
+				exitSummary(fmt.Sprintf("%v 内没有新连接", *acceptTimeout))
+				return exitErr()
+			}
+			logWarn("\x1b[33m警告: 接受连接失败: %v\x1b[0m", err)
+			// 检查是否是监听器关闭导致的错误
+			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
+				noFields.print("info", "监听器已关闭，服务器退出。")
+				return nil // 正常退出
+			}
+			continue // 其他接受错误，继续等待下一个连接
+		}
+
+		// --- 开始处理单个连接 ---
+		remoteAddrStr := conn.RemoteAddr().String()
+		if remoteAddrStr == "" || remoteAddrStr == "@" {
+			remoteAddrStr = "unix" // Unix socket 的对端通常没有绑定地址
+		}
+		// -min-free: 每次接受连接时检查可用空间, 不足时拒绝新连接, 已在处理的连接不受影响
+		if minFreeSpace > 0 && dirPath != "/dev/null" && dirPath != "-" {
+			avail, err := freeSpace(nearestExisting(dirPath))
+			switch {
+			case err != nil:
+				logWarn("\x1b[33m警告: 获取 '%s' 的文件系统信息失败, 跳过 -min-free 检查: %v\x1b[0m", dirPath, err)
+			case avail < minFreeSpace:
+				if !lowSpace {
+					lowSpace = true
+					logError("\x1b[31m'%s' 可用空间 %s 低于 -min-free %s, 暂停接受新的传输 (进行中的传输继续完成)\x1b[0m",
+						dirPath, formatBytes(avail), formatBytes(minFreeSpace))
+				}
+				peerLog(remoteAddrStr).warn("\x1b[33m可用空间不足 (%s), 拒绝连接\x1b[0m", formatBytes(avail))
+				conn.Close()
+				continue
+			case lowSpace:
+				lowSpace = false
+				noFields.print("info", "\x1b[32m'%s' 可用空间已恢复到 %s, 继续接受新的传输\x1b[0m", dirPath, formatBytes(avail))
+			}
+		}
+		peerLog(remoteAddrStr).info("接收到连接，开始处理...")
+		recvMu.Lock()
+		acceptedConns++
+		active++
+		recvMu.Unlock()
+		remoteHost := remoteAddrStr // 用于 -dir-template 的 {remote}: TCP 连接只取 IP
+		if host, _, err := net.SplitHostPort(remoteAddrStr); err == nil {
+			remoteHost = host
+		}
+
+		// 声明变量来保存传输结果，以便在匿名函数外访问
+		var fileTransferred int64
+		var fileReceiveError error
+		var fileTransferName string
+		var fileStart time.Time
+		var fileQueued bool      // 文件已交给 -writers 的后台写入线程, 写入结束后才计入接收结果
+		var batch *batchManifest // 发送端发送了批量清单时的整批信息
+
+		applyNoDelay(conn)
+		applyKeepAlive(conn)
+		applyUserTimeout(conn)
+		logMultipath(conn)
+
+		// 尝试设置 TCP 接收缓冲区
+		if tcpConn, ok := conn.(*net.TCPConn); ok && *rcvBuf > 0 {
+			if err := tcpConn.SetReadBuffer(*rcvBuf); err != nil {
+				peerLog(remoteAddrStr).warn("\x1b[33m警告: 设置 TCP 接收缓冲区为 %d 失败: %v\x1b[0m", *rcvBuf, err)
+			} else if actual, err := socketBufferSize(tcpConn, unix.SO_RCVBUF); err != nil {
+				peerLog(remoteAddrStr).warn("\x1b[33m警告: 读取 TCP 接收缓冲区实际大小失败: %v\x1b[0m", err)
+			} else {
+				peerLog(remoteAddrStr).info("TCP 接收缓冲区: 请求 %d, 内核实际 %d%s", *rcvBuf, actual, bufferClampNote(*rcvBuf, actual, "net.core.rmem_max"))
+			}
+		}
+
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			recvMu.Lock()
+			defer recvMu.Unlock()
+
+			// -deadline: 连接开始处理后超过该时间仍未完成时 shutdown 连接, 正在进行的 splice/写入随之返回错误
+			connCtx := context.Background()
+			if *deadline > 0 {
+				var cancel context.CancelFunc
+				connCtx, cancel = context.WithTimeout(connCtx, *deadline)
+				defer cancel()
+				defer abortOnCancel(connCtx, conn)()
+			}
+
+			// 处理单个连接
+			func(conn net.Conn) {
+				defer conn.Close()
+				defer peerLog(remoteAddrStr).debug("连接已关闭")
+
+				// 0. 校验魔数和协议版本, 协商双方都支持的功能
+				var features Features
+				err := readHandshake(conn)
+				if err == nil {
+					features, err = negotiate(conn, localCapabilities)
+				}
+				if err != nil {
+					peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", err)
+					return
+				}
+
+				var connRoot batchRoot // 本连接上校验通过并写入的文件, 用于比对整批根校验值
+				pool := newWriterPool(*writers)
+
+				// receiveFile 接收连接上的下一个文件, 返回连接上是否可能还有后续文件
+				receiveFile := func() (more bool) {
+					// 记录当前文件开始时间
+					fileStart = time.Now()
+
+					var batchEnd bool       // 收到单连接多文件的结束标记
+					var dryRun bool         // dry-run 文件头: 没有数据, 校验失败也不影响后续文件头的对齐
+					var checksumOnly bool   // -checksum-only 文件头: 同上, 结果已回复给发送端
+					var targetPath string   // 实际写入的路径 (常规文件时为临时 .part 文件)
+					var finalPath string    // 传输成功后改名到的正式路径
+					var useTempFile bool    // 是否启用临时文件 + 原子改名 (常规文件为 true, /dev/null 为 false)
+					appendBase := int64(-1) // -append 时目标文件原来的大小, 接收失败时截断回该大小
+					var isResume bool       // 断点续传请求: 接收失败时保留 .part, 供发送端下次续传
+					var resumeRestart bool  // 发送端要求丢弃已有的 .part 从头开始
+					var resumeReplied bool  // 已向发送端回复续传位置
+					var isDelta bool        // 增量传输: 用已有的同名文件和发送端的指令重建文件
+					var deltaReplied bool   // 已向发送端回复块签名
+					var isDedupe bool       // 发送端在数据之前附带了校验值, 等待是否跳过的回复
+					var isCompressed bool   // 数据部分为压缩帧 (ext2Compress)
+					var isFramed bool       // 数据部分为带序号和 CRC32C 的帧 (ext2Framed)
+					var ackExpected bool    // 发送端在等待本文件的确认 (-ack)
+					var fileXattrs []xattr  // TLV 文件头附带的扩展属性, 文件完整接收后恢复
+					var fileMtime time.Time // TLV 文件头附带的发送端修改时间, 零值表示未提供, 供 -if newer 判断
+					var anonFile *os.File   // -tmpfile: O_TMPFILE 创建的匿名文件, 成功后 linkat 为 finalPath, 收尾时才关闭
+					var job *writeJob       // -writers: 数据接收到内存, 收尾时交给后台写入线程
+					var receiveErr error
+					var fileName string
+					var fileSize int64
+					var totalReceived int64 = 0
+					var completedPath string // 文件完整接收后写入的路径, 用于 -manifest (分段传输时只在最后一段收齐后设置)
+					var completedBytes int64 // 完整文件的字节数 (分段传输时为整个文件的大小)
+					var checksum string      // 校验通过时的校验值, 用于 -manifest
+					var fileDigest []byte    // 校验通过时的校验值, 计入整批根校验值
+					var rootChecked bool     // 收到的是整批根校验值: 不一致时数据流仍然对齐
+
+					// 错误处理和清理
+					defer func() {
+						if receiveErr != nil && errors.Is(connCtx.Err(), context.DeadlineExceeded) {
+							receiveErr = fmt.Errorf("%w (%v): %w", errDeadline, *deadline, receiveErr)
+						}
+						if receiveErr != nil {
+							peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", receiveErr)
+						}
+						// 发送端在等待续传位置, 回复之前失败时通知其已拒绝
+						if isResume && !resumeReplied {
+							setIODeadline(conn)
+							conn.Write(binary.BigEndian.AppendUint64(nil, resumeRefused))
+						}
+						if isDelta && !deltaReplied {
+							refused := binary.BigEndian.AppendUint32(make([]byte, 0, 16), deltaRefused)
+							setIODeadline(conn)
+							conn.Write(refused[:16])
+						}
+						// -tmpfile: 成功时把匿名文件链接为正式文件, 失败时关闭即被内核回收, 不会留下任何文件
+						if anonFile != nil {
+							if receiveErr == nil {
+								if err := linkTmpFile(anonFile, finalPath); err != nil {
+									receiveErr = &FileInfoError{FilePath: finalPath, Err: fmt.Errorf("链接匿名临时文件失败: %w", err)}
+									peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", receiveErr)
+								}
+							} else {
+								peerLog(remoteAddrStr).info("已丢弃未完成的匿名临时文件, 未写入 '%s'", finalPath)
+							}
+							anonFile.Close()
+						}
+						// 临时文件收尾 (此时 dstFile 已由更晚注册的 defer 关闭):
+						// 成功则原子改名为正式文件, 失败则删除残缺临时文件, 避免留下/覆盖为不完整文件;
+						// 续传请求失败时保留临时文件, 已接收的数据留待下次续传
+						if useTempFile {
+							if receiveErr == nil {
+								if err := os.Rename(targetPath, finalPath); err != nil {
+									receiveErr = fmt.Errorf("重命名临时文件 '%s' -> '%s' 失败: %w", targetPath, finalPath, err)
+									peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", receiveErr)
+									os.Remove(targetPath)
+								}
+							} else if isResume {
+								peerLog(remoteAddrStr).info("保留临时文件 '%s'，发送端可使用 -resume 续传", targetPath)
+							} else {
+								if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
+									peerLog(remoteAddrStr).warn("\x1b[33m警告: 删除残缺临时文件 '%s' 失败: %v\x1b[0m", targetPath, err)
+								} else {
+									peerLog(remoteAddrStr).info("已删除残缺临时文件 '%s'", targetPath)
+								}
+							}
+						}
+						if appendBase >= 0 && receiveErr != nil {
+							if err := os.Truncate(targetPath, appendBase); err != nil {
+								peerLog(remoteAddrStr).warn("\x1b[33m警告: 将 '%s' 截断回追加前的大小 %d 失败: %v\x1b[0m", targetPath, appendBase, err)
+							} else {
+								peerLog(remoteAddrStr).info("已将 '%s' 截断回追加前的大小 %d", targetPath, appendBase)
+							}
+						}
+						if receiveErr == nil && completedPath != "" && len(fileXattrs) > 0 && dirPath != "/dev/null" && dirPath != "-" && job == nil {
+							restoreXattrs(remoteAddrStr, completedPath, fileXattrs)
+						}
+						// -ack: 文件数据已在接收时 fsync, 这里再同步目录使改名/新建的文件项也落盘, 然后回复确认
+						if ackExpected && receiveErr == nil && finalPath != "" {
+							if err := syncDir(filepath.Dir(finalPath)); err != nil {
+								receiveErr = fmt.Errorf("同步目录 '%s' 到磁盘失败: %w", filepath.Dir(finalPath), err)
+								peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", receiveErr)
+							}
+						}
+						if ackExpected && (!isResume || resumeReplied) && (!isDelta || deltaReplied) {
+							ack := byte(ackOK)
+							if receiveErr != nil {
+								ack = ackFail
+							}
+							setIODeadline(conn)
+							if _, err := conn.Write([]byte{ack}); err != nil {
+								peerLog(remoteAddrStr).warn("\x1b[33m警告: 回复文件 '%s' 的确认失败: %v\x1b[0m", fileName, err)
+							}
+						}
+						if receiveErr == nil && completedPath != "" {
+							completedFiles++
+							if fileDigest != nil {
+								connRoot.add(fileName, fileDigest)
+							}
+						}
+						if receiveErr == nil && completedPath != "" && *manifestPath != "" {
+							rec := manifestRecord{
+								Time:     time.Now().Format(time.RFC3339),
+								Remote:   remoteAddrStr,
+								Name:     fileName,
+								Path:     completedPath,
+								Bytes:    completedBytes,
+								Seconds:  time.Since(fileStart).Seconds(),
+								Checksum: checksum,
+							}
+							if rec.Seconds > 0 {
+								rec.SpeedMBps = float64(completedBytes) / rec.Seconds / 1024 / 1024
+							}
+							if job != nil {
+								job.manifest = &rec
+							} else if err := appendManifest(*manifestPath, rec); err != nil {
+								peerLog(remoteAddrStr).warn("\x1b[33m警告: 写入清单文件 '%s' 失败: %v\x1b[0m", *manifestPath, err)
+							}
+						}
+						if job != nil && receiveErr == nil {
+							job.bytes = totalReceived
+							job.seconds = time.Since(fileStart).Seconds()
+							pool.submit(job)
+						}
+						// 无论成功、跳过还是失败, 该文件都计为已处理
+						if batch != nil && fileName != "" && fileSize > 0 {
+							batch.done += fileSize
+						}
+						// 保存结果以便外部访问
+						fileReceiveError = receiveErr
+						fileTransferred = totalReceived
+						fileTransferName = fileName
+						fileQueued = job != nil && receiveErr == nil
+						// 出错后数据流已无法对齐, 流式传输以连接关闭为结尾, 两者都不会有后续文件
+						more = features.MultiFile && (receiveErr == nil || dryRun || checksumOnly || rootChecked) && !batchEnd && fileSize != unknownSize
+					}()
+
+					// 1. 读取文件名长度 (2 bytes)
+					lenBytes := make([]byte, 2)
+					setIODeadline(conn)
+					if _, err := io.ReadFull(conn, lenBytes); err != nil {
+						receiveErr = fmt.Errorf("读取文件名长度失败: %w", wrapIOTimeout(err))
+						return
+					}
+					fileNameLen := binary.BigEndian.Uint16(lenBytes)
+					if fileNameLen == 0 && features.MultiFile {
+						peerLog(remoteAddrStr).debug("收到结束标记，本连接的文件已全部接收")
+						batchEnd = true
+						return
+					}
+					if fileNameLen == batchRootMarker && features.BatchRoot {
+						fileName = "(整批根校验值)"
+						receiveErr = verifyBatchRoot(conn, &connRoot, remoteAddrStr)
+						rootChecked = errors.Is(receiveErr, errChecksumMismatch)
+						return
+					}
+					// 协商了 TLV 文件头时读取并解析整个文件头, 否则按旧格式逐个字段读取; 之后只使用解析出的字段
+					var h fileHeader
+					if fileNameLen == headerBlockMarker && features.HeaderTLV {
+						h, receiveErr = readHeaderBlock(conn)
+						peerLog(remoteAddrStr).debug("\x1b[32m接收到 TLV 文件头\x1b[0m")
+					} else {
+						h, receiveErr = readLegacyHeader(conn, fileNameLen)
+					}
+					if receiveErr != nil {
+						return
+					}
+					fileXattrs = h.xattrs
+					if h.mtime != 0 {
+						fileMtime = time.Unix(0, h.mtime)
+					}
+					extFlags := h.flags
+					if unexpected := extFlags &^ features.extFlags(); unexpected != 0 {
+						receiveErr = fmt.Errorf("扩展头包含未协商的标志位: %#02x", unexpected)
+						return
+					}
+					if unexpected := h.flags2 &^ features.ext2Flags(); unexpected != 0 {
+						receiveErr = fmt.Errorf("扩展头包含未协商的第二标志位: %#02x", unexpected)
+						return
+					}
+					if extFlags != 0 || h.flags2 != 0 {
+						peerLog(remoteAddrStr).debug("\x1b[32m接收到扩展头，标志位: %#02x, 第二标志位: %#02x\x1b[0m", extFlags, h.flags2)
+					}
+					isCompressed = h.flags2&ext2Compress != 0
+					isFramed = h.flags2&ext2Framed != 0
+					if h.flags2&ext2Resume != 0 {
+						if !features.Resume || *appendMode {
+							receiveErr = fmt.Errorf("拒绝续传请求: 未协商断点续传或接收端使用了 -append")
+							return
+						}
+						if extFlags != 0 || h.flags2 != ext2Resume {
+							receiveErr = fmt.Errorf("扩展头无效: 续传不能与其他标志位同时使用")
+							return
+						}
+						// 其余部分与普通文件头相同
+						isResume = true
+						resumeRestart = h.restart
+					}
+					if h.flags2&ext2Delta != 0 {
+						if !features.Delta || *appendMode || *oDirect {
+							receiveErr = fmt.Errorf("拒绝增量传输: 未协商增量传输或接收端使用了 -append / -odirect")
+							return
+						}
+						if extFlags != 0 || h.flags2 != ext2Delta {
+							receiveErr = fmt.Errorf("扩展头无效: 增量传输不能与其他标志位同时使用")
+							return
+						}
+						// 其余部分与普通文件头相同
+						isDelta = true
+					}
+					if h.flags2&ext2Dedupe != 0 {
+						if !features.Dedupe || extFlags&extFlagChecksum == 0 {
+							receiveErr = fmt.Errorf("扩展头无效: 未协商去重, 或去重没有与校验标志位同时使用")
+							return
+						}
+						isDedupe = true
+					}
+					if extFlags&extFlagManifest != 0 {
+						if extFlags != extFlagManifest || h.flags2 != 0 || h.name != "" || batch != nil {
+							receiveErr = fmt.Errorf("扩展头无效: 批量清单只能作为第一个文件头出现, 不能有文件名或其他标志位")
+							return
+						}
+						receiveErr = func() error {
+							batch = &batchManifest{bytes: h.size, files: int(h.files)}
+							if batch.bytes < 0 {
+								return fmt.Errorf("批量清单无效: 总大小 %d", batch.bytes)
+							}
+							peerLog(remoteAddrStr).info("批量传输: 共 %d 个文件, 总大小 %s bytes", batch.files, formatWithCommas(batch.bytes))
+							// 在接收任何文件之前检查整批所需的空间 (不考虑稀疏文件的空洞和已存在而被跳过的文件)
+							if dirPath == "/dev/null" || dirPath == "-" || *noSpaceChk || batch.bytes == 0 {
+								return nil
+							}
+							if err := os.MkdirAll(dirPath, 0755); err != nil {
+								return fmt.Errorf("创建目录 '%s' 失败: %w", dirPath, err)
+							}
+							if err := checkFreeSpace(dirPath, batch.bytes); err != nil {
+								return fmt.Errorf("拒绝批量传输: %w", err)
+							}
+							return nil
+						}()
+						return
+					}
+					// 拒绝长度不合法的文件名, 避免到创建文件时才因 ENAMETOOLONG 失败
+					if h.name == "" {
+						receiveErr = fmt.Errorf("拒绝文件头: 文件名为空")
+						return
+					}
+					if len(h.name) > maxFileNameLen {
+						receiveErr = fmt.Errorf("拒绝文件头: 文件名过长 (%d 字节, 最多 %d 字节)", len(h.name), maxFileNameLen)
+						return
+					}
+					fileName = h.name
+					peerLog(remoteAddrStr).debug("\x1b[32m接收到文件名: %s\x1b[0m", fileName)
+					// 文件名只能是单个路径分量, 防止写到目标目录之外
+					if err := validateFileName(fileName); err != nil {
+						receiveErr = fmt.Errorf("拒绝文件头: %w", err)
+						return
+					}
+					if batch != nil {
+						batch.index++
+						peerLog(remoteAddrStr).info("接收第 %d/%d 个文件: %s", batch.index, batch.files, fileName)
+					}
+					// 本文件的目标目录: -dir, 或按 -dir-template 展开的子目录
+					fileDir := dirPath
+					if *dirTemplate != "" && dirPath != "/dev/null" && dirPath != "-" {
+						sub, err := expandDirTemplate(*dirTemplate, remoteHost, fileName)
+						if err != nil {
+							receiveErr = err
+							return
+						}
+						fileDir = filepath.Join(dirPath, sub)
+						peerLog(remoteAddrStr).debug("\x1b[32m按 -dir-template 保存到目录: %s\x1b[0m", fileDir)
+					}
+
+					fileSize = h.size
+					if isResume && fileSize < 0 {
+						receiveErr = fmt.Errorf("拒绝续传请求: 无效的文件大小 %d", fileSize)
+						return
+					}
+					if fileSize == unknownSize {
+						peerLog(remoteAddrStr).debug("\x1b[32m文件大小: 未知 (流式传输, 读取到连接关闭为止)\x1b[0m")
+					} else {
+						peerLog(remoteAddrStr).debug("\x1b[32m文件大小: %s 字节\x1b[0m", formatWithCommas(fileSize))
+					}
+
+					// 在读取任何数据或创建文件之前执行 -max-file-size / -max-files 限制, 拒绝后直接关闭连接.
+					// 分段传输时文件头中的大小为完整文件大小; 已开始接收的分段文件的后续分段不受 -max-files 限制.
+					if maxFileSize > 0 && (fileSize == unknownSize || fileSize > maxFileSize) {
+						if fileSize == unknownSize {
+							receiveErr = fmt.Errorf("拒绝文件 '%s': 大小未知的流式传输无法检查 -max-file-size 限制", fileName)
+						} else {
+							receiveErr = fmt.Errorf("拒绝文件 '%s': 大小 %s bytes 超过 -max-file-size 限制 %s bytes", fileName, formatWithCommas(fileSize), formatWithCommas(maxFileSize))
+						}
+						logFailedFile(roleReceiver, fileName, remoteAddrStr, totalReceived, receiveErr.Error())
+						return
+					}
+					if _, owned := rangeReceived[filepath.Join(fileDir, fileName)]; *maxFiles > 0 && completedFiles >= *maxFiles && !(extFlags&extFlagRange != 0 && owned) {
+						receiveErr = fmt.Errorf("拒绝文件 '%s': 已完整接收 %d 个文件, 达到 -max-files 限制", fileName, completedFiles)
+						logFailedFile(roleReceiver, fileName, remoteAddrStr, totalReceived, receiveErr.Error())
+						return
+					}
+
+					// 分段传输: 本连接只携带 [rangeOffset, rangeOffset+fileSize) 这一段, totalFileSize 为完整文件大小
+					totalFileSize := fileSize
+					isRange := extFlags&extFlagRange != 0
+					var rangeOffset int64
+					if isRange {
+						rangeOffset = h.offset
+						rangeLength := h.length
+						if totalFileSize < 0 || rangeOffset < 0 || rangeLength < 0 || rangeOffset > totalFileSize-rangeLength {
+							receiveErr = fmt.Errorf("无效的分段 [%d, +%d) (文件大小 %d)", rangeOffset, rangeLength, totalFileSize)
+							return
+						}
+						fileSize = rangeLength
+						peerLog(remoteAddrStr).debug("\x1b[32m分段传输: 偏移量 %s, 长度 %s 字节\x1b[0m", formatWithCommas(rangeOffset), formatWithCommas(rangeLength))
+					}
+
+					// 稀疏文件: 检查数据区段表, fileSize 变为实际传输的数据字节数
+					isSparse := extFlags&extFlagSparse != 0
+					var extents []extent
+					if isSparse {
+						if isRange || totalFileSize < 0 {
+							receiveErr = fmt.Errorf("稀疏文件头无效: 不能与分段传输或未知大小同时使用")
+							return
+						}
+						extents = h.extents
+						if receiveErr = checkExtents(extents, totalFileSize); receiveErr != nil {
+							return
+						}
+						fileSize = 0
+						for _, ext := range extents {
+							fileSize += ext.length
+						}
+						peerLog(remoteAddrStr).debug("\x1b[32m稀疏文件: %d 个数据区段, 实际数据 %s / %s 字节\x1b[0m", len(extents), formatWithCommas(fileSize), formatWithCommas(totalFileSize))
+					}
+
+					// 校验: 数据之后附带该算法的摘要尾部
+					var hasher hash.Hash
+					var algo checksumAlgo
+					if extFlags&extFlagChecksum != 0 {
+						if isRange || fileSize == unknownSize {
+							receiveErr = fmt.Errorf("扩展头无效: 校验不能与分段传输或未知大小同时使用")
+							return
+						}
+						var ok bool
+						if algo, ok = checksumAlgoByCode(h.algo); !ok {
+							receiveErr = fmt.Errorf("不支持的校验算法编号: %d", h.algo)
+							return
+						}
+						hasher = algo.newHash()
+						peerLog(remoteAddrStr).debug("\x1b[32m校验算法: %s\x1b[0m", algo.name)
+					}
+
+					// 加密: 用文件头中的随机盐派生本文件的密钥; 配置了 -psk 的接收端拒绝明文传输
+					var aead cipher.AEAD
+					if extFlags&extFlagEncrypt != 0 {
+						if isRange || isSparse {
+							receiveErr = fmt.Errorf("扩展头无效: 加密不能与分段传输或稀疏文件同时使用")
+							return
+						}
+						salt := h.salt
+						if pskKey == nil {
+							receiveErr = fmt.Errorf("拒绝文件 '%s': 发送端启用了加密，但接收端未指定 -psk", fileName)
+							return
+						}
+						if aead, receiveErr = newPayloadAEAD(pskKey, salt); receiveErr != nil {
+							return
+						}
+						peerLog(remoteAddrStr).debug("\x1b[32m加密传输, 盐: %x\x1b[0m", salt)
+					} else if pskKey != nil {
+						receiveErr = fmt.Errorf("拒绝文件 '%s': 接收端指定了 -psk，只接受加密传输", fileName)
+						return
+					}
+
+					// 压缩: 检查算法编号
+					if isCompressed {
+						if isRange || isSparse || aead != nil || fileSize == unknownSize || extFlags&(extFlagDryRun|extFlagChecksumOnly|extFlagBench) != 0 {
+							receiveErr = fmt.Errorf("扩展头无效: 压缩不能与分段、稀疏、加密、未知大小或无数据的文件头同时使用")
+							return
+						}
+						if h.compress != compressDeflate {
+							receiveErr = fmt.Errorf("不支持的压缩算法编号: %d", h.compress)
+							return
+						}
+						peerLog(remoteAddrStr).debug("\x1b[32m压缩传输: deflate\x1b[0m")
+					}
+					if isFramed {
+						if isRange || isSparse || aead != nil || isCompressed || fileSize == unknownSize || extFlags&(extFlagDryRun|extFlagChecksumOnly|extFlagBench) != 0 {
+							receiveErr = fmt.Errorf("扩展头无效: 分帧不能与分段、稀疏、加密、压缩、未知大小或无数据的文件头同时使用")
+							return
+						}
+						peerLog(remoteAddrStr).debug("\x1b[32m分帧传输: 每帧附带序号和 CRC32C\x1b[0m")
+					}
+
+					// -checksum-only: 没有数据, 校验本地已有的同名文件并回复结果
+					if extFlags&extFlagChecksumOnly != 0 {
+						if extFlags != extFlagChecksum|extFlagChecksumOnly {
+							receiveErr = fmt.Errorf("扩展头无效: -checksum-only 只能与校验标志位同时使用")
+							return
+						}
+						checksumOnly = true
+						finalPath = filepath.Join(fileDir, fileName)
+						if fileDir == "/dev/null" || fileDir == "-" {
+							finalPath = ""
+						}
+						var digest []byte
+						if digest, receiveErr = checksumOnlyVerify(conn, finalPath, totalFileSize, algo); receiveErr == nil {
+							fileLog(fileName, 0).peer(remoteAddrStr).print("info", "\x1b[32m文件 '%s' 与发送端一致 (%s 校验值: %x, 未传输数据)\x1b[0m", fileName, algo.name, digest)
+						} else {
+							receiveErr = fmt.Errorf("[checksum-only] 文件 '%s': %w", fileName, receiveErr)
+						}
+						return
+					}
+
+					// bench: 数据不落盘, 读取后立即回传, 不计入接收的文件
+					if extFlags&extFlagBench != 0 {
+						if extFlags != extFlagBench || fileSize == unknownSize {
+							receiveErr = fmt.Errorf("扩展头无效: bench 不能与其他标志位同时使用, 且必须指定大小")
+							return
+						}
+						receiveErr = benchEcho(conn, fileSize, remoteAddrStr, fileName == probeFileName)
+						return
+					}
+
+					// -writers: 同名文件还在后台写入时先等它写完, 之后的存在检查和写入才能看到它
+					pool.settle(filepath.Join(fileDir, fileName))
+
+					// dry-run: 只校验目标和可用空间, 不创建目录和文件, 也没有数据需要读取
+					if extFlags&extFlagDryRun != 0 {
+						dryRun = true
+						need := totalFileSize
+						if isSparse {
+							need = fileSize
+						}
+						receiveErr = dryRunCheck(fileDir, fileName, need, totalFileSize, fileMtime)
+						if receiveErr == nil {
+							fileLog(fileName, totalFileSize).peer(remoteAddrStr).print("info", "\x1b[32m[dry-run] 文件 '%s' (%s bytes) 校验通过\x1b[0m", fileName, dryRunSize(totalFileSize))
+						} else {
+							receiveErr = fmt.Errorf("[dry-run] 文件 '%s': %w", fileName, receiveErr)
+						}
+						return
+					}
+
+					// -dedupe: 把发送端附带的校验值与同名已有文件比对后回复是否需要传输数据
+					if isDedupe {
+						digest := h.digest
+						path, status, reason := dedupeCheck(fileDir, fileName, totalFileSize, fileMtime, algo, digest)
+						setIODeadline(conn)
+						if _, err := conn.Write([]byte{status}); err != nil {
+							receiveErr = fmt.Errorf("回复去重结果失败: %w", wrapIOTimeout(err))
+							return
+						}
+						switch status {
+						case dedupeSame:
+							dedupedFiles++
+							fileLog(path, 0).peer(remoteAddrStr).print("info", "\x1b[32m文件 '%s' 与已有文件内容相同 (%s 校验值: %x)，跳过传输\x1b[0m", path, algo.name, digest)
+							return
+						case dedupeExists:
+							fileLog(path, -1).peer(remoteAddrStr).warn("\x1b[33m警告: 文件 '%s' 已存在且内容不同，跳过 (%s)\x1b[0m", path, reason)
+							if !slices.Contains(skippedFiles, path) {
+								skippedFiles = append(skippedFiles, path)
+							}
+							return
+						}
+					}
+
+					// 从这里开始发送端会等待本文件的确认, 之后的任何失败都回复否认
+					ackExpected = features.Ack && fileSize != unknownSize
+
+					// 检查目标是否为 /dev/null 或 stdout，并设置 targetPath
+					isDevNull := (fileDir == "/dev/null")
+					isStdout := (fileDir == "-")
+					if isDevNull {
+						targetPath = "/dev/null"
+						fileLog(fileName, -1).peer(remoteAddrStr).debug("\x1b[32m接收到文件名 '%s'，将数据写入 /dev/null\x1b[0m", fileName)
+					} else if isStdout {
+						if isRange || isSparse {
+							receiveErr = fmt.Errorf("写入 stdout 时不支持分段传输 (-connections) 或稀疏文件 (-sparse)")
+							return
+						}
+						targetPath = "stdout"
+						fileLog(fileName, -1).peer(remoteAddrStr).debug("\x1b[32m接收到文件名 '%s'，将数据写入 stdout\x1b[0m", fileName)
+					} else if *appendMode {
+						if isRange || isSparse {
+							receiveErr = fmt.Errorf("拒绝文件 '%s': -append 不支持分段传输 (-connections) 或稀疏文件 (-sparse)", fileName)
+							return
+						}
+						if err := os.MkdirAll(fileDir, 0755); err != nil {
+							receiveErr = fmt.Errorf("创建目录 '%s' 失败: %w", fileDir, err)
+							return
+						}
+						// 追加到已有文件, 不能使用临时文件改名
+						finalPath = filepath.Join(fileDir, fileName)
+						targetPath = finalPath
+						fileLog(fileName, -1).peer(remoteAddrStr).debug("\x1b[32m将文件 '%s' 追加到: %s\x1b[0m", fileName, targetPath)
+					} else if isRange {
+						if err := os.MkdirAll(fileDir, 0755); err != nil {
+							receiveErr = fmt.Errorf("创建目录 '%s' 失败: %w", fileDir, err)
+							return
+						}
+						// 各段由不同连接写入同一文件, 不能使用临时文件改名, 直接写目标文件
+						finalPath = filepath.Join(fileDir, fileName)
+						targetPath = finalPath
+						fileLog(fileName, -1).peer(remoteAddrStr).debug("\x1b[32m将文件 '%s' 的分段写入: %s\x1b[0m", fileName, targetPath)
+					} else {
+						// 仅在目标不是 /dev/null 时才创建目录
+						if err := os.MkdirAll(fileDir, 0755); err != nil {
+							receiveErr = fmt.Errorf("创建目录 '%s' 失败: %w", fileDir, err)
+							return
+						}
+						finalPath = filepath.Join(fileDir, fileName)
+						targetPath = finalPath + ".part" // 先写临时文件, 全部成功后再原子改名
+						useTempFile = true
+						fileLog(fileName, -1).peer(remoteAddrStr).debug("\x1b[32m将文件 '%s' 保存到: %s (临时文件: %s)\x1b[0m", fileName, finalPath, targetPath)
+					}
+					savedPath := finalPath // 清单中记录的路径: 正式文件路径, 或 /dev/null、stdout
+					if savedPath == "" {
+						savedPath = targetPath
+					}
+
+					// 目标已存在时按 -if 决定是否替换 (默认跳过, 丢弃本连接的数据以保持协议同步).
+					// 分段传输中由本次运行创建的文件不算已存在.
+					if finalPath != "" && !*appendMode {
+						_, owned := rangeReceived[finalPath]
+						info, err := os.Lstat(finalPath)
+						replace, reason := true, ""
+						if err == nil && !(isRange && owned) {
+							replace, reason = replaceExisting(info, totalFileSize, fileMtime)
+						}
+						if !replace {
+							if isResume {
+								receiveErr = fmt.Errorf("拒绝续传 '%s': 文件已存在 (%s)", finalPath, reason)
+								return
+							}
+							if isDelta {
+								receiveErr = fmt.Errorf("拒绝增量传输 '%s': 文件已存在 (%s)", finalPath, reason)
+								return
+							}
+							fileLog(finalPath, -1).peer(remoteAddrStr).warn("\x1b[33m警告: 文件 '%s' 已存在，跳过 (%s)\x1b[0m", finalPath, reason)
+							if !slices.Contains(skippedFiles, finalPath) {
+								skippedFiles = append(skippedFiles, finalPath)
+							}
+							useTempFile = false
+							wireSize := fileSize
+							if aead != nil && fileSize != unknownSize {
+								wireSize = sealedSize(fileSize, aead)
+							}
+							if isCompressed {
+								_, err = decompressToFile(conn, io.Discard, fileSize, new(int64), "/dev/null")
+							} else if isFramed {
+								_, err = unframeToFile(conn, io.Discard, fileSize, new(int64), "/dev/null")
+							} else {
+								_, err = discardPayload(conn, wireSize)
+							}
+							if err != nil {
+								receiveErr = fmt.Errorf("丢弃已跳过文件 '%s' 的数据失败: %w", fileName, err)
+							} else if hasher != nil {
+								// 校验尾部同样需要读掉, 以免影响同一连接上的后续文件
+								if _, err := discardPayload(conn, int64(hasher.Size())); err != nil {
+									receiveErr = fmt.Errorf("丢弃已跳过文件 '%s' 的校验值失败: %w", fileName, err)
+								}
+							}
+							return
+						}
+					}
+					firstRange := false // 本连接是该文件第一个到达的分段
+					if isRange {
+						if _, ok := rangeReceived[finalPath]; !ok {
+							rangeReceived[finalPath] = &rangeFile{}
+							firstRange = true
+						}
+					}
+
+					// 在创建文件之前检查可用空间, 避免写到一半才因 ENOSPC 失败
+					if !isDevNull && !isStdout && !*noSpaceChk && totalFileSize > 0 {
+						need := totalFileSize
+						if isSparse {
+							need = fileSize // 空洞不占用空间
+						}
+						if isRange {
+							// 其他分段可能已经分配了部分空间
+							var st unix.Stat_t
+							if err := unix.Stat(targetPath, &st); err == nil {
+								need -= st.Blocks * 512
+							}
+						}
+						if isResume && !resumeRestart {
+							// 已有 .part 中的数据不需要再占用空间
+							if fi, err := os.Stat(targetPath); err == nil && fi.Size() <= totalFileSize {
+								need -= fi.Size()
+							}
+						}
+						if err := checkFreeSpace(fileDir, need); err != nil {
+							receiveErr = err
+							logFailedFile(roleReceiver, filepath.Join(fileDir, fileName), remoteAddrStr, totalReceived, err.Error())
+							return
+						}
+					}
+
+					// -writers: 小文件先完整接收到内存, 校验通过后交给后台写入线程创建、写入、fsync 和改名,
+					// 接收线程随即接收下一个文件. 需要在接收过程中操作目标文件的传输仍然直接写入
+					if pool != nil && useTempFile && !*tmpFile && !*oDirect && !isRange && !isSparse && !isResume && !isDelta && !ackExpected && fileSize > 0 && fileSize <= writerMaxFile {
+						job = &writeJob{remote: remoteAddrStr, name: fileName, tmpPath: targetPath, finalPath: finalPath, data: bytes.NewBuffer(make([]byte, 0, fileSize)), xattrs: fileXattrs}
+						useTempFile = false
+						fileLog(fileName, -1).peer(remoteAddrStr).debug("文件 '%s' 接收到内存后交给后台写入", fileName)
+					}
+
+					// 创建或打开目标文件/设备
+					var dstFile *os.File
+					var err error
+					if job != nil {
+						// 由写入线程创建
+					} else if isDevNull {
+						// 直接打开 /dev/null，忽略 O_DIRECT
+						dstFile, err = os.OpenFile("/dev/null", os.O_WRONLY, 0)
+						if err != nil {
+							receiveErr = fmt.Errorf("打开 /dev/null 失败: %w", err)
+							return
+						}
+					} else if isStdout {
+						dstFile = os.Stdout
+					} else {
+						// 打开常规文件，处理 O_DIRECT
+						openFlags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+						if isRange || isResume {
+							openFlags &^= os.O_TRUNC // 其他段可能已写入 / 续传时保留已接收的数据, 不能截断
+						}
+						if *appendMode {
+							openFlags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+						}
+						if *oDirect {
+							openFlags |= unix.O_DIRECT
+							peerLog(remoteAddrStr).warn("\x1b[33m警告: 使用 O_DIRECT 打开文件 %s。这将绕过页缓存，可能影响性能，并有严格的对齐要求。标准 IO 模式 (-no-splice) 可能无法正常工作。\x1b[0m", targetPath)
+						}
+						if useTempFile && *tmpFile && !isResume {
+							// O_TMPFILE 不能与 O_CREAT/O_TRUNC 同时使用
+							f, err := os.OpenFile(fileDir, unix.O_TMPFILE|os.O_WRONLY|openFlags&unix.O_DIRECT, 0644)
+							if err == nil {
+								anonFile, dstFile = f, f
+								useTempFile = false
+								targetPath = finalPath + " (O_TMPFILE)"
+								peerLog(remoteAddrStr).debug("使用 O_TMPFILE 匿名文件接收 '%s'", finalPath)
+							} else if !noTmpFile {
+								noTmpFile = true
+								peerLog(remoteAddrStr).warn("\x1b[33m警告: 无法在 '%s' 中创建 O_TMPFILE 匿名文件 (%v)，改用 .part 临时文件\x1b[0m", fileDir, err)
+							}
+						}
+						if dstFile == nil {
+							dstFile, err = os.OpenFile(targetPath, openFlags, 0644)
+							if err != nil {
+								receiveErr = &FileInfoError{FilePath: targetPath, Err: fmt.Errorf("创建/打开目标文件 '%s' 失败: %w", targetPath, err)}
+								return
+							}
+						}
+					}
+					if !isStdout && anonFile == nil && dstFile != nil { // stdout 在多个连接之间复用, 不能关闭; 匿名文件在 linkat 之后关闭
+						defer dstFile.Close()
+					}
+					if *appendMode && !isDevNull && !isStdout {
+						end, err := dstFile.Seek(0, io.SeekEnd)
+						if err != nil {
+							receiveErr = fmt.Errorf("定位到文件 '%s' 末尾失败: %w", targetPath, err)
+							return
+						}
+						appendBase = end
+						peerLog(remoteAddrStr).info("追加到 '%s' (原大小 %s bytes)", targetPath, formatWithCommas(end))
+					}
+					// 断点续传: 以已有 .part 的大小为续传位置 (发送端要求从头开始时为 0), 回复发送端后只接收剩余部分
+					if isResume {
+						var offset int64
+						if !isDevNull && !isStdout {
+							if fi, err := dstFile.Stat(); err == nil && !resumeRestart && fi.Size() <= totalFileSize {
+								offset = fi.Size()
+							}
+							if *oDirect {
+								offset -= offset % int64(directIOBlockSize(int(dstFile.Fd())))
+							}
+							if err := dstFile.Truncate(offset); err != nil {
+								receiveErr = fmt.Errorf("调整文件 '%s' 大小失败: %w", targetPath, err)
+								return
+							}
+							if _, err := dstFile.Seek(offset, io.SeekStart); err != nil {
+								receiveErr = fmt.Errorf("定位到续传位置 %d 失败: %w", offset, err)
+								return
+							}
+						}
+						setIODeadline(conn)
+						if _, err := conn.Write(binary.BigEndian.AppendUint64(nil, uint64(offset))); err != nil {
+							receiveErr = fmt.Errorf("回复续传位置失败: %w", wrapIOTimeout(err))
+							return
+						}
+						resumeReplied = true
+						fileSize = totalFileSize - offset
+						if offset > 0 {
+							peerLog(remoteAddrStr).info("续传 '%s': 从偏移量 %s bytes 继续接收 (剩余 %s bytes)", targetPath, formatWithCommas(offset), formatWithCommas(fileSize))
+						}
+					}
+
+					// 预分配（仅对常规文件且在 Linux 上; 稀疏文件预分配会把空洞也分配出来, 因此跳过）
+					// 续传时 .part 的大小就是已接收的字节数, 预分配会改变文件大小, 因此同样跳过
+					// 分段传输时由第一个到达的分段为整个文件预分配
+					if !isDevNull && !isStdout && !isSparse && !*appendMode && !isResume && (!isRange || firstRange) && totalFileSize > 0 { // No need to check runtime.GOOS
+						// 检查是否真的打开了常规文件（dstFile 可能因错误为 nil）
+						if dstFile != nil {
+							if err := preallocate(int(dstFile.Fd()), totalFileSize); err != nil {
+								// 预分配失败通常不是致命错误，记录警告即可
+								peerLog(remoteAddrStr).warn("\x1b[33m警告: 预分配文件空间 '%s' 失败: %v\x1b[0m", targetPath, err)
+							}
+						}
+					}
+
+					// 顺序写入提示 (O_DIRECT 绕过页缓存, 提示无意义)
+					if *seqHint && !*oDirect && !isDevNull && !isStdout && dstFile != nil && fileSize > 0 {
+						if err := unix.Fadvise(int(dstFile.Fd()), rangeOffset, fileSize, unix.FADV_SEQUENTIAL); err != nil {
+							peerLog(remoteAddrStr).warn("\x1b[33m警告: 设置顺序写入提示 '%s' 失败: %v\x1b[0m", targetPath, err)
+						}
+					}
+
+					// 分段传输时将文件调整为完整大小 (清除同名旧文件多余的尾部),
+					// 并定位到本段起始偏移, 之后的写入/splice 都从文件当前位置开始
+					// 稀疏文件同样先把大小设为完整大小, 未写入的区域即为空洞.
+					if (isRange || isSparse) && !isDevNull {
+						if err := dstFile.Truncate(totalFileSize); err != nil {
+							receiveErr = fmt.Errorf("调整文件 '%s' 大小失败: %w", targetPath, err)
+							return
+						}
+					}
+					if isRange {
+						if _, err := dstFile.Seek(rangeOffset, io.SeekStart); err != nil {
+							receiveErr = fmt.Errorf("定位到分段偏移量 %d 失败: %w", rangeOffset, err)
+							return
+						}
+					}
+
+					// 设置进度显示
+					var transferred int64
+					counter := &transferred // 进度计数: 分段传输时改为该文件所有分段共享的计数 (见 receiveRange)
+					startTime := time.Now()
+					done := make(chan struct{})
+					defer close(done)
+					switch {
+					case isRange:
+						// 各分段合并显示一个进度, 由 receiveRange 启动
+					case batch != nil && fileSize != unknownSize:
+						go batch.displayProgress(batch.index, batch.done, fileSize, &transferred, startTime, done)
+					default:
+						go displayProgress(fileSize, &transferred, startTime, done)
+					}
+
+					if fileSize == 0 && hasher == nil && aead == nil && !isDelta {
+						atomic.StoreInt64(&transferred, 0)
+						time.Sleep(100 * time.Millisecond)
+						completedPath = savedPath
+						return
+					}
+
+					// Get file descriptors
+					dstFd := int(dstFile.Fd())
+					srcFd := -1
+					useStandardCopy := useStandardCopy
+					if hasher != nil && !useStandardCopy {
+						peerLog(remoteAddrStr).info("发送端启用了校验，需要在用户态计算校验值，使用标准 IO 复制而不是 splice")
+						useStandardCopy = true
+					}
+					if aead != nil {
+						peerLog(remoteAddrStr).debug("加密传输需要在用户态解密数据，使用标准 IO 复制而不是 splice")
+						useStandardCopy = true
+					}
+					if *appendMode && !useStandardCopy {
+						// splice 不能写入以 O_APPEND 打开的文件 (EINVAL)
+						peerLog(remoteAddrStr).debug("-append 模式下 splice 不可用，使用标准 IO 复制")
+						useStandardCopy = true
+					}
+					if isDelta {
+						useStandardCopy = true // 数据由字面数据和已有文件的块在用户态拼接而成
+					}
+					if isCompressed {
+						useStandardCopy = true // 需要在用户态解压
+					}
+					if isFramed {
+						useStandardCopy = true // 需要在用户态逐帧检查
+					}
+					if job != nil {
+						useStandardCopy = true // 数据写入内存
+					}
+					// -tee 只复制按顺序写入的数据; 分段、稀疏和增量传输写入的不是连续的完整内容
+					tee := teeOut
+					if tee != nil && (isRange || isSparse || isDelta) {
+						fileLog(fileName, -1).peer(remoteAddrStr).warn("\x1b[33m警告: -tee 不支持分段、稀疏和增量传输, 文件 '%s' 不写入 -tee 目标\x1b[0m", fileName)
+						tee = nil
+					}
+					if tee != nil && !useStandardCopy {
+						peerLog(remoteAddrStr).debug("-tee 需要在用户态复制数据，使用标准 IO 复制而不是 splice")
+						useStandardCopy = true
+					}
+					var zc *zeroChecker
+					if *zeroVerify {
+						peerLog(remoteAddrStr).debug("-zero-verify 需要在用户态检查数据，使用标准 IO 复制而不是 splice")
+						useStandardCopy = true
+						zc = &zeroChecker{}
+					}
+
+					// 获取TCP连接的文件描述符 (仅 splice 需要); 非 TCP 连接 (如 Unix socket) 回退到标准复制
+					if _, ok := conn.(sctpConn); ok && !useStandardCopy {
+						peerLog(remoteAddrStr).debug("SCTP 连接使用标准 IO 复制")
+						useStandardCopy = true
+					}
+					if _, ok := conn.(proxyConn); ok && !useStandardCopy {
+						peerLog(remoteAddrStr).debug("经 SOCKS5 代理的连接使用标准 IO 复制")
+						useStandardCopy = true
+					}
+					if !useStandardCopy {
+						tcpConn, ok := conn.(*net.TCPConn)
+						if !ok {
+							peerLog(remoteAddrStr).info("连接不是 TCP 连接，回退到标准 IO 复制")
+							useStandardCopy = true
+						} else {
+							srcFile, err := tcpConn.File()
+							if err != nil {
+								receiveErr = fmt.Errorf("获取连接文件描述符失败: %w", err)
+								return
+							}
+							defer srcFile.Close()
+							srcFd = int(srcFile.Fd())
+						}
+					}
+
+					// splice 要求目标是普通文件或管道, stdout 为终端等其他类型时回退到标准复制
+					if isStdout && !useStandardCopy {
+						var st unix.Stat_t
+						if err := unix.Fstat(dstFd, &st); err != nil || (st.Mode&unix.S_IFMT != unix.S_IFIFO && st.Mode&unix.S_IFMT != unix.S_IFREG) {
+							peerLog(remoteAddrStr).info("stdout 不是管道或普通文件，回退到标准 IO 复制")
+							useStandardCopy = true
+						}
+					}
+
+					// --- Begin transfer ---
+					if useStandardCopy {
+						peerLog(remoteAddrStr).debug("使用标准 IO 复制而不是 splice")
+					} else {
+						peerLog(remoteAddrStr).debug("使用 splice 系统调用传输数据")
+					}
+					// O_DIRECT 要求每次写入的长度按块对齐, splice 时只把完整的块写入目标文件
+					var align int64
+					if *oDirect && !isDevNull && !isStdout {
+						align = int64(directIOBlockSize(dstFd))
+						// 解压出的数据长度不受控制, 分帧时帧边界与对齐的尾部不一致, 整个文件以缓冲写入
+						if isCompressed || isFramed {
+							if err := clearODirect(dstFd); err != nil {
+								receiveErr = fmt.Errorf("压缩或分帧传输前清除 O_DIRECT 失败: %w", err)
+								return
+							}
+							align = 0
+						}
+					}
+					// receiveSegment 将连接上的 size 字节写入目标文件的当前位置
+					receiveSegment := func(size int64) (int64, error) {
+						if useStandardCopy {
+							var dst io.Writer = dstFile
+							if job != nil {
+								dst = job.data
+							} else if *waitSpace > 0 && !isDevNull && !isStdout {
+								dst = &spaceWaitWriter{f: dstFile, path: targetPath}
+							}
+							if hasher != nil {
+								dst = io.MultiWriter(dst, hasher)
+							}
+							if tee != nil {
+								dst = io.MultiWriter(dst, tee)
+							}
+							if zc != nil {
+								// 先检查再写入, 遇到非零字节时不落盘
+								dst = io.MultiWriter(zc, dst)
+							}
+							if aead != nil {
+								return openToFile(conn, dst, aead, size, counter, targetPath)
+							}
+							if isCompressed {
+								return decompressToFile(conn, dst, size, counter, targetPath)
+							}
+							if isFramed {
+								return unframeToFile(conn, dst, size, counter, targetPath)
+							}
+							return copyToFile(conn, dst, size, counter, targetPath)
+						}
+						return spliceToFile(srcFd, dstFd, size, counter, targetPath, align)
+					}
+					// receiveAll 将连接上的 fileSize 字节按顺序写入目标文件.
+					// O_DIRECT 要求写入长度按块对齐: 完整的块走原来的路径, 不足一块的尾部清除 O_DIRECT 后再写入
+					receiveAll := func() (int64, error) {
+						var tail int64
+						if align > 0 && fileSize > 0 {
+							tail = fileSize % align
+						}
+						n, err := receiveSegment(fileSize - tail)
+						if err != nil || tail == 0 {
+							return n, err
+						}
+						if err := clearODirect(dstFd); err != nil {
+							return n, fmt.Errorf("写入未对齐的尾部前清除 O_DIRECT 失败: %w", err)
+						}
+						peerLog(remoteAddrStr).debug("O_DIRECT: 已清除 O_DIRECT, 以缓冲写入未对齐的尾部 %d 字节", tail)
+						m, err := receiveSegment(tail)
+						return n + m, err
+					}
+					// checkReceived 检查接收到的数据大小和校验值, -ack 时再把数据同步到磁盘.
+					// 只访问本文件的状态, 分段传输时在不持有 recvMu 的情况下调用
+					checkReceived := func(n int64, err error) error {
+						if err != nil {
+							return fmt.Errorf("文件 '%s' 接收失败 (已接收 %d 字节): %w", fileName, n, err)
+						}
+						if fileSize != unknownSize && n != fileSize {
+							return fmt.Errorf("文件 '%s' 接收到的数据大小 (%d) 与预期大小 (%d) 不符", fileName, n, fileSize)
+						}
+						if hasher != nil {
+							if isSparse {
+								hashZeros(hasher, totalFileSize-sparseEnd(extents))
+							}
+							if err := verifyChecksum(conn, hasher); err != nil {
+								return fmt.Errorf("文件 '%s' %w", fileName, err)
+							}
+							fileLog(fileName, -1).peer(remoteAddrStr).print("info", "\x1b[32m文件 '%s' %s 校验通过\x1b[0m", fileName, algo.name)
+							noFields.print("info", "%s 校验值: %x  %s", algo.name, hasher.Sum(nil), savedPath)
+							checksum = fmt.Sprintf("%s:%x", algo.name, hasher.Sum(nil))
+							fileDigest = hasher.Sum(nil)
+						}
+						// -ack: 回复确认之前先把数据同步到磁盘
+						if ackExpected && !isDevNull && !isStdout {
+							if err := dstFile.Sync(); err != nil {
+								return fmt.Errorf("同步文件 '%s' 到磁盘失败: %w", targetPath, err)
+							}
+						}
+						return nil
+					}
+					if isRange {
+						// 分段连接各自写入自己的区间, 传输数据期间释放 recvMu, 同一文件的其他分段可以并发处理
+						var rangeDone bool
+						recvMu.Unlock()
+						totalReceived, rangeDone, receiveErr = receiveRange(&recvMu, rangeReceived, finalPath, totalFileSize, func(shared *int64) (int64, error) {
+							counter = shared
+							n, err := receiveAll()
+							return n, checkReceived(n, err)
+						})
+						recvMu.Lock()
+						// 所有分段都收齐后才算完整接收了该文件
+						if rangeDone {
+							completedPath = savedPath
+							completedBytes = totalFileSize
+						}
+						return
+					}
+					if isDelta {
+						// 增量传输: 回复已有同名文件的块签名, 再按发送端的指令重建文件
+						var basis *os.File
+						if !isDevNull && !isStdout {
+							if f, err := os.Open(finalPath); err == nil {
+								if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+									basis = f
+									defer basis.Close()
+								} else {
+									f.Close()
+								}
+							}
+						}
+						var sig *deltaSignature
+						if sig, receiveErr = writeDeltaSignature(conn, basis); receiveErr == nil {
+							deltaReplied = true
+							var reused int64
+							totalReceived, reused, receiveErr = applyDelta(conn, dstFile, basis, sig, totalFileSize, counter, targetPath)
+							if receiveErr == nil {
+								fileLog(fileName, totalReceived-reused).peer(remoteAddrStr).print("info", "\x1b[32m增量传输: 文件 '%s' 复用已有数据 %s，接收新数据 %s，MD5 校验通过\x1b[0m",
+									fileName, formatBytes(reused), formatBytes(totalReceived-reused))
+							}
+						}
+					} else if isSparse {
+						// 稀疏文件: 依次定位到每个数据区段写入, 区段之间保留为空洞
+						var prevEnd int64
+						for _, ext := range extents {
+							if hasher != nil {
+								hashZeros(hasher, ext.offset-prevEnd)
+								prevEnd = ext.offset + ext.length
+							}
+							if _, err := dstFile.Seek(ext.offset, io.SeekStart); err != nil {
+								receiveErr = fmt.Errorf("定位到数据区段偏移量 %d 失败: %w", ext.offset, err)
+								break
+							}
+							if zc != nil {
+								zc.offset = ext.offset
+							}
+							n, err := receiveSegment(ext.length)
+							totalReceived += n
+							if err != nil {
+								receiveErr = err
+								break
+							}
+						}
+					} else {
+						totalReceived, receiveErr = receiveAll()
+					}
+					receiveErr = checkReceived(totalReceived, receiveErr)
+					if receiveErr == nil {
+						completedPath = savedPath
+						completedBytes = totalReceived
+						if isResume {
+							completedBytes = totalFileSize
+						}
+					}
+					return // more 由上面的 defer 根据接收结果设置
+				}
+
+				// 单连接多文件时依次接收, 直到收到结束标记或出错
+				defer func() {
+					// -writers: 等待交给后台写入的文件全部落盘后再计入接收结果, 写入失败的文件计为接收失败
+					for _, j := range pool.wait() {
+						if j.err != nil {
+							completedFiles--
+							failedFiles++
+							lastFailure = j.err
+							metrics.fileFailed()
+							runStats.record(j.name, j.bytes, j.err)
+							logFailedFile(roleReceiver, j.finalPath, j.remote, j.bytes, j.err.Error())
+							continue
+						}
+						metrics.fileReceived(j.bytes, j.seconds)
+						runStats.record(j.name, j.bytes, nil)
+						atomic.AddInt64(&totalBytesReceived, j.bytes)
+						totalFilesReceived++
+					}
+				}()
+				for {
+					more := receiveFile()
+					if fileReceiveError != nil {
+						failedFiles++
+						lastFailure = fileReceiveError
+						metrics.fileFailed()
+						runStats.record(fileTransferName, fileTransferred, fileReceiveError)
+					}
+					if fileTransferred > 0 && fileReceiveError == nil && !fileQueued {
+						elapsed := time.Since(fileStart).Seconds()
+						fileAvgSpeed := float64(fileTransferred) / elapsed / 1024 / 1024
+						metrics.fileReceived(fileTransferred, elapsed)
+						runStats.record(fileTransferName, fileTransferred, nil)
+						fileLog(fileTransferName, fileTransferred).peer(remoteAddrStr).print("info", "\x1b[32m传输完成，文件 '%s' 接收了 %s，速度: %.2f MB/s\x1b[0m",
+							fileTransferName, formatBytes(fileTransferred), fileAvgSpeed)
+
+						atomic.AddInt64(&totalBytesReceived, fileTransferred)
+						totalFilesReceived++
+					}
+					if !more {
+						break
+					}
+				}
+			}(conn)
+			active--
+
+			totalElapsed := time.Since(startTime).Seconds()
+			if totalBytesReceived > 0 && totalElapsed > 0 {
+				overallAvgSpeed := float64(totalBytesReceived) / totalElapsed / 1024 / 1024
+				noFields.print("info", "\x1b[32m累计接收: %d 个文件，总大小 %s，平均速度: %.2f MB/s\x1b[0m",
+					totalFilesReceived, formatBytes(totalBytesReceived), overallAvgSpeed)
+			}
+			if len(skippedFiles) > 0 {
+				noFields.print("warn", "\x1b[33m累计跳过 %d 个已存在的文件 (使用 -force 或 -if 覆盖): %s\x1b[0m", len(skippedFiles), strings.Join(skippedFiles, ", "))
+			}
+			if dedupedFiles > 0 {
+				noFields.print("info", "\x1b[32m累计跳过 %d 个内容相同的已有文件 (-dedupe)\x1b[0m", dedupedFiles)
+			}
+
+			if exiting {
+				return
+			}
+			// 达到限制后关闭监听器, 接受连接的循环等待所有连接处理完后返回 exitResult
+			if *maxFiles > 0 && completedFiles >= *maxFiles && len(rangeReceived) == 0 {
+				noFields.print("info", "已完整接收 %d 个文件，达到 -max-files 限制，停止接受新连接", completedFiles)
+				exiting, exitResult = true, exitErr()
+				listener.Close()
+				return
+			}
+			if *acceptCount > 0 && acceptedConns >= *acceptCount && len(rangeReceived) == 0 {
+				exitSummary(fmt.Sprintf("已处理 %d 个连接，达到 -accept-count 限制", acceptedConns))
+				exiting, exitResult = true, exitErr()
+				listener.Close()
+				return
+			}
+
+			if active == 0 {
+				logInfo("等待下一个连接...")
+			}
+		}(conn)
+	}
+}
+
+// bench 测量到接收端的双向吞吐量: 先上传 -size 字节的零数据, 接收端收齐后立即回传同样大小的数据,
+// 分别统计上传、下载和往返速度. 接收端使用普通的 receive 模式即可, 数据在两端都不落盘.
+// 上传耗时以收到回传的第一个字节为止, 因此包含半个 RTT.
+func bench(ctx context.Context, connectAddr string) error {
+	size, err := parseSize(*sizeStr)
+	if err != nil {
+		return fmt.Errorf("无法解析 -size 参数 '%s': %w", *sizeStr, err)
+	}
+	conn, features, closeConn, err := connectAndNegotiate(ctx, connectAddr)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+	if !features.Bench {
+		return fmt.Errorf("接收端不支持 bench (版本过旧或经过 relay 转发)")
+	}
+
+	header := fileHeader{flags: extFlagBench, name: benchFileName, size: size}
+	setIODeadline(conn)
+	if _, err := conn.Write(encodeFileHeader(features, header)); err != nil {
+		return fmt.Errorf("发送 bench 文件头失败: %w", wrapIOTimeout(err))
+	}
+
+	logInfo("上传 %s...", formatBytes(size))
+	var uploaded int64
+	start := time.Now()
+	done := make(chan struct{})
+	go displayProgress(size, &uploaded, start, done)
+	_, err = writeZeros(conn, size, &uploaded)
+	close(done)
+	if err != nil {
+		return fmt.Errorf("上传失败 (已发送 %d bytes): %w", uploaded, wrapIOTimeout(err))
+	}
+	// 收到回传的第一个字节时, 接收端已收齐上传的数据
+	first := make([]byte, 1)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, first); err != nil {
+		return fmt.Errorf("等待接收端回传数据失败: %w", wrapIOTimeout(err))
+	}
+	downloadStart := time.Now()
+
+	logInfo("下载 %s...", formatBytes(size))
+	downloaded := int64(1)
+	done = make(chan struct{})
+	go displayProgress(size, &downloaded, downloadStart, done)
+	_, err = drainConn(conn, size-1, &downloaded)
+	close(done)
+	if err != nil {
+		return fmt.Errorf("下载失败 (已接收 %d bytes): %w", downloaded, err)
+	}
+	end := time.Now()
+	if features.MultiFile {
+		if err := writeBatchEnd(conn); err != nil {
+			return err
+		}
+	}
+	time.Sleep(100 * time.Millisecond) // 允许进度显示的 goroutine 进行最后一次更新
+
+	speed := func(bytes int64, d time.Duration) float64 {
+		return float64(bytes) / max(d.Seconds(), 0.001) / 1024 / 1024
+	}
+	upload, download, total := downloadStart.Sub(start), end.Sub(downloadStart), end.Sub(start)
+	noFields.print("info", "\x1b[32mbench 完成 (%s x 2):\x1b[0m", formatBytes(size))
+	noFields.print("info", "  上传: %.2f MB/s (%v)", speed(size, upload), upload.Round(time.Millisecond))
+	noFields.print("info", "  下载: %.2f MB/s (%v)", speed(size, download), download.Round(time.Millisecond))
+	noFields.print("info", "  往返: %.2f MB/s (%v)", speed(2*size, total), total.Round(time.Millisecond))
+	return nil
+}
+
+// probe 测量到接收端的链路特性: 用 probeRounds 次 1 字节的 bench 往返估计 RTT, 通过 TCP_MAXSEG 和 IP_MTU
+// 读取 MSS 和路径 MTU, 再上传一段数据 (-size, 默认 probeSample) 估计带宽, 最后按带宽时延积建议 -sndbuf/-rcvbuf.
+// 与 bench 一样使用接收端的 bench 功能, 接收端使用普通的 receive 模式即可.
+func probe(ctx context.Context, connectAddr string) error {
+	sample := int64(probeSample)
+	if *sizeStr != "" {
+		sample, _ = parseSize(*sizeStr) // main 中已检查
+	}
+	conn, features, closeConn, err := connectAndNegotiate(ctx, connectAddr)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+	if !features.Bench || !features.MultiFile {
+		return fmt.Errorf("接收端不支持 probe (版本过旧或经过 relay 转发)")
+	}
+
+	// 1. RTT: 文件头和 1 字节数据一次写出, 收到回传的 1 字节即为一次往返
+	var rtts []time.Duration
+	reply := make([]byte, 1)
+	for i := 0; i < probeRounds; i++ {
+		msg := append(encodeFileHeader(features, fileHeader{flags: extFlagBench, name: probeFileName, size: 1}), 0)
+		start := time.Now()
+		setIODeadline(conn)
+		if _, err := conn.Write(msg); err != nil {
+			return fmt.Errorf("发送第 %d 次往返失败: %w", i+1, wrapIOTimeout(err))
+		}
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fmt.Errorf("等待第 %d 次往返的回复失败: %w", i+1, wrapIOTimeout(err))
+		}
+		rtts = append(rtts, time.Since(start))
+	}
+	minRTT, maxRTT, sum := rtts[0], rtts[0], time.Duration(0)
+	for _, d := range rtts {
+		minRTT, maxRTT, sum = min(minRTT, d), max(maxRTT, d), sum+d
+	}
+	avgRTT := sum / time.Duration(len(rtts))
+
+	// 2. MSS 和路径 MTU
+	mss, mtu, mtuErr := pathMTU(conn)
+
+	// 3. 带宽: 上传耗时计算到收到回传的第一个字节为止, 减去半个 RTT
+	logInfo("上传 %s 测量带宽...", formatBytes(sample))
+	setIODeadline(conn)
+	if _, err := conn.Write(encodeFileHeader(features, fileHeader{flags: extFlagBench, name: probeFileName, size: sample})); err != nil {
+		return fmt.Errorf("发送 probe 文件头失败: %w", wrapIOTimeout(err))
+	}
+	var uploaded, downloaded int64
+	start := time.Now()
+	if _, err := writeZeros(conn, sample, &uploaded); err != nil {
+		return fmt.Errorf("上传失败 (已发送 %d bytes): %w", uploaded, wrapIOTimeout(err))
+	}
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("等待接收端回传数据失败: %w", wrapIOTimeout(err))
+	}
+	upload := max(time.Since(start)-minRTT/2, time.Microsecond)
+	if _, err := drainConn(conn, sample-1, &downloaded); err != nil {
+		return fmt.Errorf("接收回传数据失败 (已接收 %d bytes): %w", downloaded+1, err)
+	}
+	if err := writeBatchEnd(conn); err != nil {
+		return err
+	}
+	bandwidth := float64(sample) / upload.Seconds() // bytes/s
+	bdp := int64(bandwidth * avgRTT.Seconds())
+
+	noFields.print("info", "\x1b[32mprobe 完成 (%s):\x1b[0m", connectAddr)
+	noFields.print("info", "  RTT: 最小 %v, 平均 %v, 最大 %v (%d 次往返)", minRTT.Round(time.Microsecond), avgRTT.Round(time.Microsecond), maxRTT.Round(time.Microsecond), probeRounds)
+	if mtuErr != nil {
+		noFields.print("info", "  路径 MTU: 获取失败 (%v)", mtuErr)
+	} else {
+		noFields.print("info", "  路径 MTU: %d bytes, TCP MSS: %d bytes", mtu, mss)
+	}
+	noFields.print("info", "  带宽: %.2f MB/s (上传 %s, %v)", bandwidth/1024/1024, formatBytes(sample), upload.Round(time.Millisecond))
+	noFields.print("info", "  带宽时延积: %s", formatBytes(bdp))
+	// 内核把请求的缓冲区大小翻倍, 其中约一半用于数据, 因此请求值取不小于带宽时延积的 2 的幂
+	buf := int64(64 << 10)
+	for buf < bdp {
+		buf <<= 1
+	}
+	noFields.print("info", "\x1b[32m  建议: 发送端 -sndbuf %d, 接收端 -rcvbuf %d\x1b[0m", buf, buf)
+	for _, limit := range []struct{ sysctl, path string }{
+		{"net.core.wmem_max", "/proc/sys/net/core/wmem_max"},
+		{"net.core.rmem_max", "/proc/sys/net/core/rmem_max"},
+	} {
+		data, err := os.ReadFile(limit.path)
+		if err != nil {
+			continue
+		}
+		if v, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil && buf > v {
+			noFields.print("warn", "\x1b[33m  注意: 建议值超过本机 %s (%d), 需要先调大该内核参数 (两端都需要检查)\x1b[0m", limit.sysctl, v)
+		}
+	}
+	return nil
+}
+
+// pathMTU 读取已连接 TCP socket 的 MSS (TCP_MAXSEG) 和内核缓存的路径 MTU (IP_MTU / IPV6_MTU)
+func pathMTU(conn net.Conn) (mss, mtu int, err error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return 0, 0, fmt.Errorf("不是 TCP 连接")
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	level, opt := unix.IPPROTO_IP, unix.IP_MTU
+	if addr, ok := tcpConn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		level, opt = unix.IPPROTO_IPV6, unix.IPV6_MTU
+	}
+	var sockErr error
+	if err := rawConn.Control(func(fd uintptr) {
+		if mss, sockErr = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_MAXSEG); sockErr != nil {
+			sockErr = fmt.Errorf("读取 TCP_MAXSEG 失败: %w", sockErr)
+			return
+		}
+		if mtu, sockErr = unix.GetsockoptInt(int(fd), level, opt); sockErr != nil {
+			sockErr = fmt.Errorf("读取路径 MTU 失败: %w", sockErr)
+		}
+	}); err != nil {
+		return 0, 0, err
+	}
+	return mss, mtu, sockErr
+}
+
+// writeZeros 向连接写入 size 字节的零数据, 与发送 /dev/zero 一样使用标准写入
+func writeZeros(conn net.Conn, size int64, transferred *int64) (int64, error) {
+	return io.CopyBuffer(&progressUpdater{conn: conn, transferred: transferred}, &zeroReader{size: size}, make([]byte, copyBufferSize))
+}
+
+// drainConn 读取并丢弃连接上的 size 字节; TCP 连接时 splice 到 /dev/null, 数据不经过用户态
+func drainConn(conn net.Conn, size int64, transferred *int64) (int64, error) {
+	devNull, err := os.OpenFile("/dev/null", os.O_WRONLY, 0)
+	if err != nil {
+		return 0, fmt.Errorf("打开 /dev/null 失败: %w", err)
+	}
+	defer devNull.Close()
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		connFile, err := tcpConn.File()
+		if err != nil {
+			return 0, fmt.Errorf("获取连接文件描述符失败: %w", err)
+		}
+		defer connFile.Close()
+		return spliceToFile(int(connFile.Fd()), int(devNull.Fd()), size, transferred, "/dev/null", 0)
+	}
+	return copyToFile(conn, devNull, size, transferred, "/dev/null")
+}
+
+// serve 监听 listenAddr, 按 get 端的请求发送 dirPath 中的文件. 请求被接受后服务端转为发送端,
+// 之后的握手、能力协商和文件传输与 send 模式完全相同, 因此 -verify, -sparse, -psk, -limit 等发送端选项照常生效.
+func serve(listenAddr, dirPath string) error {
+	if info, err := os.Stat(dirPath); err != nil {
+		return &FileInfoError{FilePath: dirPath, Err: err}
+	} else if !info.IsDir() {
+		return &FileInfoError{FilePath: dirPath, Err: fmt.Errorf("不是目录")}
+	}
+	if *netType == "unix" {
+		removeStaleSocket(listenAddr)
+	}
+	lc := newListenConfig()
+	listener, err := listenStream(lc, listenAddr)
+	if err != nil {
+		return fmt.Errorf("监听 %s 失败: %w", listenAddr, err)
+	}
+	defer listener.Close()
+	logInfo("\x1b[32m服务端启动，正在监听 %s，提供目录 %s\x1b[0m", listenAddr, dirPath)
+
+	for { // 与接收端一样顺序处理连接
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logWarn("\x1b[33m警告: 接受连接失败: %v\x1b[0m", err)
+			continue
+		}
+		serveConn(conn, dirPath)
+		logInfo("等待下一个连接...")
+	}
+}
+
+// serveConn 处理单个 get 请求: 读取请求的文件名, 回复是否可以发送, 然后作为发送端发送该文件
+func serveConn(conn net.Conn, dirPath string) {
+	defer conn.Close()
+	remoteAddrStr := conn.RemoteAddr().String()
+	if remoteAddrStr == "" || remoteAddrStr == "@" {
+		remoteAddrStr = "unix"
+	}
+	applySendBuffer(conn)
+	applyNoDelay(conn)
+	applyKeepAlive(conn)
+	applyUserTimeout(conn)
+	logMultipath(conn)
+
+	name, err := readPullRequest(conn)
+	if err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", err)
+		return
+	}
+	path := filepath.Join(dirPath, name)
+	status := byte(pullOK)
+	if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+		status = pullNotFound
+	}
+	setIODeadline(conn)
+	if _, err := conn.Write([]byte{status}); err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: 回复请求失败: %v\x1b[0m", wrapIOTimeout(err))
+		return
+	}
+	if status != pullOK {
+		fileLog(name, -1).peer(remoteAddrStr).warn("\x1b[33m拒绝请求: 文件 '%s' 不存在或不是常规文件\x1b[0m", name)
+		return
+	}
+	fileLog(name, -1).peer(remoteAddrStr).info("请求文件 '%s'，开始发送...", name)
+
+	if err := writeHandshake(conn); err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", err)
+		return
+	}
+	features, err := negotiate(conn, senderCapabilities())
+	if err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", err)
+		return
+	}
+	if pskKey != nil && !features.Encrypt {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: 拉取端不支持加密传输，拒绝以明文发送\x1b[0m")
+		return
+	}
+	var offset int64
+	err = sendFile(conn, features, path, &offset)
+	if err == nil && features.MultiFile {
+		err = writeBatchEnd(conn)
+	}
+	if err != nil {
+		fileLog(name, -1).peer(remoteAddrStr).error("\x1b[31m错误: 发送文件 '%s' 失败: %v\x1b[0m", name, err)
+		logFailedFile(roleSender, path, remoteAddrStr, offset, err.Error())
+	}
+}
+
+// get 连接 serve 模式的服务端并请求文件 name. 请求被接受后服务端转为发送端,
+// 这条连接交给接收端的处理逻辑, 文件按 receive 模式的规则写入 dirPath.
+func get(ctx context.Context, name, connectAddr, dirPath string) error {
+	if err := probeWritable(dirPath); err != nil {
+		return err
+	}
+	conn, err := dialWithRetry(ctx, network(), connectAddr)
+	if err != nil {
+		return fmt.Errorf("连接失败 %s: %w", connectAddr, err)
+	}
+	peerLog(connectAddr).info("\x1b[32m已连接到服务端\x1b[0m")
+	if err := writePullRequest(conn, name); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := receiveConns(newSingleConnListener(conn), dirPath, *noSplice); err != nil {
+		return err
+	}
+	// 连接在收到文件头之前中断时接收端只记录日志, 这里以目标文件是否存在判断是否拉取成功
+	if dirPath != "-" && dirPath != "/dev/null" {
+		if _, err := os.Stat(filepath.Join(dirPath, name)); err != nil {
+			return &FileInfoError{FilePath: name, Err: fmt.Errorf("连接已结束但没有收到文件")}
+		}
+	}
+	return nil
+}
+
+// writePullRequest 发送 get 请求: 魔数和协议版本, 2 字节文件名长度和文件名, 然后读取服务端的 1 字节回复
+func writePullRequest(conn net.Conn, name string) error {
+	buf := append([]byte(protocolMagic), protocolVersion)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(name)))
+	buf = append(buf, name...)
+	setIODeadline(conn)
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("发送请求失败: %w", wrapIOTimeout(err))
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); err != nil {
+		return fmt.Errorf("读取服务端回复失败: %w", wrapIOTimeout(err))
+	}
+	if status[0] != pullOK {
+		return &FileInfoError{FilePath: name, Err: errPullRefused}
+	}
+	return nil
+}
+
+// readPullRequest 读取并校验 get 请求, 返回请求的文件名
+func readPullRequest(conn net.Conn) (string, error) {
+	if err := readHandshake(conn); err != nil {
+		return "", err
+	}
+	lenBuf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, lenBuf); err != nil {
+		return "", fmt.Errorf("读取请求失败: %w", wrapIOTimeout(err))
+	}
+	nameBuf := make([]byte, binary.BigEndian.Uint16(lenBuf))
+	if _, err := io.ReadFull(conn, nameBuf); err != nil {
+		return "", fmt.Errorf("读取请求失败: %w", wrapIOTimeout(err))
+	}
+	name := string(nameBuf)
+	if err := validateFileName(name); err != nil {
+		return "", fmt.Errorf("无效的请求: %w", err)
+	}
+	return name, nil
+}
+
+// singleConnListener 把一条已建立的连接包装成 net.Listener, 供 get 模式复用接收端的连接处理逻辑:
+// 第一次 Accept 返回该连接, 之后的 Accept 阻塞到 Close 为止
+type singleConnListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	addr      net.Addr
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{conns: make(chan net.Conn, 1), closed: make(chan struct{}), addr: conn.LocalAddr()}
+	l.conns <- conn
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// relay 监听 listenAddr, 把每个传入的连接转发到 forwardAddr (接收端或另一个 relay), 不在本地落盘.
+// 握手和能力协商分别与两端完成: 先与下一跳协商, 再只向发送端提供下一跳也支持的功能;
+// 之后的文件头和数据不做解析, 原样转发, 因此文件名、大小等字段端到端保持不变.
+func relay(listenAddr, forwardAddr string) error {
+	if *netType == "unix" {
+		removeStaleSocket(listenAddr)
+	}
+	lc := newListenConfig()
+	listener, err := listenStream(lc, listenAddr)
+	if err != nil {
+		return fmt.Errorf("监听 %s 失败: %w", listenAddr, err)
+	}
+	defer listener.Close()
+	logInfo("\x1b[32m转发端启动，正在监听 %s，转发到 %s\x1b[0m", listenAddr, forwardAddr)
+
+	for { // 与接收端一样顺序处理连接
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			logWarn("\x1b[33m警告: 接受连接失败: %v\x1b[0m", err)
+			continue
+		}
+		relayConn(conn, forwardAddr)
+		logInfo("等待下一个连接...")
+	}
+}
+
+// relayConn 转发单个传入连接, 直到发送端关闭连接或任一端出错
+func relayConn(in net.Conn, forwardAddr string) {
+	defer in.Close()
+	remoteAddrStr := in.RemoteAddr().String()
+	if remoteAddrStr == "" || remoteAddrStr == "@" {
+		remoteAddrStr = "unix"
+	}
+	peerLog(remoteAddrStr).info("接收到连接，开始转发到 %s", forwardAddr)
+	applyNoDelay(in)
+	applyKeepAlive(in)
+	applyUserTimeout(in)
+	logMultipath(in)
+
+	if err := readHandshake(in); err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", err)
+		return
+	}
+	out, downstream, closeOut, err := connectAndNegotiate(context.Background(), forwardAddr)
+	if err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: 连接下一跳失败: %v\x1b[0m", err)
+		return
+	}
+	defer closeOut()
+	// bench、-checksum-only、-resume、-ack、-delta 和 -dedupe 需要接收端向发送端回传数据, 而转发只有单向, 因此不向上游声明
+	if _, err := negotiate(in, downstream.caps()&^(capBench|capChecksumOnly|capResume|capAck|capDelta|capDedupe)); err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: %v\x1b[0m", err)
+		return
+	}
+
+	var transferred int64
+	startTime := time.Now()
+	done := make(chan struct{})
+	go displayProgress(unknownSize, &transferred, startTime, done)
+	relayed, err := relayStream(in, out, &transferred, forwardAddr)
+	if err == nil {
+		err = finishSend(out)
+	}
+	close(done)
+	if err != nil {
+		peerLog(remoteAddrStr).error("\x1b[31m错误: 转发中断 (已转发 %s): %v\x1b[0m", formatBytes(relayed), err)
+		return
+	}
+	elapsed := time.Since(startTime).Seconds()
+	peerLog(remoteAddrStr).print("info", "\x1b[32m转发完成，%s -> %s，速度: %.2f MB/s\x1b[0m",
+		formatBytes(relayed), forwardAddr, float64(relayed)/elapsed/1024/1024)
+}
+
+// relayStream 把 in 上的数据原样写到 out, 直到 in 关闭. 两端都是 TCP 连接时通过管道 splice, 数据不经过用户态;
+// 否则 (如 Unix socket 或一对多转发) 使用标准 IO 复制.
+func relayStream(in, out net.Conn, transferred *int64, forwardAddr string) (int64, error) {
+	inTCP, inOK := in.(*net.TCPConn)
+	outTCP, outOK := out.(*net.TCPConn)
+	if inOK && outOK {
+		inFile, err := inTCP.File()
+		if err != nil {
+			return 0, fmt.Errorf("获取传入连接文件描述符失败: %w", err)
+		}
+		defer inFile.Close()
+		outFile, err := outTCP.File()
+		if err != nil {
+			return 0, fmt.Errorf("获取下一跳连接文件描述符失败: %w", err)
+		}
+		defer outFile.Close()
+		return spliceToFile(int(inFile.Fd()), int(outFile.Fd()), unknownSize, transferred, forwardAddr, 0)
+	}
+	return copyToFile(in, out, unknownSize, transferred, forwardAddr)
+}
+
+// checksumOnlyVerify 处理 -checksum-only 文件头: 读取发送端的校验值, 重新计算本地文件 path 的校验值并比对,
+// 把结果以 1 字节回复给发送端. path 为空表示接收端不保存文件 (-dir 为 /dev/null 或 -), 无法校验
+func checksumOnlyVerify(conn net.Conn, path string, size int64, algo checksumAlgo) ([]byte, error) {
+	trailer := make([]byte, algo.newHash().Size())
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, trailer); err != nil {
+		return nil, fmt.Errorf("读取校验值失败: %w", wrapIOTimeout(err))
+	}
+
+	status := byte(checksumOnlyMatch)
+	var digest []byte
+	var err error
+	if path == "" {
+		status, err = checksumOnlyMissing, fmt.Errorf("接收端不保存文件 (-dir 为 /dev/null 或 -), 无法校验")
+	} else if info, serr := os.Stat(path); serr != nil || !info.Mode().IsRegular() {
+		status, err = checksumOnlyMissing, fmt.Errorf("本地文件 '%s' %w", path, errRemoteMissing)
+	} else if info.Size() != size {
+		status, err = checksumOnlyMismatch, fmt.Errorf("%w: 本地文件大小 %d 与发送端的 %d 不符", errChecksumMismatch, info.Size(), size)
+	} else if digest, err = fileDigest(path, algo); err != nil {
+		status = checksumOnlyMissing
+	} else if !bytes.Equal(trailer, digest) {
+		status, err = checksumOnlyMismatch, fmt.Errorf("%w: 发送端 %x, 接收端 %x", errChecksumMismatch, trailer, digest)
+	}
+
+	setIODeadline(conn)
+	if _, werr := conn.Write([]byte{status}); werr != nil && err == nil {
+		err = fmt.Errorf("回复校验结果失败: %w", wrapIOTimeout(werr))
+	}
+	return digest, err
+}
+
+// dedupeCheck 比对 -dedupe 文件头的校验值与 fileDir 中的同名已有文件, 返回该文件的路径和回复给发送端的结果,
+// 内容不同且按 -if 不替换时同时返回原因. 不保存文件 (-dir 为 /dev/null 或 -) 或使用 -append 时总是需要传输
+func dedupeCheck(fileDir, fileName string, size int64, mtime time.Time, algo checksumAlgo, digest []byte) (string, byte, string) {
+	if fileDir == "/dev/null" || fileDir == "-" || *appendMode {
+		return "", dedupeSend, ""
+	}
+	path := filepath.Join(fileDir, fileName)
+	info, err := os.Lstat(path)
+	if err != nil {
+		return path, dedupeSend, ""
+	}
+	if info.Mode().IsRegular() && info.Size() == size {
+		if local, err := fileDigest(path, algo); err == nil && bytes.Equal(local, digest) {
+			return path, dedupeSame, ""
+		}
+	}
+	if replace, reason := replaceExisting(info, size, mtime); !replace {
+		return path, dedupeExists, reason
+	}
+	return path, dedupeSend, ""
+}
+
+// replaceExisting 按 -if 判断是否用发送端的文件替换已存在的目标 info, size 和 mtime 是文件头中的大小和修改时间
+// (mtime 为零值表示发送端没有提供). 不替换时同时返回原因, 用于跳过时的提示
+func replaceExisting(info os.FileInfo, size int64, mtime time.Time) (bool, string) {
+	switch *ifPolicy {
+	case "always":
+		return true, ""
+	case "newer":
+		if mtime.IsZero() {
+			return false, "发送端没有提供修改时间, 无法按 -if newer 比较"
+		}
+		if !mtime.After(info.ModTime()) {
+			return false, fmt.Sprintf("已有文件的修改时间 %s 不早于源文件的 %s", info.ModTime().Format(time.DateTime), mtime.Format(time.DateTime))
+		}
+		return true, ""
+	case "size-differs":
+		if info.Size() == size {
+			return false, fmt.Sprintf("大小相同 (%d bytes)", size)
+		}
+		return true, ""
+	}
+	return false, "使用 -force 或 -if 覆盖"
+}
+
+// fileDigest 计算文件 path 的完整内容在 algo 下的摘要
+func fileDigest(path string, algo checksumAlgo) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, &FileInfoError{FilePath: path, Err: err}
+	}
+	defer f.Close()
+	h := algo.newHash()
+	if _, err := io.CopyBuffer(h, f, make([]byte, copyBufferSize)); err != nil {
+		return nil, &FileInfoError{FilePath: path, Err: fmt.Errorf("读取文件失败: %w", err)}
+	}
+	return h.Sum(nil), nil
+}
+
+// benchEcho 处理 bench 请求: 读取并丢弃 size 字节, 然后立即回传同样大小的零数据.
+// quiet 时 (probe 模式的多次小往返) 只在 -log-level debug 时输出结果
+func benchEcho(conn net.Conn, size int64, remoteAddrStr string, quiet bool) error {
+	start := time.Now()
+	var received, sent int64
+	if _, err := drainConn(conn, size, &received); err != nil {
+		return fmt.Errorf("bench 接收数据失败 (已接收 %d bytes): %w", received, err)
+	}
+	uploadSeconds := time.Since(start).Seconds()
+	if _, err := writeZeros(conn, size, &sent); err != nil {
+		return fmt.Errorf("bench 回传数据失败 (已发送 %d bytes): %w", sent, wrapIOTimeout(err))
+	}
+	msg := fmt.Sprintf("\x1b[32mbench: 接收 %s (%.2f MB/s) 并已回传\x1b[0m", formatBytes(size), float64(size)/max(uploadSeconds, 0.001)/1024/1024)
+	if quiet {
+		peerLog(remoteAddrStr).debug("%s", msg)
+	} else {
+		peerLog(remoteAddrStr).print("info", "%s", msg)
+	}
+	return nil
+}
+
+// dryRunCheck 校验 dry-run 文件头对应的目标: 目标是否已存在 (按 -if 是否会被替换) 以及可用空间是否足以容纳 need 字节.
+// 不创建任何目录或文件; 目标目录不存在时检查其最近的已存在上级目录所在的文件系统.
+func dryRunCheck(dirPath, fileName string, need, size int64, mtime time.Time) error {
+	if dirPath == "/dev/null" || dirPath == "-" {
+		return nil
+	}
+	finalPath := filepath.Join(dirPath, fileName)
+	if info, err := os.Lstat(finalPath); err == nil && !*appendMode {
+		if replace, reason := replaceExisting(info, size, mtime); !replace {
+			fileLog(finalPath, -1).warn("\x1b[33m[dry-run] 文件 '%s' 已存在，实际传输时将跳过 (%s)\x1b[0m", finalPath, reason)
+			return nil
+		}
+	}
+	if *noSpaceChk || need <= 0 {
+		return nil
+	}
+	return checkFreeSpace(nearestExisting(dirPath), need)
+}
+
+// probeWritable 在接收开始前检查 dirPath 是否可写: 在其中创建并删除一个临时文件,
+// 只读挂载或没有权限时立即失败, 而不是等到接受连接并读完文件头后才在 os.OpenFile 处出错.
+// dirPath 尚不存在时 (稍后由 MkdirAll 创建) 探测其最近的已存在上级目录, 不留下任何目录.
+func probeWritable(dirPath string) error {
+	if dirPath == "/dev/null" || dirPath == "-" {
+		return nil
+	}
+	existing := dirPath
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return &FileInfoError{FilePath: existing, Err: fmt.Errorf("不是目录")}
+			}
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return &FileInfoError{FilePath: dirPath, Err: err}
+		}
+		existing = parent
+	}
+	f, err := os.CreateTemp(existing, ".ftgo-probe-*")
+	if err != nil {
+		reason := "无法创建文件"
+		switch {
+		case errors.Is(err, unix.EROFS):
+			reason = "只读文件系统"
+		case errors.Is(err, os.ErrPermission):
+			reason = "没有写权限"
+		}
+		return &FileInfoError{FilePath: dirPath, Err: fmt.Errorf("接收目录不可写 (%s): %w", reason, err)}
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return nil
+}
+
+// copyToFile 使用标准 IO 将连接上的 size 字节写入 dst (size 为 unknownSize 时读到连接关闭为止).
+// 读取和写入分别在两个 goroutine 中进行, 返回实际写入的字节数.
+func copyToFile(conn net.Conn, dst io.Writer, size int64, transferred *int64, targetPath string) (int64, error) {
+	readCh := make(chan []byte) // 通道传递数据副本
+	readErr := make(chan error, 1)
+	stop := make(chan struct{})
+
+	// 启动读取goroutine (每次最多读取剩余字节数, 不会读到属于后续数据的内容)
+	go func() {
+		defer close(readCh)
+		defer pinThread(netCPUs, "网络读取")()
+		buffer := make([]byte, copyBufferSize)
+		var read int64
+		for size == unknownSize || read < size {
+			want := int64(len(buffer))
+			if size != unknownSize && size-read < want {
+				want = size - read
+			}
+			setIODeadline(conn)
+			n, err := conn.Read(buffer[:want])
+			if n > 0 {
+				waitRx(int64(n))
+				// 创建数据副本并发送
+				dataCopy := make([]byte, n)
+				copy(dataCopy, buffer[:n])
+				select {
+				case readCh <- dataCopy:
+				case <-stop:
+					return
+				}
+				read += int64(n)
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr <- fmt.Errorf("读取数据失败: %w", wrapIOTimeout(err))
+				}
+				return // EOF: 连接关闭, 由调用方根据大小判断是否完整
+			}
+		}
+	}()
+
+	// 处理写入
+	defer pinThread(diskCPUs, "磁盘写入")()
+	var written int64
+	for data := range readCh {
+		n, err := dst.Write(data)
+		if err != nil {
+			close(stop)
+			return written, fmt.Errorf("写入文件 '%s' 失败: %w", targetPath, err)
+		}
+		// 检查写入的字节数是否与接收到的数据块大小一致
+		if n != len(data) {
+			close(stop)
+			return written, fmt.Errorf("写入文件 '%s' 不完整: 预期 %d, 实际 %d", targetPath, len(data), n)
+		}
+		atomic.AddInt64(transferred, int64(n))
+		written += int64(n)
+	}
+	select {
+	case err := <-readErr:
+		return written, err
+	default:
+		return written, nil
+	}
+}
+
+// affinityWarnOnce 保证绑定 CPU 失败的警告只输出一次
+var affinityWarnOnce sync.Once
+
+// pinThread 把当前 goroutine 锁定到所在的系统线程并绑定到 set 中的 CPU (-cpu-affinity), 返回的函数恢复
+// 线程原来的绑定并解除锁定. set 为 nil 或系统调用失败时 (只警告一次) 不做任何事
+func pinThread(set *unix.CPUSet, role string) (restore func()) {
+	if set == nil {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	var prev unix.CPUSet
+	err := unix.SchedGetaffinity(0, &prev)
+	if err == nil {
+		err = unix.SchedSetaffinity(0, set)
+	}
+	if err != nil {
+		runtime.UnlockOSThread()
+		affinityWarnOnce.Do(func() {
+			logWarn("\x1b[33m警告: 绑定%s线程到指定 CPU 失败 (%v)，-cpu-affinity 不生效\x1b[0m", role, err)
+		})
+		return func() {}
+	}
+	logDebug("已将%s线程绑定到 %d 个 CPU", role, set.Count())
+	return func() {
+		unix.SchedSetaffinity(0, &prev)
+		runtime.UnlockOSThread()
+	}
+}
+
+// spliceToFile 通过管道将 socket 上的 size 字节 splice 到 dstFd 的当前位置
+// (size 为 unknownSize 时读到连接关闭为止), 返回实际写入的字节数.
+// align > 1 表示 dstFd 以 O_DIRECT 打开, 每次只写入 align 整数倍的字节 (size 本身应已对齐)
+func spliceToFile(srcFd, dstFd int, size int64, transferred *int64, targetPath string, align int64) (int64, error) {
+	pipeFds := make([]int, 2)
+	if err := unix.Pipe(pipeFds); err != nil {
+		return 0, fmt.Errorf("创建管道失败: %w", err)
+	}
+	defer unix.Close(pipeFds[0])
+	defer unix.Close(pipeFds[1])
+
+	// 设置管道缓冲区大小为最大值（可选）
+	unix.FcntlInt(uintptr(pipeFds[0]), unix.F_SETPIPE_SZ, copyBufferSize*4)
+	unix.FcntlInt(uintptr(pipeFds[1]), unix.F_SETPIPE_SZ, copyBufferSize*4)
+
+	watchdog := startIOWatchdog(srcFd, transferred, *ioTimeout)
+	defer watchdog.Stop()
+	timeoutErr := func(total int64) error {
+		return fmt.Errorf("接收中断 (%w, %v 内无数据进展, 已接收 %d 字节)", errIOTimeout, *ioTimeout, total)
+	}
+
+	// drain 把管道中的 n 字节写入目标 (目标为管道时可能只写入一部分, 循环直到写完)
+	var total int64
+	drain := func(n int64) error {
+		var written int64
+		for written < n {
+			w, err := unix.Splice(pipeFds[0], nil, dstFd, nil, int(n-written), unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
+			sendfileStats.splice(w)
+			if isNoSpace(err) && *waitSpace > 0 && waitForSpace(dstFd, targetPath, n-written) {
+				continue // 未写入的数据仍在管道中
+			}
+			if err == unix.EINVAL && align > 1 {
+				// 管道中的页来自 socket, 内存地址不一定对齐, 文件偏移也可能未对齐 (如分段传输),
+				// 此时 O_DIRECT 写入失败, 清除 O_DIRECT 后以缓冲写入继续, 数据仍在管道中
+				if cerr := clearODirect(dstFd); cerr == nil {
+					logWarn("\x1b[33m警告: splice 写入 O_DIRECT 文件 '%s' 失败 (未对齐), 改为缓冲写入\x1b[0m", targetPath)
+					align = 0
+					continue
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("从管道到文件 '%s' 的 splice 操作失败: %w", targetPath, err)
+			}
+			if w == 0 {
+				return fmt.Errorf("splice 写入文件 '%s' 不完整: 预期 %d, 实际 %d", targetPath, n, written)
+			}
+			written += w
+			atomic.AddInt64(transferred, w)
+			total += w
+		}
+		return nil
+	}
+
+	var pending int64 // 已读入管道但尚未写入目标的字节数
+	for size == unknownSize || total+pending < size {
+		// 从socket读取数据到管道 (每次最多读取剩余字节数)
+		chunk := int64(copyBufferSize)
+		if size != unknownSize && size-total-pending < chunk {
+			chunk = size - total - pending
+		}
+		n, err := unix.Splice(srcFd, nil, pipeFds[1], nil, int(chunk), unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
+		sendfileStats.splice(n)
+		waitRx(n)
+		if watchdog.TimedOut() {
+			return total, timeoutErr(total)
+		}
+		if err != nil {
+			return total, fmt.Errorf("从 socket 到管道的 splice 操作失败: %w", err)
+		}
+		if n == 0 {
+			break // 连接关闭
+		}
+		pending += int64(n)
+
+		// 目标要求按块对齐 (align > 1, O_DIRECT) 时只写出完整的块, 不足一块的部分留在管道中与后续数据合并
+		flush := pending
+		if align > 1 {
+			flush -= pending % align
+		}
+		if err := drain(flush); err != nil {
+			return total, err
+		}
+		pending -= flush
+	}
+	// 连接提前关闭时写出管道中剩余的数据
+	if pending > 0 {
+		if err := drain(pending); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// extent 表示文件中的一个数据区段
+type extent struct {
+	offset int64
+	length int64
+}
+
+// dataExtents 使用 SEEK_DATA/SEEK_HOLE 枚举文件中的数据区段 (跳过空洞).
+// 文件系统不支持时返回覆盖整个文件的单个区段.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	fd := int(f.Fd())
+	extents := []extent{} // 非 nil: 全是空洞的文件也按稀疏格式发送
+	var off int64
+	for off < size {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break // off 之后全是空洞
+		}
+		if err == unix.EINVAL || err == unix.EOPNOTSUPP {
+			return []extent{{offset: 0, length: size}}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("SEEK_DATA 失败: %w", err)
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, fmt.Errorf("SEEK_HOLE 失败: %w", err)
+		}
+		hole = min(hole, size)
+		if hole > data {
+			extents = append(extents, extent{offset: data, length: hole - data})
+		}
+		off = hole
+	}
+	return extents, nil
+}
+
+// sparseExtents 打开文件并返回其数据区段
+func sparseExtents(filePath string, size int64) ([]extent, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("打开源文件失败: %w", err)
+	}
+	defer f.Close()
+	return dataExtents(f, size)
+}
+
+// encodeExtents 编码稀疏文件的区段表: count(4) + count 个 (offset(8), length(8))
+func encodeExtents(extents []extent) []byte {
+	buf := make([]byte, 0, 4+len(extents)*16)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(extents)))
+	for _, ext := range extents {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(ext.offset))
+		buf = binary.BigEndian.AppendUint64(buf, uint64(ext.length))
+	}
+	return buf
+}
+
+// readExtents 读取旧格式文件头中稀疏文件的区段表, 区段数不超过 maxSparseExtents
+func readExtents(conn net.Conn) ([]extent, error) {
+	countBytes := make([]byte, 4)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, countBytes); err != nil {
+		return nil, fmt.Errorf("读取稀疏区段数失败: %w", wrapIOTimeout(err))
+	}
+	count := binary.BigEndian.Uint32(countBytes)
+	if count > maxSparseExtents {
+		return nil, fmt.Errorf("稀疏区段数 %d 超过上限 %d", count, maxSparseExtents)
+	}
+	table := make([]byte, int(count)*16)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, table); err != nil {
+		return nil, fmt.Errorf("读取稀疏区段表失败: %w", wrapIOTimeout(err))
+	}
+	extents := make([]extent, count)
+	for i := range extents {
+		extents[i] = extent{offset: int64(binary.BigEndian.Uint64(table[i*16:])), length: int64(binary.BigEndian.Uint64(table[i*16+8:]))}
+	}
+	return extents, nil
+}
+
+// checkExtents 校验稀疏文件的区段表: 区段必须按偏移升序、互不重叠且位于文件大小之内
+func checkExtents(extents []extent, fileSize int64) error {
+	if len(extents) > maxSparseExtents {
+		return fmt.Errorf("稀疏区段数 %d 超过上限 %d", len(extents), maxSparseExtents)
+	}
+	var prevEnd int64
+	for _, ext := range extents {
+		if ext.offset < prevEnd || ext.length <= 0 || ext.offset > fileSize-ext.length {
+			return fmt.Errorf("无效的稀疏区段 [%d, +%d) (文件大小 %d)", ext.offset, ext.length, fileSize)
+		}
+		prevEnd = ext.offset + ext.length
+	}
+	return nil
+}
+
+// hashZeros 把 n 个零字节计入 h. 稀疏文件的空洞不在连接上传输, 两端都按零字节计入校验值,
+// 使校验值与对完整文件运行 md5sum/sha256sum 等工具的结果一致.
+func hashZeros(h hash.Hash, n int64) {
+	zeros := make([]byte, min(n, copyBufferSize))
+	for n > 0 {
+		k := min(n, int64(len(zeros)))
+		h.Write(zeros[:k])
+		n -= k
+	}
+}
+
+// sparseEnd 返回最后一个数据区段的结束偏移, 其后直到文件末尾都是空洞
+func sparseEnd(extents []extent) int64 {
+	if len(extents) == 0 {
+		return 0
+	}
+	last := extents[len(extents)-1]
+	return last.offset + last.length
+}
+
+// verifyChecksum 读取发送端附带的校验尾部 (长度为 hasher.Size() 字节) 并与本地计算的值比对
+func verifyChecksum(conn net.Conn, hasher hash.Hash) error {
+	trailer := make([]byte, hasher.Size())
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, trailer); err != nil {
+		return fmt.Errorf("读取校验值失败: %w", wrapIOTimeout(err))
+	}
+	if got := hasher.Sum(nil); !bytes.Equal(trailer, got) {
+		return fmt.Errorf("%w: 发送端 %x, 接收端 %x", errChecksumMismatch, trailer, got)
+	}
+	return nil
+}
+
+// xattr 是一个扩展属性. POSIX ACL 以 system.posix_acl_access / system.posix_acl_default 的形式保存,
+// SELinux 标签为 security.selinux, 因此 -xattrs 同时保留这两者
+type xattr struct {
+	name  string
+	value []byte
+}
+
+// maxXattrsSize 是文件头中扩展属性的总大小上限, 超过时发送端不附带扩展属性
+const maxXattrsSize = 1 << 20
+
+// encodeXattrs 编码扩展属性: [个数 u32] + 每个属性 [名称长度 u16][名称][值长度 u32][值]
+func encodeXattrs(attrs []xattr) []byte {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(attrs)))
+	for _, a := range attrs {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(a.name)))
+		buf = append(buf, a.name...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(a.value)))
+		buf = append(buf, a.value...)
+	}
+	return buf
+}
+
+// decodeXattrs 解析 encodeXattrs 编码的扩展属性
+func decodeXattrs(b []byte) ([]xattr, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("文件头中的扩展属性被截断")
+	}
+	count := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	var attrs []xattr
+	for i := uint32(0); i < count; i++ {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("文件头中的扩展属性被截断")
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if n == 0 || len(b) < 2+n+4 {
+			return nil, fmt.Errorf("文件头中的扩展属性名称无效")
+		}
+		name := string(b[2 : 2+n])
+		b = b[2+n:]
+		vlen := binary.BigEndian.Uint32(b)
+		if uint64(vlen) > uint64(len(b)-4) {
+			return nil, fmt.Errorf("扩展属性 '%s' 的值超出文件头", name)
+		}
+		attrs = append(attrs, xattr{name: name, value: b[4 : 4+vlen]})
+		b = b[4+vlen:]
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("文件头中的扩展属性之后有多余的数据")
+	}
+	return attrs, nil
+}
+
+// readXattrs 读取 path 自身 (不跟随符号链接) 的全部扩展属性
+func readXattrs(path string) ([]xattr, error) {
+	var names []byte
+	for {
+		n, err := unix.Llistxattr(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, nil
+		}
+		names = make([]byte, n)
+		n, err = unix.Llistxattr(path, names)
+		if errors.Is(err, unix.ERANGE) {
+			continue // 两次调用之间属性被修改, 重新获取长度
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = names[:n]
+		break
+	}
+	var attrs []xattr
+	for _, name := range strings.Split(strings.TrimRight(string(names), "\x00"), "\x00") {
+		for {
+			n, err := unix.Lgetxattr(path, name, nil)
+			if errors.Is(err, unix.ENODATA) {
+				break // 属性在列出之后被删除
+			}
+			if err != nil {
+				return nil, fmt.Errorf("读取扩展属性 '%s' 失败: %w", name, err)
+			}
+			value := make([]byte, n)
+			n, err = unix.Lgetxattr(path, name, value)
+			if errors.Is(err, unix.ERANGE) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("读取扩展属性 '%s' 失败: %w", name, err)
+			}
+			attrs = append(attrs, xattr{name: name, value: value[:n]})
+			break
+		}
+	}
+	return attrs, nil
+}
+
+// headerXattrs 在指定了 -xattrs 时读取 filePath 的扩展属性, 用于附带在文件头中. 读取失败或接收端不支持
+// TLV 文件头 (旧格式无法携带扩展属性) 时只记录警告, 文件照常发送; warn 为 false 时不重复记录警告
+// (分段传输的每条连接都会调用)
+func headerXattrs(features Features, filePath string, warn bool) []xattr {
+	if !*keepXattrs {
+		return nil
+	}
+	if !features.HeaderTLV {
+		if warn {
+			logWarn("\x1b[33m警告: 接收端不支持 TLV 文件头 (版本过旧)，'%s' 的扩展属性不会发送\x1b[0m", filePath)
+		}
+		return nil
+	}
+	attrs, err := readXattrs(filePath)
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil // 源文件系统不支持扩展属性, 没有需要保留的内容
+	}
+	if err != nil {
+		if warn {
+			logWarn("\x1b[33m警告: 读取 '%s' 的扩展属性失败，不发送扩展属性: %v\x1b[0m", filePath, err)
+		}
+		return nil
+	}
+	if total := len(encodeXattrs(attrs)); total > maxXattrsSize {
+		if warn {
+			logWarn("\x1b[33m警告: '%s' 的扩展属性过大 (%d 字节, 最多 %d 字节)，不发送扩展属性\x1b[0m", filePath, total, maxXattrsSize)
+		}
+		return nil
+	}
+	if warn && len(attrs) > 0 {
+		logDebug("'%s' 附带 %d 个扩展属性", filePath, len(attrs))
+	}
+	return attrs
+}
+
+// restoreXattrs 把文件头附带的扩展属性写到 path. 目标文件系统不支持扩展属性时记录一条警告后放弃,
+// 单个属性写入失败 (如非 root 用户写 security.* / trusted.*) 时记录警告并继续写入其余属性, 都不使接收失败
+func restoreXattrs(remoteAddrStr, path string, attrs []xattr) {
+	restored := 0
+	for _, a := range attrs {
+		err := unix.Lsetxattr(path, a.name, a.value, 0)
+		if errors.Is(err, unix.ENOTSUP) {
+			peerLog(remoteAddrStr).warn("\x1b[33m警告: '%s' 所在的文件系统不支持扩展属性，跳过 %d 个扩展属性\x1b[0m", path, len(attrs))
+			return
+		}
+		if err != nil {
+			peerLog(remoteAddrStr).warn("\x1b[33m警告: 恢复 '%s' 的扩展属性 '%s' 失败: %v\x1b[0m", path, a.name, err)
+			continue
+		}
+		restored++
+	}
+	peerLog(remoteAddrStr).debug("已恢复 '%s' 的 %d 个扩展属性", path, restored)
+}
+
+// batchRoot 累积单连接多文件中每个通过校验的文件的校验值, 计算整批的根校验值: 按文件名排序后,
+// 用 -verify 的算法对各文件的 [文件名长度 u16][文件名][校验值] 依次计算摘要. 发送端计入发出了校验尾部的文件,
+// 接收端计入校验通过并成功写入的文件, 两端的根校验值一致说明整批文件完整到达.
+// 方法在 nil 接收者上什么都不做, 未启用时调用方不需要判断
+type batchRoot struct {
+	leaves []batchLeaf
+}
+
+type batchLeaf struct {
+	name   string
+	digest []byte
+}
+
+// sentDigests 在发送端启用了整批根校验值的批量发送期间非 nil, 由 sendFile 在发送校验尾部时记录
+var sentDigests *batchRoot
+
+func (b *batchRoot) add(name string, digest []byte) {
+	if b == nil {
+		return
+	}
+	b.leaves = append(b.leaves, batchLeaf{name: name, digest: slices.Clone(digest)})
+}
+
+// sum 用 algo 计算根校验值. 按文件名 (相同时按校验值) 排序, 结果与文件的发送顺序无关
+func (b *batchRoot) sum(algo checksumAlgo) []byte {
+	var leaves []batchLeaf
+	if b != nil {
+		leaves = slices.Clone(b.leaves)
+	}
+	slices.SortFunc(leaves, func(x, y batchLeaf) int {
+		return cmp.Or(strings.Compare(x.name, y.name), bytes.Compare(x.digest, y.digest))
+	})
+	h := algo.newHash()
+	for _, leaf := range leaves {
+		h.Write(binary.BigEndian.AppendUint16(nil, uint16(len(leaf.name))))
+		h.Write([]byte(leaf.name))
+		h.Write(leaf.digest)
+	}
+	return h.Sum(nil)
+}
+
+// count 返回计入的文件数
+func (b *batchRoot) count() int {
+	if b == nil {
+		return 0
+	}
+	return len(b.leaves)
+}
+
+// sendBatchRoot 在结束标记之前发送整批的根校验值并等待接收端的比对结果, 不一致时返回 errChecksumMismatch
+func sendBatchRoot(conn net.Conn, b *batchRoot) error {
+	algo, _ := checksumAlgoByName(*verify)
+	root := b.sum(algo)
+	msg := binary.BigEndian.AppendUint16(nil, batchRootMarker)
+	msg = append(append(msg, algo.code), root...)
+	setIODeadline(conn)
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("发送整批根校验值失败: %w", wrapIOTimeout(err))
+	}
+	reply := make([]byte, 1)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("等待接收端比对整批根校验值失败: %w", wrapIOTimeout(err))
+	}
+	if reply[0] != batchRootMatch {
+		return fmt.Errorf("整批 %d 个文件的根%w (%s: %x, 详见接收端日志)", b.count(), errChecksumMismatch, algo.name, root)
+	}
+	noFields.print("info", "\x1b[32m整批 %d 个文件的根校验值与接收端一致 (%s: %x)\x1b[0m", b.count(), algo.name, root)
+	return nil
+}
+
+// verifyBatchRoot 读取发送端在结束标记之前发送的整批根校验值 (batchRootMarker 之后的部分),
+// 与本连接上校验通过并写入的文件计算的根校验值比对, 回复比对结果. 不一致时返回 errChecksumMismatch
+func verifyBatchRoot(conn net.Conn, b *batchRoot, remoteAddrStr string) error {
+	code := make([]byte, 1)
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, code); err != nil {
+		return fmt.Errorf("读取整批根校验值失败: %w", wrapIOTimeout(err))
+	}
+	algo, ok := checksumAlgoByCode(code[0])
+	if !ok {
+		return fmt.Errorf("不支持的整批根校验算法编号 %d", code[0])
+	}
+	want := make([]byte, algo.newHash().Size())
+	setIODeadline(conn)
+	if _, err := io.ReadFull(conn, want); err != nil {
+		return fmt.Errorf("读取整批根校验值失败: %w", wrapIOTimeout(err))
+	}
+	got := b.sum(algo)
+	result := byte(batchRootMatch)
+	if !bytes.Equal(want, got) {
+		result = batchRootMismatch
+	}
+	setIODeadline(conn)
+	if _, err := conn.Write([]byte{result}); err != nil {
+		return fmt.Errorf("回复整批根校验值的比对结果失败: %w", wrapIOTimeout(err))
+	}
+	if result != batchRootMatch {
+		return fmt.Errorf("整批根%w: 发送端 %x, 接收端 %x (接收端计入 %d 个文件, 已存在而跳过或接收失败的文件不计入)", errChecksumMismatch, want, got, b.count())
+	}
+	peerLog(remoteAddrStr).print("info", "\x1b[32m整批 %d 个文件的根校验值一致 (%s: %x)\x1b[0m", b.count(), algo.name, got)
+	return nil
+}
+
+// manifestRecord 是 -manifest 清单文件中的一条记录 (每行一个 JSON 对象)
+type manifestRecord struct {
+	Time      string  `json:"time"`
+	Remote    string  `json:"remote"`
+	Name      string  `json:"name"`
+	Path      string  `json:"path"`
+	Bytes     int64   `json:"bytes"`
+	Seconds   float64 `json:"seconds"`
+	SpeedMBps float64 `json:"speed_mbps"`
+	Checksum  string  `json:"checksum,omitempty"`
+}
+
+// appendManifest 以追加方式写入一条清单记录.
+// 每条记录通过一次 O_APPEND 写入完整的一行, 即使中途崩溃, 已写入的行仍是有效的 JSON Lines.
+func appendManifest(path string, rec manifestRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// runStats 收集本次运行中每个文件的结果, -json-summary 时在退出前输出
+var runStats = &runSummary{start: time.Now()}
+
+// runSummary 是 -json-summary 输出的汇总, 一次运行输出一个 JSON 对象
+type runSummary struct {
+	mu    sync.Mutex
+	start time.Time
+
+	Mode        string       `json:"mode"`
+	OK          bool         `json:"ok"`
+	Error       string       `json:"error,omitempty"`
+	Files       int          `json:"files"`        // 成功传输的文件数
+	FailedFiles int          `json:"failed_files"` // 失败或跳过的文件数
+	Bytes       int64        `json:"bytes"`        // 成功传输的文件的总字节数
+	Seconds     float64      `json:"seconds"`
+	SpeedMBps   float64      `json:"speed_mbps"`
+	Results     []fileResult `json:"results"`
+}
+
+type fileResult struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// record 追加一个文件的结果, err 为 nil 表示成功
+func (s *runSummary) record(name string, bytes int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := fileResult{Name: name, Bytes: bytes, OK: err == nil}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	s.Results = append(s.Results, r)
+}
+
+// fail 记录文件失败. 文件数据已发送完但之后的步骤 (如结束标记、一对多发送的收尾) 失败时,
+// 最后一条结果就是该文件, 将其改为失败而不是重复记录
+func (s *runSummary) fail(name string, err error) {
+	s.mu.Lock()
+	if n := len(s.Results); n > 0 && s.Results[n-1].Name == name && s.Results[n-1].OK {
+		s.Results[n-1].OK = false
+		s.Results[n-1].Error = err.Error()
+		s.mu.Unlock()
+		return
+	}
+	s.mu.Unlock()
+	s.record(name, 0, err)
+}
+
+// emit 在指定 -json-summary 时输出汇总; 接收到 stdout (-dir -) 时 stdout 用于数据, 改为输出到 stderr
+func (s *runSummary) emit(err error) {
+	if !*jsonSummary {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Mode = *mode
+	s.OK = err == nil
+	if err != nil {
+		s.Error = err.Error()
+	}
+	for _, r := range s.Results {
+		if r.OK {
+			s.Files++
+			s.Bytes += r.Bytes
+		} else {
+			s.FailedFiles++
+		}
+	}
+	if s.Results == nil {
+		s.Results = []fileResult{}
+	}
+	s.Seconds = time.Since(s.start).Seconds()
+	s.SpeedMBps = float64(s.Bytes) / max(s.Seconds, 0.001) / 1024 / 1024
+	out := os.Stdout
+	if *mode == "receive" && (*dir == "-" || *teeTarget == "-") {
+		out = os.Stderr
+	}
+	json.NewEncoder(out).Encode(s)
+}
+
+// durationBuckets 是 ftgo_transfer_duration_seconds 直方图的桶上界 (秒)
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+// metrics 是接收端的统计数据, 未指定 -metrics-addr 时同样累加, 只是不对外提供
+var metrics = &receiverMetrics{durationBuckets: make([]int64, len(durationBuckets))}
+
+// receiverMetrics 汇总接收端的文件和字节计数, 以及每个文件传输耗时的直方图
+type receiverMetrics struct {
+	mu              sync.Mutex
+	filesReceived   int64
+	bytesReceived   int64
+	failedFiles     int64
+	durationBuckets []int64 // 与 durationBuckets 的上界一一对应的累计计数
+	durationSum     float64
+	durationCount   int64
+}
+
+// fileReceived 记录一个接收成功的文件
+func (m *receiverMetrics) fileReceived(bytes int64, seconds float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.filesReceived++
+	m.bytesReceived += bytes
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			m.durationBuckets[i]++
+		}
+	}
+	m.durationSum += seconds
+	m.durationCount++
+}
+
+// fileFailed 记录一个接收失败的文件
+func (m *receiverMetrics) fileFailed() {
+	m.mu.Lock()
+	m.failedFiles++
+	m.mu.Unlock()
+}
+
+// ServeHTTP 以 Prometheus 文本格式 (text/plain; version=0.0.4) 输出当前统计
+func (m *receiverMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	counter := func(name, help string, v int64) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, v)
+	}
+	counter("ftgo_files_received_total", "完整接收的文件数.", m.filesReceived)
+	counter("ftgo_bytes_received_total", "完整接收的文件的总字节数.", m.bytesReceived)
+	counter("ftgo_failed_files_total", "接收失败的文件数.", m.failedFiles)
+	b.WriteString("# HELP ftgo_transfer_duration_seconds 每个接收成功的文件的传输耗时.\n# TYPE ftgo_transfer_duration_seconds histogram\n")
+	for i, le := range durationBuckets {
+		fmt.Fprintf(&b, "ftgo_transfer_duration_seconds_bucket{le=\"%s\"} %d\n", strconv.FormatFloat(le, 'g', -1, 64), m.durationBuckets[i])
+	}
+	fmt.Fprintf(&b, "ftgo_transfer_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	fmt.Fprintf(&b, "ftgo_transfer_duration_seconds_sum %g\n", m.durationSum)
+	fmt.Fprintf(&b, "ftgo_transfer_duration_seconds_count %d\n", m.durationCount)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// startMetricsServer 在 addr 上启动 /metrics HTTP 服务. 监听同步完成, 以便地址被占用时接收端直接报错退出.
+func startMetricsServer(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("监听 metrics 地址 %s 失败: %w", addr, err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	go func() {
+		if err := http.Serve(ln, mux); err != nil {
+			logWarn("\x1b[33m警告: metrics 服务退出: %v\x1b[0m", err)
+		}
+	}()
+	logInfo("metrics 服务已启动: http://%s/metrics", ln.Addr())
+	return nil
+}
+
+// sizeIntFlags 是以字节数为值的整数参数, 来自环境变量和 -config 的值可以带单位 (e.g., 4M), 由 parseSize 解析
+var sizeIntFlags = []string{"sndbuf", "rcvbuf"}
+
+// setFlagValue 按命令行的写法设置参数 name 的值, sizeIntFlags 中的参数额外接受带单位的大小
+func setFlagValue(name, value string) error {
+	if slices.Contains(sizeIntFlags, name) {
+		if _, err := strconv.Atoi(value); err != nil {
+			size, err := parseSize(value)
+			if err != nil {
+				return err
+			}
+			value = strconv.FormatInt(size, 10)
+		}
+	}
+	return flag.Set(name, value)
+}
+
+// envName 返回参数对应的环境变量名: FTGO_ 加大写的参数名, '-' 换成 '_' (e.g., io-timeout -> FTGO_IO_TIMEOUT)
+func envName(flagName string) string {
+	return "FTGO_" + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnvDefaults 把已设置且非空的 FTGO_* 环境变量应用到命令行上没有显式指定的参数
+func applyEnvDefaults() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+		key := envName(f.Name)
+		value := os.Getenv(key)
+		if value == "" {
+			return
+		}
+		if setErr := setFlagValue(f.Name, value); setErr != nil {
+			err = fmt.Errorf("无效的环境变量 %s=%q: %w", key, value, setErr)
+		}
+	})
+	return err
+}
+
+// applyConfigFile 读取 -config 文件, 把其中的值设置到命令行上没有显式指定的参数. 键为参数名 (不含 '-'),
+// 值按命令行上的写法解析 (大小、时长等使用与命令行相同的格式). 未知的参数名和无效的值都会报错.
+func applyConfigFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var values map[string]string
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		values, err = parseJSONConfig(data)
+	} else {
+		values, err = parseTOMLConfig(data)
+	}
+	if err != nil {
+		return fmt.Errorf("解析 '%s' 失败: %w", path, err)
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if name == "config" {
+			return fmt.Errorf("'%s' 中不能再指定 config", path)
+		}
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("'%s' 中的参数 %q 不存在", path, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := setFlagValue(name, values[name]); err != nil {
+			return fmt.Errorf("'%s' 中参数 %s 的值 %q 无效: %w", path, name, values[name], err)
+		}
+	}
+	return nil
+}
+
+// parseJSONConfig 解析 JSON 格式的配置文件: 一个对象, 值为字符串、数字或布尔值
+func parseJSONConfig(data []byte) (map[string]string, error) {
+	var raw map[string]any
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(raw))
+	for key, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[key] = v
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("参数 %q 的值必须是字符串、数字或布尔值", key)
+		}
+	}
+	return values, nil
+}
+
+// parseTOMLConfig 解析 TOML 格式配置文件的子集: 每行一个 key = value, value 为带引号的字符串、
+// 数字或 true/false; 支持 # 注释, 不支持表 ([section]) 和数组, 参数都在顶层.
+func parseTOMLConfig(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("第 %d 行: 不支持表 %s, 参数必须写在顶层", lineNo, line)
+		}
+		key, rest, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("第 %d 行: 缺少 '='", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			key = unquoted
+		}
+		if key == "" {
+			return nil, fmt.Errorf("第 %d 行: 参数名为空", lineNo)
+		}
+		value, err := parseTOMLValue(strings.TrimSpace(rest))
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 行: %w", lineNo, err)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("第 %d 行: 参数 %q 重复", lineNo, key)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// parseTOMLValue 解析一个 TOML 值 (可带行尾注释): "基本字符串", '字面字符串', 数字或 true/false
+func parseTOMLValue(s string) (string, error) {
+	var value, rest string
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return "", fmt.Errorf("字符串缺少结尾的引号: %s", s)
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("无效的字符串 %s: %w", s[:end+1], err)
+		}
+		value, rest = v, s[end+1:]
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("字符串缺少结尾的引号: %s", s)
+		}
+		value, rest = s[1:end+1], s[end+2:]
+	default:
+		value, rest, _ = strings.Cut(s, "#")
+		value = strings.TrimSpace(value)
+		rest = ""
+		if value != "true" && value != "false" {
+			// TOML 数字允许用下划线分隔 (e.g., 4_194_304)
+			value = strings.ReplaceAll(value, "_", "")
+			if _, err := strconv.ParseFloat(value, 64); err != nil {
+				return "", fmt.Errorf("无效的值 %q (字符串需要加引号)", s)
+			}
+		}
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+		return "", fmt.Errorf("值之后有多余的内容: %s", rest)
+	}
+	return value, nil
+}
+
+// loadPSK 加载 -psk 指定的预共享密钥: 参数为已存在的文件时读取文件内容 (去除首尾空白后能按十六进制解码则解码,
+// 否则直接使用原始内容), 否则按十六进制字符串解析. 密钥至少 16 字节.
+func loadPSK(spec string) ([]byte, error) {
+	var key []byte
+	if _, err := os.Stat(spec); err == nil {
+		data, err := os.ReadFile(spec)
+		if err != nil {
+			return nil, fmt.Errorf("读取密钥文件失败: %w", err)
+		}
+		trimmed := strings.TrimSpace(string(data))
+		if decoded, err := hex.DecodeString(trimmed); err == nil {
+			key = decoded
+		} else {
+			key = data
+		}
+	} else {
+		decoded, err := hex.DecodeString(spec)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' 既不是密钥文件也不是有效的十六进制字符串", spec)
+		}
+		key = decoded
+	}
+	if len(key) < 16 {
+		return nil, fmt.Errorf("密钥过短: %d 字节 (至少 16 字节)", len(key))
+	}
+	return key, nil
+}
+
+// newPayloadAEAD 用 HKDF-SHA256 从预共享密钥和本文件的随机盐派生 AES-256-GCM 密钥
+func newPayloadAEAD(psk, salt []byte) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, psk, salt, "ftgo payload", 32)
+	if err != nil {
+		return nil, fmt.Errorf("派生加密密钥失败: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("创建 AES 密码失败: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// frameAAD 返回帧的附加认证数据: 帧序号 (8 字节) + 是否为结束帧 (1 字节),
+// 使帧被重排、丢弃或提前截断时解密失败
+func frameAAD(seq uint64, final bool) []byte {
+	aad := make([]byte, 9)
+	binary.BigEndian.PutUint64(aad, seq)
+	if final {
+		aad[8] = 1
+	}
+	return aad
+}
+
+// sealWriter 把写入的明文按 encryptChunk 分帧加密后写入 w, 每帧为 [密文长度 u32][nonce][密文].
+// Close 写出包含剩余明文 (可能为空) 的结束帧. plain 非 nil 时累加已加密的明文字节数, 用于进度显示.
+type sealWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	plain *int64
+	seq   uint64
+	buf   []byte
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	s.buf = append(s.buf, p...)
+	for len(s.buf) >= encryptChunk {
+		if err := s.writeFrame(s.buf[:encryptChunk], false); err != nil {
+			return 0, err
+		}
+		s.buf = s.buf[encryptChunk:]
+	}
+	s.buf = slices.Clip(s.buf)
+	return len(p), nil
+}
+
+// Close 写出结束帧, 不关闭 w
+func (s *sealWriter) Close() error {
+	err := s.writeFrame(s.buf, true)
+	s.buf = nil
+	return err
+}
+
+func (s *sealWriter) writeFrame(plaintext []byte, final bool) error {
+	nonceSize := s.aead.NonceSize()
+	frame := make([]byte, 4+nonceSize, 4+nonceSize+len(plaintext)+s.aead.Overhead())
+	if _, err := rand.Read(frame[4 : 4+nonceSize]); err != nil {
+		return fmt.Errorf("生成 nonce 失败: %w", err)
+	}
+	frame = s.aead.Seal(frame, frame[4:4+nonceSize], plaintext, frameAAD(s.seq, final))
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4-nonceSize))
+	s.seq++
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	if s.plain != nil {
+		atomic.AddInt64(s.plain, int64(len(plaintext)))
+	}
+	return nil
+}
+
+// sealedSize 返回 size 字节明文经 sealWriter 加密后在连接上的字节数:
+// size/encryptChunk 个完整帧加上一个包含余数的结束帧
+func sealedSize(size int64, aead cipher.AEAD) int64 {
+	frames := size/encryptChunk + 1
+	return size + frames*int64(4+aead.NonceSize()+aead.Overhead())
+}
+
+// openToFile 从连接读取 sealWriter 写出的帧, 解密后写入 dst, 直到结束帧为止.
+// size 不为 unknownSize 时, 明文超过 size 即视为错误. 返回写入的明文字节数.
+func openToFile(conn net.Conn, dst io.Writer, aead cipher.AEAD, size int64, transferred *int64, targetPath string) (int64, error) {
+	nonceSize := aead.NonceSize()
+	maxFrame := encryptChunk + aead.Overhead()
+	lenBuf := make([]byte, 4)
+	frame := make([]byte, nonceSize+maxFrame)
+	var plaintext []byte
+	var written int64
+	for seq := uint64(0); ; seq++ {
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return written, fmt.Errorf("读取加密帧失败: %w", wrapIOTimeout(err))
+		}
+		n := int(binary.BigEndian.Uint32(lenBuf))
+		if n < aead.Overhead() || n > maxFrame {
+			return written, fmt.Errorf("无效的加密帧长度: %d", n)
+		}
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, frame[:nonceSize+n]); err != nil {
+			return written, fmt.Errorf("读取加密帧失败: %w", wrapIOTimeout(err))
+		}
+		// 先按普通帧解密, 失败再按结束帧解密; 两者都失败说明数据被篡改或密钥不一致
+		final := false
+		var err error
+		plaintext, err = aead.Open(plaintext[:0], frame[:nonceSize], frame[nonceSize:nonceSize+n], frameAAD(seq, false))
+		if err != nil {
+			final = true
+			plaintext, err = aead.Open(plaintext[:0], frame[:nonceSize], frame[nonceSize:nonceSize+n], frameAAD(seq, true))
+			if err != nil {
+				return written, fmt.Errorf("第 %d 帧解密失败 (密钥不一致或数据被篡改)", seq)
+			}
+		}
+		if size != unknownSize && written+int64(len(plaintext)) > size {
+			return written, fmt.Errorf("解密后的数据超过文件大小 %d", size)
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return written, fmt.Errorf("写入文件 '%s' 失败: %w", targetPath, err)
+		}
+		written += int64(len(plaintext))
+		rxLimiter.wait(int64(len(plaintext)))
+		atomic.AddInt64(transferred, int64(len(plaintext)))
+		if final {
+			return written, nil
+		}
+	}
+}
+
+// framedWriter 把写入的数据按 copyBufferSize 分帧写入 w, 每帧为 [序号 u32][长度 u32][CRC32C u32][数据] (-framed).
+// Close 写出剩余不足一帧的数据, 不关闭 w. raw 非 nil 时累加已发送的数据字节数, 用于进度显示
+type framedWriter struct {
+	w   io.Writer
+	raw *int64
+	seq uint32
+	buf []byte
+}
+
+func (f *framedWriter) Write(p []byte) (int, error) {
+	f.buf = append(f.buf, p...)
+	for len(f.buf) >= copyBufferSize {
+		if err := f.writeFrame(f.buf[:copyBufferSize]); err != nil {
+			return 0, err
+		}
+		f.buf = f.buf[copyBufferSize:]
+	}
+	f.buf = slices.Clip(f.buf)
+	return len(p), nil
+}
+
+// Close 写出剩余的数据
+func (f *framedWriter) Close() error {
+	var err error
+	if len(f.buf) > 0 {
+		err = f.writeFrame(f.buf)
+	}
+	f.buf = nil
+	return err
+}
+
+func (f *framedWriter) writeFrame(chunk []byte) error {
+	frame := make([]byte, framedHeaderSize, framedHeaderSize+len(chunk))
+	binary.BigEndian.PutUint32(frame, f.seq)
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(chunk)))
+	binary.BigEndian.PutUint32(frame[8:], crc32.Checksum(chunk, crc32cTable))
+	frame = append(frame, chunk...)
+	f.seq++
+	if _, err := f.w.Write(frame); err != nil {
+		return err
+	}
+	if f.raw != nil {
+		atomic.AddInt64(f.raw, int64(len(chunk)))
+	}
+	return nil
+}
+
+// unframeToFile 从连接读取 framedWriter 写出的帧, 逐帧检查序号和 CRC32C 后写入 dst, 直到收齐 size 字节为止.
+// 出错时报告出错的帧所在的文件偏移量. 返回写入的字节数
+func unframeToFile(conn net.Conn, dst io.Writer, size int64, transferred *int64, targetPath string) (int64, error) {
+	head := make([]byte, framedHeaderSize)
+	chunk := make([]byte, copyBufferSize)
+	var written int64
+	for seq := uint32(0); written < size; seq++ {
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, head); err != nil {
+			return written, fmt.Errorf("读取第 %d 帧失败 (偏移量 %d): %w", seq, written, wrapIOTimeout(err))
+		}
+		if got := binary.BigEndian.Uint32(head); got != seq {
+			return written, fmt.Errorf("帧序号不符 (偏移量 %d): 期望第 %d 帧, 收到第 %d 帧", written, seq, got)
+		}
+		n := binary.BigEndian.Uint32(head[4:])
+		if n == 0 || n > copyBufferSize || int64(n) > size-written {
+			return written, fmt.Errorf("第 %d 帧 (偏移量 %d) 长度无效: %d", seq, written, n)
+		}
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, chunk[:n]); err != nil {
+			return written, fmt.Errorf("读取第 %d 帧失败 (偏移量 %d): %w", seq, written, wrapIOTimeout(err))
+		}
+		if want, got := binary.BigEndian.Uint32(head[8:]), crc32.Checksum(chunk[:n], crc32cTable); got != want {
+			return written, fmt.Errorf("第 %d 帧的数据已损坏: 偏移量 [%d, %d) 的 CRC32C 为 %08x, 发送端为 %08x", seq, written, written+int64(n), got, want)
+		}
+		rxLimiter.wait(int64(n))
+		if _, err := dst.Write(chunk[:n]); err != nil {
+			return written, fmt.Errorf("写入文件 '%s' 失败: %w", targetPath, err)
+		}
+		written += int64(n)
+		atomic.AddInt64(transferred, int64(n))
+	}
+	return written, nil
+}
+
+// sampleCompressRatio 试压缩文件开头 compressSample 字节 (/dev/zero 为全零数据), 返回压缩后与压缩前大小之比,
+// 用于 -compress auto 判断文件是否值得压缩. 空文件返回 1
+func sampleCompressRatio(filePath string, isDevZero bool) (float64, error) {
+	sample := make([]byte, compressSample)
+	n := len(sample)
+	if !isDevZero {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return 0, fmt.Errorf("打开源文件失败: %w", err)
+		}
+		defer f.Close()
+		if n, err = io.ReadFull(f, sample); err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return 0, fmt.Errorf("读取源文件失败: %w", err)
+		}
+	}
+	if n == 0 {
+		return 1, nil
+	}
+	var cw countingWriter
+	fw, _ := flate.NewWriter(&cw, flate.BestSpeed)
+	fw.Write(sample[:n])
+	fw.Close()
+	return float64(cw.n) / float64(n), nil
+}
+
+// countingWriter 丢弃写入的数据, 只统计字节数
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// compressWriter 把写入的原始数据按 compressChunk 分块独立压缩后写入 w, 每帧为 [长度 u32][数据];
+// 压缩后没有变小的块以原样存储 (长度带 compressStored 位). Close 写出剩余不足一块的数据, 不关闭 w.
+// raw 非 nil 时累加已发送的原始字节数, 用于进度显示
+type compressWriter struct {
+	w   io.Writer
+	raw *int64
+	buf []byte
+	out bytes.Buffer
+	flw *flate.Writer
+}
+
+func newCompressWriter(w io.Writer, raw *int64) *compressWriter {
+	cw := &compressWriter{w: w, raw: raw}
+	cw.flw, _ = flate.NewWriter(&cw.out, flate.BestSpeed)
+	return cw
+}
+
+func (c *compressWriter) Write(p []byte) (int, error) {
+	c.buf = append(c.buf, p...)
+	for len(c.buf) >= compressChunk {
+		if err := c.writeFrame(c.buf[:compressChunk]); err != nil {
+			return 0, err
+		}
+		c.buf = c.buf[compressChunk:]
+	}
+	c.buf = slices.Clip(c.buf)
+	return len(p), nil
+}
+
+// Close 写出剩余的数据
+func (c *compressWriter) Close() error {
+	var err error
+	if len(c.buf) > 0 {
+		err = c.writeFrame(c.buf)
+	}
+	c.buf = nil
+	return err
+}
+
+func (c *compressWriter) writeFrame(chunk []byte) error {
+	c.out.Reset()
+	c.out.Write(make([]byte, 4))
+	c.flw.Reset(&c.out)
+	c.flw.Write(chunk)
+	c.flw.Close()
+	frame := c.out.Bytes()
+	if len(frame)-4 < len(chunk) {
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	} else {
+		frame = append(frame[:4], chunk...)
+		binary.BigEndian.PutUint32(frame, uint32(len(chunk))|compressStored)
+	}
+	if _, err := c.w.Write(frame); err != nil {
+		return err
+	}
+	if c.raw != nil {
+		atomic.AddInt64(c.raw, int64(len(chunk)))
+	}
+	return nil
+}
+
+// inflateChunk 把 fr 中的一帧完整解压到 chunk, 压缩流被截断或解压后超过 len(chunk) 时返回错误
+func inflateChunk(fr io.Reader, chunk []byte) (int, error) {
+	var m int
+	for {
+		k, err := fr.Read(chunk[m:])
+		m += k
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return m, err
+		}
+		if m == len(chunk) {
+			var extra [1]byte
+			if k, err := fr.Read(extra[:]); k > 0 {
+				return m, fmt.Errorf("超过 %d 字节", len(chunk))
+			} else if err != io.EOF {
+				return m, err
+			}
+			return m, nil
+		}
+	}
+}
+
+// decompressToFile 从连接读取 compressWriter 写出的帧, 解压后写入 dst, 直到收齐 size 字节的原始数据为止.
+// 返回写入的原始字节数
+func decompressToFile(conn net.Conn, dst io.Writer, size int64, transferred *int64, targetPath string) (int64, error) {
+	lenBuf := make([]byte, 4)
+	frame := make([]byte, compressChunk+compressChunk/8)
+	chunk := make([]byte, compressChunk)
+	fr := flate.NewReader(nil)
+	var br bytes.Reader
+	var written int64
+	for written < size {
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, lenBuf); err != nil {
+			return written, fmt.Errorf("读取压缩帧失败: %w", wrapIOTimeout(err))
+		}
+		n := binary.BigEndian.Uint32(lenBuf)
+		stored := n&compressStored != 0
+		n &^= compressStored
+		if n == 0 || int(n) > len(frame) || (stored && n > compressChunk) {
+			return written, fmt.Errorf("无效的压缩帧长度: %d", n)
+		}
+		setIODeadline(conn)
+		if _, err := io.ReadFull(conn, frame[:n]); err != nil {
+			return written, fmt.Errorf("读取压缩帧失败: %w", wrapIOTimeout(err))
+		}
+		rxLimiter.wait(int64(n))
+		data := frame[:n]
+		if !stored {
+			br.Reset(data)
+			fr.(flate.Resetter).Reset(&br, nil)
+			m, err := inflateChunk(fr, chunk)
+			if err != nil {
+				return written, fmt.Errorf("第 %d 字节处的压缩帧解压失败: %w", written, err)
+			}
+			data = chunk[:m]
+		}
+		if written+int64(len(data)) > size {
+			return written, fmt.Errorf("解压后的数据超过文件大小 %d", size)
+		}
+		if _, err := dst.Write(data); err != nil {
+			return written, fmt.Errorf("写入文件 '%s' 失败: %w", targetPath, err)
+		}
+		written += int64(len(data))
+		atomic.AddInt64(transferred, int64(len(data)))
+	}
+	return written, nil
+}
+
+// discardPayload 读取并丢弃 size 字节的数据 (size 为 unknownSize 时读到连接关闭为止),
+// 用于跳过文件时保持连接上的协议同步
+func discardPayload(conn net.Conn, size int64) (int64, error) {
+	buf := make([]byte, copyBufferSize)
+	var discarded int64
+	for size == unknownSize || discarded < size {
+		want := int64(len(buf))
+		if size != unknownSize && size-discarded < want {
+			want = size - discarded
+		}
+		setIODeadline(conn)
+		n, err := conn.Read(buf[:want])
+		discarded += int64(n)
+		if err != nil {
+			if err == io.EOF && size == unknownSize {
+				return discarded, nil
+			}
+			return discarded, wrapIOTimeout(err)
+		}
+	}
+	return discarded, nil
+}
+
+// parseSize 解析带单位的大小字符串 (如 "1G", "500M", "1024K", "10TB", "1048576") 返回字节数.
+// 单位不区分大小写, 均为 1024 进制: K, M, G, T, 可带可选的 B 后缀 (如 "500MB");
+// 不带单位或只有 B 后缀时按字节计算. 结果超出 int64 范围时返回错误.
+func parseSize(sizeStr string) (int64, error) {
+	sizeStr = strings.ToUpper(strings.TrimSpace(sizeStr))
+	numStr := strings.TrimSuffix(sizeStr, "B")
+	multiplier := int64(1)
+
+	switch {
+	case strings.HasSuffix(numStr, "T"):
+		multiplier = 1024 * 1024 * 1024 * 1024
+	case strings.HasSuffix(numStr, "G"):
+		multiplier = 1024 * 1024 * 1024
+	case strings.HasSuffix(numStr, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(numStr, "K"):
+		multiplier = 1024
+	}
+	if multiplier > 1 {
+		numStr = numStr[:len(numStr)-1]
+	}
+
+	num, err := strconv.ParseInt(numStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("无法解析数字部分 '%s': %w", numStr, err)
+	}
+
+	if num <= 0 {
+		return 0, fmt.Errorf("大小必须为正数")
+	}
+	if num > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("大小 '%s' 超出范围 (最大 %d 字节)", sizeStr, int64(math.MaxInt64))
+	}
+
+	return num * multiplier, nil
+}
+
+// zeroReader 模拟 size 字节的 /dev/zero 数据.
+// fill 为 false 时只推进读取位置而不清零 p (仅适用于数据会被丢弃的场景, 如写到 /dev/null).
+type zeroReader struct {
+	size    int64
+	readPos int64
+	fill    bool
+}
+
+func (zr *zeroReader) Read(p []byte) (n int, err error) {
+	if zr.readPos >= zr.size {
+		return 0, io.EOF // 已达到指定大小
+	}
+	remaining := zr.size - zr.readPos
+	readLen := int64(len(p))
+	if remaining < readLen {
+		readLen = remaining
+	}
+	// 复用的缓冲区中可能残留其他数据, 需要真实零字节时清零
+	if zr.fill {
+		clear(p[:readLen])
+	}
+	zr.readPos += readLen
+	return int(readLen), nil
+}
+
+// zeroChecker 检查写入的数据是否全为零字节 (-zero-verify), offset 为下一个写入字节在文件中的偏移量
+type zeroChecker struct {
+	offset int64
+}
+
+// zeroBlock 是只读的全零缓冲区, 用于比较 (-zero-verify) 和 vmsplice 发送 (-vmsplice), 不能写入
+var zeroBlock = make([]byte, 64*1024)
+
+func (zc *zeroChecker) Write(p []byte) (int, error) {
+	for start := 0; start < len(p); start += len(zeroBlock) {
+		chunk := p[start:min(start+len(zeroBlock), len(p))]
+		if bytes.Equal(chunk, zeroBlock[:len(chunk)]) {
+			continue
+		}
+		for i, b := range chunk {
+			if b != 0 {
+				return start + i, fmt.Errorf("-zero-verify: 偏移量 %d 处收到非零字节 0x%02x", zc.offset+int64(start+i), b)
 			}
-			reader = srcFile
 		}
+	}
+	zc.offset += int64(len(p))
+	return len(p), nil
+}
 
-		progressWriter := &progressUpdater{conn: conn, transferred: &transferred}
-		written, err := io.CopyBuffer(progressWriter, reader, buffer)
-		totalSent = written
+// progressUpdater 把数据写入连接并累加进度. 底层写入只写出一部分时继续写入剩余部分, 只有写完 p 或出错才返回,
+// 因此包装它的 sealWriter/compressWriter 等可以只检查错误; 没有进展也没有错误时返回 io.ErrShortWrite
+type progressUpdater struct {
+	conn        net.Conn
+	transferred *int64
+	zc          *zerocopyWriter // -zerocopy 时非 nil, 经由 MSG_ZEROCOPY 发送
+}
+
+func (pu *progressUpdater) Write(p []byte) (written int, err error) {
+	for written < len(p) {
+		var n int
+		setIODeadline(pu.conn)
+		if pu.zc != nil {
+			n, err = pu.zc.Write(p[written:])
+		} else {
+			n, err = pu.conn.Write(p[written:])
+		}
+		if n > 0 {
+			txLimiter.wait(int64(n))
+			atomic.AddInt64(pu.transferred, int64(n))
+			written += n
+		}
 		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && (opErr.Err == unix.EPIPE || opErr.Err == unix.ECONNRESET) {
-				log.Printf("发送端检测到连接断开 (标准写入): %v", err)
-				return fmt.Errorf("连接已断开: %w", err)
-			}
-			return fmt.Errorf("标准写入失败 (已发送 %d bytes): %w", totalSent, err)
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
 		}
-		log.Printf("\x1b[32m标准网络写入完成，总共发送 %d bytes\x1b[0m", totalSent)
 	}
+	return written, nil
+}
 
-	// 短暂休眠，允许进度显示的 goroutine 可能进行最后一次更新
-	time.Sleep(100 * time.Millisecond)
+// rateLimiter 是限制传输速度的令牌桶 (-limit、-limit-rx、-limit-tx), 由本进程的所有连接共享, 在 sendfile/splice/标准复制的循环中
+// 每传输一块数据后调用 wait. 指定了 -ramp 时, 允许的速度从第一次传输开始在 ramp 时间内由上限的 5% 线性提高到上限;
+// 指定了 -schedule 时, 每次 wait 按当前时间所在的时段选择上限
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 上限, 字节/秒, 0 表示不限速
+	ramp   time.Duration
+	slots  []scheduleEntry // -schedule 的各时段, 按顺序取第一个包含当前时间的时段
+	slot   int             // 当前所在时段在 slots 中的下标, -1 表示不在任何时段内
+	start  time.Time       // 第一次传输的时间, ramp 从此开始计算
+	last   time.Time
+	tokens float64 // 可以为负: 已传输但尚未 "付清" 的字节数, 由 wait 睡眠偿还
+	scale  float64 // -throttle-on-load 按系统负载调整的比例, (0, 1]
+}
+
+// rxLimiter / txLimiter 分别限制从连接读取和向连接写入的速度, 该方向不限速时为 nil.
+// 只指定 -limit / -schedule 时两者是同一个限速器, 两个方向合计计算
+var rxLimiter, txLimiter *rateLimiter
 
-	// 最终检查: 确保发送的总字节数与预期文件大小匹配
-	if totalSent != fileSize {
-		return fmt.Errorf("最终发送字节数 (%d) 与预期文件大小 (%d) 不符", totalSent, fileSize)
+// waitRx 记录从连接读取的 n 字节. relay 把读到的数据原样写到下一跳, 同样的字节也计入发送方向
+// (两个方向共用同一个限速器时只计一次)
+func waitRx(n int64) {
+	rxLimiter.wait(n)
+	if *mode == "relay" && txLimiter != rxLimiter {
+		txLimiter.wait(n)
 	}
+}
 
-	log.Printf("发送完成，总共发送 %s bytes", formatWithCommas(totalSent)) // Generic completion message
-	return nil
+func newRateLimiter(rate int64, ramp time.Duration) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), ramp: ramp, scale: 1, slot: -1}
 }
 
-// --- 文件预热函数 (使用 Readahead 预热整个文件) ---
-func doPrewarm(filePath string) error {
-	log.Printf("发起预读请求: 文件 %s (整个文件)...", filePath)
-	prewarmStartTime := time.Now()
+// currentRate 返回 now 时刻允许的速度, 0 表示不限速
+func (l *rateLimiter) currentRate(now time.Time) float64 {
+	rate := l.scheduledRate(now)
+	if elapsed := now.Sub(l.start); l.ramp > 0 && elapsed < l.ramp {
+		const startFraction = 0.05
+		return l.scale * rate * (startFraction + (1-startFraction)*float64(elapsed)/float64(l.ramp))
+	}
+	return l.scale * rate
+}
 
-	// 获取文件信息以得到大小
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		return fmt.Errorf("预热时获取文件信息失败: %w", err)
+// scheduledRate 返回 now 所在时段的上限 (不在任何时段内时为 -limit), 进入另一个时段时记录日志
+func (l *rateLimiter) scheduledRate(now time.Time) float64 {
+	if len(l.slots) == 0 {
+		return l.rate
 	}
-	fileSize := fileInfo.Size()
-	if fileSize == 0 {
-		log.Printf("文件 %s 大小为 0，跳过预热。", filePath)
-		return nil
+	minute := now.Hour()*60 + now.Minute()
+	active := -1
+	for i, entry := range l.slots {
+		if entry.contains(minute) {
+			active = i
+			break
+		}
 	}
-
-	f, err := os.Open(filePath)
-	if err != nil {
-		return fmt.Errorf("预热时打开文件失败: %w", err)
+	rate := l.rate
+	if active >= 0 {
+		rate = float64(l.slots[active].rate)
 	}
-	defer f.Close()
-	fd := int(f.Fd())
-	_, _, err = unix.Syscall(unix.SYS_READAHEAD, uintptr(fd), uintptr(0), uintptr(fileSize))
-
-	prewarmDuration := time.Since(prewarmStartTime)
-
-	// unix.Syscall 返回的 err 是 unix.Errno 类型
-	// 如果 err == 0, 表示成功
-	if err.(unix.Errno) != 0 { // Errno 应与 0 比较而非 nil
-		// Readahead 失败通常不是致命的，记录警告
-		log.Printf("\x1b[33m警告: 发起 Readahead 请求失败: %v\x1b[0m", err)
-	} else {
-		log.Printf("Readahead 请求已发起，耗时: %v (注意: 数据加载是异步的)", prewarmDuration)
+	if active != l.slot {
+		l.slot = active
+		limit := "不限速"
+		if rate > 0 {
+			limit = "速度上限 " + formatBytes(int64(rate)) + "/s"
+		}
+		if active >= 0 {
+			logWarn("\x1b[33m进入 -schedule 时段 %s，%s\x1b[0m", l.slots[active].spec, limit)
+		} else {
+			logWarn("\x1b[33m不在 -schedule 的任何时段内，%s\x1b[0m", limit)
+		}
 	}
-	// Readahead 失败不应阻止主流程
-	return nil
+	return rate
 }
 
-func receiver(dirPath string, listenAddr string, useStandardCopy bool) error {
-	// 添加变量来跟踪所有文件的传输统计
-	var totalBytesReceived int64
-	var totalFilesReceived int
-	var startTime = time.Now()
+// scheduleEntry 是 -schedule 中的一个时段: 一天中的 [from, to) 分钟, to 不大于 from 时跨越午夜
+type scheduleEntry struct {
+	from, to int
+	rate     int64 // 字节/秒, 0 表示不限速
+	spec     string
+}
 
-	listener, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		return fmt.Errorf("监听 %s 失败: %w", listenAddr, err) // 监听失败是致命错误
+// contains 报告一天中的第 minute 分钟是否在该时段内; from 与 to 相同时为全天
+func (e scheduleEntry) contains(minute int) bool {
+	if e.from < e.to {
+		return minute >= e.from && minute < e.to
 	}
-	defer listener.Close()
-	log.Printf("\x1b[32m服务器启动，正在监听 %s\x1b[0m", listenAddr)
+	return minute >= e.from || minute < e.to
+}
 
-	for { // 无限循环，顺序处理连接
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Printf("\x1b[33m警告: 接受连接失败: %v\x1b[0m", err)
-			// 检查是否是监听器关闭导致的错误
-			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
-				log.Println("监听器已关闭，服务器退出。")
-				return nil // 正常退出
+// parseSchedule 解析 -schedule: 逗号分隔的 HH:MM-HH:MM=速度, 速度的单位同 -size, unlimited 表示不限速
+func parseSchedule(s string) ([]scheduleEntry, error) {
+	parseClock := func(v string) (int, error) {
+		var h, m int
+		if n, err := fmt.Sscanf(v, "%d:%d", &h, &m); err != nil || n != 2 || len(v) != 5 || h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+			return 0, fmt.Errorf("无效的时间 %q (格式为 HH:MM)", v)
+		}
+		return (h*60 + m) % (24 * 60), nil
+	}
+	var entries []scheduleEntry
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		span, rateStr, ok := strings.Cut(item, "=")
+		from, to, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("无效的时段 %q (格式为 HH:MM-HH:MM=速度)", item)
+		}
+		entry := scheduleEntry{spec: span}
+		var err error
+		if entry.from, err = parseClock(strings.TrimSpace(from)); err != nil {
+			return nil, err
+		}
+		if entry.to, err = parseClock(strings.TrimSpace(to)); err != nil {
+			return nil, err
+		}
+		if rateStr = strings.TrimSpace(rateStr); !strings.EqualFold(rateStr, "unlimited") {
+			if entry.rate, err = parseSize(rateStr); err != nil || entry.rate <= 0 {
+				return nil, fmt.Errorf("时段 %s 的速度 %q 无效", span, rateStr)
 			}
-			continue // 其他接受错误，继续等待下一个连接
 		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
 
-		// --- 开始处理单个连接 ---
-		remoteAddrStr := conn.RemoteAddr().String()
-		log.Printf("[%s] 接收到连接，开始处理...", remoteAddrStr)
-
-		// 声明变量来保存传输结果，以便在匿名函数外访问
-		var fileTransferred int64
-		var fileReceiveError error
-		var fileTransferName string
-		var connectionStart time.Time
+// loadCheckInterval 是 -throttle-on-load 检查系统负载的间隔, minLoadScale 是负载很高时速度上限的最低比例
+const (
+	loadCheckInterval = 5 * time.Second
+	minLoadScale      = 0.05
+)
 
-		// 尝试设置 TCP 接收缓冲区
-		if tcpConn, ok := conn.(*net.TCPConn); ok && *rcvBuf > 0 {
-			if err := tcpConn.SetReadBuffer(*rcvBuf); err != nil {
-				log.Printf("\x1b[33m[%s] 警告: 设置 TCP 接收缓冲区为 %d 失败: %v\x1b[0m", remoteAddrStr, *rcvBuf, err)
-			} else {
-				// 无法直接通过 Go API 获取实际大小，需要 OS 工具检查
-				log.Printf("[%s] 已尝试设置 TCP 接收缓冲区为 %d (实际大小需通过 OS 工具检查)", remoteAddrStr, *rcvBuf)
-			}
+// followLoad 每隔 loadCheckInterval 读取系统 1 分钟平均负载 (sysinfo), 超过 threshold 时把速度上限降为
+// threshold/负载 (不低于 minLoadScale), 负载回落到 threshold 以下时恢复全速. 在独立的 goroutine 中运行
+func (l *rateLimiter) followLoad(threshold float64) {
+	ticker := time.NewTicker(loadCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var info unix.Sysinfo_t
+		if err := unix.Sysinfo(&info); err != nil {
+			logWarn("\x1b[33m警告: 读取系统负载失败 (%v)，-throttle-on-load 停止调整速度\x1b[0m", err)
+			l.mu.Lock()
+			l.scale = 1
+			l.mu.Unlock()
+			return
+		}
+		load := float64(info.Loads[0]) / (1 << unix.SI_LOAD_SHIFT)
+		scale := 1.0
+		if load > threshold {
+			scale = max(threshold/load, minLoadScale)
 		}
+		l.mu.Lock()
+		prev := l.scale
+		l.scale = scale
+		l.mu.Unlock()
+		switch {
+		case scale < 1 && prev == 1:
+			logWarn("\x1b[33m系统负载 %.2f 超过 %.2f，速度上限降为 %.0f%%\x1b[0m", load, threshold, scale*100)
+		case scale == 1 && prev < 1:
+			logInfo("系统负载回落到 %.2f，恢复全速", load)
+		case scale != prev:
+			logDebug("系统负载 %.2f，速度上限调整为 %.0f%%", load, scale*100)
+		}
+	}
+}
 
-		// 在循环内处理单个连接
-		func(conn net.Conn) {
-			defer conn.Close()
+// wait 记录刚传输的 n 字节, 超出当前速度时睡眠到速度回落为止. 该方向不限速 (l 为 nil) 时直接返回
+func (l *rateLimiter) wait(n int64) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.start.IsZero() {
+		l.start, l.last = now, now
+	}
+	rate := l.currentRate(now)
+	if rate == 0 {
+		// 不限速: 不积攒令牌, 之后切换到限速时段时从空桶开始
+		l.tokens, l.last = 0, now
+		l.mu.Unlock()
+		return
+	}
+	// 最多积攒 100ms 的令牌, 空闲之后不会出现过大的突发
+	burst := max(rate/10, copyBufferSize)
+	l.tokens = min(l.tokens+rate*now.Sub(l.last).Seconds(), burst) - float64(n)
+	l.last = now
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
 
-			// 记录当前连接开始时间
-			connectionStart = time.Now()
+// zerocopyMinSize 以下的写入直接复制发送: 小块数据固定页和处理完成通知的开销超过复制本身
+const zerocopyMinSize = 16 * 1024
 
-			var targetPath string // 实际写入的路径 (常规文件时为临时 .part 文件)
-			var finalPath string  // 传输成功后改名到的正式路径
-			var useTempFile bool  // 是否启用临时文件 + 原子改名 (常规文件为 true, /dev/null 为 false)
-			var receiveErr error
-			var fileName string
-			var fileSize int64
-			var totalReceived int64 = 0
+// zerocopyWriter 以 MSG_ZEROCOPY 向 TCP 连接发送数据 (-zerocopy), 内核直接引用用户态缓冲区而不复制.
+// 缓冲区在内核通过错误队列发来完成通知之前不能修改, 调用方 (io.CopyBuffer 等) 又会复用缓冲区,
+// 因此每次 Write 都等到本次发送的数据全部完成后才返回
+type zerocopyWriter struct {
+	conn   net.Conn
+	raw    syscall.RawConn
+	sent   uint32 // 已发出的 zerocopy 发送次数, 内核按此序号 (从 0 开始) 发送完成通知
+	acked  uint32 // 已收到完成通知的发送次数
+	copied bool   // 内核是否回退为复制 (如回环连接或网卡不支持 scatter-gather)
+	oob    []byte
+}
 
-			// 错误处理和清理
-			defer func() {
-				if receiveErr != nil {
-					log.Printf("\x1b[31m[%s] 错误: %v\x1b[0m", remoteAddrStr, receiveErr)
-				}
-				// 临时文件收尾 (此时 dstFile 已由更晚注册的 defer 关闭):
-				// 成功则原子改名为正式文件, 失败则删除残缺临时文件, 避免留下/覆盖为不完整文件
-				if useTempFile {
-					if receiveErr == nil {
-						if err := os.Rename(targetPath, finalPath); err != nil {
-							receiveErr = fmt.Errorf("重命名临时文件 '%s' -> '%s' 失败: %w", targetPath, finalPath, err)
-							log.Printf("\x1b[31m[%s] 错误: %v\x1b[0m", remoteAddrStr, receiveErr)
-							os.Remove(targetPath)
-						}
-					} else {
-						if err := os.Remove(targetPath); err != nil && !os.IsNotExist(err) {
-							log.Printf("\x1b[33m[%s] 警告: 删除残缺临时文件 '%s' 失败: %v\x1b[0m", remoteAddrStr, targetPath, err)
-						} else {
-							log.Printf("[%s] 已删除残缺临时文件 '%s'", remoteAddrStr, targetPath)
-						}
-					}
-				}
-				// 保存结果以便外部访问
-				fileReceiveError = receiveErr
-				fileTransferred = totalReceived
-				fileTransferName = fileName
-				log.Printf("[%s] 连接已关闭", remoteAddrStr)
-			}()
+// newZerocopyWriter 在指定了 -zerocopy 时为 TCP 连接启用 SO_ZEROCOPY, 未指定、不是 TCP 连接或内核不支持时返回 nil (回退到普通写入)
+func newZerocopyWriter(conn net.Conn) *zerocopyWriter {
+	if !*zeroCopy {
+		return nil
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+	}); err != nil || sockErr != nil {
+		logDebug("内核不支持 SO_ZEROCOPY (%v)，使用普通写入", cmp.Or(sockErr, err))
+		return nil
+	}
+	logDebug("已启用 SO_ZEROCOPY")
+	return &zerocopyWriter{conn: conn, raw: raw, oob: make([]byte, 256)}
+}
 
-			// 1. 读取文件名长度 (2 bytes)
-			lenBytes := make([]byte, 2)
-			if _, err := io.ReadFull(conn, lenBytes); err != nil {
-				receiveErr = fmt.Errorf("读取文件名长度失败: %w", err)
-				return
+func (z *zerocopyWriter) Write(p []byte) (int, error) {
+	if len(p) < zerocopyMinSize {
+		return z.conn.Write(p)
+	}
+	var written int
+	var sendErr error
+	err := z.raw.Write(func(fd uintptr) bool {
+		for written < len(p) {
+			flags := unix.MSG_ZEROCOPY
+			n, err := unix.SendmsgN(int(fd), p[written:], nil, nil, flags)
+			if err == unix.ENOBUFS {
+				// 超出 optmem_max 限制, 这一块改为复制发送
+				flags = 0
+				n, err = unix.SendmsgN(int(fd), p[written:], nil, nil, flags)
 			}
-			fileNameLen := binary.BigEndian.Uint16(lenBytes)
-			log.Printf("\x1b[32m[%s] 接收到文件名长度: %d\x1b[0m", remoteAddrStr, fileNameLen)
-
-			// 2. 读取文件名
-			fileNameBytes := make([]byte, fileNameLen)
-			if _, err := io.ReadFull(conn, fileNameBytes); err != nil {
-				receiveErr = fmt.Errorf("读取文件名失败: %w", err)
-				return
+			switch {
+			case err == unix.EINTR:
+				continue
+			case err == unix.EAGAIN:
+				return false // 等待 socket 可写
+			case err != nil:
+				sendErr = &net.OpError{Op: "write", Net: "tcp", Source: z.conn.LocalAddr(), Addr: z.conn.RemoteAddr(), Err: os.NewSyscallError("sendmsg", err)}
+				return true
 			}
-			fileName = string(fileNameBytes)
-			log.Printf("\x1b[32m[%s] 接收到文件名: %s\x1b[0m", remoteAddrStr, fileName)
-
-			// 3. 读取文件大小信息 (8 bytes)
-			sizeBytes := make([]byte, 8)
-			if _, err := io.ReadFull(conn, sizeBytes); err != nil {
-				receiveErr = fmt.Errorf("读取文件大小失败: %w", err)
-				return
+			written += n
+			if flags != 0 {
+				z.sent++
 			}
-			fileSize = int64(binary.BigEndian.Uint64(sizeBytes))
-			log.Printf("\x1b[32m[%s] 文件大小: %s 字节\x1b[0m", remoteAddrStr, formatWithCommas(fileSize))
+		}
+		return true
+	})
+	if err := cmp.Or(sendErr, err, z.wait()); err != nil {
+		return written, err
+	}
+	return written, nil
+}
 
-			// 检查目标是否为 /dev/null，并设置 targetPath
-			isDevNull := (dirPath == "/dev/null")
-			if isDevNull {
-				targetPath = "/dev/null"
-				log.Printf("\x1b[32m[%s] 接收到文件名 '%s'，将数据写入 /dev/null\x1b[0m", remoteAddrStr, fileName)
-			} else {
-				// 仅在目标不是 /dev/null 时才创建目录
-				if err := os.MkdirAll(dirPath, 0755); err != nil {
-					receiveErr = fmt.Errorf("创建目录 '%s' 失败: %w", dirPath, err)
-					return
-				}
-				finalPath = filepath.Join(dirPath, fileName)
-				targetPath = finalPath + ".part" // 先写临时文件, 全部成功后再原子改名
-				useTempFile = true
-				log.Printf("\x1b[32m[%s] 将文件 '%s' 保存到: %s (临时文件: %s)\x1b[0m", remoteAddrStr, fileName, finalPath, targetPath)
+// wait 读取错误队列中的完成通知, 直到之前的所有 zerocopy 发送都已完成 (内核不再引用缓冲区)
+func (z *zerocopyWriter) wait() error {
+	var waitErr error
+	var hup bool
+	err := z.raw.Control(func(fd uintptr) {
+		for int32(z.sent-z.acked) > 0 {
+			_, oobn, _, _, err := unix.Recvmsg(int(fd), nil, z.oob, unix.MSG_ERRQUEUE)
+			if err == unix.EINTR {
+				continue
 			}
-
-			// 创建或打开目标文件/设备
-			var dstFile *os.File
-			var err error
-			if isDevNull {
-				// 直接打开 /dev/null，忽略 O_DIRECT
-				dstFile, err = os.OpenFile("/dev/null", os.O_WRONLY, 0)
-				if err != nil {
-					receiveErr = fmt.Errorf("打开 /dev/null 失败: %w", err)
+			if err == unix.EAGAIN {
+				// 连接出错时 socket 持续处于 POLLERR 状态, 不能只依靠 poll 等待完成通知
+				if soErr, _ := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR); soErr != 0 || hup {
+					waitErr = &net.OpError{Op: "write", Net: "tcp", Source: z.conn.LocalAddr(), Addr: z.conn.RemoteAddr(), Err: os.NewSyscallError("sendmsg", cmp.Or(unix.Errno(soErr), unix.EPIPE))}
 					return
 				}
-			} else {
-				// 打开常规文件，处理 O_DIRECT
-				openFlags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
-				if *oDirect {
-					openFlags |= unix.O_DIRECT
-					log.Printf("\x1b[33m[%s] 警告: 使用 O_DIRECT 打开文件 %s。这将绕过页缓存，可能影响性能，并有严格的对齐要求。标准 IO 模式 (-no-splice) 可能无法正常工作。\x1b[0m", remoteAddrStr, targetPath)
+				// 完成通知以 POLLERR 事件到达 (不需要在 events 中指定)
+				timeout := -1
+				if *ioTimeout > 0 {
+					timeout = int(ioTimeout.Milliseconds())
+				}
+				fds := []unix.PollFd{{Fd: int32(fd)}}
+				n, err := unix.Poll(fds, timeout)
+				if err == unix.EINTR {
+					continue
+				}
+				hup = fds[0].Revents&unix.POLLHUP != 0
+				if err == nil && n == 0 {
+					err = fmt.Errorf("%w: %v 内未收到 MSG_ZEROCOPY 完成通知", errIOTimeout, *ioTimeout)
 				}
-				dstFile, err = os.OpenFile(targetPath, openFlags, 0644)
 				if err != nil {
-					receiveErr = &FileInfoError{FilePath: targetPath, Err: fmt.Errorf("创建/打开目标文件 '%s' 失败: %w", targetPath, err)}
+					waitErr = err
 					return
 				}
+				continue
 			}
-			defer dstFile.Close()
-
-			// 预分配（仅对常规文件且在 Linux 上）
-			if !isDevNull && fileSize > 0 { // No need to check runtime.GOOS
-				// 检查是否真的打开了常规文件（dstFile 可能因错误为 nil）
-				if dstFile != nil {
-					if err := unix.Fallocate(int(dstFile.Fd()), 0, 0, fileSize); err != nil {
-						// 预分配失败通常不是致命错误，记录警告即可
-						log.Printf("\x1b[33m[%s] 警告: 预分配文件空间 '%s' 失败: %v\x1b[0m", remoteAddrStr, targetPath, err)
-					}
-				}
-			}
-
-			// 设置进度显示
-			var transferred int64
-			startTime := time.Now()
-			done := make(chan struct{})
-			defer close(done)
-			go displayProgress(fileSize, &transferred, startTime, done)
-
-			if fileSize == 0 {
-				atomic.StoreInt64(&transferred, 0)
-				time.Sleep(100 * time.Millisecond)
-				return
-			}
-
-			// 获取TCP连接的文件描述符
-			tcpConn, ok := conn.(*net.TCPConn)
-			if !ok {
-				receiveErr = fmt.Errorf("连接不是 TCP 连接")
+			if err != nil {
+				waitErr = fmt.Errorf("读取 MSG_ZEROCOPY 完成通知失败: %w", err)
 				return
 			}
-
-			srcFile, err := tcpConn.File()
+			msgs, err := unix.ParseSocketControlMessage(z.oob[:oobn])
 			if err != nil {
-				receiveErr = fmt.Errorf("获取连接文件描述符失败: %w", err)
+				waitErr = fmt.Errorf("解析 MSG_ZEROCOPY 完成通知失败: %w", err)
 				return
 			}
-			defer srcFile.Close()
-
-			// Get file descriptors
-			srcFd := int(srcFile.Fd())
-			dstFd := int(dstFile.Fd())
-
-			// --- Begin transfer ---
-			if useStandardCopy {
-				log.Printf("[%s] 使用标准 IO 复制而不是 splice", remoteAddrStr)
-				buffer := make([]byte, copyBufferSize)
-
-				// 提高性能的并发读写 (修复竞态条件)
-				readCh := make(chan []byte) // 通道传递数据副本
-				errorCh := make(chan error, 1)
-				doneCh := make(chan struct{})
-
-				// 启动读取goroutine
-				go func() {
-					defer close(readCh)
-					defer close(doneCh)
-					for totalReceived < fileSize {
-						n, err := conn.Read(buffer)
-						if err != nil {
-							if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
-								return
-							}
-							select {
-							case errorCh <- fmt.Errorf("[%s] 读取数据失败: %w", remoteAddrStr, err):
-							default:
-							}
-							return
-						}
-						if n == 0 {
-							break
-						}
-						// 创建数据副本并发送
-						dataCopy := make([]byte, n)
-						copy(dataCopy, buffer[:n])
-						readCh <- dataCopy
-					}
-				}()
-
-				// 处理写入
-				for data := range readCh {
-					written, err := dstFile.Write(data)
-					if err != nil {
-						select {
-						case errorCh <- fmt.Errorf("[%s] 写入文件 '%s' 失败: %w", remoteAddrStr, targetPath, err):
-						default:
-						}
-						break
-					}
-					// 检查写入的字节数是否与接收到的数据块大小一致
-					if written != len(data) {
-						select {
-						case errorCh <- fmt.Errorf("[%s] 写入文件 '%s' 不完整: 预期 %d, 实际 %d", remoteAddrStr, targetPath, len(data), written):
-						default:
-						}
-						break
-					}
-
-					// 更新进度
-					atomic.AddInt64(&transferred, int64(written))
-					totalReceived += int64(written) // totalReceived 仍然累加写入的字节数
-				}
-
-				// 等待读取完成或出错
-				select {
-				case <-doneCh:
-					// 读取完成
-				case err := <-errorCh:
-					if receiveErr == nil {
-						receiveErr = err
-					}
+			for _, m := range msgs {
+				isRecvErr := (m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) ||
+					(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR)
+				if !isRecvErr || len(m.Data) < 16 {
+					continue
 				}
-
-				// 与 splice 分支保持一致: 校验实际接收字节数是否等于声明大小
-				if receiveErr == nil {
-					if totalReceived != fileSize {
-						receiveErr = fmt.Errorf("文件 '%s' 接收到的数据大小 (%d) 与预期大小 (%d) 不符", fileName, totalReceived, fileSize)
+				// struct sock_extended_err: errno(4) origin(1) type(1) code(1) pad(1) info(4) data(4)
+				errno := binary.NativeEndian.Uint32(m.Data[0:])
+				if m.Data[4] != unix.SO_EE_ORIGIN_ZEROCOPY {
+					if errno != 0 {
+						waitErr = os.NewSyscallError("sendmsg", unix.Errno(errno))
+						return
 					}
+					continue
 				}
-
-			} else {
-				// 使用splice系统调用
-				log.Printf("[%s] 使用 splice 系统调用传输数据", remoteAddrStr)
-				pipeFds := make([]int, 2)
-				if err := unix.Pipe(pipeFds); err != nil {
-					receiveErr = fmt.Errorf("创建管道失败: %w", err)
-					return
-				}
-				defer unix.Close(pipeFds[0])
-				defer unix.Close(pipeFds[1])
-
-				// 设置管道缓冲区大小为最大值（可选）
-				unix.FcntlInt(uintptr(pipeFds[0]), unix.F_SETPIPE_SZ, copyBufferSize*4)
-				unix.FcntlInt(uintptr(pipeFds[1]), unix.F_SETPIPE_SZ, copyBufferSize*4)
-
-				for totalReceived < fileSize {
-					// 从socket读取数据到管道
-					n, err := unix.Splice(srcFd, nil, pipeFds[1], nil, copyBufferSize, unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
-					if err != nil {
-						receiveErr = fmt.Errorf("从 socket 到管道的 splice 操作失败: %w", err)
-						break
-					}
-					if n == 0 {
-						break // 连接关闭
-					}
-
-					// 从管道写入数据到文件
-					written, err := unix.Splice(pipeFds[0], nil, dstFd, nil, int(n), unix.SPLICE_F_MOVE|unix.SPLICE_F_MORE)
-					if err != nil {
-						receiveErr = fmt.Errorf("从管道到文件 '%s' 的 splice 操作失败: %w", targetPath, err)
-						break
-					}
-
-					if written != n {
-						receiveErr = fmt.Errorf("splice 写入文件 '%s' 不完整: 预期 %d, 实际 %d", targetPath, n, written)
-						break
-					}
-
-					atomic.AddInt64(&transferred, written)
-					totalReceived += written
+				// 通知覆盖序号区间 [info, data], 按序到达
+				if last := binary.NativeEndian.Uint32(m.Data[12:]); int32(last+1-z.acked) > 0 {
+					z.acked = last + 1
 				}
-
-				if receiveErr == nil { // 只有在 splice 循环中没出错才检查大小
-					if totalReceived != fileSize {
-						receiveErr = fmt.Errorf("文件 '%s' 接收到的数据大小 (%d) 与预期大小 (%d) 不符", fileName, totalReceived, fileSize)
-					}
+				if m.Data[6]&unix.SO_EE_CODE_ZEROCOPY_COPIED != 0 && !z.copied {
+					z.copied = true
+					logDebug("MSG_ZEROCOPY: 内核回退为复制发送 (如回环连接或网卡不支持)")
 				}
 			}
-		}(conn)
-
-		if fileTransferred > 0 && fileReceiveError == nil {
-			elapsed := time.Since(connectionStart).Seconds()
-			fileAvgSpeed := float64(fileTransferred) / elapsed / 1024 / 1024
-			log.Printf("\x1b[32m[%s] 传输完成，文件 '%s' 接收了 %s bytes，速度: %.2f MB/s\x1b[0m",
-				remoteAddrStr, fileTransferName, formatWithCommas(fileTransferred), fileAvgSpeed)
-
-			atomic.AddInt64(&totalBytesReceived, fileTransferred)
-			totalFilesReceived++
 		}
-
-		totalElapsed := time.Since(startTime).Seconds()
-		if totalBytesReceived > 0 && totalElapsed > 0 {
-			overallAvgSpeed := float64(totalBytesReceived) / totalElapsed / 1024 / 1024
-			log.Printf("\x1b[32m累计接收: %d 个文件，总大小 %s bytes，平均速度: %.2f MB/s\x1b[0m",
-				totalFilesReceived, formatWithCommas(totalBytesReceived), overallAvgSpeed)
-		}
-
-		log.Printf("等待下一个连接...")
-	}
-	// 通常不会执行到这里 (因为 for 循环是无限的)
-	return nil
+	})
+	return cmp.Or(waitErr, err)
 }
 
-// parseSize 解析带单位的大小字符串 (如 "1G", "500M", "1024K") 返回字节数
-// (strconv 和 strings 已在顶部导入)
-
-func parseSize(sizeStr string) (int64, error) {
-	sizeStr = strings.ToUpper(strings.TrimSpace(sizeStr))
-	multiplier := int64(1)
-	suffix := ""
-
-	if strings.HasSuffix(sizeStr, "G") {
-		multiplier = 1024 * 1024 * 1024
-		suffix = "G"
-	} else if strings.HasSuffix(sizeStr, "M") {
-		multiplier = 1024 * 1024
-		suffix = "M"
-	} else if strings.HasSuffix(sizeStr, "K") {
-		multiplier = 1024
-		suffix = "K"
-	}
-
-	numStr := strings.TrimSuffix(sizeStr, suffix)
-	num, err := strconv.ParseInt(numStr, 10, 64)
-	if err != nil {
-		return 0, fmt.Errorf("无法解析数字部分 '%s': %w", numStr, err)
+// setIODeadline 在每次网络 I/O 之前刷新连接的读写超时 (仅在设置了 -io-timeout 时生效)
+func setIODeadline(conn net.Conn) {
+	if *ioTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(*ioTimeout))
 	}
+}
 
-	if num <= 0 {
-		return 0, fmt.Errorf("大小必须为正数")
+// wrapIOTimeout 将 deadline 触发的错误转换为明确的超时错误
+func wrapIOTimeout(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: %v 内无数据进展: %v", errIOTimeout, *ioTimeout, err)
 	}
-
-	return num * multiplier, nil
+	return err
 }
 
-type zeroReader struct {
-	size    int64
-	readPos int64
+// ioWatchdog 监视 sendfile/splice 路径的传输进度.
+// 这些路径直接操作 raw fd, 不受 net.Conn 的 deadline 控制, 因此在超过 timeout 无进展时
+// 通过 shutdown socket 唤醒阻塞中的系统调用.
+type ioWatchdog struct {
+	fired atomic.Bool
+	stop  chan struct{}
 }
 
-func (zr *zeroReader) Read(p []byte) (n int, err error) {
-	if zr.readPos >= zr.size {
-		return 0, io.EOF // 已达到指定大小
-	}
-	remaining := zr.size - zr.readPos
-	readLen := int64(len(p))
-	if remaining < readLen {
-		readLen = remaining
+func startIOWatchdog(sockFd int, transferred *int64, timeout time.Duration) *ioWatchdog {
+	w := &ioWatchdog{stop: make(chan struct{})}
+	if timeout <= 0 {
+		return w
 	}
-	// 不需要填充 p，因为我们只关心读取的字节数 n
-	// for i := range p[:readLen] { p[i] = 0 } // 如果需要严格模拟零字节
-	zr.readPos += readLen
-	return int(readLen), nil
+	go func() {
+		interval := timeout / 4
+		if interval < 10*time.Millisecond {
+			interval = 10 * time.Millisecond
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := atomic.LoadInt64(transferred)
+		lastProgress := time.Now()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				current := atomic.LoadInt64(transferred)
+				if current != last {
+					last = current
+					lastProgress = time.Now()
+					continue
+				}
+				if time.Since(lastProgress) >= timeout {
+					w.fired.Store(true)
+					unix.Shutdown(sockFd, unix.SHUT_RDWR)
+					return
+				}
+			}
+		}
+	}()
+	return w
 }
 
-type progressUpdater struct {
-	conn        net.Conn
-	transferred *int64
+func (w *ioWatchdog) Stop() {
+	close(w.stop)
 }
 
-func (pu *progressUpdater) Write(p []byte) (n int, err error) {
-	n, err = pu.conn.Write(p)
-	if n > 0 {
-		atomic.AddInt64(pu.transferred, int64(n))
-	}
-	return n, err
+// TimedOut 报告看门狗是否因超时断开了连接
+func (w *ioWatchdog) TimedOut() bool {
+	return w.fired.Load()
 }
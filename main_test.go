@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// shortConn 是每次最多写入 max 字节的 net.Conn 桩, max 为 0 时模拟没有任何进展的写入
+type shortConn struct {
+	net.Conn
+	buf bytes.Buffer
+	max int
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	n := min(len(p), c.max)
+	c.buf.Write(p[:n])
+	return n, nil
+}
+
+func (c *shortConn) SetDeadline(time.Time) error { return nil }
+
+func TestProgressUpdaterShortWrite(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	conn := &shortConn{max: 7}
+	var transferred int64
+	pu := &progressUpdater{conn: conn, transferred: &transferred}
+	n, err := pu.Write(data)
+	if err != nil {
+		t.Fatalf("Write 返回错误: %v", err)
+	}
+	if n != len(data) {
+		t.Fatalf("Write 返回 %d, 期望 %d", n, len(data))
+	}
+	if !bytes.Equal(conn.buf.Bytes(), data) {
+		t.Fatalf("写入的数据与输入不一致 (%d 字节)", conn.buf.Len())
+	}
+	if transferred != int64(len(data)) {
+		t.Fatalf("transferred 为 %d, 期望 %d", transferred, len(data))
+	}
+
+	stalled := &shortConn{max: 0}
+	transferred = 0
+	pu = &progressUpdater{conn: stalled, transferred: &transferred}
+	n, err = pu.Write(data)
+	if !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("无进展的写入返回 %v, 期望 io.ErrShortWrite", err)
+	}
+	if n != 0 || transferred != 0 {
+		t.Fatalf("无进展的写入返回 %d 字节, transferred 为 %d, 期望都为 0", n, transferred)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{"1048576", 1048576, false},
+		{"4k", 4 << 10, false},
+		{"100MB", 100 << 20, false},
+		{" 2G ", 2 << 30, false},
+		{"1t", 1 << 40, false},
+		{"10TB", 10 << 40, false},
+		{"99999999999G", 0, true},
+		{"9223372036854775807", 1<<63 - 1, false},
+		{"0", 0, true},
+		{"-1M", 0, true},
+		{"", 0, true},
+		{"abc", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, 期望返回错误", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v, 期望 %d", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestHeaderRoundTrip(t *testing.T) {
+	salt := bytes.Repeat([]byte{0xAB}, saltSize)
+	digest := bytes.Repeat([]byte{0xCD}, 16) // md5
+	extents := []extent{{offset: 0, length: 4096}, {offset: 1 << 20, length: 100}}
+	tests := []struct {
+		name string
+		h    fileHeader
+	}{
+		{"plain", fileHeader{name: "a.bin", size: 1234}},
+		{"stream", fileHeader{name: "stdin", size: unknownSize}},
+		{"manifest", fileHeader{flags: extFlagManifest, size: 1 << 30, files: 42}},
+		{"range", fileHeader{flags: extFlagRange, name: "a.bin", size: 1000, offset: 250, length: 250}},
+		{"sparse", fileHeader{flags: extFlagSparse, name: "a.bin", size: 2 << 20, extents: extents}},
+		{"checksum", fileHeader{flags: extFlagChecksum, name: "a.bin", size: 1, algo: 3}},
+		{"encrypt", fileHeader{flags: extFlagEncrypt, name: "a.bin", size: 10, salt: salt}},
+		{"sparse+checksum+encrypt", fileHeader{flags: extFlagSparse | extFlagChecksum | extFlagEncrypt, name: "a.bin", size: 2 << 20, extents: extents, algo: 1, salt: salt}},
+		{"dry-run", fileHeader{flags: extFlagDryRun, name: "a.bin", size: 10}},
+		{"bench", fileHeader{flags: extFlagBench, name: probeFileName, size: 1}},
+		{"checksum-only", fileHeader{flags: extFlagChecksum | extFlagChecksumOnly, name: "a.bin", size: 10, algo: 4}},
+		{"resume", fileHeader{flags2: ext2Resume, name: "a.bin", size: 10, restart: true}},
+		{"resume-continue", fileHeader{flags2: ext2Resume, name: "a.bin", size: 10}},
+		{"delta", fileHeader{flags2: ext2Delta, name: "a.bin", size: 10}},
+		{"dedupe", fileHeader{flags: extFlagChecksum, flags2: ext2Dedupe, name: "a.bin", size: 10, algo: 2, digest: digest}},
+		{"dedupe+sparse+compress", fileHeader{flags: extFlagSparse | extFlagChecksum, flags2: ext2Dedupe | ext2Compress, name: "a.bin", size: 2 << 20, extents: extents, algo: 2, compress: compressDeflate, digest: digest}},
+		{"compress", fileHeader{flags2: ext2Compress, name: "a.bin", size: 10, compress: compressDeflate}},
+		{"framed+checksum", fileHeader{flags: extFlagChecksum, flags2: ext2Framed, name: "a.bin", size: 10, algo: 3}},
+	}
+	for _, tt := range tests {
+		got, err := decodeHeader(encodeHeader(tt.h)[6:])
+		if err != nil {
+			t.Errorf("%s: decodeHeader 返回错误: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.h) {
+			t.Errorf("%s: decodeHeader(encodeHeader(h)) = %+v, 期望 %+v", tt.name, got, tt.h)
+		}
+
+		// 旧格式: 调用方先读取文件名长度 (或扩展头标记), 其余部分由 readLegacyHeader 读取
+		client, server := net.Pipe()
+		go func() {
+			client.Write(encodeLegacyHeader(tt.h))
+			client.Close()
+		}()
+		lenBytes := make([]byte, 2)
+		if _, err := io.ReadFull(server, lenBytes); err != nil {
+			t.Fatalf("%s: 读取旧格式文件名长度失败: %v", tt.name, err)
+		}
+		got, err = readLegacyHeader(server, binary.BigEndian.Uint16(lenBytes))
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: readLegacyHeader 返回错误: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.h) {
+			t.Errorf("%s: readLegacyHeader(encodeLegacyHeader(h)) = %+v, 期望 %+v", tt.name, got, tt.h)
+		}
+	}
+
+	// 只有 TLV 格式能携带扩展属性和修改时间
+	h := fileHeader{name: "a.bin", size: 10, xattrs: []xattr{{name: "user.k", value: []byte("v")}}, mtime: 1700000000123456789}
+	if got, err := decodeHeader(encodeHeader(h)[6:]); err != nil || !reflect.DeepEqual(got, h) {
+		t.Errorf("xattrs: decodeHeader(encodeHeader(h)) = %+v, %v, 期望 %+v", got, err, h)
+	}
+}
+
+func TestDecodeHeaderInvalid(t *testing.T) {
+	field := func(tag byte, value []byte) []byte {
+		return append(binary.BigEndian.AppendUint32([]byte{tag}, uint32(len(value))), value...)
+	}
+	h := fileHeader{flags: extFlagRange, name: "a.bin", size: 1000, offset: 0, length: 500}
+	block := encodeHeader(h)[6:]
+
+	// 截断: 最后一个字段的值不完整, 以及只剩字段类型
+	for _, n := range []int{1, len(block) - 2} {
+		if _, err := decodeHeader(block[:len(block)-n]); err == nil {
+			t.Errorf("截断 %d 字节的文件头没有返回错误", n)
+		}
+	}
+
+	// 标志位要求的字段缺失: 有 extFlagRange 但没有分段字段
+	missing := []byte{headerVersion}
+	missing = append(missing, field(hdrTagFlags, []byte{extFlagRange})...)
+	missing = append(missing, field(hdrTagName, []byte("a.bin"))...)
+	missing = append(missing, field(hdrTagSize, binary.BigEndian.AppendUint64(nil, 1000))...)
+	if _, err := decodeHeader(missing); err == nil {
+		t.Errorf("缺少分段字段的文件头没有返回错误")
+	}
+
+	// 不认识的字段类型被跳过
+	unknown := append(bytes.Clone(block), field(200, []byte("future"))...)
+	if got, err := decodeHeader(unknown); err != nil || !reflect.DeepEqual(got, h) {
+		t.Errorf("带未知字段的文件头解析为 %+v, %v, 期望 %+v", got, err, h)
+	}
+
+	// 不支持的版本
+	if _, err := decodeHeader(append([]byte{headerVersion + 1}, block[1:]...)); err == nil {
+		t.Errorf("不支持的文件头版本没有返回错误")
+	}
+}
+
+// deltaRoundTrip 在 net.Pipe 上走一遍增量传输: 接收端计算 basis 的块签名, 发送端用 deltaScan 生成指令,
+// 接收端用 applyDelta 重建. basis 为 nil 表示接收端没有已有文件. 返回重建的数据和其中复用的字节数.
+func deltaRoundTrip(t *testing.T, basis, data []byte) ([]byte, int64) {
+	t.Helper()
+	var basisFile *os.File
+	if basis != nil {
+		path := filepath.Join(t.TempDir(), "basis")
+		if err := os.WriteFile(path, basis, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		basisFile = f
+	}
+	sendConn, recvConn := net.Pipe()
+	defer sendConn.Close()
+	defer recvConn.Close()
+
+	sendErr := make(chan error, 1)
+	go func() {
+		sig, err := readDeltaSignature(sendConn, "a.bin")
+		if err != nil {
+			sendErr <- err
+			return
+		}
+		enc := &deltaEncoder{conn: sendConn, w: bufio.NewWriter(sendConn)}
+		h := md5.New()
+		var transferred int64
+		if err := deltaScan(bytes.NewReader(data), sig, enc, h, &transferred); err != nil {
+			sendErr <- err
+			return
+		}
+		if err := enc.flushCopy(); err != nil {
+			sendErr <- err
+			return
+		}
+		if err := enc.op(deltaOpEnd, 0, 0); err != nil {
+			sendErr <- err
+			return
+		}
+		enc.w.Write(h.Sum(nil))
+		sendErr <- enc.w.Flush()
+	}()
+
+	sig, err := writeDeltaSignature(recvConn, basisFile)
+	if err != nil {
+		t.Fatalf("writeDeltaSignature 返回错误: %v", err)
+	}
+	var out bytes.Buffer
+	var counter int64
+	written, reused, err := applyDelta(recvConn, &out, basisFile, sig, int64(len(data)), &counter, "a.bin")
+	if err != nil {
+		t.Fatalf("applyDelta 返回错误: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("发送增量指令失败: %v", err)
+	}
+	if written != int64(len(data)) || counter != written {
+		t.Fatalf("写入 %d 字节, 计数 %d, 期望 %d", written, counter, len(data))
+	}
+	return out.Bytes(), reused
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	basis := make([]byte, 4*2048+1000) // 块大小 2048, 最后一块不足一块
+	rng.Read(basis)
+	fresh := make([]byte, 5000)
+	rng.Read(fresh)
+
+	changedTail := bytes.Clone(basis)
+	changedTail[len(changedTail)-1] ^= 0xFF
+
+	tests := []struct {
+		name   string
+		basis  []byte
+		data   []byte
+		reused int64
+	}{
+		{"identical", basis, basis, int64(len(basis))},
+		{"insert at front", basis, append([]byte("inserted"), basis...), int64(len(basis))},
+		{"changed last partial block", basis, changedTail, 4 * 2048},
+		{"empty basis", nil, fresh, 0},
+		{"basis longer than new file", basis, basis[:5000], 2 * 2048},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reused := deltaRoundTrip(t, tt.basis, tt.data)
+			if !bytes.Equal(got, tt.data) {
+				t.Fatalf("重建的数据与新文件不同 (%d 字节, 期望 %d 字节)", len(got), len(tt.data))
+			}
+			if reused != tt.reused {
+				t.Errorf("复用 %d 字节, 期望 %d", reused, tt.reused)
+			}
+		})
+	}
+}